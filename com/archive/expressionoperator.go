@@ -59,7 +59,7 @@ var NullExpressionOperator *ExpressionOperator = nil
 
 func init() {
   ovalMap_ExpressionOperator = make(map[uint32]uint32)
-  for oval, nval := range nvalTable_<Enum> {
+  for oval, nval := range nvalTable_ExpressionOperator {
     ovalMap_ExpressionOperator[nval] = uint32(oval)
   }
 }
@@ -142,7 +142,7 @@ func (receiver *ExpressionOperator) Encode(encoder mal.Encoder) error {
     return specific(receiver, encoder)
   }
 
-  value := mal.NewUOctet(codedNativeType(receiver.GetOrdinalValue()))
+  value := mal.NewUOctet(uint8(receiver.GetOrdinalValue()))
   return encoder.EncodeUOctet(value)
 }
 
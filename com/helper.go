@@ -11,3 +11,10 @@ const (
   ERROR_INVALID mal.UInteger = 70000
   ERROR_DUPLICATE mal.UInteger = 70001
 )
+
+// Registers the COM specific errors, their extra information is operation specific so it
+// is left undecoded (see MalError.Msg).
+func init() {
+  mal.RegisterError(&mal.ErrorDefinition{Code: ERROR_INVALID, Name: "INVALID", Description: "Operation specific."})
+  mal.RegisterError(&mal.ErrorDefinition{Code: ERROR_DUPLICATE, Name: "DUPLICATE", Description: "Operation specific."})
+}
@@ -23,6 +23,209 @@
  */
 package mal
 
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Defines the interface of the access control handler of a MAL context.
+// The CheckSend method is called by the MAL context for each outgoing message before
+// its transmission, the CheckReceive method is called for each incoming message before
+// its delivery. A non nil returned error rejects the message, the error should be an
+// AccessError in order to specify the MAL error code (AUTHENTICATION_FAIL or
+// AUTHORISATION_FAIL).
 type AccessControl interface {
-	check(msg *Message) error
+	CheckSend(msg *Message) error
+	CheckReceive(msg *Message) error
+}
+
+// Error returned by an access control handler when a message is rejected.
+type AccessError struct {
+	// MAL error code: ERROR_AUTHENTICATION_FAIL or ERROR_AUTHORISATION_FAIL
+	Code   UInteger
+	Reason string
+}
+
+func NewAuthenticationError(reason string) *AccessError {
+	return &AccessError{ERROR_AUTHENTICATION_FAIL, reason}
+}
+
+func NewAuthorisationError(reason string) *AccessError {
+	return &AccessError{ERROR_AUTHORISATION_FAIL, reason}
+}
+
+func (e *AccessError) Error() string {
+	if e.Code == ERROR_AUTHENTICATION_FAIL {
+		return "Authentication failed: " + e.Reason
+	}
+	return "Authorisation failed: " + e.Reason
+}
+
+// ################################################################################
+// Defines a built-in access control handler based on an ordered list of rules.
+// ################################################################################
+
+type AccessDecision byte
+
+const (
+	ACCESS_DENY AccessDecision = iota
+	ACCESS_ALLOW
+)
+
+// Defines an access rule, a nil (resp. empty) field matches any value of the
+// corresponding message field.
+type AccessRule struct {
+	Decision         AccessDecision
+	AuthenticationId *Blob
+	// The last identifier of the domain may be the wildcard character '*', in this case
+	// the rule matches all sub-domains.
+	Domain          IdentifierList
+	NetworkZone     *Identifier
+	ServiceArea     *UShort
+	Service         *UShort
+	Operation       *UShort
+	InteractionType *InteractionType
+}
+
+func domainMatches(domain IdentifierList, required IdentifierList) bool {
+	all := false
+	if len(required) > 0 && *required[len(required)-1] == "*" {
+		all = true
+		required = required[:len(required)-1]
+	}
+	if len(domain) < len(required) || (len(domain) > len(required) && !all) {
+		return false
+	}
+	for idx, id := range required {
+		if *id != *domain[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the rule applies to the specified message.
+func (rule *AccessRule) Matches(msg *Message) bool {
+	if rule.AuthenticationId != nil && !bytes.Equal(*rule.AuthenticationId, msg.AuthenticationId) {
+		return false
+	}
+	if len(rule.Domain) > 0 && !domainMatches(msg.Domain, rule.Domain) {
+		return false
+	}
+	if rule.NetworkZone != nil && *rule.NetworkZone != msg.NetworkZone {
+		return false
+	}
+	if rule.ServiceArea != nil && *rule.ServiceArea != msg.ServiceArea {
+		return false
+	}
+	if rule.Service != nil && *rule.Service != msg.Service {
+		return false
+	}
+	if rule.Operation != nil && *rule.Operation != msg.Operation {
+		return false
+	}
+	if rule.InteractionType != nil && *rule.InteractionType != msg.InteractionType {
+		return false
+	}
+	return true
+}
+
+// Built-in AccessControl implementation.
+//
+// Authentication: if at least one authentication identifier is declared, the
+// AuthenticationId of each incoming message must be one of them, otherwise the message
+// is rejected with an AUTHENTICATION_FAIL error.
+//
+// Authorisation: the rules are evaluated in their order of declaration, the first
+// matching rule decides. If no rule matches the default decision is applied, a denied
+// message is rejected with an AUTHORISATION_FAIL error. Incoming and outgoing messages
+// are checked against distinct set of rules.
+type AccessPolicy struct {
+	lock     sync.RWMutex
+	authIds  []Blob
+	inRules  []*AccessRule
+	outRules []*AccessRule
+	dfltIn   AccessDecision
+	dfltOut  AccessDecision
+}
+
+// Creates a new access policy with the specified default decisions for incoming
+// and outgoing messages.
+func NewAccessPolicy(dfltIn AccessDecision, dfltOut AccessDecision) *AccessPolicy {
+	return &AccessPolicy{dfltIn: dfltIn, dfltOut: dfltOut}
+}
+
+// Declares an authentication identifier allowed for incoming messages.
+func (policy *AccessPolicy) AddAuthenticationId(id Blob) *AccessPolicy {
+	policy.lock.Lock()
+	policy.authIds = append(policy.authIds, id)
+	policy.lock.Unlock()
+	return policy
+}
+
+// Adds a rule at the end of the list of rules checking incoming messages.
+func (policy *AccessPolicy) AddIncomingRule(rule *AccessRule) *AccessPolicy {
+	policy.lock.Lock()
+	policy.inRules = append(policy.inRules, rule)
+	policy.lock.Unlock()
+	return policy
+}
+
+// Adds a rule at the end of the list of rules checking outgoing messages.
+func (policy *AccessPolicy) AddOutgoingRule(rule *AccessRule) *AccessPolicy {
+	policy.lock.Lock()
+	policy.outRules = append(policy.outRules, rule)
+	policy.lock.Unlock()
+	return policy
+}
+
+func (policy *AccessPolicy) authenticate(msg *Message) error {
+	if len(policy.authIds) == 0 {
+		return nil
+	}
+	for _, id := range policy.authIds {
+		if bytes.Equal(id, msg.AuthenticationId) {
+			return nil
+		}
+	}
+	return NewAuthenticationError(fmt.Sprintf("unknown authentication id from %s", uriString(msg.UriFrom)))
+}
+
+func authorise(msg *Message, rules []*AccessRule, dflt AccessDecision) error {
+	decision := dflt
+	for _, rule := range rules {
+		if rule.Matches(msg) {
+			decision = rule.Decision
+			break
+		}
+	}
+	if decision != ACCESS_ALLOW {
+		return NewAuthorisationError(fmt.Sprintf("operation %d.%d.%d denied for %s",
+			msg.ServiceArea, msg.Service, msg.Operation, uriString(msg.UriFrom)))
+	}
+	return nil
+}
+
+func (policy *AccessPolicy) CheckSend(msg *Message) error {
+	policy.lock.RLock()
+	defer policy.lock.RUnlock()
+	return authorise(msg, policy.outRules, policy.dfltOut)
+}
+
+func (policy *AccessPolicy) CheckReceive(msg *Message) error {
+	policy.lock.RLock()
+	defer policy.lock.RUnlock()
+	err := policy.authenticate(msg)
+	if err != nil {
+		return err
+	}
+	return authorise(msg, policy.inRules, policy.dfltIn)
+}
+
+func uriString(uri *URI) string {
+	if uri == nil {
+		return "<nil>"
+	}
+	return string(*uri)
 }
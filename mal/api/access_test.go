@@ -0,0 +1,149 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api_test
+
+import (
+	"context"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"testing"
+	"time"
+)
+
+const (
+	access_provider_url = "invm://access_provider"
+	access_consumer_url = "invm://access_consumer"
+)
+
+func newAccessProvider(policy AccessControl) (*Context, *ClientContext, error) {
+	ctx, err := NewContext(access_provider_url)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx.SetAccessControl(policy)
+	cctx, err := NewClientContext(ctx, "provider")
+	if err != nil {
+		ctx.Close()
+		return nil, nil, err
+	}
+	requestHandler := func(msg *Message, t Transaction) error {
+		body := t.NewBody()
+		body.EncodeLastParameter(NewString("reply message"), false)
+		return t.(RequestTransaction).Reply(body, false)
+	}
+	cctx.RegisterRequestHandler(200, 1, 1, 1, requestHandler)
+	cctx.RegisterRequestHandler(200, 1, 1, 2, requestHandler)
+	return ctx, cctx, nil
+}
+
+func accessRequest(consumer *ClientContext, urito *URI, operation UShort) (*Message, error) {
+	op := consumer.NewRequestOperation(urito, 200, 1, 1, operation)
+	body := op.NewBody()
+	body.EncodeLastParameter(NewString("message"), false)
+	return op.Request(body)
+}
+
+func accessErrorCode(t *testing.T, msg *Message) UInteger {
+	if msg == nil {
+		t.Fatal("Expected an error message")
+	}
+	code, err := msg.DecodeParameter(NullUInteger)
+	if err != nil {
+		t.Fatal("Error decoding error code, ", err)
+	}
+	return *code.(*UInteger)
+}
+
+func TestAccessControl(t *testing.T) {
+	operation := UShort(2)
+	policy := NewAccessPolicy(ACCESS_ALLOW, ACCESS_ALLOW)
+	policy.AddAuthenticationId(Blob("consumer"))
+	policy.AddIncomingRule(&AccessRule{Decision: ACCESS_DENY, Operation: &operation})
+
+	provider_ctx, provider, err := newAccessProvider(policy)
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider_ctx.Close()
+
+	consumer_ctx, err := NewContext(access_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewClientContext(consumer_ctx, "consumer")
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	// Unknown authentication identifier
+	consumer.SetAuthenticationId(Blob("intruder"))
+	ret, err := accessRequest(consumer, provider.Uri, 1)
+	if err == nil {
+		t.Fatal("Request should be rejected")
+	}
+	if code := accessErrorCode(t, ret); code != ERROR_AUTHENTICATION_FAIL {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_AUTHENTICATION_FAIL)
+	}
+
+	// Authorized operation
+	consumer.SetAuthenticationId(Blob("consumer"))
+	_, err = accessRequest(consumer, provider.Uri, 1)
+	if err != nil {
+		t.Fatal("Request should be accepted, ", err)
+	}
+
+	// Forbidden operation
+	ret, err = accessRequest(consumer, provider.Uri, operation)
+	if err == nil {
+		t.Fatal("Request should be rejected")
+	}
+	if code := accessErrorCode(t, ret); code != ERROR_AUTHORISATION_FAIL {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_AUTHORISATION_FAIL)
+	}
+
+	// The rejection is reported even if the provider cannot send any message
+	provider_ctx.SetAccessControl(NewAccessPolicy(ACCESS_DENY, ACCESS_DENY))
+	op := consumer.NewRequestOperation(provider.Uri, 200, 1, 1, 1)
+	body := op.NewBody()
+	body.EncodeLastParameter(NewString("message"), false)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ret, err = op.RequestWithContext(ctx, body)
+	if (err == nil) || (ret == nil) {
+		t.Fatal("Request should be rejected with an error message, ", err)
+	}
+	if code := accessErrorCode(t, ret); code != ERROR_AUTHORISATION_FAIL {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_AUTHORISATION_FAIL)
+	}
+
+	// Outgoing messages
+	consumer_ctx.SetAccessControl(NewAccessPolicy(ACCESS_ALLOW, ACCESS_DENY))
+	_, err = accessRequest(consumer, provider.Uri, 1)
+	if aerr, ok := err.(*AccessError); !ok || aerr.Code != ERROR_AUTHORISATION_FAIL {
+		t.Errorf("Outgoing request should be rejected, get: %v", err)
+	}
+}
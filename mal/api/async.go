@@ -0,0 +1,413 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2017 - 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"sync"
+)
+
+// ================================================================================
+// Future
+
+// Result of an asynchronous operation, it is completed once with the awaited message
+// (acknowledge or response depending of the interaction) or an error.
+type Future struct {
+	done chan bool
+	msg  *Message
+	err  error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan bool)}
+}
+
+func (f *Future) complete(msg *Message, err error) {
+	f.msg = msg
+	f.err = err
+	close(f.done)
+}
+
+// Returns a channel closed when the future is completed, it allows to wait for several
+// operations in a select statement.
+func (f *Future) Done() <-chan bool {
+	return f.done
+}
+
+// Waits for the completion of the future and returns its result. If the result is a MAL
+// error message, the message is returned with a non nil error.
+func (f *Future) Get() (*Message, error) {
+	<-f.done
+	return f.msg, f.err
+}
+
+// ================================================================================
+// Asynchronous operation
+
+// Defines the callbacks of an asynchronous operation, a nil callback is ignored.
+// The callbacks are called by the goroutine routing the messages of the ClientContext,
+// so they should not block.
+type AsyncCallbacks struct {
+	// Called for each acknowledge: SUBMIT_ACK, INVOKE_ACK, PROGRESS_ACK and the
+	// acknowledges of PubSub registration and deregistration.
+	OnAck func(msg *Message)
+	// Called for each PROGRESS_UPDATE message.
+	OnUpdate func(msg *Message)
+	// Called for the REQUEST_RESPONSE, INVOKE_RESPONSE or PROGRESS_RESPONSE message.
+	OnResponse func(msg *Message)
+	// Called for each PUBSUB_NOTIFY message.
+	OnNotify func(msg *Message)
+	// Called for each MAL error message (msg is then the error message), or when the
+	// operation ends abnormally (msg is then nil).
+	OnError func(msg *Message, err error)
+}
+
+// Non-blocking counterpart of the Operation interfaces: each initiating method sends the
+// message and returns a future completed by the awaited acknowledge or response, the
+// other messages are reported through callbacks. An asynchronous operation handles a
+// unique interaction, it can be reused after the end of this interaction (see Reset).
+type AsyncOperation interface {
+	// Get current TransactionId
+	GetTid() ULong
+	// Returns a new Body ready to encode
+	NewBody() Body
+	// Reset the operation in order to reuse it
+	Reset() error
+	// Close the operation
+	Close() error
+	Submit(body Body) (*Future, error)
+	Request(body Body) (*Future, error)
+	Invoke(body Body) (*Future, error)
+	Progress(body Body) (*Future, error)
+	Register(body Body) (*Future, error)
+	Deregister(body Body) (*Future, error)
+	PublishRegister(body Body) (*Future, error)
+	Publish(body Body) error
+	PublishDeregister(body Body) (*Future, error)
+}
+
+type AsyncOperationX struct {
+	cctx        *ClientContext
+	tid         ULong
+	urito       *URI
+	area        UShort
+	areaVersion UOctet
+	service     UShort
+	operation   UShort
+	callbacks   AsyncCallbacks
+	// Protects the status and the pending future, they are modified by both the user
+	// goroutine and the goroutine routing the messages.
+	lock   sync.Mutex
+	status byte
+	itype  InteractionType
+	future *Future
+}
+
+func (cctx *ClientContext) NewAsyncOperation(urito *URI, area UShort, areaVersion UOctet, service UShort, operation UShort, callbacks *AsyncCallbacks) AsyncOperation {
+	// Gets a new TransactionId for operation
+	tid := cctx.TransactionId()
+	op := &AsyncOperationX{
+		cctx: cctx, tid: tid, urito: urito,
+		area: area, areaVersion: areaVersion, service: service, operation: operation,
+		status: _CREATED,
+	}
+	if callbacks != nil {
+		op.callbacks = *callbacks
+	}
+	return op
+}
+
+func (op *AsyncOperationX) GetTid() ULong {
+	return op.tid
+}
+
+func (op *AsyncOperationX) NewBody() Body {
+	return op.cctx.Ctx.NewBody()
+}
+
+func (op *AsyncOperationX) newMessage(itype InteractionType, stage InteractionStage, body Body) *Message {
+	return &Message{
+		UriFrom:          op.cctx.Uri,
+		UriTo:            op.urito,
+		AuthenticationId: op.cctx.AuthenticationId,
+		EncodingId:       op.cctx.EncodingId,
+		QoSLevel:         op.cctx.QoSLevel,
+		Priority:         op.cctx.Priority,
+		Domain:           op.cctx.Domain,
+		NetworkZone:      op.cctx.NetworkZone,
+		Session:          op.cctx.Session,
+		SessionName:      op.cctx.SessionName,
+		InteractionType:  itype,
+		InteractionStage: stage,
+		ServiceArea:      op.area,
+		AreaVersion:      op.areaVersion,
+		Service:          op.service,
+		Operation:        op.operation,
+		TransactionId:    op.tid,
+		Body:             body,
+	}
+}
+
+// Initiates the interaction: registers the operation in the ClientContext then sends
+// the initiating message.
+func (op *AsyncOperationX) initiate(itype InteractionType, stage InteractionStage, status byte, body Body) (*Future, error) {
+	op.lock.Lock()
+	if op.status != _CREATED {
+		op.lock.Unlock()
+		return nil, errors.New("Bad operation status")
+	}
+	op.status = status
+	op.itype = itype
+	future := newFuture()
+	op.future = future
+	op.lock.Unlock()
+
+	err := op.cctx.registerOp(op.tid, op)
+	if err != nil {
+		op.abort()
+		return nil, err
+	}
+	err = op.cctx.Ctx.Send(op.newMessage(itype, stage, body))
+	if err != nil {
+		op.cctx.deregisterOp(op.tid)
+		op.abort()
+		return nil, err
+	}
+	return future, nil
+}
+
+// Sends a message in an already registered PubSub interaction.
+func (op *AsyncOperationX) next(stage InteractionStage, status byte, body Body) (*Future, error) {
+	op.lock.Lock()
+	if op.status != _REGISTERED {
+		op.lock.Unlock()
+		return nil, errors.New("Bad operation status")
+	}
+	op.status = status
+	future := newFuture()
+	op.future = future
+	op.lock.Unlock()
+
+	err := op.cctx.Ctx.Send(op.newMessage(MAL_INTERACTIONTYPE_PUBSUB, stage, body))
+	if err != nil {
+		op.cctx.deregisterOp(op.tid)
+		op.abort()
+		return nil, err
+	}
+	return future, nil
+}
+
+// Ends the interaction after a failure before any reply.
+func (op *AsyncOperationX) abort() {
+	op.lock.Lock()
+	op.status = _FINAL
+	op.future = nil
+	op.lock.Unlock()
+}
+
+func (op *AsyncOperationX) Submit(body Body) (*Future, error) {
+	return op.initiate(MAL_INTERACTIONTYPE_SUBMIT, MAL_IP_STAGE_SUBMIT, _INITIATED, body)
+}
+
+func (op *AsyncOperationX) Request(body Body) (*Future, error) {
+	return op.initiate(MAL_INTERACTIONTYPE_REQUEST, MAL_IP_STAGE_REQUEST, _INITIATED, body)
+}
+
+// The returned future is completed by the response, the acknowledge is reported through
+// the OnAck callback.
+func (op *AsyncOperationX) Invoke(body Body) (*Future, error) {
+	return op.initiate(MAL_INTERACTIONTYPE_INVOKE, MAL_IP_STAGE_INVOKE, _INITIATED, body)
+}
+
+// The returned future is completed by the response, the acknowledge and the updates are
+// reported through the OnAck and OnUpdate callbacks.
+func (op *AsyncOperationX) Progress(body Body) (*Future, error) {
+	return op.initiate(MAL_INTERACTIONTYPE_PROGRESS, MAL_IP_STAGE_PROGRESS, _INITIATED, body)
+}
+
+// Registers a subscriber, the returned future is completed by the acknowledge. Then the
+// notifications are reported through the OnNotify callback.
+func (op *AsyncOperationX) Register(body Body) (*Future, error) {
+	return op.initiate(MAL_INTERACTIONTYPE_PUBSUB, MAL_IP_STAGE_PUBSUB_REGISTER, _REGISTER_INITIATED, body)
+}
+
+func (op *AsyncOperationX) Deregister(body Body) (*Future, error) {
+	return op.next(MAL_IP_STAGE_PUBSUB_DEREGISTER, _DEREGISTER_INITIATED, body)
+}
+
+// Registers a publisher, the returned future is completed by the acknowledge. Then the
+// PUBLISH_ERROR messages are reported through the OnError callback.
+func (op *AsyncOperationX) PublishRegister(body Body) (*Future, error) {
+	return op.initiate(MAL_INTERACTIONTYPE_PUBSUB, MAL_IP_STAGE_PUBSUB_PUBLISH_REGISTER, _REGISTER_INITIATED, body)
+}
+
+func (op *AsyncOperationX) Publish(body Body) error {
+	op.lock.Lock()
+	status := op.status
+	op.lock.Unlock()
+	if status != _REGISTERED {
+		return errors.New("Bad operation status")
+	}
+	return op.cctx.Ctx.Send(op.newMessage(MAL_INTERACTIONTYPE_PUBSUB, MAL_IP_STAGE_PUBSUB_PUBLISH, body))
+}
+
+func (op *AsyncOperationX) PublishDeregister(body Body) (*Future, error) {
+	return op.next(MAL_IP_STAGE_PUBSUB_PUBLISH_DEREGISTER, _DEREGISTER_INITIATED, body)
+}
+
+func (op *AsyncOperationX) onMessage(msg *Message) {
+	// Verify the message: service area, version, service, operation
+	if (msg.ServiceArea != op.area) || (msg.AreaVersion != op.areaVersion) ||
+		(msg.Service != op.service) || (msg.Operation != op.operation) || (msg.InteractionType != op.itype) {
+		logger.Errorf("ASYNC Operation (%s,%d) receives Bad message: %+v", *op.urito, op.tid, msg)
+		return
+	}
+	if (msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH) && msg.IsErrorMessage {
+		// It is a PUBLISH_ERROR, the publisher remains registered
+		logger.Debugf("AsyncOperation.onMessage: PublishError (%s, %d)", op.cctx.Uri, op.tid)
+		if op.callbacks.OnError != nil {
+			op.callbacks.OnError(msg, NewMalErrorFromPublishError(msg))
+		}
+		return
+	}
+
+	// Determines the callback, the new status of the operation and if the message
+	// completes the pending future.
+	var callback func(*Message)
+	// The status is unchanged if it remains _CREATED
+	var status byte = _CREATED
+	complete := true
+	itype, stage := msg.InteractionType, msg.InteractionStage
+	switch {
+	case (itype == MAL_INTERACTIONTYPE_SUBMIT) && (stage == MAL_IP_STAGE_SUBMIT_ACK):
+		callback, status = op.callbacks.OnAck, _FINAL
+	case (itype == MAL_INTERACTIONTYPE_REQUEST) && (stage == MAL_IP_STAGE_REQUEST_RESPONSE):
+		callback, status = op.callbacks.OnResponse, _FINAL
+	case (itype == MAL_INTERACTIONTYPE_INVOKE) && (stage == MAL_IP_STAGE_INVOKE_ACK):
+		callback, status, complete = op.callbacks.OnAck, _ACKNOWLEDGED, false
+	case (itype == MAL_INTERACTIONTYPE_INVOKE) && (stage == MAL_IP_STAGE_INVOKE_RESPONSE):
+		callback, status = op.callbacks.OnResponse, _FINAL
+	case (itype == MAL_INTERACTIONTYPE_PROGRESS) && (stage == MAL_IP_STAGE_PROGRESS_ACK):
+		callback, status, complete = op.callbacks.OnAck, _ACKNOWLEDGED, false
+	case (itype == MAL_INTERACTIONTYPE_PROGRESS) && (stage == MAL_IP_STAGE_PROGRESS_UPDATE):
+		callback, status, complete = op.callbacks.OnUpdate, _PROGRESSING, false
+	case (itype == MAL_INTERACTIONTYPE_PROGRESS) && (stage == MAL_IP_STAGE_PROGRESS_RESPONSE):
+		callback, status = op.callbacks.OnResponse, _FINAL
+	case (itype == MAL_INTERACTIONTYPE_PUBSUB) &&
+		((stage == MAL_IP_STAGE_PUBSUB_REGISTER_ACK) || (stage == MAL_IP_STAGE_PUBSUB_PUBLISH_REGISTER_ACK)):
+		callback, status = op.callbacks.OnAck, _REGISTERED
+	case (itype == MAL_INTERACTIONTYPE_PUBSUB) && (stage == MAL_IP_STAGE_PUBSUB_NOTIFY):
+		// The status is unchanged: a notify can be received during the deregistration
+		callback, complete = op.callbacks.OnNotify, false
+	case (itype == MAL_INTERACTIONTYPE_PUBSUB) &&
+		((stage == MAL_IP_STAGE_PUBSUB_DEREGISTER_ACK) || (stage == MAL_IP_STAGE_PUBSUB_PUBLISH_DEREGISTER_ACK)):
+		callback, status = op.callbacks.OnAck, _FINAL
+	default:
+		logger.Errorf("AsyncOperation.onMessage: Bad return message, operation (%s, %d), stage %d", op.cctx.Uri, op.tid, stage)
+		return
+	}
+	var err error
+	if msg.IsErrorMessage {
+		// An error message always ends the interaction
+		err = NewMalErrorFromMessage(msg)
+		status, complete = _FINAL, true
+	}
+
+	op.lock.Lock()
+	if status != _CREATED {
+		op.status = status
+	}
+	var future *Future
+	if complete {
+		future = op.future
+		op.future = nil
+	}
+	op.lock.Unlock()
+	if status == _FINAL {
+		// This operation should not received anymore messages, unregisters it.
+		op.cctx.deregisterOp(op.tid)
+	}
+
+	if err != nil {
+		if op.callbacks.OnError != nil {
+			op.callbacks.OnError(msg, err)
+		}
+	} else if callback != nil {
+		callback(msg)
+	}
+	if future != nil {
+		future.complete(msg, err)
+	}
+}
+
+// Resets the operation for a new use, a new TransactionId is allocated.
+// Be careful, the operation must be in a FINAL state
+func (op *AsyncOperationX) Reset() error {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if op.status != _FINAL {
+		return errors.New("Bad operation status")
+	}
+	// Gets a new TransactionId for operation
+	op.tid = op.cctx.TransactionId()
+	op.status = _CREATED
+	return nil
+}
+
+// Ends the operation, the pending future is completed with an error.
+func (op *AsyncOperationX) end(err error) {
+	op.lock.Lock()
+	if op.status == _CLOSED {
+		op.lock.Unlock()
+		return
+	}
+	active := (op.status != _CREATED) && (op.status != _FINAL)
+	op.status = _CLOSED
+	future := op.future
+	op.future = nil
+	op.lock.Unlock()
+	if !active {
+		return
+	}
+	op.cctx.deregisterOp(op.tid)
+	if op.callbacks.OnError != nil {
+		op.callbacks.OnError(nil, err)
+	}
+	if future != nil {
+		future.complete(nil, err)
+	}
+}
+
+// Closes the operation, if the interaction is not ended the operation is deregistered.
+// Be careful a closed operation cannot be used anymore.
+func (op *AsyncOperationX) Close() error {
+	op.end(errors.New("Operation closed"))
+	return nil
+}
+
+// This function is called when underlying ClientContext is closed
+func (op *AsyncOperationX) onClose() {
+	op.end(errors.New("Operation ends"))
+}
@@ -0,0 +1,137 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api_test
+
+import (
+	"fmt"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	async_provider_url = "invm://async_provider"
+	async_consumer_url = "invm://async_consumer"
+)
+
+func TestAsync(t *testing.T) {
+	provider_ctx, err := NewContext(async_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	provider.RegisterRequestHandler(200, 1, 1, 1, func(msg *Message, t Transaction) error {
+		body := t.NewBody()
+		body.EncodeLastParameter(NewString("reply message"), false)
+		return t.(RequestTransaction).Reply(body, false)
+	})
+	provider.RegisterProgressHandler(200, 1, 1, 2, func(msg *Message, t Transaction) error {
+		transaction := t.(ProgressTransaction)
+		transaction.Ack(t.NewBody(), false)
+		for i := 0; i < 5; i++ {
+			body := t.NewBody()
+			body.EncodeLastParameter(NewString(fmt.Sprintf("update.#%d", i)), false)
+			transaction.Update(body, false)
+		}
+		body := t.NewBody()
+		body.EncodeLastParameter(NewString("last message"), false)
+		return transaction.Reply(body, false)
+	})
+
+	consumer_ctx, err := NewContext(async_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewClientContext(consumer_ctx, "consumer")
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	// Request
+	op := consumer.NewAsyncOperation(provider.Uri, 200, 1, 1, 1, nil)
+	body := op.NewBody()
+	body.EncodeLastParameter(NewString("request"), false)
+	future, err := op.Request(body)
+	if err != nil {
+		t.Fatal("Error during request, ", err)
+	}
+	msg, err := future.Get()
+	if err != nil || msg.InteractionStage != MAL_IP_STAGE_REQUEST_RESPONSE {
+		t.Fatal("Bad response, ", err)
+	}
+
+	// Concurrent progress operations handled without dedicated goroutine
+	const nbop = 50
+	var acks, updates, responses int32
+	callbacks := &AsyncCallbacks{
+		OnAck:      func(msg *Message) { atomic.AddInt32(&acks, 1) },
+		OnUpdate:   func(msg *Message) { atomic.AddInt32(&updates, 1) },
+		OnResponse: func(msg *Message) { atomic.AddInt32(&responses, 1) },
+		OnError:    func(msg *Message, err error) { t.Error("Unexpected error, ", err) },
+	}
+	futures := make([]*Future, nbop)
+	for i := range futures {
+		op := consumer.NewAsyncOperation(provider.Uri, 200, 1, 1, 2, callbacks)
+		body := op.NewBody()
+		body.EncodeLastParameter(NewString("progress"), false)
+		futures[i], err = op.Progress(body)
+		if err != nil {
+			t.Fatal("Error during progress, ", err)
+		}
+	}
+	for _, future := range futures {
+		msg, err := future.Get()
+		if err != nil || msg.InteractionStage != MAL_IP_STAGE_PROGRESS_RESPONSE {
+			t.Fatal("Bad response, ", err)
+		}
+	}
+	if acks != nbop || updates != 5*nbop || responses != nbop {
+		t.Errorf("Bad counters: %d, %d, %d", acks, updates, responses)
+	}
+
+	// Unsupported operation
+	op = consumer.NewAsyncOperation(provider.Uri, 200, 1, 1, 3, nil)
+	body = op.NewBody()
+	body.EncodeLastParameter(NewString("request"), false)
+	future, err = op.Request(body)
+	if err != nil {
+		t.Fatal("Error during request, ", err)
+	}
+	msg, err = future.Get()
+	if err == nil || !bool(msg.IsErrorMessage) {
+		t.Fatal("Expect an error message")
+	}
+	if op.Reset() != nil {
+		t.Error("Operation should be ended")
+	}
+}
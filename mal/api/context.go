@@ -25,8 +25,10 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	. "github.com/CNES/ccsdsmo-malgo/mal"
 	"github.com/CNES/ccsdsmo-malgo/mal/debug"
+	"sync"
 	"sync/atomic"
 )
 
@@ -65,13 +67,34 @@ type ClientContext struct {
 	Session          SessionType
 	SessionName      Identifier
 
+	// Protects the map of operations, an operation can be deregistered by the consumer
+	// goroutine while a message is routed.
+	oplock      sync.Mutex
 	operations  map[ULong]OperationHandler
 	handlers    map[uint64](*pDesc)
 	txcounter   uint64
 	concurrency bool
+	// Executes the provider handlers if set, see SetWorkerPool. The pool can be changed
+	// while messages are routed, it should always be acceded through getPool.
+	poollock sync.Mutex
+	pool     *workerPool
 }
 
 func NewClientContext(ctx *Context, service string) (*ClientContext, error) {
+	return newClientContext(ctx, service, func(uri *URI, cctx *ClientContext) error {
+		return ctx.RegisterEndPoint(uri, cctx)
+	})
+}
+
+// Creates a new ClientContext with a dispatch queue of the specified length and policy,
+// see Context.RegisterEndPointWithDispatch.
+func NewClientContextWithDispatch(ctx *Context, service string, length uint, policy DispatchPolicy) (*ClientContext, error) {
+	return newClientContext(ctx, service, func(uri *URI, cctx *ClientContext) error {
+		return ctx.RegisterEndPointWithDispatch(uri, cctx, length, policy)
+	})
+}
+
+func newClientContext(ctx *Context, service string, register func(*URI, *ClientContext) error) (*ClientContext, error) {
 	// TODO (AF): Verify the uri
 	uri := ctx.NewURI(service)
 	operations := make(map[ULong]OperationHandler)
@@ -80,7 +103,7 @@ func NewClientContext(ctx *Context, service string) (*ClientContext, error) {
 		Ctx: ctx, Uri: uri, operations: operations, handlers: handlers, txcounter: 0, concurrency: false,
 		QoSLevel: QOSLEVEL_BESTEFFORT, Session: SESSIONTYPE_LIVE,
 	}
-	err := ctx.RegisterEndPoint(uri, cctx)
+	err := register(uri, cctx)
 	if err != nil {
 		return nil, err
 	}
@@ -133,12 +156,42 @@ func (cctx *ClientContext) SetConcurrency(multi bool) *ClientContext {
 	return cctx
 }
 
+// Executes the provider handlers in a pool of the specified number of goroutines. The
+// messages of a same transaction (same consumer URI and TransactionId) are handled in
+// their order of arrival, independent transactions are handled in parallel. If there is
+// already max messages being handled or waiting, an incoming message is answered with
+// a TOO_MANY error. A zero number of workers removes the pool. When the pool is replaced
+// the messages waiting for a previous message of their transaction are answered with a
+// SHUTDOWN error.
+// The pool takes precedence over the concurrency setting (see SetConcurrency).
+func (cctx *ClientContext) SetWorkerPool(workers uint, max uint) *ClientContext {
+	var pool *workerPool
+	if workers != 0 {
+		pool = newWorkerPool(workers, max)
+	}
+	cctx.poollock.Lock()
+	old := cctx.pool
+	cctx.pool = pool
+	cctx.poollock.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return cctx
+}
+
+func (cctx *ClientContext) getPool() *workerPool {
+	cctx.poollock.Lock()
+	defer cctx.poollock.Unlock()
+	return cctx.pool
+}
+
 func (cctx *ClientContext) TransactionId() ULong {
 	return ULong(atomic.AddUint64(&cctx.txcounter, 1))
 }
 
 func (cctx *ClientContext) registerOp(tid ULong, handler OperationHandler) error {
-	// TODO (AF): Synchronization
+	cctx.oplock.Lock()
+	defer cctx.oplock.Unlock()
 	old := cctx.operations[tid]
 	if old != nil {
 		logger.Warnf("Handler already registered for this transaction: %d", tid)
@@ -149,7 +202,8 @@ func (cctx *ClientContext) registerOp(tid ULong, handler OperationHandler) error
 }
 
 func (cctx *ClientContext) deregisterOp(tid ULong) error {
-	// TODO (AF): Synchronization
+	cctx.oplock.Lock()
+	defer cctx.oplock.Unlock()
 	if cctx.operations[tid] == nil {
 		logger.Warnf("No handler registered for this transaction: %d", tid)
 		return errors.New("No handler registered for this transaction")
@@ -207,17 +261,28 @@ func (cctx *ClientContext) deregisterProviderHandler(hdltype InteractionType, ar
 
 func (cctx *ClientContext) cleanOps() {
 	// Closes and removes all operations
-	for tid, op := range cctx.operations {
+	cctx.oplock.Lock()
+	operations := cctx.operations
+	cctx.operations = nil
+	cctx.oplock.Unlock()
+	for tid, op := range operations {
 		logger.Debugf("ClientContext: close operation: %d", tid)
 		op.onClose()
 	}
-	cctx.operations = nil
+}
+
+func (cctx *ClientContext) cleanPool() {
+	if pool := cctx.getPool(); pool != nil {
+		pool.close()
+	}
 }
 
 func (cctx *ClientContext) cleanHandlers() {
 	cctx.handlers = nil
 }
 
+// Closes the ClientContext, waits for the end of the message being delivered.
+// Be careful: this method should not be called from a handler, it would wait for itself.
 func (cctx *ClientContext) Close() error {
 	logger.Debugf("ClientContext.Close: %s", cctx.Uri)
 
@@ -229,6 +294,7 @@ func (cctx *ClientContext) Close() error {
 
 	cctx.cleanOps()
 	cctx.cleanHandlers()
+	cctx.cleanPool()
 
 	return nil
 }
@@ -253,6 +319,54 @@ func (cctx *ClientContext) getProviderHandler(stype InteractionType, area UShort
 	}
 }
 
+// Calls the provider handler, if it returns an error or panics before the final stage of
+// the transaction, an error message is sent back to the consumer and the failure is
+// reported through the error channel and listener of the MAL context.
+func (cctx *ClientContext) callHandler(handler ProviderHandler, msg *Message, transaction Transaction) {
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Provider handler panic: %v", r)
+		}
+		if err != nil {
+			logger.Errorf("ClientContext: provider handler fails for message from %s: %s", *msg.UriFrom, err)
+			cctx.Ctx.Error(NewMessageError(msg, errorCode(err), err))
+			ferr := transaction.fail(err)
+			if ferr != nil {
+				logger.Errorf("Cannot reply error to %s: %s", *msg.UriFrom, ferr)
+			}
+		}
+	}()
+	err = handler(msg, transaction)
+}
+
+// Reports to the originator of a message without provider handler the reason of the
+// failure: UNSUPPORTED_AREA, UNSUPPORTED_VERSION or UNSUPPORTED_OPERATION.
+func (cctx *ClientContext) replyUnsupported(msg *Message) {
+	code, info := ERROR_UNSUPPORTED_AREA, ERROR_UNSUPPORTED_AREA_MESSAGE
+	for _, desc := range cctx.handlers {
+		if desc.area != msg.ServiceArea {
+			continue
+		}
+		if desc.areaVersion == msg.AreaVersion {
+			code, info = ERROR_UNSUPPORTED_OPERATION, ERROR_UNSUPPORTED_OPERATION_MESSAGE
+			break
+		}
+		code, info = ERROR_UNSUPPORTED_VERSION, ERROR_UNSUPPORTED_VERSION_MESSAGE
+	}
+	cctx.replyError(msg, code, info)
+}
+
+// Reports a message that cannot be handled through the error channel and listener of the
+// MAL context, then sends back an error message to its originator.
+func (cctx *ClientContext) replyError(msg *Message, code UInteger, info String) {
+	cctx.Ctx.Error(NewMessageError(msg, code, errors.New(string(info))))
+	err := cctx.Ctx.SendErrorReply(msg, code, &info)
+	if err != nil {
+		logger.Errorf("Cannot reply error to %s: %s", *msg.UriFrom, err)
+	}
+}
+
 // TODO (AF): Take in account operations and handlers!!
 func (cctx *ClientContext) OnMessage(msg *Message) {
 	// TODO (AF): /!\ The broker can send a PUBLISH to the publisher to report an error.
@@ -265,6 +379,7 @@ func (cctx *ClientContext) OnMessage(msg *Message) {
 		if err != nil {
 			// TODO (AF): Log an error? Adds an error listener?
 			logger.Errorf("Cannot route message: %t", msg)
+			cctx.replyUnsupported(msg)
 			return
 		}
 		var transaction Transaction
@@ -310,33 +425,101 @@ func (cctx *ClientContext) OnMessage(msg *Message) {
 			logger.Errorf("Unknown interaction type: %s", msg)
 			return
 		}
-		if cctx.concurrency {
+		if pool := cctx.getPool(); pool != nil {
+			if !pool.submit(cctx, msg, handler, transaction) {
+				logger.Warnf("ClientContext.OnMessage: too many messages, rejects message from %s", *msg.UriFrom)
+				cctx.replyError(msg, ERROR_TOO_MANY, ERROR_TOO_MANY_MESSAGE)
+			}
+		} else if cctx.concurrency {
 			// Note (AF): Be careful, each MAL message is handled in a separate goroutine. It is the responsability
 			// of the provider to ensure the order of message processing.
-			go handler(msg, transaction)
+			go cctx.callHandler(handler, msg, transaction)
 		} else {
-			handler(msg, transaction)
+			cctx.callHandler(handler, msg, transaction)
 		}
 	} else {
 		// Note (AF): The generated TransactionId is unique for this requesting URI so we
 		// can use it as key to retrieve the Operation (This is more restrictive than the
 		// MAL API (see section 3.2).
+		cctx.oplock.Lock()
 		to, ok := cctx.operations[msg.TransactionId]
+		cctx.oplock.Unlock()
 		if ok {
 			logger.Debugf("Operation.onMessage %t", to)
 			// There is no need to call a go routine as this code is not blocking.
 			to.onMessage(msg)
 			logger.Debugf("OnMessageMessage handled: %s", msg)
+		} else if (msg.InteractionType == MAL_INTERACTIONTYPE_PUBSUB) && (msg.InteractionStage == MAL_IP_STAGE_PUBSUB_NOTIFY) && !msg.IsErrorMessage {
+			cctx.deregisterStray(msg)
 		} else {
 			logger.Errorf("Unknown TransactionID, cannot route message: %tv", msg)
 		}
 	}
 }
 
+// Sends a best-effort DEREGISTER for the subscription of a NOTIFY whose operation has ended,
+// for example when the wait of a SubscriberOperation is cancelled, so that the broker stops
+// notifying it. The acknowledge of the DEREGISTER is ignored.
+func (cctx *ClientContext) deregisterStray(msg *Message) {
+	p, err := decodeParameter(msg.Body, NullIdentifier, false)
+	if err != nil || p.IsNull() {
+		logger.Warnf("ClientContext: cannot decode the subscription of a notify from %s: %v", *msg.UriFrom, err)
+		return
+	}
+	subid := p.(*Identifier)
+	logger.Warnf("ClientContext: notify of ended operation (%s, %d), deregisters subscription %s", *msg.UriFrom, msg.TransactionId, *subid)
+	list := IdentifierList([]*Identifier{subid})
+	body := cctx.Ctx.NewBody()
+	if err := body.EncodeLastParameter(&list, false); err != nil {
+		logger.Errorf("ClientContext: cannot encode deregister: %s", err)
+		return
+	}
+	err = cctx.Ctx.Send(&Message{
+		UriFrom:          cctx.Uri,
+		UriTo:            msg.UriFrom,
+		AuthenticationId: cctx.AuthenticationId,
+		EncodingId:       cctx.EncodingId,
+		QoSLevel:         cctx.QoSLevel,
+		Priority:         cctx.Priority,
+		Domain:           cctx.Domain,
+		NetworkZone:      cctx.NetworkZone,
+		Session:          cctx.Session,
+		SessionName:      cctx.SessionName,
+		InteractionType:  MAL_INTERACTIONTYPE_PUBSUB,
+		InteractionStage: MAL_IP_STAGE_PUBSUB_DEREGISTER,
+		ServiceArea:      msg.ServiceArea,
+		AreaVersion:      msg.AreaVersion,
+		Service:          msg.Service,
+		Operation:        msg.Operation,
+		TransactionId:    msg.TransactionId,
+		Body:             body,
+	})
+	if err != nil {
+		logger.Warnf("ClientContext: cannot deregister subscription %s: %s", *subid, err)
+	}
+}
+
+// Creates the transaction of a PubSub REGISTER message without handling it, it allows a
+// broker to restore a subscription from the saved header of its registration message.
+func (cctx *ClientContext) NewSubscriberTransaction(msg *Message) SubscriberTransaction {
+	transaction := &SubscriberTransactionX{TransactionX{ctx: cctx.Ctx, uri: cctx.Uri, urifrom: msg.UriFrom}}
+	transaction.init(msg)
+	return transaction
+}
+
+// Creates the transaction of a PubSub PUBLISH_REGISTER message without handling it, it allows
+// a broker to restore a publisher from the saved header of its registration message.
+func (cctx *ClientContext) NewPublisherTransaction(msg *Message) PublisherTransaction {
+	transaction := &PublisherTransactionX{TransactionX{ctx: cctx.Ctx, uri: cctx.Uri, urifrom: msg.UriFrom}}
+	transaction.init(msg)
+	return transaction
+}
+
 // Closes operations and handlers.
 func (cctx *ClientContext) OnClose() error {
 	logger.Infof("ClientContext.OnClose: %s", cctx.Uri)
 	cctx.cleanOps()
 	cctx.cleanHandlers()
+	cctx.cleanPool()
 	return nil
 }
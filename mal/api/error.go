@@ -1,55 +1,161 @@
-/**
- * MIT License
- *
- * Copyright (c) 2020 CNES
- *
- * Permission is hereby granted, free of charge, to any person obtaining a copy
- * of this software and associated documentation files (the "Software"), to deal
- * in the Software without restriction, including without limitation the rights
- * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
- * copies of the Software, and to permit persons to whom the Software is
- * furnished to do so, subject to the following conditions:
- *
- * The above copyright notice and this permission notice shall be included in all
- * copies or substantial portions of the Software.
- *
- * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
- * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
- * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
- * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
- * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
- * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
- * SOFTWARE.
- */
-package api
-
-import (
-	"fmt"
-	"github.com/CNES/ccsdsmo-malgo/mal"
-)
-
-/*
- * This structure represents an error as it can be returned by an operation according to the CCSDS MAL specification.
- * It includes a code, represented by a UInteger, and extra information, represented by an abstract Element.
- * The MalError structure also conforms to the error interface of the standard errors go package.
- * A MalError may then be returned when an error is expected.
- *
- * The MalError structure is generally not used in the malgo api functions, as the concrete type of the Element
- * in the extra information is specific to service operations, and cannot be known by generic mal functions.
- */
-type MalError struct {
-    Code mal.UInteger
-    ExtraInfo mal.Element
-}
-
-func NewMalError(code mal.UInteger, extraInfo ...mal.Element) *MalError {
-	var e mal.Element = nil
-	if len(extraInfo) == 1 {
-		e = extraInfo[0]
-	}
-	return &MalError{ code, e }
-}
-
-func (e *MalError) Error() string {
-	return fmt.Sprintf("MAL error %v", e.Code)
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api
+
+import (
+	"fmt"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+)
+
+// Sentinel errors for the standard MAL error codes, they allow to check the code of an
+// error returned by an operation using errors.Is, for example:
+//   errors.Is(err, api.ErrDeliveryTimedOut)
+var (
+	ErrDeliveryFailed       = NewMalError(mal.ERROR_DELIVERY_FAILED)
+	ErrDeliveryTimedOut     = NewMalError(mal.ERROR_DELIVERY_TIMEDOUT)
+	ErrDeliveryDelayed      = NewMalError(mal.ERROR_DELIVERY_DELAYED)
+	ErrDestinationUnknown   = NewMalError(mal.ERROR_DESTINATION_UNKNOWN)
+	ErrDestinationTransient = NewMalError(mal.ERROR_DESTINATION_TRANSIENT)
+	ErrDestinationLost      = NewMalError(mal.ERROR_DESTINATION_LOST)
+	ErrAuthenticationFail   = NewMalError(mal.ERROR_AUTHENTICATION_FAIL)
+	ErrAuthorisationFail    = NewMalError(mal.ERROR_AUTHORISATION_FAIL)
+	ErrEncryptionFail       = NewMalError(mal.ERROR_ENCRYPTION_FAIL)
+	ErrUnsupportedArea      = NewMalError(mal.ERROR_UNSUPPORTED_AREA)
+	ErrUnsupportedOperation = NewMalError(mal.ERROR_UNSUPPORTED_OPERATION)
+	ErrUnsupportedVersion   = NewMalError(mal.ERROR_UNSUPPORTED_VERSION)
+	ErrBadEncoding          = NewMalError(mal.ERROR_BAD_ENCODING)
+	ErrInternal             = NewMalError(mal.ERROR_INTERNAL)
+	ErrUnknown              = NewMalError(mal.ERROR_UNKNOWN)
+	ErrIncorrectState       = NewMalError(mal.ERROR_INCORRECT_STATE)
+	ErrTooMany              = NewMalError(mal.ERROR_TOO_MANY)
+	ErrShutdown             = NewMalError(mal.ERROR_SHUTDOWN)
+)
+
+/*
+ * This structure represents an error as it can be returned by an operation according to the CCSDS MAL specification.
+ * It includes a code, represented by a UInteger, and extra information, represented by an abstract Element.
+ * The MalError structure also conforms to the error interface of the standard errors go package.
+ * A MalError may then be returned when an error is expected.
+ *
+ * The blocking operations of the malgo api return a MalError when an error message is received. The extra
+ * information is decoded using the type registered in the error catalogue (see mal.RegisterError), it is nil
+ * if the code is not registered or if the extra information cannot be decoded. The received message is kept
+ * in the Msg field, so that service specific extra information can always be decoded from its body.
+ */
+type MalError struct {
+    Code mal.UInteger
+    ExtraInfo mal.Element
+    // The error message received, nil if the error is not built from a message.
+    Msg *mal.Message
+}
+
+func NewMalError(code mal.UInteger, extraInfo ...mal.Element) *MalError {
+	var e mal.Element = nil
+	if len(extraInfo) == 1 {
+		e = extraInfo[0]
+	}
+	return &MalError{ Code: code, ExtraInfo: e }
+}
+
+// Builds the MalError corresponding to a received error message. The standard error body
+// (error code then extra information) is decoded, then the body is reset so that it can be
+// decoded anew by the caller. If specified, extraInfo is the null value of the type of the
+// extra information, it overrides the type registered in the catalogue.
+func NewMalErrorFromMessage(msg *mal.Message, extraInfo ...mal.Element) *MalError {
+	merr := &MalError{ Code: mal.ERROR_UNKNOWN, Msg: msg }
+	if msg.Body == nil {
+		return merr
+	}
+	defer msg.Body.Reset(false)
+
+	code, err := decodeParameter(msg.Body, mal.NullUInteger, false)
+	if err != nil {
+		logger.Warnf("NewMalErrorFromMessage: cannot decode error code: %s", err)
+		merr.Code = mal.ERROR_BAD_ENCODING
+		return merr
+	}
+	merr.Code = *code.(*mal.UInteger)
+	var infoType mal.Element
+	if len(extraInfo) == 1 {
+		infoType = extraInfo[0]
+	} else if def := mal.LookupError(merr.Code); def != nil {
+		infoType = def.ExtraInfo
+	}
+	if infoType != nil {
+		info, err := decodeParameter(msg.Body, infoType, true)
+		if err == nil {
+			merr.ExtraInfo = info
+		}
+	}
+	return merr
+}
+
+// Builds the MalError corresponding to a PUBLISH_ERROR message (see GetPublishError), the
+// extra information of an UNKNOWN error is the list of the unknown entity keys (see 3.5.6.8).
+func NewMalErrorFromPublishError(msg *mal.Message) *MalError {
+	merr := NewMalErrorFromMessage(msg)
+	if merr.Code == mal.ERROR_UNKNOWN {
+		merr = NewMalErrorFromMessage(msg, mal.NullEntityKeyList)
+	}
+	return merr
+}
+
+// Decodes a parameter of a received body, the decoders may panic on a truncated body so
+// the panic is turned into an error.
+func decodeParameter(body mal.Body, element mal.Element, last bool) (elt mal.Element, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			elt, err = nil, fmt.Errorf("bad encoding: %v", r)
+		}
+	}()
+	if last {
+		return body.DecodeLastParameter(element, false)
+	}
+	return body.DecodeParameter(element)
+}
+
+// Returns the MAL error code of the specified error: the code of a MalError, otherwise
+// INTERNAL.
+func errorCode(err error) mal.UInteger {
+	if merr, ok := err.(*MalError); ok {
+		return merr.Code
+	}
+	return mal.ERROR_INTERNAL
+}
+
+func (e *MalError) Error() string {
+	if def := mal.LookupError(e.Code); def != nil {
+		return fmt.Sprintf("MAL error %v (%s)", e.Code, def.Name)
+	}
+	return fmt.Sprintf("MAL error %v", e.Code)
+}
+
+// Reports whether the target is a MalError with the same code, the extra information is
+// ignored. This method allows to compare an error with the sentinel errors using errors.Is.
+func (e *MalError) Is(target error) bool {
+	if t, ok := target.(*MalError); ok {
+		return t.Code == e.Code
+	}
+	return false
 }
\ No newline at end of file
@@ -0,0 +1,126 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"testing"
+	"time"
+)
+
+const (
+	error_provider_url = "invm://error_provider"
+	error_consumer_url = "invm://error_consumer"
+
+	ERROR_TEST_SPECIFIC UInteger = 70100
+)
+
+func TestMalError(t *testing.T) {
+	err := RegisterError(&ErrorDefinition{Code: ERROR_TEST_SPECIFIC, Name: "SPECIFIC", Description: "Test error.", ExtraInfo: NullUInteger})
+	if err != nil {
+		t.Fatal("Error registering error code, ", err)
+	}
+	if RegisterError(&ErrorDefinition{Code: ERROR_INTERNAL, Name: "INTERNAL"}) == nil {
+		t.Error("A standard error code should not be redefined")
+	}
+	if def := LookupError(ERROR_DELIVERY_TIMEDOUT); def == nil || def.Name != "DELIVERY_TIMEDOUT" {
+		t.Errorf("Bad definition for DELIVERY_TIMEDOUT: %v", def)
+	}
+
+	provider_ctx, err := NewContext(error_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	provider.RegisterRequestHandler(200, 1, 1, 1, func(msg *Message, t Transaction) error {
+		return NewMalError(ERROR_UNKNOWN, NewString("operation failed"))
+	})
+	provider.RegisterRequestHandler(200, 1, 1, 2, func(msg *Message, t Transaction) error {
+		return NewMalError(ERROR_TEST_SPECIFIC, NewUInteger(3))
+	})
+	provider.RegisterRequestHandler(200, 1, 1, 3, func(msg *Message, t Transaction) error {
+		// Never answers
+		return nil
+	})
+
+	consumer_ctx, err := NewContext(error_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewClientContext(consumer_ctx, "consumer")
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	// Standard error: the code and extra information are decoded
+	ret, err := accessRequest(consumer, provider.Uri, 1)
+	if !errors.Is(err, ErrUnknown) || errors.Is(err, ErrInternal) {
+		t.Errorf("Bad error %v, expect %v", err, ErrUnknown)
+	}
+	var merr *MalError
+	if !errors.As(err, &merr) {
+		t.Fatal("Expected a MalError, ", err)
+	}
+	if info, ok := merr.ExtraInfo.(*String); !ok || *info != "operation failed" {
+		t.Errorf("Bad extra information %v", merr.ExtraInfo)
+	}
+	if merr.Msg != ret {
+		t.Error("The MalError should reference the error message")
+	}
+	// The body can still be decoded from the message
+	if code := accessErrorCode(t, ret); code != ERROR_UNKNOWN {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_UNKNOWN)
+	}
+
+	// Registered area specific error
+	_, err = accessRequest(consumer, provider.Uri, 2)
+	if !errors.As(err, &merr) || merr.Code != ERROR_TEST_SPECIFIC {
+		t.Fatalf("Bad error %v, expect %d", err, ERROR_TEST_SPECIFIC)
+	}
+	if info, ok := merr.ExtraInfo.(*UInteger); !ok || *info != 3 {
+		t.Errorf("Bad extra information %v", merr.ExtraInfo)
+	}
+
+	// Cancelled operation
+	op := consumer.NewRequestOperation(provider.Uri, 200, 1, 1, 3)
+	body := op.NewBody()
+	body.EncodeLastParameter(NewString("message"), false)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = op.RequestWithContext(ctx, body)
+	if !errors.Is(err, ErrDeliveryTimedOut) {
+		t.Errorf("Bad error %v, expect %v", err, ErrDeliveryTimedOut)
+	}
+}
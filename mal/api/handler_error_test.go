@@ -0,0 +1,114 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api_test
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"testing"
+)
+
+const (
+	handler_error_provider_url = "invm://handler_error_provider"
+	handler_error_consumer_url = "invm://handler_error_consumer"
+)
+
+func TestHandlerError(t *testing.T) {
+	provider_ctx, err := NewContext(handler_error_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	provider.RegisterRequestHandler(200, 1, 1, 1, func(msg *Message, t Transaction) error {
+		return NewMalError(ERROR_UNKNOWN, NewString("operation failed"))
+	})
+	provider.RegisterRequestHandler(200, 1, 1, 2, func(msg *Message, t Transaction) error {
+		return errors.New("handler failed")
+	})
+	provider.RegisterRequestHandler(200, 1, 1, 3, func(msg *Message, t Transaction) error {
+		panic("handler panic")
+	})
+	provider.RegisterInvokeHandler(200, 1, 1, 4, func(msg *Message, t Transaction) error {
+		t.(InvokeTransaction).Ack(t.NewBody(), false)
+		return errors.New("handler failed")
+	})
+
+	consumer_ctx, err := NewContext(handler_error_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewClientContext(consumer_ctx, "consumer")
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	// MalError: the code and extra information are transmitted
+	ret, err := accessRequest(consumer, provider.Uri, 1)
+	if err == nil {
+		t.Fatal("Request should fail")
+	}
+	if code := accessErrorCode(t, ret); code != ERROR_UNKNOWN {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_UNKNOWN)
+	}
+	info, err := ret.DecodeLastParameter(NullString, false)
+	if err != nil || *info.(*String) != "operation failed" {
+		t.Errorf("Bad extra information %v, %v", info, err)
+	}
+
+	// Other errors and panics are INTERNAL errors
+	for _, operation := range []UShort{2, 3} {
+		ret, err = accessRequest(consumer, provider.Uri, operation)
+		if err == nil {
+			t.Fatal("Request should fail")
+		}
+		if code := accessErrorCode(t, ret); code != ERROR_INTERNAL {
+			t.Errorf("Bad error code %d, expect %d", code, ERROR_INTERNAL)
+		}
+	}
+
+	// The error is sent in the response stage after the acknowledge
+	op := consumer.NewInvokeOperation(provider.Uri, 200, 1, 1, 4)
+	body := op.NewBody()
+	body.EncodeLastParameter(NewString("message"), false)
+	_, err = op.Invoke(body)
+	if err != nil {
+		t.Fatal("Invoke should be acknowledged, ", err)
+	}
+	ret, err = op.GetResponse()
+	if err == nil {
+		t.Fatal("Invoke should fail")
+	}
+	if code := accessErrorCode(t, ret); code != ERROR_INTERNAL {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_INTERNAL)
+	}
+}
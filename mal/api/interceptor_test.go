@@ -0,0 +1,165 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api_test
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	interceptor_provider_url = "invm://interceptor_provider"
+	interceptor_consumer_url = "invm://interceptor_consumer"
+)
+
+// Counts the messages, rewrites the network zone of outgoing messages. If filter is set
+// rejects or discards the incoming messages depending of the operation.
+type testInterceptor struct {
+	lock     sync.Mutex
+	name     string
+	filter   bool
+	trace    *[]string
+	sent     int
+	received int
+}
+
+func (i *testInterceptor) InterceptSend(msg *Message) (bool, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.sent += 1
+	*i.trace = append(*i.trace, i.name)
+	msg.NetworkZone = Identifier(i.name)
+	return true, nil
+}
+
+func (i *testInterceptor) InterceptReceive(msg *Message) (bool, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.received += 1
+	if !i.filter {
+		return true, nil
+	}
+	switch msg.Operation {
+	case 2:
+		return false, NewMessageError(msg, ERROR_UNSUPPORTED_OPERATION, errors.New("operation rejected"))
+	case 3:
+		return false, nil
+	}
+	return true, nil
+}
+
+func TestInterceptor(t *testing.T) {
+	provider_ctx, err := NewContext(interceptor_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	var zone Identifier
+	requestHandler := func(msg *Message, t Transaction) error {
+		zone = msg.NetworkZone
+		body := t.NewBody()
+		body.EncodeLastParameter(NewString("reply message"), false)
+		return t.(RequestTransaction).Reply(body, false)
+	}
+	provider.RegisterRequestHandler(200, 1, 1, 1, requestHandler)
+	provider.RegisterRequestHandler(200, 1, 1, 2, requestHandler)
+	var trace []string
+	in := &testInterceptor{name: "provider", filter: true, trace: &trace}
+	provider_ctx.AddInterceptor(in)
+
+	consumer_ctx, err := NewContext(interceptor_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewClientContext(consumer_ctx, "consumer")
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+	out1 := &testInterceptor{name: "first", trace: &trace}
+	out2 := &testInterceptor{name: "second", trace: &trace}
+	consumer_ctx.AddInterceptor(out1)
+	consumer_ctx.AddInterceptor(out2)
+
+	// The interceptors are called in their order of registration, the last one
+	// rewrites the network zone.
+	_, err = accessRequest(consumer, provider.Uri, 1)
+	if err != nil {
+		t.Fatal("Request should be accepted, ", err)
+	}
+	if len(trace) < 2 || trace[0] != "first" || trace[1] != "second" {
+		t.Errorf("Bad interceptors order: %v", trace)
+	}
+	if zone != "second" {
+		t.Errorf("Bad network zone %s, expect second", zone)
+	}
+	if in.received != 1 || out1.sent != 1 || out2.received != 1 {
+		t.Errorf("Bad counters %d, %d, %d", in.received, out1.sent, out2.received)
+	}
+
+	// Rejected incoming request
+	ret, err := accessRequest(consumer, provider.Uri, 2)
+	if err == nil {
+		t.Fatal("Request should be rejected")
+	}
+	if code := accessErrorCode(t, ret); code != ERROR_UNSUPPORTED_OPERATION {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_UNSUPPORTED_OPERATION)
+	}
+
+	// Discarded incoming message, it is neither delivered nor reported
+	errch := make(chan *MessageError, 10)
+	provider_ctx.SetErrorChannel(errch)
+	consumer_ctx.RemoveInterceptor(out2)
+	err = consumer_ctx.RemoveInterceptor(out2)
+	if err == nil {
+		t.Error("Interceptor should be already removed")
+	}
+	op := consumer.NewSendOperation(provider.Uri, 200, 1, 1, 3)
+	body := op.NewBody()
+	body.EncodeLastParameter(NewString("message"), false)
+	err = op.Send(body)
+	if err != nil {
+		t.Fatal("Error sending message, ", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if in.received != 3 || out1.sent != 3 || out2.sent != 2 {
+		t.Errorf("Bad counters %d, %d, %d", in.received, out1.sent, out2.sent)
+	}
+	select {
+	case merr := <-errch:
+		t.Errorf("Unexpected error: %s", merr)
+	default:
+	}
+}
@@ -0,0 +1,95 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+)
+
+// ================================================================================
+// Keyed publish-subscribe model
+
+// The keyed publish-subscribe model of the newer MAL drafts (MAL v2) replaces the entity keys
+// by named keys. A broker supports it for an area version given at its configuration (see
+// broker.EnableKeyedModel), the operations using this model must be created with this area
+// version. Each publish and notify holds a single update: a KeyedUpdateHeader followed by
+// the update value lists, each one with a single value.
+
+// Registers a subscription of the keyed model.
+func (op *SubscriberOperationX) RegisterKeyed(subscription *KeyedSubscription) (*Message, error) {
+	body := op.NewBody()
+	err := body.EncodeLastParameter(subscription, false)
+	if err != nil {
+		return nil, err
+	}
+	return op.Register(body)
+}
+
+// Decodes the subscription identifier and the update header of a notify of the keyed model,
+// the update value lists remain to be decoded.
+func DecodeKeyedNotify(msg *Message) (*Identifier, *KeyedUpdateHeader, error) {
+	p, err := msg.DecodeParameter(NullIdentifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	subid := p.(*Identifier)
+	p, err = msg.DecodeParameter(NullKeyedUpdateHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return subid, p.(*KeyedUpdateHeader), nil
+}
+
+// Registers a publisher of the keyed model, the key values of its updates are given in the
+// order of the key names.
+func (op *PublisherOperationX) RegisterKeyed(keyNames *IdentifierList) (*Message, error) {
+	body := op.NewBody()
+	err := body.EncodeLastParameter(keyNames, false)
+	if err != nil {
+		return nil, err
+	}
+	return op.Register(body)
+}
+
+// Publishes an update of the keyed model.
+func (op *PublisherOperationX) PublishKeyed(header *KeyedUpdateHeader, values ...ElementList) error {
+	body := op.NewBody()
+	var err error
+	if len(values) == 0 {
+		err = body.EncodeLastParameter(header, false)
+	} else {
+		err = body.EncodeParameter(header)
+	}
+	for i := 0; (err == nil) && (i < len(values)); i++ {
+		if i == len(values)-1 {
+			err = body.EncodeLastParameter(values[i], false)
+		} else {
+			err = body.EncodeParameter(values[i])
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return op.Publish(body)
+}
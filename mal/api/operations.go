@@ -24,6 +24,7 @@
 package api
 
 import (
+	"context"
 	"errors"
 	. "github.com/CNES/ccsdsmo-malgo/mal"
 )
@@ -66,6 +67,9 @@ type OperationX struct {
 	status      byte
 	// Channel used for asynchronous errors (for example PublishError)
 	err_ch chan *Message
+	// Closed when the wait of a message is cancelled, so that a message arriving meanwhile
+	// does not block the ClientContext.
+	done chan bool
 }
 
 // Verifies that the incoming message corresponds to the initiated operation
@@ -95,6 +99,35 @@ func (op *OperationX) NewBody() Body {
 	return op.cctx.Ctx.NewBody()
 }
 
+// Waits for the next message of the operation. If the specified context is done before,
+// the operation is finalized (so deregistered from its ClientContext) and a MalError with
+// the DELIVERY_TIMEDOUT code is returned.
+func (op *OperationX) waitMessage(ctx context.Context) (*Message, bool, error) {
+	select {
+	case msg, more := <-op.ch:
+		return msg, more, nil
+	case <-ctx.Done():
+		logger.Warnf("Operation.waitMessage: Operation cancelled (%s, %d): %s", *op.cctx.Uri, op.tid, ctx.Err())
+		op.finalize()
+		select {
+		case <-op.done:
+		default:
+			close(op.done)
+		}
+		return nil, true, NewMalError(ERROR_DELIVERY_TIMEDOUT, NewString(ctx.Err().Error()))
+	}
+}
+
+// Forwards an incoming message to the waiting operation, the message is discarded if the
+// wait has been cancelled.
+func (op *OperationX) deliver(msg *Message) {
+	select {
+	case op.ch <- msg:
+	case <-op.done:
+		logger.Warnf("Operation.deliver: Operation cancelled (%s, %d), discards message", *op.cctx.Uri, op.tid)
+	}
+}
+
 // Interrupts the operation.
 func (op *OperationX) Interrupt() {
 	if op.status == _CLOSED {
@@ -137,6 +170,13 @@ func (op *OperationX) Reset() error {
 	// Gets a new TransactionId for operation
 	op.tid = op.cctx.TransactionId()
 	op.status = _CREATED
+	if op.done != nil {
+		select {
+		case <-op.done:
+			op.done = make(chan bool)
+		default:
+		}
+	}
 	return nil
 }
 
@@ -155,7 +195,7 @@ type SendOperationX struct {
 func (cctx *ClientContext) NewSendOperation(urito *URI, area UShort, areaVersion UOctet, service UShort, operation UShort) SendOperation {
 	// Gets a new TransactionId for operation
 	tid := cctx.TransactionId()
-	op := &SendOperationX{OperationX: OperationX{cctx, tid, nil, urito, area, areaVersion, service, operation, _CREATED, nil}}
+	op := &SendOperationX{OperationX: OperationX{cctx, tid, nil, urito, area, areaVersion, service, operation, _CREATED, nil, nil}}
 	return op
 }
 
@@ -207,6 +247,7 @@ func (op *SendOperationX) onClose() {
 type SubmitOperation interface {
 	Operation
 	Submit(body Body) (*Message, error)
+	SubmitWithContext(ctx context.Context, body Body) (*Message, error)
 }
 
 type SubmitOperationX struct {
@@ -218,11 +259,17 @@ func (cctx *ClientContext) NewSubmitOperation(urito *URI, area UShort, areaVersi
 	tid := cctx.TransactionId()
 	// Normally should not receive more than one message
 	ch := make(chan *Message)
-	op := &SubmitOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil}}
+	op := &SubmitOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil, make(chan bool)}}
 	return op
 }
 
 func (op *SubmitOperationX) Submit(body Body) (*Message, error) {
+	return op.SubmitWithContext(context.Background(), body)
+}
+
+// Same as Submit, the wait of the acknowledge is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *SubmitOperationX) SubmitWithContext(ctx context.Context, body Body) (*Message, error) {
 	if op.status != _CREATED {
 		return nil, errors.New("Bad operation status")
 	}
@@ -262,7 +309,10 @@ func (op *SubmitOperationX) Submit(body Body) (*Message, error) {
 	}
 
 	// Waits for the SUBMIT_ACK MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Errorf("SubmitOperation.Sumit: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -281,7 +331,7 @@ func (op *SubmitOperationX) Submit(body Body) (*Message, error) {
 	op.finalize()
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		return msg, nil
 	}
@@ -290,7 +340,7 @@ func (op *SubmitOperationX) Submit(body Body) (*Message, error) {
 func (op *SubmitOperationX) onMessage(msg *Message) {
 	// Verify the message: service area, version, service, operation
 	if op.verify(msg) && (msg.InteractionType == MAL_INTERACTIONTYPE_SUBMIT) {
-		op.ch <- msg
+		op.deliver(msg)
 	} else {
 		logger.Errorf("SUBMIT Operation (%s,%d) receives Bad message: %+v", *op.urito, op.tid, msg)
 	}
@@ -307,6 +357,7 @@ func (op *SubmitOperationX) onClose() {
 type RequestOperation interface {
 	Operation
 	Request(body Body) (*Message, error)
+	RequestWithContext(ctx context.Context, body Body) (*Message, error)
 }
 
 type RequestOperationX struct {
@@ -318,11 +369,17 @@ func (cctx *ClientContext) NewRequestOperation(urito *URI, area UShort, areaVers
 	tid := cctx.TransactionId()
 	// Normally should not receive more than one message
 	ch := make(chan *Message)
-	op := &RequestOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil}}
+	op := &RequestOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil, make(chan bool)}}
 	return op
 }
 
 func (op *RequestOperationX) Request(body Body) (*Message, error) {
+	return op.RequestWithContext(context.Background(), body)
+}
+
+// Same as Request, the wait of the response is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *RequestOperationX) RequestWithContext(ctx context.Context, body Body) (*Message, error) {
 	if op.status != _CREATED {
 		return nil, errors.New("Bad operation status")
 	}
@@ -362,7 +419,10 @@ func (op *RequestOperationX) Request(body Body) (*Message, error) {
 	}
 
 	// Waits for the RESPONSE MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("RequetOperation.Request: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -382,7 +442,7 @@ func (op *RequestOperationX) Request(body Body) (*Message, error) {
 	op.finalize()
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		return msg, nil
 	}
@@ -391,7 +451,7 @@ func (op *RequestOperationX) Request(body Body) (*Message, error) {
 func (op *RequestOperationX) onMessage(msg *Message) {
 	// Verify the message: service area, version, service, operation
 	if op.verify(msg) && (msg.InteractionType == MAL_INTERACTIONTYPE_REQUEST) {
-		op.ch <- msg
+		op.deliver(msg)
 	} else {
 		logger.Errorf("REQUEST Operation (%s,%d) receives Bad message: %+v", *op.urito, op.tid, msg)
 	}
@@ -408,7 +468,9 @@ func (op *RequestOperationX) onClose() {
 type InvokeOperation interface {
 	Operation
 	Invoke(body Body) (*Message, error)
+	InvokeWithContext(ctx context.Context, body Body) (*Message, error)
 	GetResponse() (*Message, error)
+	GetResponseWithContext(ctx context.Context) (*Message, error)
 }
 
 type InvokeOperationX struct {
@@ -422,11 +484,17 @@ func (cctx *ClientContext) NewInvokeOperation(urito *URI, area UShort, areaVersi
 	tid := cctx.TransactionId()
 	// Normally should not receive more than 2 messages, and it waits first message (ack) synchronously.
 	ch := make(chan *Message)
-	op := &InvokeOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil}}
+	op := &InvokeOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil, make(chan bool)}}
 	return op
 }
 
 func (op *InvokeOperationX) Invoke(body Body) (*Message, error) {
+	return op.InvokeWithContext(context.Background(), body)
+}
+
+// Same as Invoke, the wait of the acknowledge is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *InvokeOperationX) InvokeWithContext(ctx context.Context, body Body) (*Message, error) {
 	if op.status != _CREATED {
 		return nil, errors.New("Bad operation status")
 	}
@@ -466,7 +534,10 @@ func (op *InvokeOperationX) Invoke(body Body) (*Message, error) {
 	}
 
 	// Waits for the INVOKE_ACK MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("InvokeOperation.Invoke: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -487,7 +558,7 @@ func (op *InvokeOperationX) Invoke(body Body) (*Message, error) {
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
 		op.finalize()
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		return msg, nil
 	}
@@ -495,9 +566,15 @@ func (op *InvokeOperationX) Invoke(body Body) (*Message, error) {
 
 // Returns the response.
 func (op *InvokeOperationX) GetResponse() (*Message, error) {
+	return op.GetResponseWithContext(context.Background())
+}
+
+// Same as GetResponse, the wait of the response is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *InvokeOperationX) GetResponseWithContext(ctx context.Context) (*Message, error) {
 	if (op.status == _FINAL) && (op.response != nil) {
 		if op.response.IsErrorMessage {
-			return op.response, errors.New("Error message")
+			return op.response, NewMalErrorFromMessage(op.response)
 		} else {
 			return op.response, nil
 		}
@@ -507,7 +584,10 @@ func (op *InvokeOperationX) GetResponse() (*Message, error) {
 	}
 
 	// Waits for next MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("InvokeOperation.GetResponse: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -528,7 +608,7 @@ func (op *InvokeOperationX) GetResponse() (*Message, error) {
 	op.response = msg
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		return msg, nil
 	}
@@ -537,7 +617,7 @@ func (op *InvokeOperationX) GetResponse() (*Message, error) {
 func (op *InvokeOperationX) onMessage(msg *Message) {
 	// Verify the message: service area, version, service, operation
 	if op.verify(msg) && (msg.InteractionType == MAL_INTERACTIONTYPE_INVOKE) {
-		op.ch <- msg
+		op.deliver(msg)
 	} else {
 		logger.Errorf("INVOKE Operation (%s,%d) receives Bad message: %+v", *op.urito, op.tid, msg)
 	}
@@ -554,8 +634,11 @@ func (op *InvokeOperationX) onClose() {
 type ProgressOperation interface {
 	Operation
 	Progress(body Body) (*Message, error)
+	ProgressWithContext(ctx context.Context, body Body) (*Message, error)
 	GetUpdate() (*Message, error)
+	GetUpdateWithContext(ctx context.Context) (*Message, error)
 	GetResponse() (*Message, error)
+	GetResponseWithContext(ctx context.Context) (*Message, error)
 }
 
 type ProgressOperationX struct {
@@ -571,11 +654,17 @@ func (cctx *ClientContext) NewProgressOperation(urito *URI, area UShort, areaVer
 	// MAL context thread.
 	// TODO (AF): Fix length of channel
 	ch := make(chan *Message, 10)
-	op := &ProgressOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil}}
+	op := &ProgressOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil, make(chan bool)}}
 	return op
 }
 
 func (op *ProgressOperationX) Progress(body Body) (*Message, error) {
+	return op.ProgressWithContext(context.Background(), body)
+}
+
+// Same as Progress, the wait of the acknowledge is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *ProgressOperationX) ProgressWithContext(ctx context.Context, body Body) (*Message, error) {
 	if op.status != _CREATED {
 		return nil, errors.New("Bad operation status")
 	}
@@ -615,7 +704,10 @@ func (op *ProgressOperationX) Progress(body Body) (*Message, error) {
 	}
 
 	// Waits for the PROGRESS_ACK MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("ProgressOperation.Progress: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -636,7 +728,7 @@ func (op *ProgressOperationX) Progress(body Body) (*Message, error) {
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
 		op.finalize()
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		return msg, nil
 	}
@@ -644,12 +736,21 @@ func (op *ProgressOperationX) Progress(body Body) (*Message, error) {
 
 // Returns next update or nil if there is no more update.
 func (op *ProgressOperationX) GetUpdate() (*Message, error) {
+	return op.GetUpdateWithContext(context.Background())
+}
+
+// Same as GetUpdate, the wait of the next message is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *ProgressOperationX) GetUpdateWithContext(ctx context.Context) (*Message, error) {
 	if (op.status != _ACKNOWLEDGED) && (op.status != _PROGRESSING) {
 		return nil, errors.New("Bad operation status")
 	}
 
 	// Waits for next MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("ProgressOperation.GetUpdate: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -672,7 +773,7 @@ func (op *ProgressOperationX) GetUpdate() (*Message, error) {
 		// Verify that the message is ok (ack or error)
 		if msg.IsErrorMessage {
 			op.finalize()
-			return msg, errors.New("Error message")
+			return msg, NewMalErrorFromMessage(msg)
 		} else {
 			return msg, nil
 		}
@@ -685,9 +786,15 @@ func (op *ProgressOperationX) GetUpdate() (*Message, error) {
 
 // Returns the response.
 func (op *ProgressOperationX) GetResponse() (*Message, error) {
+	return op.GetResponseWithContext(context.Background())
+}
+
+// Same as GetResponse, the wait of the response is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *ProgressOperationX) GetResponseWithContext(ctx context.Context) (*Message, error) {
 	if (op.status == _FINAL) && (op.response != nil) {
 		if op.response.IsErrorMessage {
-			return op.response, errors.New("Error message")
+			return op.response, NewMalErrorFromMessage(op.response)
 		} else {
 			return op.response, nil
 		}
@@ -697,7 +804,10 @@ func (op *ProgressOperationX) GetResponse() (*Message, error) {
 	}
 
 	// Waits for next MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("ProgressOperation.GetResponse: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -717,7 +827,7 @@ func (op *ProgressOperationX) GetResponse() (*Message, error) {
 	op.response = msg
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		return msg, nil
 	}
@@ -726,7 +836,7 @@ func (op *ProgressOperationX) GetResponse() (*Message, error) {
 func (op *ProgressOperationX) onMessage(msg *Message) {
 	// Verify the message: service area, version, service, operation
 	if op.verify(msg) && (msg.InteractionType == MAL_INTERACTIONTYPE_PROGRESS) {
-		op.ch <- msg
+		op.deliver(msg)
 	} else {
 		logger.Errorf("PROGRESS Operation (%s,%d) receives Bad message: %+v", *op.urito, op.tid, msg)
 	}
@@ -743,8 +853,12 @@ func (op *ProgressOperationX) onClose() {
 type SubscriberOperation interface {
 	Operation
 	Register(body Body) (*Message, error)
+	RegisterWithContext(ctx context.Context, body Body) (*Message, error)
+	RegisterKeyed(subscription *KeyedSubscription) (*Message, error)
 	GetNotify() (*Message, error)
+	GetNotifyWithContext(ctx context.Context) (*Message, error)
 	Deregister(body Body) (*Message, error)
+	DeregisterWithContext(ctx context.Context, body Body) (*Message, error)
 }
 
 type SubscriberOperationX struct {
@@ -759,11 +873,18 @@ func (cctx *ClientContext) NewSubscriberOperation(urito *URI, area UShort, areaV
 	// MAL context thread.
 	// TODO (AF): Fix length of channel
 	ch := make(chan *Message, 10)
-	op := &SubscriberOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil}}
+	op := &SubscriberOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, nil, make(chan bool)}}
 	return op
 }
 
 func (op *SubscriberOperationX) Register(body Body) (*Message, error) {
+	return op.RegisterWithContext(context.Background(), body)
+}
+
+// Same as Register, the wait of the acknowledge is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError. The broker is
+// not informed, the subscription is deregistered on its next notify (see ClientContext.OnMessage).
+func (op *SubscriberOperationX) RegisterWithContext(ctx context.Context, body Body) (*Message, error) {
 	// TODO (AF): Be careful we can register anew a Subscriber
 	if op.status != _CREATED {
 		return nil, errors.New("Bad operation status")
@@ -804,7 +925,10 @@ func (op *SubscriberOperationX) Register(body Body) (*Message, error) {
 	}
 
 	// Waits for the REGISTER_ACK MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("SubscriberOperation.Register: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -824,7 +948,7 @@ func (op *SubscriberOperationX) Register(body Body) (*Message, error) {
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
 		op.finalize()
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		op.status = _REGISTERED
 		return msg, nil
@@ -833,6 +957,13 @@ func (op *SubscriberOperationX) Register(body Body) (*Message, error) {
 
 // Returns next notify.
 func (op *SubscriberOperationX) GetNotify() (*Message, error) {
+	return op.GetNotifyWithContext(context.Background())
+}
+
+// Same as GetNotify, the wait of the next notify is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError. The broker is
+// not informed, the subscription is deregistered on its next notify (see ClientContext.OnMessage).
+func (op *SubscriberOperationX) GetNotifyWithContext(ctx context.Context) (*Message, error) {
 	// TODO (AF): May be we have to allow a timeout to this operation.
 	if (op.status != _REGISTERED) && (op.status != _REREGISTER_INITIATED) && (op.status != _DEREGISTER_INITIATED) {
 		return nil, errors.New("Bad operation status")
@@ -840,7 +971,10 @@ func (op *SubscriberOperationX) GetNotify() (*Message, error) {
 	// TODO (AF): Handle _REREGISTER_INITIATED and _DEREGISTER_INITIATED status
 
 	// Waits for next MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("SubscriberOperation.GetNotify: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -859,13 +993,19 @@ func (op *SubscriberOperationX) GetNotify() (*Message, error) {
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
 		op.finalize()
-		return msg, errors.New("SubscriberOperation.GetNotify: Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		return msg, nil
 	}
 }
 
 func (op *SubscriberOperationX) Deregister(body Body) (*Message, error) {
+	return op.DeregisterWithContext(context.Background(), body)
+}
+
+// Same as Deregister, the wait of the acknowledge is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *SubscriberOperationX) DeregisterWithContext(ctx context.Context, body Body) (*Message, error) {
 	if op.status != _REGISTERED {
 		return nil, errors.New("Bad operation status")
 	}
@@ -900,7 +1040,10 @@ func (op *SubscriberOperationX) Deregister(body Body) (*Message, error) {
 
 	// Waits for the DEREGISTER_ACK MAL message, removing useless notify waiting messages
 	for {
-		msg, more := <-op.ch
+		msg, more, err := op.waitMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
 		if !more {
 			op.finalize()
 			logger.Debugf("SubscriberOperation.Deregister: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -922,7 +1065,7 @@ func (op *SubscriberOperationX) Deregister(body Body) (*Message, error) {
 		}
 		op.finalize()
 		if msg.IsErrorMessage {
-			return msg, errors.New("Error message")
+			return msg, NewMalErrorFromMessage(msg)
 		} else {
 			return msg, nil
 		}
@@ -932,7 +1075,7 @@ func (op *SubscriberOperationX) Deregister(body Body) (*Message, error) {
 func (op *SubscriberOperationX) onMessage(msg *Message) {
 	// Verify the message: service area, version, service, operation
 	if op.verify(msg) && (msg.InteractionType == MAL_INTERACTIONTYPE_PUBSUB) {
-		op.ch <- msg
+		op.deliver(msg)
 	} else {
 		logger.Errorf("PUBSUB Operation (%s,%d) receives Bad message: %+v", *op.urito, op.tid, msg)
 	}
@@ -949,9 +1092,13 @@ func (op *SubscriberOperationX) onClose() {
 type PublisherOperation interface {
 	Operation
 	Register(body Body) (*Message, error)
+	RegisterWithContext(ctx context.Context, body Body) (*Message, error)
+	RegisterKeyed(keyNames *IdentifierList) (*Message, error)
 	Publish(body Body) error
+	PublishKeyed(header *KeyedUpdateHeader, values ...ElementList) error
 	GetPublishError() (*Message, error)
 	Deregister(body Body) (*Message, error)
+	DeregisterWithContext(ctx context.Context, body Body) (*Message, error)
 }
 
 type PublisherOperationX struct {
@@ -966,11 +1113,17 @@ func (cctx *ClientContext) NewPublisherOperation(urito *URI, area UShort, areaVe
 	ch := make(chan *Message)
 	// Make channel for PublishError
 	err_ch := make(chan *Message, 5)
-	op := &PublisherOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, err_ch}}
+	op := &PublisherOperationX{OperationX: OperationX{cctx, tid, ch, urito, area, areaVersion, service, operation, _CREATED, err_ch, make(chan bool)}}
 	return op
 }
 
 func (op *PublisherOperationX) Register(body Body) (*Message, error) {
+	return op.RegisterWithContext(context.Background(), body)
+}
+
+// Same as Register, the wait of the acknowledge is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *PublisherOperationX) RegisterWithContext(ctx context.Context, body Body) (*Message, error) {
 	// TODO (AF): Be careful currently we cannot register anew a publisher
 	if op.status != _CREATED {
 		return nil, errors.New("Bad operation status")
@@ -1010,7 +1163,10 @@ func (op *PublisherOperationX) Register(body Body) (*Message, error) {
 		return nil, err
 	}
 	// Waits for the PUBLISH_REGISTER_ACK MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("PublisherOperation.Register: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -1030,7 +1186,7 @@ func (op *PublisherOperationX) Register(body Body) (*Message, error) {
 	// Verify that the message is ok (ack or error)
 	if msg.IsErrorMessage {
 		op.finalize()
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		op.status = _REGISTERED
 		return msg, nil
@@ -1072,6 +1228,8 @@ func (op *PublisherOperationX) Publish(body Body) error {
 	return nil
 }
 
+// Returns the next pending PUBLISH_ERROR message, or nil if there is none. The corresponding
+// MalError is built by NewMalErrorFromPublishError.
 func (op *PublisherOperationX) GetPublishError() (*Message, error) {
 	if op.status != _REGISTERED {
 		return nil, errors.New("Bad operation status")
@@ -1090,6 +1248,12 @@ func (op *PublisherOperationX) GetPublishError() (*Message, error) {
 }
 
 func (op *PublisherOperationX) Deregister(body Body) (*Message, error) {
+	return op.DeregisterWithContext(context.Background(), body)
+}
+
+// Same as Deregister, the wait of the acknowledge is aborted when the specified
+// context is done, then the operation ends with a DELIVERY_TIMEDOUT MalError.
+func (op *PublisherOperationX) DeregisterWithContext(ctx context.Context, body Body) (*Message, error) {
 	if op.status != _REGISTERED {
 		return nil, errors.New("Bad operation status")
 	}
@@ -1123,7 +1287,10 @@ func (op *PublisherOperationX) Deregister(body Body) (*Message, error) {
 	}
 
 	// Waits for the PUBLISH_DEREGISTER_ACK MAL message
-	msg, more := <-op.ch
+	msg, more, err := op.waitMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if !more {
 		op.finalize()
 		logger.Debugf("PublisherOperation.Deregister: Operation ends: %s, %s", op.cctx.Uri, op.tid)
@@ -1142,7 +1309,7 @@ func (op *PublisherOperationX) Deregister(body Body) (*Message, error) {
 	}
 	op.finalize()
 	if msg.IsErrorMessage {
-		return msg, errors.New("Error message")
+		return msg, NewMalErrorFromMessage(msg)
 	} else {
 		return msg, nil
 	}
@@ -1156,7 +1323,7 @@ func (op *PublisherOperationX) onMessage(msg *Message) {
 			logger.Debugf("PublisherOperation.onMessage: PublishError (%s, %s)", op.cctx.Uri, op.tid)
 			op.err_ch <- msg
 		} else {
-			op.ch <- msg
+			op.deliver(msg)
 		}
 	} else {
 		logger.Errorf("PUBSUB Operation (%s,%d) receives Bad message: %+v", *op.urito, op.tid, msg)
@@ -0,0 +1,95 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api_test
+
+import (
+	"context"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"testing"
+	"time"
+)
+
+const (
+	timeout_provider_url = "invm://timeout_provider"
+	timeout_consumer_url = "invm://timeout_consumer"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	provider_ctx, err := NewContext(timeout_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	// The first request is answered only after the release of the provider.
+	release := make(chan bool)
+	requestHandler := func(msg *Message, t Transaction) error {
+		if msg.Operation == 1 {
+			<-release
+		}
+		body := t.NewBody()
+		body.EncodeLastParameter(NewString("reply message"), false)
+		return t.(RequestTransaction).Reply(body, false)
+	}
+	provider.RegisterRequestHandler(200, 1, 1, 1, requestHandler)
+	provider.RegisterRequestHandler(200, 1, 1, 2, requestHandler)
+
+	consumer_ctx, err := NewContext(timeout_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewClientContext(consumer_ctx, "consumer")
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	op := consumer.NewRequestOperation(provider.Uri, 200, 1, 1, 1)
+	body := op.NewBody()
+	body.EncodeLastParameter(NewString("message"), false)
+	_, err = op.RequestWithContext(ctx, body)
+	if merr, ok := err.(*MalError); !ok || merr.Code != ERROR_DELIVERY_TIMEDOUT {
+		t.Fatalf("Request should be timed out, get: %v", err)
+	}
+
+	// The late response is discarded and the consumer can be used anew.
+	release <- true
+	_, err = accessRequest(consumer, provider.Uri, 2)
+	if err != nil {
+		t.Fatal("Request should be accepted, ", err)
+	}
+	err = op.Reset()
+	if err != nil {
+		t.Fatal("Operation should be reusable, ", err)
+	}
+}
@@ -25,6 +25,14 @@ package api
 
 import (
 	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"sync/atomic"
+)
+
+// Stages reached by a transaction, see TransactionX.state.
+const (
+	_TX_INITIATED uint32 = iota
+	_TX_ACKNOWLEDGED
+	_TX_FINAL
 )
 
 // Defines a generic root Transaction interface (context of an incoming interaction)
@@ -34,6 +42,8 @@ type Transaction interface {
 	getTid() ULong
 	// Returns a new Body ready to encode
 	NewBody() Body
+	// Answers the consumer with an error message if the final stage is not reached
+	fail(err error) error
 }
 
 // Defines a generic root Transaction structure
@@ -56,6 +66,9 @@ type TransactionX struct {
 	areaVersion UOctet
 	service     UShort
 	operation   UShort
+	// Stage reached by the transaction, it is atomically updated as the provider may
+	// reply from another goroutine than the handler one.
+	state uint32
 }
 
 // Fix additionnal parameters from incoming message
@@ -83,6 +96,42 @@ func (tx *TransactionX) NewBody() Body {
 	return tx.ctx.NewBody()
 }
 
+func (tx *TransactionX) reach(state uint32) {
+	atomic.StoreUint32(&tx.state, state)
+}
+
+func (tx *TransactionX) reached() uint32 {
+	return atomic.LoadUint32(&tx.state)
+}
+
+// By default there is nothing to answer (SEND and PUBSUB interactions).
+func (tx *TransactionX) fail(err error) error {
+	return nil
+}
+
+// Sends the error message corresponding to the specified error using the specified
+// stage: the Code and ExtraInfo of a MalError, otherwise an INTERNAL error with a String
+// extra information.
+func (tx *TransactionX) replyError(cause error, reply func(body Body, isError bool) error) error {
+	code, extraInfo := errorCode(cause), Element(NewString(cause.Error()))
+	if merr, ok := cause.(*MalError); ok {
+		extraInfo = merr.ExtraInfo
+		if extraInfo == nil {
+			extraInfo = NullString
+		}
+	}
+	body := tx.NewBody()
+	err := body.EncodeParameter(&code)
+	if err != nil {
+		return err
+	}
+	err = body.EncodeLastParameter(extraInfo, false)
+	if err != nil {
+		return err
+	}
+	return reply(body, true)
+}
+
 // ================================================================================
 // MAL Send interaction
 
@@ -106,6 +155,13 @@ type SubmitTransactionX struct {
 	TransactionX
 }
 
+func (tx *SubmitTransactionX) fail(err error) error {
+	if tx.reached() != _TX_INITIATED {
+		return nil
+	}
+	return tx.replyError(err, tx.Ack)
+}
+
 func (tx *SubmitTransactionX) Ack(body Body, isError bool) error {
 	msg := &Message{
 		UriFrom:          tx.uri,
@@ -128,6 +184,7 @@ func (tx *SubmitTransactionX) Ack(body Body, isError bool) error {
 		IsErrorMessage:   Boolean(isError),
 		Body:             body,
 	}
+	tx.reach(_TX_FINAL)
 	return tx.ctx.Send(msg)
 }
 
@@ -143,6 +200,13 @@ type RequestTransactionX struct {
 	TransactionX
 }
 
+func (tx *RequestTransactionX) fail(err error) error {
+	if tx.reached() != _TX_INITIATED {
+		return nil
+	}
+	return tx.replyError(err, tx.Reply)
+}
+
 func (tx *RequestTransactionX) Reply(body Body, isError bool) error {
 	msg := &Message{
 		UriFrom:          tx.uri,
@@ -165,6 +229,7 @@ func (tx *RequestTransactionX) Reply(body Body, isError bool) error {
 		IsErrorMessage:   Boolean(isError),
 		Body:             body,
 	}
+	tx.reach(_TX_FINAL)
 	return tx.ctx.Send(msg)
 }
 
@@ -181,6 +246,18 @@ type InvokeTransactionX struct {
 	TransactionX
 }
 
+// The error is sent in the acknowledge stage if it is not already sent, otherwise in the
+// response stage.
+func (tx *InvokeTransactionX) fail(err error) error {
+	switch tx.reached() {
+	case _TX_INITIATED:
+		return tx.replyError(err, tx.Ack)
+	case _TX_ACKNOWLEDGED:
+		return tx.replyError(err, tx.Reply)
+	}
+	return nil
+}
+
 func (tx *InvokeTransactionX) Ack(body Body, isError bool) error {
 	msg := &Message{
 		UriFrom:          tx.uri,
@@ -203,6 +280,7 @@ func (tx *InvokeTransactionX) Ack(body Body, isError bool) error {
 		IsErrorMessage:   Boolean(isError),
 		Body:             body,
 	}
+	tx.reach(_TX_ACKNOWLEDGED)
 	return tx.ctx.Send(msg)
 }
 
@@ -228,6 +306,7 @@ func (tx *InvokeTransactionX) Reply(body Body, isError bool) error {
 		IsErrorMessage:   Boolean(isError),
 		Body:             body,
 	}
+	tx.reach(_TX_FINAL)
 	return tx.ctx.Send(msg)
 }
 
@@ -245,6 +324,18 @@ type ProgressTransactionX struct {
 	TransactionX
 }
 
+// The error is sent in the acknowledge stage if it is not already sent, otherwise in the
+// response stage.
+func (tx *ProgressTransactionX) fail(err error) error {
+	switch tx.reached() {
+	case _TX_INITIATED:
+		return tx.replyError(err, tx.Ack)
+	case _TX_ACKNOWLEDGED:
+		return tx.replyError(err, tx.Reply)
+	}
+	return nil
+}
+
 func (tx *ProgressTransactionX) Ack(body Body, isError bool) error {
 	msg := &Message{
 		UriFrom:          tx.uri,
@@ -267,6 +358,7 @@ func (tx *ProgressTransactionX) Ack(body Body, isError bool) error {
 		IsErrorMessage:   Boolean(isError),
 		Body:             body,
 	}
+	tx.reach(_TX_ACKNOWLEDGED)
 	return tx.ctx.Send(msg)
 }
 
@@ -317,6 +409,7 @@ func (tx *ProgressTransactionX) Reply(body Body, isError bool) error {
 		IsErrorMessage:   Boolean(isError),
 		Body:             body,
 	}
+	tx.reach(_TX_FINAL)
 	return tx.ctx.Send(msg)
 }
 
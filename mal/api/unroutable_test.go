@@ -0,0 +1,102 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api_test
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"testing"
+)
+
+const (
+	unroutable_provider_url = "invm://unroutable_provider"
+	unroutable_consumer_url = "invm://unroutable_consumer"
+)
+
+// Tests the error replies to messages that cannot be delivered to a provider handler.
+func TestUnroutable(t *testing.T) {
+	provider_ctx, err := NewContext(unroutable_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	errch := make(chan *MessageError, 10)
+	provider_ctx.SetErrorChannel(errch)
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	provider.RegisterRequestHandler(200, 1, 1, 1, func(msg *Message, t Transaction) error {
+		return t.(RequestTransaction).Reply(t.NewBody(), false)
+	})
+
+	consumer_ctx, err := NewContext(unroutable_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewClientContext(consumer_ctx, "consumer")
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	tests := []struct {
+		urito       *URI
+		area        UShort
+		areaVersion UOctet
+		operation   UShort
+		code        UInteger
+	}{
+		{provider_ctx.NewURI("unknown"), 200, 1, 1, ERROR_DESTINATION_UNKNOWN},
+		{provider.Uri, 201, 1, 1, ERROR_UNSUPPORTED_AREA},
+		{provider.Uri, 200, 2, 1, ERROR_UNSUPPORTED_VERSION},
+		{provider.Uri, 200, 1, 2, ERROR_UNSUPPORTED_OPERATION},
+	}
+	for _, test := range tests {
+		op := consumer.NewRequestOperation(test.urito, test.area, test.areaVersion, 1, test.operation)
+		body := op.NewBody()
+		body.EncodeLastParameter(NewString("message"), false)
+		ret, err := op.Request(body)
+		if err == nil {
+			t.Fatal("Request should fail")
+		}
+		if code := accessErrorCode(t, ret); code != test.code {
+			t.Errorf("Bad error code %d, expect %d", code, test.code)
+		}
+	}
+
+	// Each failure is reported through the error channel of the provider context.
+	for _, test := range tests {
+		select {
+		case merr := <-errch:
+			if merr.Code != test.code || merr.Msg == nil {
+				t.Errorf("Bad reported error %s, expect code %d", merr, test.code)
+			}
+		default:
+			t.Errorf("Error %d not reported", test.code)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2017 - 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"sync"
+)
+
+// Identifies a transaction from the provider point of view: the consumer URI and the
+// TransactionId it allocated.
+type txKey struct {
+	uri URI
+	tid ULong
+}
+
+type task struct {
+	cctx        *ClientContext
+	key         txKey
+	msg         *Message
+	handler     ProviderHandler
+	transaction Transaction
+}
+
+// Bounded pool of goroutines executing the provider handlers of a ClientContext. The
+// messages of a same transaction are handled in their order of arrival, the messages of
+// independent transactions are handled in parallel.
+type workerPool struct {
+	// Protects the pending tasks and the status of the pool.
+	lock sync.Mutex
+	// Tasks of each active transaction, the first one is either executing or waiting
+	// in the ready channel.
+	pending  map[txKey][]*task
+	inflight uint
+	max      uint
+	closed   bool
+	// Tasks ready to execute, its capacity is the maximum in-flight count so pushing a
+	// task never blocks.
+	ready chan *task
+}
+
+func newWorkerPool(workers uint, max uint) *workerPool {
+	if workers == 0 {
+		workers = 1
+	}
+	if max < workers {
+		max = workers
+	}
+	pool := &workerPool{
+		pending: make(map[txKey][]*task),
+		max:     max,
+		ready:   make(chan *task, max),
+	}
+	for i := uint(0); i < workers; i++ {
+		go pool.run()
+	}
+	return pool
+}
+
+// Submits a message to the pool, returns false if the maximum in-flight count is
+// reached.
+func (pool *workerPool) submit(cctx *ClientContext, msg *Message, handler ProviderHandler, transaction Transaction) bool {
+	key := txKey{tid: msg.TransactionId}
+	if msg.UriFrom != nil {
+		key.uri = *msg.UriFrom
+	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.closed || (pool.inflight >= pool.max) {
+		return false
+	}
+	pool.inflight += 1
+	t := &task{cctx, key, msg, handler, transaction}
+	queue := append(pool.pending[key], t)
+	pool.pending[key] = queue
+	if len(queue) == 1 {
+		// There is no previous message for this transaction
+		pool.ready <- t
+	}
+	return true
+}
+
+func (pool *workerPool) run() {
+	for t := range pool.ready {
+		t.cctx.callHandler(t.handler, t.msg, t.transaction)
+
+		pool.lock.Lock()
+		pool.inflight -= 1
+		queue := pool.pending[t.key][1:]
+		if len(queue) == 0 {
+			delete(pool.pending, t.key)
+		} else {
+			// The pool is not closed, otherwise the following tasks are discarded.
+			pool.pending[t.key] = queue
+			pool.ready <- queue[0]
+		}
+		pool.lock.Unlock()
+	}
+}
+
+// Stops the pool, the tasks already in the ready channel are executed but the following
+// messages of their transactions are discarded: their originators receive a SHUTDOWN
+// error.
+func (pool *workerPool) close() {
+	pool.lock.Lock()
+	if pool.closed {
+		pool.lock.Unlock()
+		return
+	}
+	pool.closed = true
+	close(pool.ready)
+	var dropped []*task
+	for key, queue := range pool.pending {
+		dropped = append(dropped, queue[1:]...)
+		pool.pending[key] = queue[:1]
+	}
+	pool.inflight -= uint(len(dropped))
+	pool.lock.Unlock()
+
+	for _, t := range dropped {
+		logger.Warnf("ClientContext: worker pool closed, rejects message from %s", t.key.uri)
+		err := t.transaction.fail(ErrShutdown)
+		if err != nil {
+			logger.Errorf("Cannot reply error to %s: %s", t.key.uri, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package api_test
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	workers_provider_url = "invm://workers_provider"
+	workers_consumer_url = "invm://workers_consumer"
+)
+
+func TestWorkerPool(t *testing.T) {
+	provider_ctx, err := NewContext(workers_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	provider.SetWorkerPool(4, 100)
+
+	// Records the order of messages of each transaction and the maximum number of
+	// handlers running in parallel.
+	var lock sync.Mutex
+	var running, maxrunning int32
+	var wg sync.WaitGroup
+	order := make(map[ULong][]Integer)
+	provider.RegisterSendHandler(200, 1, 1, 1, func(msg *Message, t Transaction) error {
+		defer wg.Done()
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		seq, err := msg.DecodeLastParameter(NullInteger, false)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		if n > maxrunning {
+			maxrunning = n
+		}
+		order[msg.TransactionId] = append(order[msg.TransactionId], *seq.(*Integer))
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	consumer_ctx, err := NewContext(workers_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewEndPoint(consumer_ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	const nbtx, nbmsg = 3, 5
+	wg.Add(nbtx * nbmsg)
+	for seq := 0; seq < nbmsg; seq++ {
+		for tid := 1; tid <= nbtx; tid++ {
+			body := consumer_ctx.NewBody()
+			body.EncodeLastParameter(NewInteger(int32(seq)), false)
+			msg := &Message{
+				UriTo:            provider.Uri,
+				InteractionType:  MAL_INTERACTIONTYPE_SEND,
+				InteractionStage: MAL_IP_STAGE_SEND,
+				ServiceArea:      200,
+				AreaVersion:      1,
+				Service:          1,
+				Operation:        1,
+				TransactionId:    ULong(tid),
+				QoSLevel:         QOSLEVEL_BESTEFFORT,
+				Session:          SESSIONTYPE_LIVE,
+				Body:             body,
+			}
+			err = consumer.Send(msg)
+			if err != nil {
+				t.Fatal("Error sending message, ", err)
+			}
+		}
+	}
+	wg.Wait()
+
+	for tid, list := range order {
+		for seq, n := range list {
+			if int(n) != seq {
+				t.Errorf("Transaction %d: bad order %v", tid, list)
+				break
+			}
+		}
+	}
+	if maxrunning < 2 {
+		t.Errorf("Transactions should be handled in parallel, max %d", maxrunning)
+	}
+}
+
+func TestWorkerPoolOverflow(t *testing.T) {
+	provider_ctx, err := NewContext(workers_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	provider.SetWorkerPool(1, 1)
+	release := make(chan bool)
+	provider.RegisterRequestHandler(200, 1, 1, 1, func(msg *Message, t Transaction) error {
+		<-release
+		body := t.NewBody()
+		body.EncodeLastParameter(NewString("reply message"), false)
+		return t.(RequestTransaction).Reply(body, false)
+	})
+
+	consumer_ctx, err := NewContext(workers_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewClientContext(consumer_ctx, "consumer")
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	futures := make([]*Future, 2)
+	for i := range futures {
+		op := consumer.NewAsyncOperation(provider.Uri, 200, 1, 1, 1, nil)
+		body := op.NewBody()
+		body.EncodeLastParameter(NewString("request"), false)
+		futures[i], err = op.Request(body)
+		if err != nil {
+			t.Fatal("Error during request, ", err)
+		}
+	}
+
+	// The second request exceeds the maximum in-flight count
+	msg, err := futures[1].Get()
+	if err == nil {
+		t.Fatal("Request should be rejected")
+	}
+	if code := accessErrorCode(t, msg); code != ERROR_TOO_MANY {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_TOO_MANY)
+	}
+	release <- true
+	_, err = futures[0].Get()
+	if err != nil {
+		t.Error("Request should be accepted, ", err)
+	}
+}
+
+// The pool can be changed while messages are handled.
+func TestWorkerPoolChange(t *testing.T) {
+	provider_ctx, err := NewContext(workers_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	var handled int32
+	provider.RegisterSendHandler(200, 1, 1, 1, func(msg *Message, t Transaction) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+
+	consumer_ctx, err := NewContext(workers_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewEndPoint(consumer_ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			msg := &Message{
+				UriTo:            provider.Uri,
+				InteractionType:  MAL_INTERACTIONTYPE_SEND,
+				InteractionStage: MAL_IP_STAGE_SEND,
+				ServiceArea:      200,
+				AreaVersion:      1,
+				Service:          1,
+				Operation:        1,
+				TransactionId:    consumer.TransactionId(),
+				QoSLevel:         QOSLEVEL_BESTEFFORT,
+				Session:          SESSIONTYPE_LIVE,
+				Body:             consumer_ctx.NewBody(),
+			}
+			if err := consumer.Send(msg); err != nil {
+				t.Error("Error sending message, ", err)
+				return
+			}
+		}
+	}()
+	for i := uint(0); i < 10; i++ {
+		provider.SetWorkerPool(i%3, 100)
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&handled) == 0 {
+		t.Error("No message handled")
+	}
+}
+
+// The following messages of a transaction are rejected when the pool is replaced.
+func TestWorkerPoolReplace(t *testing.T) {
+	provider_ctx, err := NewContext(workers_provider_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer provider_ctx.Close()
+	provider, err := NewClientContext(provider_ctx, "provider")
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+	defer provider.Close()
+	provider.SetWorkerPool(1, 10)
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	provider.RegisterRequestHandler(200, 1, 1, 1, func(msg *Message, t Transaction) error {
+		started <- true
+		<-release
+		body := t.NewBody()
+		body.EncodeLastParameter(NewString("reply message"), false)
+		return t.(RequestTransaction).Reply(body, false)
+	})
+
+	consumer_ctx, err := NewContext(workers_consumer_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer consumer_ctx.Close()
+	consumer, err := NewEndPoint(consumer_ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	defer consumer.Close()
+
+	// Both requests belong to the same transaction, the second one waits for the first.
+	tid := consumer.TransactionId()
+	for i := 0; i < 2; i++ {
+		body := consumer_ctx.NewBody()
+		body.EncodeLastParameter(NewString("request"), false)
+		msg := &Message{
+			UriTo:            provider.Uri,
+			InteractionType:  MAL_INTERACTIONTYPE_REQUEST,
+			InteractionStage: MAL_IP_STAGE_REQUEST,
+			ServiceArea:      200,
+			AreaVersion:      1,
+			Service:          1,
+			Operation:        1,
+			TransactionId:    tid,
+			QoSLevel:         QOSLEVEL_BESTEFFORT,
+			Session:          SESSIONTYPE_LIVE,
+			Body:             body,
+		}
+		if err := consumer.Send(msg); err != nil {
+			t.Fatal("Error sending message, ", err)
+		}
+	}
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	provider.SetWorkerPool(1, 10)
+
+	// The queued request is answered with a SHUTDOWN error.
+	msg, err := consumer.Recv()
+	if err != nil {
+		t.Fatal("Error receiving message, ", err)
+	}
+	if !bool(msg.IsErrorMessage) {
+		t.Fatal("Expect an error message")
+	}
+	if code := accessErrorCode(t, msg); code != ERROR_SHUTDOWN {
+		t.Errorf("Bad error code %d, expect %d", code, ERROR_SHUTDOWN)
+	}
+	release <- true
+	msg, err = consumer.Recv()
+	if err != nil {
+		t.Fatal("Error receiving message, ", err)
+	}
+	if bool(msg.IsErrorMessage) {
+		t.Error("The request being handled should be answered")
+	}
+	select {
+	case <-started:
+		t.Error("The queued request should not be handled")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,322 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	"sort"
+	"sync/atomic"
+)
+
+// Operations of the administration service of the broker (see RegisterAdminService), they
+// all use the REQUEST interaction pattern.
+const (
+	ADMIN_LIST_SUBSCRIPTIONS UShort = iota + 1
+	ADMIN_LIST_PUBLISHERS
+	ADMIN_REMOVE_SUBSCRIPTION
+	ADMIN_REMOVE_PUBLISHER
+)
+
+// Returns the active subscriptions sorted by subscriber and identifier.
+func (handler *BrokerHandler) ListSubscriptions() SubscriptionInfoList {
+	handler.lock.RLock()
+	subs := make([]*BrokerSub, 0, len(handler.subs))
+	for _, sub := range handler.subs {
+		subs = append(subs, sub)
+	}
+	handler.lock.RUnlock()
+	sort.Slice(subs, func(i, j int) bool { return subs[i].key < subs[j].key })
+
+	infos := make(SubscriptionInfoList, 0, len(subs))
+	for _, sub := range subs {
+		infos = append(infos, &SubscriptionInfo{
+			Subscriber:     *sub.urifrom,
+			SubscriptionId: sub.subid,
+			Domain:         append(IdentifierList{}, sub.domain...),
+			Session:        sub.session,
+			SessionName:    sub.sessionName,
+			Area:           sub.serviceArea,
+			Service:        sub.service,
+			Operation:      sub.operation,
+			Entities:       append(EntityRequestList{}, *sub.entities...),
+			Peer:           Boolean(sub.route != nil),
+			Notifies:       ULong(atomic.LoadUint64(&sub.notifies)),
+			Updates:        ULong(atomic.LoadUint64(&sub.updates)),
+		})
+	}
+	return infos
+}
+
+// Returns the registered publishers sorted by URI.
+func (handler *BrokerHandler) ListPublishers() PublisherInfoList {
+	handler.lock.RLock()
+	infos := make(PublisherInfoList, 0, len(handler.pubs))
+	for pubid, pub := range handler.pubs {
+		infos = append(infos, &PublisherInfo{
+			Publisher:   URI(pubid),
+			Domain:      append(IdentifierList{}, pub.domain...),
+			Session:     pub.session,
+			SessionName: pub.sessionName,
+			Area:        pub.serviceArea,
+			Service:     pub.Service,
+			Operation:   pub.operation,
+			Keys:        append(EntityKeyList{}, *pub.keys...),
+			Publishes:   ULong(atomic.LoadUint64(&pub.publishes)),
+		})
+	}
+	handler.lock.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Publisher < infos[j].Publisher })
+	return infos
+}
+
+// Forcibly removes a subscription, for example when its subscriber is gone without
+// deregistering. Returns false if there is no such subscription.
+func (handler *BrokerHandler) RemoveSubscription(subscriber *URI, subid Identifier) bool {
+	key := subkey(string(*subscriber), string(subid))
+	handler.lock.Lock()
+	sub := handler.subs[key]
+	if sub != nil {
+		handler.removeSub(sub)
+	}
+	handler.lock.Unlock()
+	if sub == nil {
+		return false
+	}
+	logger.Warnf("Broker: subscription %s removed by administration", key)
+	handler.unsave(subRegistrationKey(key))
+	return true
+}
+
+// Forcibly removes the registration of a publisher. Returns false if the publisher is not
+// registered.
+func (handler *BrokerHandler) RemovePublisher(publisher *URI) bool {
+	pubid := string(*publisher)
+	handler.lock.Lock()
+	_, ok := handler.pubs[pubid]
+	delete(handler.pubs, pubid)
+	handler.touchDemand()
+	handler.lock.Unlock()
+	if !ok {
+		return false
+	}
+	logger.Warnf("Broker: publisher %s removed by administration", pubid)
+	handler.unsave(pubRegistrationKey(pubid))
+	return true
+}
+
+// Registers the administration service of the broker in its client context, so that
+// AdminConsumer can list and remove the registrations remotely. Each request is checked with
+// the CheckReceive method of the specified access control handler, independently of the
+// access control of the MAL context, a rejected request is answered with the error code of
+// the AccessError (AUTHORISATION_FAIL by default).
+func (handler *BrokerHandler) RegisterAdminService(area UShort, areaVersion UOctet, service UShort, achdlr AccessControl) error {
+	if achdlr == nil {
+		return errors.New("The administration service needs an access control handler")
+	}
+	handlers := map[UShort]func(msg *Message) ([]Element, error){
+		ADMIN_LIST_SUBSCRIPTIONS:  handler.onListSubscriptions,
+		ADMIN_LIST_PUBLISHERS:     handler.onListPublishers,
+		ADMIN_REMOVE_SUBSCRIPTION: handler.onRemoveSubscription,
+		ADMIN_REMOVE_PUBLISHER:    handler.onRemovePublisher,
+	}
+	for operation, reply := range handlers {
+		reply := reply
+		err := handler.cctx.RegisterRequestHandler(area, areaVersion, service, operation, func(msg *Message, t Transaction) error {
+			if err := achdlr.CheckReceive(msg); err != nil {
+				logger.Warnf("Broker: administration request from %s rejected: %s", *msg.UriFrom, err)
+				return accessError(err)
+			}
+			params, err := reply(msg)
+			if err != nil {
+				return err
+			}
+			body := t.NewBody()
+			if err := encodeParameters(body, params); err != nil {
+				return err
+			}
+			return t.(RequestTransaction).Reply(body, false)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the MalError answered to a request rejected by the access control handler.
+func accessError(err error) *MalError {
+	if aerr, ok := err.(*AccessError); ok {
+		return NewMalError(aerr.Code, NewString(aerr.Reason))
+	}
+	return NewMalError(ERROR_AUTHORISATION_FAIL, NewString(err.Error()))
+}
+
+func (handler *BrokerHandler) onListSubscriptions(msg *Message) ([]Element, error) {
+	infos := handler.ListSubscriptions()
+	return []Element{&infos}, nil
+}
+
+func (handler *BrokerHandler) onListPublishers(msg *Message) ([]Element, error) {
+	infos := handler.ListPublishers()
+	return []Element{&infos}, nil
+}
+
+func (handler *BrokerHandler) onRemoveSubscription(msg *Message) ([]Element, error) {
+	params, err := decodeParameters(msg.Body, NullURI, NullIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	removed := handler.RemoveSubscription(params[0].(*URI), *params[1].(*Identifier))
+	return []Element{NewBoolean(removed)}, nil
+}
+
+func (handler *BrokerHandler) onRemovePublisher(msg *Message) ([]Element, error) {
+	params, err := decodeParameters(msg.Body, NullURI)
+	if err != nil {
+		return nil, err
+	}
+	removed := handler.RemovePublisher(params[0].(*URI))
+	return []Element{NewBoolean(removed)}, nil
+}
+
+// Encodes the parameters of a message body.
+func encodeParameters(body Body, params []Element) error {
+	for idx, param := range params {
+		var err error
+		if idx == len(params)-1 {
+			err = body.EncodeLastParameter(param, false)
+		} else {
+			err = body.EncodeParameter(param)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes the next parameters of a message body, the last one of the body must be decoded
+// with last set. A NULL parameter is an error.
+func decodeParams(body Body, last bool, elements ...Element) ([]Element, error) {
+	params := make([]Element, 0, len(elements))
+	for idx, element := range elements {
+		var p Element
+		var err error
+		if last && idx == len(elements)-1 {
+			p, err = body.DecodeLastParameter(element, false)
+		} else {
+			p, err = body.DecodeParameter(element)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p == nil || p.IsNull() {
+			return nil, errors.New("Unexpected NULL parameter")
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+// Decodes all the parameters of a message body.
+func decodeParameters(body Body, elements ...Element) ([]Element, error) {
+	return decodeParams(body, true, elements...)
+}
+
+// Client of the administration service of a remote broker (see RegisterAdminService).
+type AdminConsumer struct {
+	cctx        *ClientContext
+	broker      *URI
+	area        UShort
+	areaVersion UOctet
+	service     UShort
+}
+
+func NewAdminConsumer(cctx *ClientContext, broker *URI, area UShort, areaVersion UOctet, service UShort) *AdminConsumer {
+	return &AdminConsumer{cctx: cctx, broker: broker, area: area, areaVersion: areaVersion, service: service}
+}
+
+// Sends a request to the broker and returns the response body.
+func (consumer *AdminConsumer) request(operation UShort, params ...Element) (Body, error) {
+	op := consumer.cctx.NewRequestOperation(consumer.broker, consumer.area, consumer.areaVersion, consumer.service, operation)
+	body := op.NewBody()
+	if err := encodeParameters(body, params); err != nil {
+		return nil, err
+	}
+	msg, err := op.Request(body)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Body, nil
+}
+
+// Returns the active subscriptions of the broker.
+func (consumer *AdminConsumer) ListSubscriptions() (SubscriptionInfoList, error) {
+	body, err := consumer.request(ADMIN_LIST_SUBSCRIPTIONS)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeParameters(body, NullSubscriptionInfoList)
+	if err != nil {
+		return nil, err
+	}
+	return *p[0].(*SubscriptionInfoList), nil
+}
+
+// Returns the registered publishers of the broker.
+func (consumer *AdminConsumer) ListPublishers() (PublisherInfoList, error) {
+	body, err := consumer.request(ADMIN_LIST_PUBLISHERS)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeParameters(body, NullPublisherInfoList)
+	if err != nil {
+		return nil, err
+	}
+	return *p[0].(*PublisherInfoList), nil
+}
+
+// Removes a subscription of the broker, returns false if there is no such subscription.
+func (consumer *AdminConsumer) RemoveSubscription(subscriber *URI, subid Identifier) (bool, error) {
+	return consumer.remove(ADMIN_REMOVE_SUBSCRIPTION, subscriber, &subid)
+}
+
+// Removes a publisher of the broker, returns false if the publisher is not registered.
+func (consumer *AdminConsumer) RemovePublisher(publisher *URI) (bool, error) {
+	return consumer.remove(ADMIN_REMOVE_PUBLISHER, publisher)
+}
+
+func (consumer *AdminConsumer) remove(operation UShort, params ...Element) (bool, error) {
+	body, err := consumer.request(operation, params...)
+	if err != nil {
+		return false, err
+	}
+	p, err := decodeParameters(body, NullBoolean)
+	if err != nil {
+		return false, err
+	}
+	return bool(*p[0].(*Boolean)), nil
+}
@@ -0,0 +1,218 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"testing"
+	"time"
+)
+
+const (
+	admin_broker_url = "maltcp://127.0.0.1:16059"
+	admin_client_url = "maltcp://127.0.0.1:16060"
+	admin_cancel_url = "maltcp://127.0.0.1:16084"
+)
+
+func TestBrokerAdmin(t *testing.T) {
+	broker_ctx, err := NewContext(admin_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	// The publishers cannot be removed remotely
+	operation := ADMIN_REMOVE_PUBLISHER
+	policy := NewAccessPolicy(ACCESS_ALLOW, ACCESS_ALLOW).AddIncomingRule(&AccessRule{Decision: ACCESS_DENY, Operation: &operation})
+	if err := broker.RegisterAdminService(200, 1, 2, nil); err == nil {
+		t.Error("Admin service without access control should be rejected")
+	}
+	err = broker.RegisterAdminService(200, 1, 2, policy)
+	if err != nil {
+		t.Fatal("Error registering admin service, ", err)
+	}
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	err = broker.LocalPublishRegister(200, 1, 1, 1, &eklist)
+	if err != nil {
+		t.Fatal("Error registering publisher, ", err)
+	}
+
+	client_ctx, err := NewContext(admin_client_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer client_ctx.Close()
+	client, err := NewClientContext(client_ctx, "client")
+	if err != nil {
+		t.Fatal("Error creating client, ", err)
+	}
+	defer client.Close()
+
+	subop := client.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body := subop.NewBody()
+	eksub := &EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}
+	erlist := EntityRequestList([]*EntityRequest{
+		&EntityRequest{nil, false, false, false, false, EntityKeyList([]*EntityKey{eksub})},
+	})
+	body.EncodeLastParameter(&Subscription{Identifier("Admin"), erlist}, false)
+	_, err = subop.Register(body)
+	if err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+
+	hdrs := UpdateHeaderList([]*UpdateHeader{
+		&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_CREATION, EntityKey{NewIdentifier("key1"), NewLong(1), NewLong(1), NewLong(1)}},
+		&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_CREATION, EntityKey{NewIdentifier("key2"), NewLong(1), NewLong(1), NewLong(1)}},
+	})
+	values := BlobList([]*Blob{&Blob{1}, &Blob{2}})
+	err = broker.LocalPublishValues(200, 1, 1, 1, &hdrs, &values)
+	if err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = subop.GetNotifyWithContext(ctx)
+	if err != nil {
+		t.Fatal("Error in GetNotify, ", err)
+	}
+
+	admin := NewAdminConsumer(client, broker.Uri(), 200, 1, 2)
+	subs, err := admin.ListSubscriptions()
+	if err != nil {
+		t.Fatal("Error listing subscriptions, ", err)
+	}
+	if len(subs) != 1 {
+		t.Fatalf("Bad number of subscriptions %d, expect 1", len(subs))
+	}
+	sub := subs[0]
+	if (sub.Subscriber != *client.Uri) || (sub.SubscriptionId != "Admin") || (len(sub.Entities) != 1) ||
+		(sub.Notifies != 1) || (sub.Updates != 2) || sub.Peer {
+		t.Errorf("Bad subscription %+v", sub)
+	}
+	if local := broker.ListSubscriptions(); (len(local) != 1) || (local[0].Updates != sub.Updates) {
+		t.Errorf("Bad local subscriptions %+v", local)
+	}
+
+	pubs, err := admin.ListPublishers()
+	if err != nil {
+		t.Fatal("Error listing publishers, ", err)
+	}
+	if (len(pubs) != 1) || (pubs[0].Publisher != *broker.Uri()) || (len(pubs[0].Keys) != 1) || (pubs[0].Publishes != 1) {
+		t.Errorf("Bad publishers %+v", pubs)
+	}
+
+	// Removes the subscription remotely, then the publisher locally
+	removed, err := admin.RemoveSubscription(client.Uri, Identifier("Admin"))
+	if err != nil || !removed {
+		t.Errorf("Error removing subscription: %t, %v", removed, err)
+	}
+	removed, err = admin.RemoveSubscription(client.Uri, Identifier("Admin"))
+	if err != nil || removed {
+		t.Errorf("Subscription removed twice: %t, %v", removed, err)
+	}
+	subs, err = admin.ListSubscriptions()
+	if err != nil || len(subs) != 0 {
+		t.Errorf("Bad subscriptions after removal: %+v, %v", subs, err)
+	}
+
+	_, err = admin.RemovePublisher(broker.Uri())
+	if !errors.Is(err, ErrAuthorisationFail) {
+		t.Errorf("Bad error %v, expect %v", err, ErrAuthorisationFail)
+	}
+	if !broker.RemovePublisher(broker.Uri()) {
+		t.Error("Error removing publisher")
+	}
+	if pubs := broker.ListPublishers(); len(pubs) != 0 {
+		t.Errorf("Bad publishers after removal %+v", pubs)
+	}
+	err = broker.LocalPublishValues(200, 1, 1, 1, &hdrs, &values)
+	if err == nil {
+		t.Error("Publication of a removed publisher should fail")
+	}
+}
+
+// The subscription of a cancelled subscriber is deregistered on its next notify.
+func TestCancelledSubscriber(t *testing.T) {
+	broker_ctx, err := NewContext(admin_cancel_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+
+	subscriber, err := NewClientContext(broker_ctx, "subscriber")
+	if err != nil {
+		t.Fatal("Error creating subscriber, ", err)
+	}
+	defer subscriber.Close()
+	subop := subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body := subop.NewBody()
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, eklist}})
+	body.EncodeLastParameter(&Subscription{Identifier("Cancelled"), erlist}, false)
+	if _, err := subop.Register(body); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := subop.GetNotifyWithContext(ctx); !errors.Is(err, ErrDeliveryTimedOut) {
+		t.Fatalf("Bad error %v, expect %v", err, ErrDeliveryTimedOut)
+	}
+
+	hdrs := UpdateHeaderList([]*UpdateHeader{
+		&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_UPDATE, EntityKey{NewIdentifier("key1"), NewLong(1), NewLong(1), NewLong(1)}},
+	})
+	values := BlobList([]*Blob{&Blob{1}})
+	if err := broker.Publish(&hdrs, &values); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	for i := 0; len(broker.ListSubscriptions()) != 0; i++ {
+		if i == 40 {
+			t.Fatal("The subscription of the cancelled subscriber is not removed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,482 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+)
+
+// The composites of the administration service belong to the service registered by
+// RegisterAdminService, whose area and service numbers are chosen by the application. So
+// they are not registered for polymorphism, their short forms have null area and service
+// numbers and they are only encoded as non-abstract parameters.
+const (
+	SUBSCRIPTION_INFO_TYPE_SHORT_FORM      Integer = 0x01
+	SUBSCRIPTION_INFO_LIST_TYPE_SHORT_FORM Integer = -0x01
+	PUBLISHER_INFO_TYPE_SHORT_FORM         Integer = 0x02
+	PUBLISHER_INFO_LIST_TYPE_SHORT_FORM    Integer = -0x02
+
+	SUBSCRIPTION_INFO_SHORT_FORM      Long = 0x01
+	SUBSCRIPTION_INFO_LIST_SHORT_FORM Long = 0xFFFFFF
+	PUBLISHER_INFO_SHORT_FORM         Long = 0x02
+	PUBLISHER_INFO_LIST_SHORT_FORM    Long = 0xFFFFFE
+)
+
+// Encodes the fields of a composite in their order.
+func encodeFields(encoder Encoder, fields ...Element) error {
+	for _, field := range fields {
+		if err := encoder.EncodeElement(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes the fields of a composite in their order, the elements give their types.
+func decodeFields(decoder Decoder, elements ...Element) ([]Element, error) {
+	fields := make([]Element, 0, len(elements))
+	for _, element := range elements {
+		field, err := decoder.DecodeElement(element)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// ################################################################################
+// Defines SubscriptionInfo type
+// ################################################################################
+
+// Description of an active subscription.
+type SubscriptionInfo struct {
+	Subscriber     URI
+	SubscriptionId Identifier
+	Domain         IdentifierList
+	Session        SessionType
+	SessionName    Identifier
+	Area           UShort
+	Service        UShort
+	Operation      UShort
+	Entities       EntityRequestList
+	// True if it is the subscription of a peer broker
+	Peer Boolean
+	// Number of notifications and updates sent to the subscriber
+	Notifies ULong
+	Updates  ULong
+}
+
+var (
+	NullSubscriptionInfo *SubscriptionInfo = nil
+)
+
+func NewSubscriptionInfo() *SubscriptionInfo {
+	return new(SubscriptionInfo)
+}
+
+func (info *SubscriptionInfo) Composite() Composite {
+	return info
+}
+
+// Returns the absolute short form of the element type.
+func (*SubscriptionInfo) GetShortForm() Long {
+	return SUBSCRIPTION_INFO_SHORT_FORM
+}
+
+// Returns the number of the area this element type belongs to.
+func (*SubscriptionInfo) GetAreaNumber() UShort {
+	return 0
+}
+
+// Returns the version of the area this element type belongs to.
+func (*SubscriptionInfo) GetAreaVersion() UOctet {
+	return 0
+}
+
+// Returns the number of the service this element type belongs to.
+func (*SubscriptionInfo) GetServiceNumber() UShort {
+	return 0
+}
+
+// Returns the relative short form of the element type.
+func (*SubscriptionInfo) GetTypeShortForm() Integer {
+	return SUBSCRIPTION_INFO_TYPE_SHORT_FORM
+}
+
+// Encodes this element using the supplied encoder.
+func (info *SubscriptionInfo) Encode(encoder Encoder) error {
+	return encodeFields(encoder, &info.Subscriber, &info.SubscriptionId, &info.Domain, &info.Session,
+		&info.SessionName, &info.Area, &info.Service, &info.Operation, &info.Entities, &info.Peer,
+		&info.Notifies, &info.Updates)
+}
+
+// Decodes an instance of this element type using the supplied decoder.
+func (info *SubscriptionInfo) Decode(decoder Decoder) (Element, error) {
+	p, err := decodeFields(decoder, NullURI, NullIdentifier, NullIdentifierList, NullSessionType,
+		NullIdentifier, NullUShort, NullUShort, NullUShort, NullEntityRequestList, NullBoolean,
+		NullULong, NullULong)
+	if err != nil {
+		return nil, err
+	}
+	return &SubscriptionInfo{
+		Subscriber:     *p[0].(*URI),
+		SubscriptionId: *p[1].(*Identifier),
+		Domain:         *p[2].(*IdentifierList),
+		Session:        *p[3].(*SessionType),
+		SessionName:    *p[4].(*Identifier),
+		Area:           *p[5].(*UShort),
+		Service:        *p[6].(*UShort),
+		Operation:      *p[7].(*UShort),
+		Entities:       *p[8].(*EntityRequestList),
+		Peer:           *p[9].(*Boolean),
+		Notifies:       *p[10].(*ULong),
+		Updates:        *p[11].(*ULong),
+	}, nil
+}
+
+// The method allows the creation of an element in a generic way, i.e., using the MAL Element polymorphism.
+func (*SubscriptionInfo) CreateElement() Element {
+	return NewSubscriptionInfo()
+}
+
+func (info *SubscriptionInfo) IsNull() bool {
+	return info == nil
+}
+
+func (*SubscriptionInfo) Null() Element {
+	return NullSubscriptionInfo
+}
+
+// ################################################################################
+// Defines SubscriptionInfoList type
+// ################################################################################
+
+type SubscriptionInfoList []*SubscriptionInfo
+
+var (
+	NullSubscriptionInfoList *SubscriptionInfoList = nil
+)
+
+func NewSubscriptionInfoList(size int) *SubscriptionInfoList {
+	var list SubscriptionInfoList = SubscriptionInfoList(make([]*SubscriptionInfo, size))
+	return &list
+}
+
+func (list *SubscriptionInfoList) Size() int {
+	if list != nil {
+		return len(*list)
+	}
+	return -1
+}
+
+func (list *SubscriptionInfoList) GetElementAt(i int) Element {
+	if (list != nil) && (i < list.Size()) {
+		return (*list)[i]
+	}
+	return nil
+}
+
+func (list *SubscriptionInfoList) AppendElement(element Element) {
+	if list != nil {
+		*list = append(*list, element.(*SubscriptionInfo))
+	}
+}
+
+func (list *SubscriptionInfoList) Composite() Composite {
+	return list
+}
+
+// Returns the absolute short form of the element type.
+func (*SubscriptionInfoList) GetShortForm() Long {
+	return SUBSCRIPTION_INFO_LIST_SHORT_FORM
+}
+
+// Returns the number of the area this element type belongs to.
+func (*SubscriptionInfoList) GetAreaNumber() UShort {
+	return 0
+}
+
+// Returns the version of the area this element type belongs to.
+func (*SubscriptionInfoList) GetAreaVersion() UOctet {
+	return 0
+}
+
+// Returns the number of the service this element type belongs to.
+func (*SubscriptionInfoList) GetServiceNumber() UShort {
+	return 0
+}
+
+// Returns the relative short form of the element type.
+func (*SubscriptionInfoList) GetTypeShortForm() Integer {
+	return SUBSCRIPTION_INFO_LIST_TYPE_SHORT_FORM
+}
+
+// Encodes this element using the supplied encoder.
+func (list *SubscriptionInfoList) Encode(encoder Encoder) error {
+	err := encoder.EncodeUInteger(NewUInteger(uint32(len(*list))))
+	if err != nil {
+		return err
+	}
+	for _, e := range *list {
+		err = encoder.EncodeNullableElement(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes an instance of this element type using the supplied decoder.
+func (list *SubscriptionInfoList) Decode(decoder Decoder) (Element, error) {
+	size, err := decoder.DecodeUInteger()
+	if err != nil {
+		return nil, err
+	}
+	decoded := SubscriptionInfoList(make([]*SubscriptionInfo, int(*size)))
+	for i := range decoded {
+		element, err := decoder.DecodeNullableElement(NullSubscriptionInfo)
+		if err != nil {
+			return nil, err
+		}
+		decoded[i] = element.(*SubscriptionInfo)
+	}
+	return &decoded, nil
+}
+
+// The method allows the creation of an element in a generic way, i.e., using the MAL Element polymorphism.
+func (*SubscriptionInfoList) CreateElement() Element {
+	return NewSubscriptionInfoList(0)
+}
+
+func (list *SubscriptionInfoList) IsNull() bool {
+	return list == nil
+}
+
+func (*SubscriptionInfoList) Null() Element {
+	return NullSubscriptionInfoList
+}
+
+// ################################################################################
+// Defines PublisherInfo type
+// ################################################################################
+
+// Description of a registered publisher.
+type PublisherInfo struct {
+	Publisher   URI
+	Domain      IdentifierList
+	Session     SessionType
+	SessionName Identifier
+	Area        UShort
+	Service     UShort
+	Operation   UShort
+	Keys        EntityKeyList
+	// Number of publications accepted by the broker
+	Publishes ULong
+}
+
+var (
+	NullPublisherInfo *PublisherInfo = nil
+)
+
+func NewPublisherInfo() *PublisherInfo {
+	return new(PublisherInfo)
+}
+
+func (info *PublisherInfo) Composite() Composite {
+	return info
+}
+
+// Returns the absolute short form of the element type.
+func (*PublisherInfo) GetShortForm() Long {
+	return PUBLISHER_INFO_SHORT_FORM
+}
+
+// Returns the number of the area this element type belongs to.
+func (*PublisherInfo) GetAreaNumber() UShort {
+	return 0
+}
+
+// Returns the version of the area this element type belongs to.
+func (*PublisherInfo) GetAreaVersion() UOctet {
+	return 0
+}
+
+// Returns the number of the service this element type belongs to.
+func (*PublisherInfo) GetServiceNumber() UShort {
+	return 0
+}
+
+// Returns the relative short form of the element type.
+func (*PublisherInfo) GetTypeShortForm() Integer {
+	return PUBLISHER_INFO_TYPE_SHORT_FORM
+}
+
+// Encodes this element using the supplied encoder.
+func (info *PublisherInfo) Encode(encoder Encoder) error {
+	return encodeFields(encoder, &info.Publisher, &info.Domain, &info.Session, &info.SessionName,
+		&info.Area, &info.Service, &info.Operation, &info.Keys, &info.Publishes)
+}
+
+// Decodes an instance of this element type using the supplied decoder.
+func (info *PublisherInfo) Decode(decoder Decoder) (Element, error) {
+	p, err := decodeFields(decoder, NullURI, NullIdentifierList, NullSessionType, NullIdentifier,
+		NullUShort, NullUShort, NullUShort, NullEntityKeyList, NullULong)
+	if err != nil {
+		return nil, err
+	}
+	return &PublisherInfo{
+		Publisher:   *p[0].(*URI),
+		Domain:      *p[1].(*IdentifierList),
+		Session:     *p[2].(*SessionType),
+		SessionName: *p[3].(*Identifier),
+		Area:        *p[4].(*UShort),
+		Service:     *p[5].(*UShort),
+		Operation:   *p[6].(*UShort),
+		Keys:        *p[7].(*EntityKeyList),
+		Publishes:   *p[8].(*ULong),
+	}, nil
+}
+
+// The method allows the creation of an element in a generic way, i.e., using the MAL Element polymorphism.
+func (*PublisherInfo) CreateElement() Element {
+	return NewPublisherInfo()
+}
+
+func (info *PublisherInfo) IsNull() bool {
+	return info == nil
+}
+
+func (*PublisherInfo) Null() Element {
+	return NullPublisherInfo
+}
+
+// ################################################################################
+// Defines PublisherInfoList type
+// ################################################################################
+
+type PublisherInfoList []*PublisherInfo
+
+var (
+	NullPublisherInfoList *PublisherInfoList = nil
+)
+
+func NewPublisherInfoList(size int) *PublisherInfoList {
+	var list PublisherInfoList = PublisherInfoList(make([]*PublisherInfo, size))
+	return &list
+}
+
+func (list *PublisherInfoList) Size() int {
+	if list != nil {
+		return len(*list)
+	}
+	return -1
+}
+
+func (list *PublisherInfoList) GetElementAt(i int) Element {
+	if (list != nil) && (i < list.Size()) {
+		return (*list)[i]
+	}
+	return nil
+}
+
+func (list *PublisherInfoList) AppendElement(element Element) {
+	if list != nil {
+		*list = append(*list, element.(*PublisherInfo))
+	}
+}
+
+func (list *PublisherInfoList) Composite() Composite {
+	return list
+}
+
+// Returns the absolute short form of the element type.
+func (*PublisherInfoList) GetShortForm() Long {
+	return PUBLISHER_INFO_LIST_SHORT_FORM
+}
+
+// Returns the number of the area this element type belongs to.
+func (*PublisherInfoList) GetAreaNumber() UShort {
+	return 0
+}
+
+// Returns the version of the area this element type belongs to.
+func (*PublisherInfoList) GetAreaVersion() UOctet {
+	return 0
+}
+
+// Returns the number of the service this element type belongs to.
+func (*PublisherInfoList) GetServiceNumber() UShort {
+	return 0
+}
+
+// Returns the relative short form of the element type.
+func (*PublisherInfoList) GetTypeShortForm() Integer {
+	return PUBLISHER_INFO_LIST_TYPE_SHORT_FORM
+}
+
+// Encodes this element using the supplied encoder.
+func (list *PublisherInfoList) Encode(encoder Encoder) error {
+	err := encoder.EncodeUInteger(NewUInteger(uint32(len(*list))))
+	if err != nil {
+		return err
+	}
+	for _, e := range *list {
+		err = encoder.EncodeNullableElement(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes an instance of this element type using the supplied decoder.
+func (list *PublisherInfoList) Decode(decoder Decoder) (Element, error) {
+	size, err := decoder.DecodeUInteger()
+	if err != nil {
+		return nil, err
+	}
+	decoded := PublisherInfoList(make([]*PublisherInfo, int(*size)))
+	for i := range decoded {
+		element, err := decoder.DecodeNullableElement(NullPublisherInfo)
+		if err != nil {
+			return nil, err
+		}
+		decoded[i] = element.(*PublisherInfo)
+	}
+	return &decoded, nil
+}
+
+// The method allows the creation of an element in a generic way, i.e., using the MAL Element polymorphism.
+func (*PublisherInfoList) CreateElement() Element {
+	return NewPublisherInfoList(0)
+}
+
+func (list *PublisherInfoList) IsNull() bool {
+	return list == nil
+}
+
+func (*PublisherInfoList) Null() Element {
+	return NullPublisherInfoList
+}
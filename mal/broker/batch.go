@@ -0,0 +1,191 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"sync"
+	"time"
+)
+
+// An update waiting in a batch.
+type batchEntry struct {
+	// Domain of the publication, needed by the notifies of the keyed model
+	domain IdentifierList
+	header *UpdateHeader
+	// Handler holding only the value of this update
+	value UpdateValueHandler
+}
+
+// Accumulates the updates matching a subscription, they are sent in a single notify when the
+// window elapses or when the maximum number of updates is reached.
+type notifyBatch struct {
+	handler  *BrokerHandler
+	sub      *BrokerSub
+	window   time.Duration
+	max      int
+	coalesce bool
+
+	lock    sync.Mutex
+	entries []*batchEntry
+	// Number of updates in the batch, the entries replaced by coalescing are nil
+	size int
+	// Position of the entry of each key, only used with coalescing
+	positions map[keyValue]int
+	timer     *time.Timer
+	closed    bool
+	// Serializes the flushes so that the notifications are sent in order
+	sendLock sync.Mutex
+}
+
+// Reports whether the update values of the specified handler can be batched.
+func canBatch(updtHandler UpdateValueHandler) bool {
+	_, factory := updtHandler.(UpdateValueHandlerFactory)
+	_, selector := updtHandler.(UpdateValueSelector)
+	_, appender := updtHandler.(UpdateValueAppender)
+	return factory && selector && appender
+}
+
+func newNotifyBatch(handler *BrokerHandler, sub *BrokerSub, window time.Duration, max uint, coalesce bool) *notifyBatch {
+	return &notifyBatch{
+		handler:   handler,
+		sub:       sub,
+		window:    window,
+		max:       int(max),
+		coalesce:  coalesce,
+		positions: make(map[keyValue]int),
+	}
+}
+
+// Adds the specified updates of a publication to the batch, with coalescing an update
+// replaces the pending update of the same key.
+func (b *notifyBatch) add(domain IdentifierList, uhlist *UpdateHeaderList, updtHandler UpdateValueHandler, updates []int) {
+	selector := updtHandler.(UpdateValueSelector)
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	for _, idx := range updates {
+		hdr := (*uhlist)[idx]
+		if b.coalesce {
+			kv := newKeyValue(&hdr.Key)
+			if pos, ok := b.positions[kv]; ok {
+				b.entries[pos] = nil
+				b.size -= 1
+			}
+			b.positions[kv] = len(b.entries)
+		}
+		b.entries = append(b.entries, &batchEntry{domain: domain, header: hdr, value: selector.SelectUpdateValue(idx)})
+		b.size += 1
+	}
+	full := (b.max > 0) && (b.size >= b.max)
+	if !full && (b.timer == nil) {
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.lock.Unlock()
+	if full {
+		b.flush()
+	}
+}
+
+// Sends the pending updates in a single notify.
+func (b *notifyBatch) flush() {
+	b.sendLock.Lock()
+	defer b.sendLock.Unlock()
+
+	b.lock.Lock()
+	entries := b.entries
+	b.entries = nil
+	b.size = 0
+	b.positions = make(map[keyValue]int)
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	closed := b.closed
+	b.lock.Unlock()
+	if closed {
+		return
+	}
+	if b.sub.keyed != nil {
+		b.flushKeyed(entries)
+		return
+	}
+
+	var headers UpdateHeaderList = make([]*UpdateHeader, 0, len(entries))
+	keys := make([]*EntityKey, 0, len(entries))
+	values := b.handler.updtHandler.(UpdateValueHandlerFactory).CreateUpdateValueHandler()
+	appender := values.(UpdateValueAppender)
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		headers = append(headers, entry.header)
+		keys = append(keys, &entry.header.Key)
+		appender.AppendUpdateValues(entry.value)
+	}
+	if len(headers) == 0 {
+		return
+	}
+	for idx := range headers {
+		values.AppendValue(idx)
+	}
+
+	body := b.sub.transaction.NewBody()
+	body.EncodeParameter(&b.sub.subid)
+	body.EncodeParameter(&headers)
+	if err := values.EncodeUpdateValueList(body); err != nil {
+		logger.Errorf("Broker: cannot encode batch of %s: %s", b.sub.key, err)
+		return
+	}
+	b.handler.notify(b.sub, keys, body)
+}
+
+// Sends the pending updates of a keyed subscription, a notify for each update.
+func (b *notifyBatch) flushKeyed(entries []*batchEntry) {
+	factory := b.handler.updtHandler.(UpdateValueHandlerFactory)
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		values := factory.CreateUpdateValueHandler()
+		values.(UpdateValueAppender).AppendUpdateValues(entry.value)
+		if !b.handler.notifyKeyedUpdate(b.sub, entry.domain, entry.header, values, 0) {
+			return
+		}
+	}
+}
+
+// Closes the batch, the pending updates are discarded.
+func (b *notifyBatch) close() {
+	b.lock.Lock()
+	b.closed = true
+	b.entries = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.lock.Unlock()
+}
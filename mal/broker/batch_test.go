@@ -0,0 +1,214 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"context"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"testing"
+	"time"
+)
+
+const (
+	batch_broker1_url     = "maltcp://127.0.0.1:16068"
+	batch_subscriber1_url = "maltcp://127.0.0.1:16069"
+	batch_broker2_url     = "maltcp://127.0.0.1:16070"
+	batch_subscriber2_url = "maltcp://127.0.0.1:16071"
+	batch_broker3_url     = "maltcp://127.0.0.1:16081"
+	batch_subscriber3_url = "maltcp://127.0.0.1:16082"
+)
+
+// Starts a broker batching the notifications and registers a subscription to all keys.
+func newBatchBroker(t *testing.T, broker_url string, subscriber_url string, updtHandler UpdateValueHandler,
+	window time.Duration, maxUpdates uint, coalesce bool) (*LocalBroker, SubscriberOperation) {
+	broker_ctx, err := NewContext(broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	t.Cleanup(func() { broker_ctx.Close() })
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, updtHandler, 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	t.Cleanup(broker.Close)
+	broker.SetBatching(window, maxUpdates, coalesce)
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+
+	sub_ctx, err := NewContext(subscriber_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	t.Cleanup(func() { sub_ctx.Close() })
+	subscriber, err := NewClientContext(sub_ctx, "subscriber")
+	if err != nil {
+		t.Fatal("Error creating subscriber, ", err)
+	}
+	subop := subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body := subop.NewBody()
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, eklist}})
+	body.EncodeLastParameter(&Subscription{Identifier("Batch"), erlist}, false)
+	if _, err := subop.Register(body); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+	return broker, subop
+}
+
+func batchHeaders(broker *LocalBroker, key string) *UpdateHeaderList {
+	hdrs := UpdateHeaderList([]*UpdateHeader{
+		&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_UPDATE, EntityKey{NewIdentifier(key), NewLong(1), NewLong(1), NewLong(1)}},
+	})
+	return &hdrs
+}
+
+// Waits for the next notify and decodes its headers.
+func batchNotify(t *testing.T, subop SubscriberOperation, timeout time.Duration) (*Message, UpdateHeaderList) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	msg, err := subop.GetNotifyWithContext(ctx)
+	if err != nil {
+		t.Fatal("Error in GetNotify, ", err)
+	}
+	msg.DecodeParameter(NullIdentifier)
+	p, err := msg.DecodeParameter(NullUpdateHeaderList)
+	if err != nil {
+		t.Fatal("Error decoding notify, ", err)
+	}
+	return msg, *p.(*UpdateHeaderList)
+}
+
+func checkBatchKeys(t *testing.T, headers UpdateHeaderList, keys ...string) {
+	ok := len(headers) == len(keys)
+	for i := 0; ok && (i < len(keys)); i++ {
+		ok = string(*headers[i].Key.FirstSubKey) == keys[i]
+	}
+	if !ok {
+		t.Errorf("Bad notified headers %v, expect keys %v", headers, keys)
+	}
+}
+
+// The updates published during the window are sent in a single notify.
+func TestBatchWindow(t *testing.T) {
+	broker, subop := newBatchBroker(t, batch_broker1_url, batch_subscriber1_url, NewBlobUpdateValueHandler(), 300*time.Millisecond, 0, false)
+	for i, key := range []string{"key1", "key2", "key1"} {
+		values := BlobList([]*Blob{&Blob{byte(i)}})
+		if err := broker.Publish(batchHeaders(broker, key), &values); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+
+	msg, headers := batchNotify(t, subop, 2*time.Second)
+	checkBatchKeys(t, headers, "key1", "key2", "key1")
+	p, err := msg.DecodeLastParameter(NullBlobList, false)
+	if err != nil {
+		t.Fatal("Error decoding values, ", err)
+	}
+	if blist := *p.(*BlobList); (len(blist) != 3) || ((*blist[0])[0] != 0) || ((*blist[2])[0] != 2) {
+		t.Errorf("Bad notified values %v", blist)
+	}
+}
+
+// With coalescing only the latest update of each key is sent, the batch is sent as soon as
+// it holds the maximum number of updates.
+func TestBatchCoalesce(t *testing.T) {
+	broker, subop := newBatchBroker(t, batch_broker2_url, batch_subscriber2_url,
+		NewGenericUpdateValueHandler(NullStringList, NullLongList), time.Minute, 2, true)
+	for i, key := range []string{"key1", "key1", "key2"} {
+		strings := StringList([]*String{NewString(key)})
+		longs := LongList([]*Long{NewLong(int64(i))})
+		if err := broker.Publish(batchHeaders(broker, key), &strings, &longs); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+
+	msg, headers := batchNotify(t, subop, 2*time.Second)
+	checkBatchKeys(t, headers, "key1", "key2")
+	p1, err := msg.DecodeParameter(NullStringList)
+	if err != nil {
+		t.Fatal("Error decoding values, ", err)
+	}
+	p2, err := msg.DecodeLastParameter(NullLongList, false)
+	if err != nil {
+		t.Fatal("Error decoding values, ", err)
+	}
+	strings, longs := *p1.(*StringList), *p2.(*LongList)
+	if (len(strings) != 2) || (*strings[0] != "key1") || (*strings[1] != "key2") ||
+		(len(longs) != 2) || (*longs[0] != 1) || (*longs[1] != 2) {
+		t.Errorf("Bad notified values %v, %v", strings, longs)
+	}
+}
+
+// An UpdateValueHandler implementing none of the optional interfaces.
+type plainUpdateValueHandler struct {
+	blob *BlobUpdateValueHandler
+}
+
+func (h *plainUpdateValueHandler) InitUpdateValueList(list []ElementList) error {
+	return h.blob.InitUpdateValueList(list)
+}
+func (h *plainUpdateValueHandler) DecodeUpdateValueList(body Body) error {
+	return h.blob.DecodeUpdateValueList(body)
+}
+func (h *plainUpdateValueHandler) UpdateValueListSize() int {
+	return h.blob.UpdateValueListSize()
+}
+func (h *plainUpdateValueHandler) AppendValue(idx int) {
+	h.blob.AppendValue(idx)
+}
+func (h *plainUpdateValueHandler) EncodeUpdateValueList(body Body) error {
+	return h.blob.EncodeUpdateValueList(body)
+}
+func (h *plainUpdateValueHandler) ResetValues() {
+	h.blob.ResetValues()
+}
+
+// Without the optional interfaces the batching is disabled, each publish is notified.
+func TestBatchPlainHandler(t *testing.T) {
+	plain := &plainUpdateValueHandler{NewBlobUpdateValueHandler()}
+	broker, subop := newBatchBroker(t, batch_broker3_url, batch_subscriber3_url, plain, time.Minute, 0, false)
+	for i, key := range []string{"key1", "key2"} {
+		values := BlobList([]*Blob{&Blob{byte(i)}})
+		if err := broker.Publish(batchHeaders(broker, key), &values); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+	for i, key := range []string{"key1", "key2"} {
+		msg, headers := batchNotify(t, subop, 2*time.Second)
+		checkBatchKeys(t, headers, key)
+		p, err := msg.DecodeLastParameter(NullBlobList, false)
+		if err != nil {
+			t.Fatal("Error decoding values, ", err)
+		}
+		if blist := *p.(*BlobList); (len(blist) != 1) || ((*blist[0])[0] != byte(i)) {
+			t.Errorf("Bad notified values %v", blist)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"container/list"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"sync"
+)
+
+// Comparable value of an EntityKey, nulls tells which sub-keys are NULL.
+type keyValue struct {
+	first  Identifier
+	second Long
+	third  Long
+	fourth Long
+	nulls  byte
+}
+
+func newKeyValue(key *EntityKey) keyValue {
+	var kv keyValue
+	if key.FirstSubKey != nil {
+		kv.first = *key.FirstSubKey
+	} else {
+		kv.nulls |= 1
+	}
+	for i, subkey := range []*Long{key.SecondSubKey, key.ThirdSubKey, key.FourthSubKey} {
+		if subkey == nil {
+			kv.nulls |= 2 << uint(i)
+			continue
+		}
+		switch i {
+		case 0:
+			kv.second = *subkey
+		case 1:
+			kv.third = *subkey
+		case 2:
+			kv.fourth = *subkey
+		}
+	}
+	return kv
+}
+
+// Identifies a cached update.
+type cacheKey struct {
+	domain      string
+	session     SessionType
+	sessionName Identifier
+	area        UShort
+	service     UShort
+	operation   UShort
+	key         keyValue
+}
+
+// Last update published for a key.
+type cachedUpdate struct {
+	ckey cacheKey
+	// Message holding the domain, session and service of the publication
+	msg    *Message
+	header *UpdateHeader
+	// Handler holding only the value of this update
+	value UpdateValueHandler
+}
+
+// Cache of the last update of each key, when it is full the least recently updated key is
+// removed.
+type lastValueCache struct {
+	max     int
+	lock    sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+func newLastValueCache(max uint) *lastValueCache {
+	return &lastValueCache{
+		max:     int(max),
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Records the updates of a publication, the DELETION updates remove the key from the cache.
+// The update values must be selectable (see UpdateValueSelector).
+func (cache *lastValueCache) put(pub *Message, uhlist *UpdateHeaderList, updtHandler UpdateValueHandler) {
+	selector, ok := updtHandler.(UpdateValueSelector)
+	if !ok {
+		return
+	}
+	domains := domainKeys(pub.Domain)
+	msg := &Message{
+		Domain:      pub.Domain,
+		Session:     pub.Session,
+		SessionName: pub.SessionName,
+		ServiceArea: pub.ServiceArea,
+		AreaVersion: pub.AreaVersion,
+		Service:     pub.Service,
+		Operation:   pub.Operation,
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for idx, hdr := range *uhlist {
+		ckey := cacheKey{
+			domain:      domains[len(domains)-1],
+			session:     pub.Session,
+			sessionName: pub.SessionName,
+			area:        pub.ServiceArea,
+			service:     pub.Service,
+			operation:   pub.Operation,
+			key:         newKeyValue(&hdr.Key),
+		}
+		if elt := cache.entries[ckey]; elt != nil {
+			cache.lru.Remove(elt)
+			delete(cache.entries, ckey)
+		}
+		if hdr.UpdateType == MAL_UPDATETYPE_DELETION {
+			continue
+		}
+		update := &cachedUpdate{ckey: ckey, msg: msg, header: hdr, value: selector.SelectUpdateValue(idx)}
+		cache.entries[ckey] = cache.lru.PushBack(update)
+		if cache.lru.Len() > cache.max {
+			oldest := cache.lru.Front()
+			cache.lru.Remove(oldest)
+			delete(cache.entries, oldest.Value.(*cachedUpdate).ckey)
+		}
+	}
+}
+
+// Builds a NOTIFY body for each cached update matching the subscription and its value
+// filters, from the least to the most recently updated.
+func (cache *lastValueCache) notifications(sub *BrokerSub) []*notification {
+	index := newSubIndex()
+	index.add(sub)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	notifications := make([]*notification, 0)
+	for elt := cache.lru.Front(); elt != nil; elt = elt.Next() {
+		update := elt.Value.(*cachedUpdate)
+		headers := UpdateHeaderList([]*UpdateHeader{update.header})
+		if len(index.match(update.msg, &headers)) == 0 {
+			continue
+		}
+		if (sub.keyed != nil) && !sub.keyed.matches(&update.header.Key) {
+			continue
+		}
+		if len(sub.filter.apply(&headers, update.value, []int{0})) == 0 {
+			continue
+		}
+		body := sub.transaction.NewBody()
+		body.EncodeParameter(&sub.subid)
+		if sub.keyed != nil {
+			body.EncodeParameter(sub.keyed.header(update.header, update.msg.Domain))
+		} else {
+			body.EncodeParameter(&headers)
+		}
+		update.value.AppendValue(0)
+		update.value.EncodeUpdateValueList(body)
+		notifications = append(notifications, &notification{keys: []*EntityKey{&update.header.Key}, body: body})
+	}
+	return notifications
+}
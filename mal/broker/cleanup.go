@@ -0,0 +1,339 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	"sync"
+	"time"
+)
+
+// Cause of the purge of the registrations of a consumer inactive for longer than the lease.
+var ErrLeaseExpired = errors.New("Broker: lease expired")
+
+// Minimum lease of the consumers, the leases are checked 4 times per lease.
+const min_cleanup_lease = 100 * time.Millisecond
+
+// Registrations of a lost consumer purged by the broker.
+type Purge struct {
+	Uri URI
+	// Cause of the purge: the delivery failure or ErrLeaseExpired
+	Cause error
+	// Identifiers of the purged subscriptions
+	Subscriptions []Identifier
+	// True if the publisher registration is purged
+	Publisher bool
+}
+
+// Hook called after each purge, it is called by a dedicated goroutine.
+type PurgeHandler func(purge *Purge)
+
+// State of the purge of the lost consumers, see EnableCleanup. With a lease it intercepts
+// the incoming messages of the broker context in order to renew the lease of their sender.
+type cleanup struct {
+	uri   URI
+	hook  PurgeHandler
+	lease time.Duration
+
+	lock sync.Mutex
+	// Last activity of each consumer, only maintained with a lease
+	seen map[URI]time.Time
+	done chan bool
+}
+
+// Enables the purge of the registrations of the lost consumers: subscriptions and publisher
+// registration of a URI are removed when a message of the broker cannot be delivered to it.
+// The delivery failures reported asynchronously by the transport (e.g. TCP) are only detected
+// if the broker is set as error listener of its MAL context (see OnError).
+// If lease is not 0, the registrations of a consumer are also purged if there is no activity
+// of the consumer during the lease: any message received by the broker from the consumer
+// renews its lease, as well as a notification successfully sent to it. A consumer without
+// other activity (e.g. a subscriber to a quiet topic) should periodically send a keep-alive
+// message (see EnableKeepAlive). A lease shorter than 100ms is raised to 100ms, a negative
+// lease is ignored. The hook, if not nil, is called after each purge.
+func (handler *BrokerHandler) EnableCleanup(lease time.Duration, hook PurgeHandler) *BrokerHandler {
+	if lease < 0 {
+		logger.Warnf("Broker: negative cleanup lease %s, the lease is disabled", lease)
+		lease = 0
+	} else if (lease > 0) && (lease < min_cleanup_lease) {
+		logger.Warnf("Broker: cleanup lease %s too short, raised to %s", lease, min_cleanup_lease)
+		lease = min_cleanup_lease
+	}
+	c := &cleanup{
+		uri:   *handler.Uri(),
+		hook:  hook,
+		lease: lease,
+		seen:  make(map[URI]time.Time),
+		done:  make(chan bool),
+	}
+	handler.lock.Lock()
+	old := handler.cleanup
+	handler.cleanup = c
+	handler.lock.Unlock()
+	if old != nil {
+		handler.closeCleanup(old)
+	}
+	if lease > 0 {
+		handler.cctx.Ctx.AddInterceptor(c)
+		go handler.sweep(c)
+	}
+	return handler
+}
+
+// Stops the purge of the lost consumers.
+func (handler *BrokerHandler) stopCleanup() {
+	handler.lock.Lock()
+	c := handler.cleanup
+	handler.cleanup = nil
+	handler.lock.Unlock()
+	if c != nil {
+		handler.closeCleanup(c)
+	}
+}
+
+// Stops the sweep and the renewal of the leases of a replaced or stopped cleanup.
+func (handler *BrokerHandler) closeCleanup(c *cleanup) {
+	if c.lease > 0 {
+		handler.cctx.Ctx.RemoveInterceptor(c)
+	}
+	close(c.done)
+}
+
+func (handler *BrokerHandler) getCleanup() *cleanup {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	return handler.cleanup
+}
+
+// Records the activity of a consumer for its lease.
+func (handler *BrokerHandler) touch(uri *URI) {
+	c := handler.getCleanup()
+	if (c == nil) || (c.lease == 0) || (uri == nil) {
+		return
+	}
+	c.lock.Lock()
+	c.seen[*uri] = time.Now()
+	c.lock.Unlock()
+}
+
+// Implements the Interceptor interface, the outgoing messages are left unchanged.
+func (c *cleanup) InterceptSend(msg *Message) (bool, error) {
+	return true, nil
+}
+
+// Implements the Interceptor interface: any message received by the broker renews the lease
+// of its sender.
+func (c *cleanup) InterceptReceive(msg *Message) (bool, error) {
+	if (msg.UriFrom != nil) && (msg.UriTo != nil) && (*msg.UriTo == c.uri) {
+		c.lock.Lock()
+		c.seen[*msg.UriFrom] = time.Now()
+		c.lock.Unlock()
+	}
+	return true, nil
+}
+
+// Registers the keep-alive operation of the broker: a SEND message with an empty body whose
+// only effect is to renew the lease of its sender (see EnableCleanup and KeepAliveConsumer).
+func (handler *BrokerHandler) EnableKeepAlive(area UShort, areaVersion UOctet, service UShort, operation UShort) error {
+	// The lease is renewed by the interception of the message
+	return handler.cctx.RegisterSendHandler(area, areaVersion, service, operation, func(msg *Message, t Transaction) error {
+		return nil
+	})
+}
+
+// Client of the keep-alive operation of a remote broker (see EnableKeepAlive), it renews the
+// lease of the registrations of its client context.
+type KeepAliveConsumer struct {
+	cctx        *ClientContext
+	broker      *URI
+	area        UShort
+	areaVersion UOctet
+	service     UShort
+	operation   UShort
+
+	lock sync.Mutex
+	done chan bool
+}
+
+func NewKeepAliveConsumer(cctx *ClientContext, broker *URI, area UShort, areaVersion UOctet, service UShort, operation UShort) *KeepAliveConsumer {
+	return &KeepAliveConsumer{cctx: cctx, broker: broker, area: area, areaVersion: areaVersion, service: service, operation: operation}
+}
+
+// Sends a keep-alive message to the broker.
+func (consumer *KeepAliveConsumer) KeepAlive() error {
+	op := consumer.cctx.NewSendOperation(consumer.broker, consumer.area, consumer.areaVersion, consumer.service, consumer.operation)
+	return op.Send(op.NewBody())
+}
+
+// Periodically sends a keep-alive message to the broker until Stop is called, the period
+// should be shorter than half the lease of the broker. A previous periodic sending is stopped.
+func (consumer *KeepAliveConsumer) Start(period time.Duration) {
+	done := make(chan bool)
+	consumer.lock.Lock()
+	old := consumer.done
+	consumer.done = done
+	consumer.lock.Unlock()
+	if old != nil {
+		close(old)
+	}
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := consumer.KeepAlive(); err != nil {
+					logger.Warnf("Broker: cannot send keep-alive to %s: %s", *consumer.broker, err)
+				}
+			}
+		}
+	}()
+}
+
+// Stops the periodic sending of the keep-alive messages.
+func (consumer *KeepAliveConsumer) Stop() {
+	consumer.lock.Lock()
+	done := consumer.done
+	consumer.done = nil
+	consumer.lock.Unlock()
+	if done != nil {
+		close(done)
+	}
+}
+
+// Implements the ErrorListener interface: the failures of the delivery of the messages of the
+// broker purge the registrations of their destination.
+func (handler *BrokerHandler) OnError(merr *MessageError) {
+	msg := merr.Msg
+	if (msg == nil) || (msg.UriFrom == nil) || (msg.UriTo == nil) || (*msg.UriFrom != *handler.Uri()) {
+		return
+	}
+	switch merr.Code {
+	case ERROR_DELIVERY_FAILED, ERROR_DESTINATION_UNKNOWN, ERROR_DESTINATION_LOST:
+		// The listener is called by the transport and must not block
+		go handler.lost(*msg.UriTo, merr)
+	}
+}
+
+// Purges the registrations of a consumer to which a notification cannot be delivered.
+func (handler *BrokerHandler) lost(uri URI, cause error) {
+	if handler.getCleanup() == nil {
+		return
+	}
+	handler.purge(uri, cause)
+}
+
+// Removes all the registrations of a consumer, then calls the hook.
+func (handler *BrokerHandler) purge(uri URI, cause error) {
+	if uri == *handler.Uri() {
+		return
+	}
+	purge := &Purge{Uri: uri, Cause: cause}
+	removed := make([]string, 0)
+	handler.lock.Lock()
+	for key, sub := range handler.subs {
+		if *sub.urifrom == uri {
+			handler.removeSub(sub)
+			removed = append(removed, subRegistrationKey(key))
+			purge.Subscriptions = append(purge.Subscriptions, sub.subid)
+		}
+	}
+	if _, ok := handler.pubs[string(uri)]; ok {
+		delete(handler.pubs, string(uri))
+		handler.touchDemand()
+		removed = append(removed, pubRegistrationKey(string(uri)))
+		purge.Publisher = true
+	}
+	c := handler.cleanup
+	handler.lock.Unlock()
+
+	if c != nil {
+		c.lock.Lock()
+		delete(c.seen, uri)
+		c.lock.Unlock()
+	}
+	if len(removed) == 0 {
+		return
+	}
+	logger.Warnf("Broker: purges %d registrations of %s: %s", len(removed), uri, cause)
+	for _, key := range removed {
+		handler.unsave(key)
+	}
+	if (c != nil) && (c.hook != nil) {
+		c.hook(purge)
+	}
+}
+
+// Periodically purges the registrations of the consumers whose lease is expired.
+func (handler *BrokerHandler) sweep(c *cleanup) {
+	ticker := time.NewTicker(c.lease / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			for _, uri := range handler.expired(c, now) {
+				handler.purge(uri, ErrLeaseExpired)
+			}
+		}
+	}
+}
+
+// Returns the registered consumers whose lease is expired, a consumer without recorded
+// activity (e.g. restored from the store) starts its lease.
+func (handler *BrokerHandler) expired(c *cleanup, now time.Time) []URI {
+	uris := make(map[URI]bool)
+	handler.lock.RLock()
+	for _, sub := range handler.subs {
+		uris[*sub.urifrom] = true
+	}
+	for pubid := range handler.pubs {
+		uris[URI(pubid)] = true
+	}
+	handler.lock.RUnlock()
+	delete(uris, *handler.Uri())
+
+	expired := make([]URI, 0)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for uri := range c.seen {
+		if !uris[uri] {
+			delete(c.seen, uri)
+		}
+	}
+	for uri := range uris {
+		seen, ok := c.seen[uri]
+		if !ok {
+			c.seen[uri] = now
+		} else if now.Sub(seen) > c.lease {
+			expired = append(expired, uri)
+		}
+	}
+	return expired
+}
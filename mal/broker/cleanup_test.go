@@ -0,0 +1,210 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"testing"
+	"time"
+)
+
+const (
+	cleanup_broker_url = "maltcp://127.0.0.1:16063"
+	cleanup_client_url = "maltcp://127.0.0.1:16064"
+)
+
+// Starts a broker purging the lost consumers, the purges are sent to the returned channel.
+func newCleanupBroker(t *testing.T, lease time.Duration) (*BrokerHandler, chan *Purge) {
+	ctx, err := NewContext(cleanup_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	t.Cleanup(func() { ctx.Close() })
+	cctx, err := NewClientContext(ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	t.Cleanup(broker.Close)
+	purges := make(chan *Purge, 10)
+	broker.EnableCleanup(lease, func(purge *Purge) { purges <- purge })
+	ctx.SetErrorListener(broker)
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.LocalPublishRegister(200, 1, 1, 1, &eklist)
+	return broker, purges
+}
+
+// Registers a subscription and a publisher from a new client context.
+func newCleanupClient(t *testing.T, broker *URI) (*Context, *ClientContext) {
+	ctx, err := NewContext(cleanup_client_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	client, err := NewClientContext(ctx, "client")
+	if err != nil {
+		t.Fatal("Error creating client, ", err)
+	}
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	subop := client.NewSubscriberOperation(broker, 200, 1, 1, 1)
+	body := subop.NewBody()
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, eklist}})
+	body.EncodeLastParameter(&Subscription{Identifier("Lost"), erlist}, false)
+	if _, err := subop.Register(body); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+	pubop := client.NewPublisherOperation(broker, 200, 1, 1, 1)
+	body = pubop.NewBody()
+	body.EncodeLastParameter(&eklist, false)
+	if _, err := pubop.Register(body); err != nil {
+		t.Fatal("Error registering publisher, ", err)
+	}
+	return ctx, client
+}
+
+func checkPurge(t *testing.T, purges chan *Purge, uri *URI) *Purge {
+	select {
+	case purge := <-purges:
+		if (purge.Uri != *uri) || (len(purge.Subscriptions) != 1) || (purge.Subscriptions[0] != "Lost") || !purge.Publisher {
+			t.Errorf("Bad purge %+v", purge)
+		}
+		return purge
+	case <-time.After(5 * time.Second):
+		t.Fatal("Registrations not purged")
+	}
+	return nil
+}
+
+// The registrations of a consumer are purged when a notify cannot be delivered.
+func TestCleanupDeliveryFailure(t *testing.T) {
+	broker, purges := newCleanupBroker(t, 0)
+	ctx, client := newCleanupClient(t, broker.Uri())
+	uri := *client.Uri
+	ctx.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	hdrs := UpdateHeaderList([]*UpdateHeader{
+		&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_CREATION, EntityKey{NewIdentifier("key"), NewLong(1), NewLong(1), NewLong(1)}},
+	})
+	values := BlobList([]*Blob{&Blob{1}})
+	if err := broker.LocalPublishValues(200, 1, 1, 1, &hdrs, &values); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	purge := checkPurge(t, purges, &uri)
+	var merr *MessageError
+	if !errors.As(purge.Cause, &merr) {
+		t.Errorf("Bad purge cause %v", purge.Cause)
+	}
+	if subs, pubs := broker.ListSubscriptions(), broker.ListPublishers(); (len(subs) != 0) || (len(pubs) != 1) {
+		t.Errorf("Bad registrations after purge %+v, %+v", subs, pubs)
+	}
+}
+
+// The registrations of an inactive consumer are purged when its lease expires.
+func TestCleanupLease(t *testing.T) {
+	time.Sleep(200 * time.Millisecond)
+	broker, purges := newCleanupBroker(t, 400*time.Millisecond)
+	ctx, client := newCleanupClient(t, broker.Uri())
+	defer ctx.Close()
+
+	// Renews the lease registering again the subscription
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, eklist}})
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		subop := client.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+		body := subop.NewBody()
+		body.EncodeLastParameter(&Subscription{Identifier("Lost"), erlist}, false)
+		if _, err := subop.Register(body); err != nil {
+			t.Fatal("Error renewing subscription, ", err)
+		}
+	}
+	if len(purges) != 0 {
+		t.Fatal("Registrations purged despite activity")
+	}
+	purge := checkPurge(t, purges, client.Uri)
+	if purge.Cause != ErrLeaseExpired {
+		t.Errorf("Bad purge cause %v", purge.Cause)
+	}
+}
+
+// The notifies successfully sent to a subscriber renew its lease, a too short lease is raised
+// to the minimum.
+func TestCleanupNotifyLease(t *testing.T) {
+	time.Sleep(200 * time.Millisecond)
+	broker, purges := newCleanupBroker(t, time.Nanosecond)
+	ctx, client := newCleanupClient(t, broker.Uri())
+	defer ctx.Close()
+
+	values := BlobList([]*Blob{&Blob{1}})
+	for i := 0; i < 8; i++ {
+		time.Sleep(40 * time.Millisecond)
+		hdrs := UpdateHeaderList([]*UpdateHeader{
+			&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_UPDATE, EntityKey{NewIdentifier("key"), NewLong(1), NewLong(1), NewLong(1)}},
+		})
+		if err := broker.LocalPublishValues(200, 1, 1, 1, &hdrs, &values); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+	if len(purges) != 0 {
+		t.Fatal("Registrations purged despite notifies")
+	}
+	purge := checkPurge(t, purges, client.Uri)
+	if purge.Cause != ErrLeaseExpired {
+		t.Errorf("Bad purge cause %v", purge.Cause)
+	}
+}
+
+// An idle subscriber still connected to the broker keeps its registrations sending
+// keep-alive messages, they are purged when it stops.
+func TestCleanupKeepAlive(t *testing.T) {
+	time.Sleep(200 * time.Millisecond)
+	broker, purges := newCleanupBroker(t, 400*time.Millisecond)
+	if err := broker.EnableKeepAlive(200, 1, 1, 2); err != nil {
+		t.Fatal("Error enabling keep-alive, ", err)
+	}
+	ctx, client := newCleanupClient(t, broker.Uri())
+	defer ctx.Close()
+
+	keepalive := NewKeepAliveConsumer(client, broker.Uri(), 200, 1, 1, 2)
+	keepalive.Start(100 * time.Millisecond)
+	time.Sleep(1200 * time.Millisecond)
+	if len(purges) != 0 {
+		t.Fatal("Registrations purged despite keep-alive")
+	}
+	if subs := broker.ListSubscriptions(); len(subs) != 1 {
+		t.Fatalf("Bad subscriptions %+v", subs)
+	}
+	keepalive.Stop()
+	purge := checkPurge(t, purges, client.Uri)
+	if purge.Cause != ErrLeaseExpired {
+		t.Errorf("Bad purge cause %v", purge.Cause)
+	}
+}
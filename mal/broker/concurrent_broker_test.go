@@ -0,0 +1,190 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"context"
+	"fmt"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	ct_broker_url     = "maltcp://127.0.0.1:16040"
+	ct_publisher_url  = "maltcp://127.0.0.1:16041"
+	ct_subscriber_url = "maltcp://127.0.0.1:16042"
+
+	ct_nbpub     = 4
+	ct_nbsub     = 4
+	ct_nbpublish = 20
+)
+
+// Publishers and subscribers use concurrently a shared broker handling the messages concurrently,
+// each notify must contain the update values of the corresponding publish.
+func TestConcurrentBroker(t *testing.T) {
+	broker_ctx, err := NewContext(ct_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	cctx.SetConcurrency(true)
+	broker, err := NewBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+
+	pub_ctx, err := NewContext(ct_publisher_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer pub_ctx.Close()
+	sub_ctx, err := NewContext(ct_subscriber_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer sub_ctx.Close()
+
+	// Registers concurrently the publishers and subscribers
+	var wg sync.WaitGroup
+	pubops := make([]PublisherOperation, ct_nbpub)
+	subops := make([]SubscriberOperation, ct_nbsub)
+	for i := 0; i < ct_nbpub; i++ {
+		publisher, err := NewClientContext(pub_ctx, fmt.Sprintf("publisher%d", i))
+		if err != nil {
+			t.Fatal("Error creating publisher, ", err)
+		}
+		defer publisher.Close()
+		pubops[i] = publisher.NewPublisherOperation(broker.Uri(), 200, 1, 1, 1)
+		wg.Add(1)
+		go func(op PublisherOperation) {
+			defer wg.Done()
+			body := op.NewBody()
+			eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+			body.EncodeLastParameter(&eklist, false)
+			if _, err := op.Register(body); err != nil {
+				t.Error("Error registering publisher, ", err)
+			}
+		}(pubops[i])
+	}
+	for i := 0; i < ct_nbsub; i++ {
+		subscriber, err := NewClientContext(sub_ctx, fmt.Sprintf("subscriber%d", i))
+		if err != nil {
+			t.Fatal("Error creating subscriber, ", err)
+		}
+		defer subscriber.Close()
+		subops[i] = subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+		wg.Add(1)
+		go func(op SubscriberOperation) {
+			defer wg.Done()
+			body := op.NewBody()
+			eksub := &EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}
+			erlist := EntityRequestList([]*EntityRequest{
+				&EntityRequest{nil, true, true, true, true, EntityKeyList([]*EntityKey{eksub})},
+			})
+			body.EncodeLastParameter(&Subscription{Identifier("sub"), erlist}, false)
+			if _, err := op.Register(body); err != nil {
+				t.Error("Error registering subscriber, ", err)
+			}
+		}(subops[i])
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// Publishes concurrently, the update values identify the publisher and the publish
+	for i := 0; i < ct_nbpub; i++ {
+		wg.Add(1)
+		go func(i int, op PublisherOperation) {
+			defer wg.Done()
+			for k := 0; k < ct_nbpublish; k++ {
+				key := &EntityKey{NewIdentifier(fmt.Sprintf("p%d", i)), NewLong(int64(k)), NewLong(0), NewLong(0)}
+				uri := URI("publisher")
+				hdrs := UpdateHeaderList([]*UpdateHeader{
+					&UpdateHeader{*TimeNow(), uri, MAL_UPDATETYPE_CREATION, *key},
+					&UpdateHeader{*TimeNow(), uri, MAL_UPDATETYPE_UPDATE, *key},
+				})
+				values := BlobList([]*Blob{&Blob{byte(i), byte(k), 0}, &Blob{byte(i), byte(k), 1}})
+				body := op.NewBody()
+				body.EncodeParameter(&hdrs)
+				body.EncodeLastParameter(&values, false)
+				if err := op.Publish(body); err != nil {
+					t.Error("Error publishing, ", err)
+				}
+			}
+		}(i, pubops[i])
+	}
+
+	// Each subscriber receives all the publish
+	for _, op := range subops {
+		wg.Add(1)
+		go func(op SubscriberOperation) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for n := 0; n < ct_nbpub*ct_nbpublish; n++ {
+				msg, err := op.GetNotifyWithContext(ctx)
+				if err != nil {
+					t.Error("Error getting notify, ", err)
+					return
+				}
+				msg.DecodeParameter(NullIdentifier)
+				p, err := msg.DecodeParameter(NullUpdateHeaderList)
+				if err != nil {
+					t.Error("Error decoding headers, ", err)
+					return
+				}
+				hdrs := *p.(*UpdateHeaderList)
+				p, err = msg.DecodeLastParameter(NullBlobList, false)
+				if err != nil {
+					t.Error("Error decoding values, ", err)
+					return
+				}
+				values := *p.(*BlobList)
+				if len(hdrs) != 2 || len(values) != 2 {
+					t.Errorf("Bad notify size %d, %d", len(hdrs), len(values))
+					return
+				}
+				for idx, hdr := range hdrs {
+					expected := fmt.Sprintf("p%d", (*values[idx])[0])
+					if (string(*hdr.Key.FirstSubKey) != expected) || (byte(*hdr.Key.SecondSubKey) != (*values[idx])[1]) ||
+						(int((*values[idx])[2]) != idx) {
+						t.Errorf("Update value %v does not match header %v", *values[idx], hdr.Key)
+					}
+				}
+			}
+		}(op)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,295 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	"sync"
+)
+
+// Handler called when the demand of a publisher changes, keys are the registered keys of the
+// publisher matched by at least one subscription.
+type DemandHandler func(publisher URI, keys EntityKeyList)
+
+// Service used to send the demand to the remote publishers (see EnableRemoteDemand).
+type demandService struct {
+	area        UShort
+	areaVersion UOctet
+	service     UShort
+	operation   UShort
+}
+
+// Tracks the demand of the publishers, the demand is computed by a dedicated goroutine after
+// each change of the registrations.
+type demandTracker struct {
+	handler *BrokerHandler
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	hook   DemandHandler
+	remote *demandService
+	dirty  bool
+	closed bool
+	// Last demand signaled to each publisher, a publisher initially has no demand
+	last map[string]EntityKeyList
+	done chan bool
+}
+
+// Returns true if a key can match both patterns (see EntityKey.Match).
+func keysOverlap(key1 *EntityKey, key2 *EntityKey) bool {
+	id1, id2 := key1.FirstSubKey, key2.FirstSubKey
+	if ((id1 == nil) || (*id1 != "*")) && ((id2 == nil) || (*id2 != "*")) {
+		if (id1 == nil) || (id2 == nil) {
+			if (id1 != nil) || (id2 != nil) {
+				return false
+			}
+		} else if *id1 != *id2 {
+			return false
+		}
+	}
+	longs1 := []*Long{key1.SecondSubKey, key1.ThirdSubKey, key1.FourthSubKey}
+	longs2 := []*Long{key2.SecondSubKey, key2.ThirdSubKey, key2.FourthSubKey}
+	for i, l1 := range longs1 {
+		l2 := longs2[i]
+		if ((l1 != nil) && (*l1 == 0)) || ((l2 != nil) && (*l2 == 0)) {
+			continue
+		}
+		if (l1 == nil) || (l2 == nil) {
+			if (l1 != nil) || (l2 != nil) {
+				return false
+			}
+		} else if *l1 != *l2 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the subscription can match an update of the key published by the publisher.
+func (sub *BrokerSub) demands(pub *BrokerPub, key *EntityKey) bool {
+	if (pub.session != sub.session) || (pub.sessionName != sub.sessionName) {
+		return false
+	}
+	for _, request := range *sub.entities {
+		if !sub.domainMatches(pub.domain, request.SubDomain) ||
+			(!bool(request.AllAreas) && (pub.serviceArea != sub.serviceArea)) ||
+			(!bool(request.AllServices) && (pub.Service != sub.service)) ||
+			(!bool(request.AllOperations) && (pub.operation != sub.operation)) {
+			continue
+		}
+		for _, rkey := range request.EntityKeys {
+			if keysOverlap(rkey, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the registered keys of the publisher matched by at least one subscription, the
+// lock must be held.
+func (handler *BrokerHandler) demand(pub *BrokerPub) EntityKeyList {
+	keys := EntityKeyList{}
+	for _, key := range *pub.keys {
+		for _, sub := range handler.subs {
+			if sub.demands(pub, key) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// Returns the registered keys of the publisher currently matched by at least one subscription,
+// nil if the publisher is not registered.
+func (handler *BrokerHandler) GetDemand(publisher *URI) EntityKeyList {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	pub := handler.pubs[string(*publisher)]
+	if pub == nil {
+		return nil
+	}
+	return handler.demand(pub)
+}
+
+// Sets the handler called each time the demand of a publisher changes.
+func (handler *BrokerHandler) SetDemandHandler(hook DemandHandler) *BrokerHandler {
+	tracker := handler.demandTracker()
+	tracker.lock.Lock()
+	tracker.hook = hook
+	tracker.dirty = true
+	tracker.cond.Signal()
+	tracker.lock.Unlock()
+	return handler
+}
+
+// Sends each change of the demand of a remote publisher in a SEND message of the specified
+// operation, its body is the list of the demanded keys. The publisher receives it with a
+// handler registered by RegisterDemandListener.
+func (handler *BrokerHandler) EnableRemoteDemand(area UShort, areaVersion UOctet, service UShort, operation UShort) *BrokerHandler {
+	tracker := handler.demandTracker()
+	tracker.lock.Lock()
+	tracker.remote = &demandService{area, areaVersion, service, operation}
+	tracker.dirty = true
+	tracker.cond.Signal()
+	tracker.lock.Unlock()
+	return handler
+}
+
+// Returns the demand tracker, it is created and started on first use.
+func (handler *BrokerHandler) demandTracker() *demandTracker {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.demands == nil {
+		tracker := &demandTracker{
+			handler: handler,
+			last:    make(map[string]EntityKeyList),
+			done:    make(chan bool),
+		}
+		tracker.cond = sync.NewCond(&tracker.lock)
+		handler.demands = tracker
+		go tracker.run()
+	}
+	return handler.demands
+}
+
+// Signals a change of the registrations, the lock of the handler must be held.
+func (handler *BrokerHandler) touchDemand() {
+	if handler.demands != nil {
+		handler.demands.touch()
+	}
+}
+
+func (tracker *demandTracker) touch() {
+	tracker.lock.Lock()
+	tracker.dirty = true
+	tracker.cond.Signal()
+	tracker.lock.Unlock()
+}
+
+// Forgets the demand signaled to a publisher registering anew, it is signaled again.
+func (tracker *demandTracker) reset(pubid string) {
+	tracker.lock.Lock()
+	delete(tracker.last, pubid)
+	tracker.dirty = true
+	tracker.cond.Signal()
+	tracker.lock.Unlock()
+}
+
+func (tracker *demandTracker) close() {
+	tracker.lock.Lock()
+	tracker.closed = true
+	tracker.cond.Signal()
+	tracker.lock.Unlock()
+	<-tracker.done
+}
+
+func sameKeys(keys1 EntityKeyList, keys2 EntityKeyList) bool {
+	if len(keys1) != len(keys2) {
+		return false
+	}
+	for i, key := range keys1 {
+		if !sameKey(key, keys2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Computes the demand of the publishers after each change, then signals the changes.
+func (tracker *demandTracker) run() {
+	defer close(tracker.done)
+	for {
+		tracker.lock.Lock()
+		for !tracker.dirty && !tracker.closed {
+			tracker.cond.Wait()
+		}
+		if tracker.closed {
+			tracker.lock.Unlock()
+			return
+		}
+		tracker.dirty = false
+		hook, remote := tracker.hook, tracker.remote
+		tracker.lock.Unlock()
+
+		handler := tracker.handler
+		demands := make(map[string]EntityKeyList)
+		handler.lock.RLock()
+		for pubid, pub := range handler.pubs {
+			demands[pubid] = handler.demand(pub)
+		}
+		handler.lock.RUnlock()
+
+		changes := make(map[string]EntityKeyList)
+		tracker.lock.Lock()
+		for pubid, keys := range demands {
+			if !sameKeys(tracker.last[pubid], keys) {
+				changes[pubid] = keys
+			}
+			tracker.last[pubid] = keys
+		}
+		for pubid := range tracker.last {
+			if _, ok := demands[pubid]; !ok {
+				delete(tracker.last, pubid)
+			}
+		}
+		tracker.lock.Unlock()
+
+		for pubid, keys := range changes {
+			logger.Debugf("Broker: demand of %s -> %v", pubid, keys)
+			if hook != nil {
+				hook(URI(pubid), keys)
+			}
+			if (remote != nil) && (pubid != string(*handler.Uri())) {
+				tracker.send(URI(pubid), keys, remote)
+			}
+		}
+	}
+}
+
+// Sends the demand to a remote publisher.
+func (tracker *demandTracker) send(publisher URI, keys EntityKeyList, remote *demandService) {
+	op := tracker.handler.cctx.NewSendOperation(&publisher, remote.area, remote.areaVersion, remote.service, remote.operation)
+	body := op.NewBody()
+	body.EncodeLastParameter(&keys, false)
+	if err := op.Send(body); err != nil {
+		logger.Warnf("Broker: cannot send demand to %s: %s", publisher, err)
+	}
+}
+
+// Registers in the client context of a publisher the handler of the demand sent by a broker
+// (see EnableRemoteDemand), the listener receives the URI of the broker and the demanded keys.
+func RegisterDemandListener(cctx *ClientContext, area UShort, areaVersion UOctet, service UShort, operation UShort, listener func(broker URI, keys EntityKeyList)) error {
+	return cctx.RegisterSendHandler(area, areaVersion, service, operation, func(msg *Message, t Transaction) error {
+		p, err := msg.DecodeLastParameter(NullEntityKeyList, false)
+		if err != nil {
+			logger.Warnf("Cannot decode demand from %s: %s", *msg.UriFrom, err)
+			return err
+		}
+		listener(*msg.UriFrom, *p.(*EntityKeyList))
+		return nil
+	})
+}
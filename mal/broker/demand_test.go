@@ -0,0 +1,185 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"testing"
+	"time"
+)
+
+const (
+	demand_broker_url = "maltcp://127.0.0.1:16066"
+	demand_client_url = "maltcp://127.0.0.1:16067"
+)
+
+type demandEvent struct {
+	uri  URI
+	keys EntityKeyList
+}
+
+// Waits for the next demand event and verifies its keys.
+func checkDemand(t *testing.T, what string, events chan demandEvent, uri *URI, expected ...string) {
+	select {
+	case event := <-events:
+		ok := (event.uri == *uri) && (len(event.keys) == len(expected))
+		for i := 0; ok && (i < len(expected)); i++ {
+			ok = string(*event.keys[i].FirstSubKey) == expected[i]
+		}
+		if !ok {
+			t.Errorf("%s: bad demand %s %v, expect %v", what, event.uri, event.keys, expected)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("%s: no demand event", what)
+	}
+}
+
+func demandSubscribe(t *testing.T, client *ClientContext, broker *URI, subid string, key string) SubscriberOperation {
+	subop := client.NewSubscriberOperation(broker, 200, 1, 1, 1)
+	body := subop.NewBody()
+	eksub := &EntityKey{NewIdentifier(key), NewLong(0), NewLong(0), NewLong(0)}
+	erlist := EntityRequestList([]*EntityRequest{
+		&EntityRequest{nil, false, false, false, false, EntityKeyList([]*EntityKey{eksub})},
+	})
+	body.EncodeLastParameter(&Subscription{Identifier(subid), erlist}, false)
+	if _, err := subop.Register(body); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+	return subop
+}
+
+func TestPublishDemand(t *testing.T) {
+	broker_ctx, err := NewContext(demand_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	local := make(chan demandEvent, 10)
+	broker.SetDemandHandler(func(publisher URI, keys EntityKeyList) {
+		// The handler is also called for the remote publisher
+		if publisher == *broker.Uri() {
+			local <- demandEvent{publisher, keys}
+		}
+	}).EnableRemoteDemand(200, 1, 3, 1)
+	eklist := EntityKeyList([]*EntityKey{
+		&EntityKey{NewIdentifier("key1"), NewLong(0), NewLong(0), NewLong(0)},
+		&EntityKey{NewIdentifier("key2"), NewLong(0), NewLong(0), NewLong(0)},
+	})
+	broker.PublishRegister(&eklist)
+	if keys := broker.GetDemand(); len(keys) != 0 {
+		t.Errorf("Bad initial demand %v", keys)
+	}
+
+	client_ctx, err := NewContext(demand_client_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer client_ctx.Close()
+	client, err := NewClientContext(client_ctx, "client")
+	if err != nil {
+		t.Fatal("Error creating client, ", err)
+	}
+	defer client.Close()
+	remote := make(chan demandEvent, 10)
+	err = RegisterDemandListener(client, 200, 1, 3, 1, func(broker URI, keys EntityKeyList) {
+		remote <- demandEvent{broker, keys}
+	})
+	if err != nil {
+		t.Fatal("Error registering demand listener, ", err)
+	}
+	pubop := client.NewPublisherOperation(broker.Uri(), 200, 1, 1, 1)
+	body := pubop.NewBody()
+	body.EncodeLastParameter(&EntityKeyList{eklist[1]}, false)
+	if _, err := pubop.Register(body); err != nil {
+		t.Fatal("Error registering publisher, ", err)
+	}
+
+	subop1 := demandSubscribe(t, client, broker.Uri(), "sub1", "key1")
+	checkDemand(t, "key1 subscription", local, broker.Uri(), "key1")
+	if keys := broker.GetDemand(); (len(keys) != 1) || (*keys[0].FirstSubKey != "key1") {
+		t.Errorf("Bad demand %v", keys)
+	}
+
+	demandSubscribe(t, client, broker.Uri(), "sub2", "*")
+	checkDemand(t, "wildcard subscription", local, broker.Uri(), "key1", "key2")
+	checkDemand(t, "remote wildcard subscription", remote, broker.Uri(), "key2")
+
+	subop := client.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body = subop.NewBody()
+	body.EncodeLastParameter(&Subscription{Identifier("sub2"), EntityRequestList{}}, false)
+	subop.Register(body)
+	checkDemand(t, "wildcard removal", local, broker.Uri(), "key1")
+	checkDemand(t, "remote wildcard removal", remote, broker.Uri())
+	if len(local)+len(remote) != 0 {
+		t.Errorf("Unexpected demand events")
+	}
+
+	// The removed remote publisher is no longer signaled
+	if !broker.RemovePublisher(client.Uri) {
+		t.Error("Publisher not removed")
+	}
+	demandSubscribe(t, client, broker.Uri(), "sub3", "key2")
+	checkDemand(t, "key2 subscription", local, broker.Uri(), "key1", "key2")
+	if len(remote) != 0 {
+		t.Errorf("Demand signaled to a removed publisher")
+	}
+
+	idlist := IdentifierList([]*Identifier{NewIdentifier("sub1")})
+	body = subop1.NewBody()
+	body.EncodeLastParameter(&idlist, false)
+	// The broker acknowledges the deregistration as an error
+	subop1.Deregister(body)
+	checkDemand(t, "key1 deregistration", local, broker.Uri(), "key2")
+
+	// A publisher registering anew after its removal receives its demand
+	pubop = client.NewPublisherOperation(broker.Uri(), 200, 1, 1, 1)
+	body = pubop.NewBody()
+	body.EncodeLastParameter(&EntityKeyList{eklist[1]}, false)
+	if _, err := pubop.Register(body); err != nil {
+		t.Fatal("Error registering publisher, ", err)
+	}
+	checkDemand(t, "remote registration", remote, broker.Uri(), "key2")
+
+	if err := broker.PublishDeregister(); err != nil {
+		t.Fatal("Error deregistering local publisher, ", err)
+	}
+	if keys := broker.GetDemand(); keys != nil {
+		t.Errorf("Bad demand of deregistered publisher %v", keys)
+	}
+	if len(local)+len(remote) != 0 {
+		t.Errorf("Unexpected demand events")
+	}
+}
@@ -0,0 +1,605 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prefix of the identifiers of the subscriptions registered by a broker to its peers.
+const federationPrefix = "federation/"
+
+// Prefix of the names of the ClientContexts registering the subscriptions to the peers.
+const federationName = "federation"
+
+// Maximum wait of the acknowledge of a peer broker.
+const federationTimeout = 5 * time.Second
+
+// Number of the last publications of each origin broker remembered to drop the publications
+// received again, the older ones are dropped.
+const federationWindow = 1024
+
+// Operation of the federation service of the broker (see RegisterFederationService), it uses
+// the SUBMIT interaction pattern.
+const (
+	FEDERATION_SERVICE_LINK UShort = iota + 1
+)
+
+// Counter used to name the ClientContexts of the federations.
+var federationCounter uint32
+
+// The REGISTER messages are sent with the session of their ClientContext, so there is a
+// ClientContext for each session of the local subscriptions.
+type sessionKey struct {
+	session     SessionType
+	sessionName Identifier
+}
+
+// A peer broker and the subscriptions registered to it for each bucket, by route (see
+// routeKey).
+type peerLink struct {
+	uri  *URI
+	subs map[bucketKey]map[string]AsyncOperation
+}
+
+// A subscription registered to a peer: the aggregated requests of the subscriptions of a
+// bucket with the same route, and the route of the registration.
+type peerRequest struct {
+	request *EntityRequest
+	// A subscription of the bucket giving the service of the registration
+	model *BrokerSub
+	route URIList
+}
+
+// Origin of a publication forwarded between the brokers: the broker where it was published
+// and its sequence number on this broker.
+type fedTrace struct {
+	origin URI
+	seq    ULong
+}
+
+// Identifies the publications received for a bucket from an origin broker.
+type traceKey struct {
+	origin URI
+	bkey   bucketKey
+}
+
+// The last publications received from an origin broker: the highest sequence number and the
+// sequence numbers of the window ending with it.
+type seenPublications struct {
+	max  ULong
+	seqs map[ULong]bool
+}
+
+// Links a broker to its peer brokers: for each bucket of its subscriptions, the broker
+// registers to each peer subscriptions aggregating the requests of the bucket, then forwards
+// the notified updates to the subscriptions of the bucket.
+// Before registering a subscription a broker declares it to the peer with its route through
+// the federation service: the brokers on behalf of which it is registered, starting with the
+// registering broker. A subscription is never registered to a broker of its route, so the
+// subscriptions of the bucket are aggregated by route and the registrations never form a
+// cycle. The updates are forwarded along a chain of links: if C is linked to B and B to A,
+// the updates published on A reach the subscribers of C.
+// The notifies sent to the subscriptions of the peers carry the trace of the publication, a
+// broker drops the publications it has already forwarded and never sends a publication to
+// a subscription whose route contains its origin. So the links may form any graph, for
+// example a ring or a diamond, and each subscriber receives an update once.
+type federation struct {
+	handler *BrokerHandler
+	// Federation service of the broker and of its peers
+	area        UShort
+	areaVersion UOctet
+	service     UShort
+
+	lock  sync.Mutex
+	cond  *sync.Cond
+	peers []*peerLink
+	// Buckets modified since the last update of the peers
+	dirty  map[bucketKey]bool
+	closed bool
+	cctxs  map[sessionKey]*ClientContext
+	// Routes declared by the peers for their next registrations, by subscription key
+	links map[string]URIList
+	// Publications already forwarded
+	seen map[traceKey]*seenPublications
+
+	// Identifier of the subscription of each bucket and route, only used by the worker
+	// goroutine
+	ids  map[bucketKey]map[string]Identifier
+	done chan bool
+}
+
+func newFederation(handler *BrokerHandler, area UShort, areaVersion UOctet, service UShort) *federation {
+	fed := &federation{
+		handler:     handler,
+		area:        area,
+		areaVersion: areaVersion,
+		service:     service,
+		dirty:       make(map[bucketKey]bool),
+		cctxs:       make(map[sessionKey]*ClientContext),
+		links:       make(map[string]URIList),
+		seen:        make(map[traceKey]*seenPublications),
+		ids:         make(map[bucketKey]map[string]Identifier),
+		done:        make(chan bool),
+	}
+	fed.cond = sync.NewCond(&fed.lock)
+	go fed.run()
+	return fed
+}
+
+// Registers the federation service of the broker in its client context, all brokers of a
+// federation must register it with the same area, version and service. The peers declare
+// their subscriptions through this service before registering them, so that the broker
+// recognizes the subscriptions of the peers.
+func (handler *BrokerHandler) RegisterFederationService(area UShort, areaVersion UOctet, service UShort) error {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.federation != nil {
+		return errors.New("The federation service is already registered")
+	}
+	fed := newFederation(handler, area, areaVersion, service)
+	err := handler.cctx.RegisterSubmitHandler(area, areaVersion, service, FEDERATION_SERVICE_LINK, func(msg *Message, t Transaction) error {
+		params, err := decodeParameters(msg.Body, NullIdentifier, NullURIList)
+		if err != nil {
+			return err
+		}
+		route := *params[1].(*URIList)
+		if len(route) == 0 {
+			return NewMalError(ERROR_BAD_ENCODING, NewString("Empty route"))
+		}
+		fed.link(subkey(string(*msg.UriFrom), string(*params[0].(*Identifier))), route)
+		return t.(SubmitTransaction).Ack(nil, false)
+	})
+	if err != nil {
+		fed.close()
+		return err
+	}
+	handler.federation = fed
+	return nil
+}
+
+// Links the broker to a peer broker of the same service, the federation service must be
+// registered (see RegisterFederationService). The broker subscribes to the peer on behalf of
+// its subscriptions, then forwards them the updates published on the peer. The links are
+// unidirectional, the peer must be linked to this broker to receive the updates published on
+// it.
+func (handler *BrokerHandler) AddPeer(peer *URI) error {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.federation == nil {
+		return errors.New("The federation service is not registered")
+	}
+	handler.federation.addPeer(peer)
+	// The requests of all buckets are registered to the new peer
+	for bkey := range handler.index.buckets {
+		handler.federation.touch(bkey)
+	}
+	return nil
+}
+
+func (handler *BrokerHandler) getFederation() *federation {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	return handler.federation
+}
+
+// Marks the buckets of a subscription as modified, the lock must be held.
+func (handler *BrokerHandler) touchFederation(sub *BrokerSub) {
+	if handler.federation == nil {
+		return
+	}
+	for _, entry := range handler.index.entries[sub] {
+		handler.federation.touch(entry.bucket.bkey)
+	}
+}
+
+// Reports whether the URI is in the route.
+func inRoute(route URIList, uri *URI) bool {
+	for _, u := range route {
+		if *u == *uri {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the key of a route, the subscriptions of a bucket with the same route are
+// registered together.
+func routeKey(route URIList) string {
+	uris := make([]string, 0, len(route))
+	for _, uri := range route {
+		uris = append(uris, string(*uri))
+	}
+	return strings.Join(uris, " ")
+}
+
+// Returns the subscriptions to register to a peer for a bucket by route (see routeKey): the
+// subscriptions of the bucket are aggregated by route, except the ones whose route contains
+// the peer.
+func (handler *BrokerHandler) federationRequests(bkey bucketKey, peer *URI) map[string]*peerRequest {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	requests := make(map[string]*peerRequest)
+	bucket := handler.index.buckets[bkey]
+	if bucket == nil {
+		return requests
+	}
+	for _, entry := range bucket.entries() {
+		if inRoute(entry.sub.route, peer) {
+			continue
+		}
+		rkey := routeKey(entry.sub.route)
+		preq := requests[rkey]
+		if preq == nil {
+			// The registration message has an empty domain, so the subdomain of the request
+			// is the complete domain of the bucket.
+			domain := append(IdentifierList(nil), bucket.domain...)
+			preq = &peerRequest{
+				request: &EntityRequest{
+					SubDomain:     &domain,
+					AllAreas:      Boolean(bkey.area == anyId),
+					AllServices:   Boolean(bkey.service == anyId),
+					AllOperations: Boolean(bkey.operation == anyId),
+					OnlyOnChange:  false,
+				},
+				model: entry.sub,
+				route: append(URIList{handler.Uri()}, entry.sub.route...),
+			}
+			requests[rkey] = preq
+		}
+		preq.request.EntityKeys = append(preq.request.EntityKeys, entry.key)
+	}
+	return requests
+}
+
+// Returns the trace of a new publication of the broker. The sequence numbers start from the
+// start time of the broker, so that they keep increasing when it restarts.
+func (handler *BrokerHandler) newTrace() *fedTrace {
+	return &fedTrace{origin: *handler.Uri(), seq: ULong(atomic.AddUint64(&handler.seq, 1))}
+}
+
+// Adds the trace of the publication at the end of a notify sent to a peer.
+func encodeTrace(body Body, trace *fedTrace) error {
+	if err := body.EncodeParameter(&trace.origin); err != nil {
+		return err
+	}
+	return body.EncodeLastParameter(&trace.seq, false)
+}
+
+func decodeTrace(body Body) (*fedTrace, error) {
+	params, err := decodeParameters(body, NullURI, NullULong)
+	if err != nil {
+		return nil, err
+	}
+	return &fedTrace{origin: *params[0].(*URI), seq: *params[1].(*ULong)}, nil
+}
+
+// Forwards the updates notified by a peer broker to the subscriptions of the bucket, except
+// the ones of the brokers which already have them.
+func (handler *BrokerHandler) forward(bkey bucketKey, peer *URI, msg *Message) {
+	_, err := msg.DecodeParameter(NullIdentifier)
+	if err != nil {
+		logger.Warnf("Broker: cannot decode notify from %s: %s", *msg.UriFrom, err)
+		return
+	}
+	p, err := msg.DecodeParameter(NullUpdateHeaderList)
+	if err != nil {
+		logger.Warnf("Broker: cannot decode notify from %s: %s", *msg.UriFrom, err)
+		return
+	}
+	uhlist := p.(*UpdateHeaderList)
+	updtHandler, release := handler.newUpdateValueHandler()
+	defer release()
+	err = updtHandler.DecodeUpdateValueList(msg.Body)
+	if err != nil {
+		logger.Warnf("Broker: cannot decode notify from %s: %s", *msg.UriFrom, err)
+		return
+	}
+	if updtHandler.UpdateValueListSize() != len(*uhlist) {
+		logger.Warnf("Broker: bad notify from %s, %d values for %d updates", *msg.UriFrom, updtHandler.UpdateValueListSize(), len(*uhlist))
+		return
+	}
+	trace, err := decodeTrace(msg.Body)
+	if err != nil {
+		logger.Warnf("Broker: cannot decode notify from %s: %s", *msg.UriFrom, err)
+		return
+	}
+	if !handler.getFederation().first(bkey, trace) {
+		return
+	}
+
+	handler.lock.RLock()
+	var matches []*subMatch
+	if bucket := handler.index.buckets[bkey]; bucket != nil {
+		matches = matchBuckets([]*keyBucket{bucket}, uhlist)
+	}
+	handler.lock.RUnlock()
+	forwarded := matches[:0]
+	for _, match := range matches {
+		if !inRoute(match.sub.route, &trace.origin) && !inRoute(match.sub.route, peer) {
+			forwarded = append(forwarded, match)
+		}
+	}
+	handler.notifyMatches(forwarded, msg.Domain, uhlist, updtHandler, trace)
+}
+
+func (fed *federation) addPeer(uri *URI) {
+	fed.lock.Lock()
+	defer fed.lock.Unlock()
+	fed.peers = append(fed.peers, &peerLink{uri: uri, subs: make(map[bucketKey]map[string]AsyncOperation)})
+}
+
+// Memorizes the route declared by a peer for its next registration of the subscription.
+func (fed *federation) link(key string, route URIList) {
+	fed.lock.Lock()
+	defer fed.lock.Unlock()
+	fed.links[key] = route
+}
+
+// Returns the route declared by a peer for a subscription it registers, nil if the
+// subscription is not registered by a peer.
+func (fed *federation) route(key string) URIList {
+	fed.lock.Lock()
+	defer fed.lock.Unlock()
+	route := fed.links[key]
+	delete(fed.links, key)
+	return route
+}
+
+// Reports whether a publication is received for the first time for the bucket, and
+// memorizes it. The publications of the broker itself are never received again.
+func (fed *federation) first(bkey bucketKey, trace *fedTrace) bool {
+	if trace.origin == *fed.handler.Uri() {
+		return false
+	}
+	fed.lock.Lock()
+	defer fed.lock.Unlock()
+	tkey := traceKey{origin: trace.origin, bkey: bkey}
+	seen := fed.seen[tkey]
+	if seen == nil {
+		seen = &seenPublications{seqs: make(map[ULong]bool)}
+		fed.seen[tkey] = seen
+	}
+	if (trace.seq+federationWindow <= seen.max) || seen.seqs[trace.seq] {
+		return false
+	}
+	if trace.seq > seen.max {
+		if trace.seq-seen.max >= federationWindow {
+			seen.seqs = make(map[ULong]bool)
+		} else {
+			for seq := seen.max + 1; seq <= trace.seq; seq++ {
+				delete(seen.seqs, seq-federationWindow)
+			}
+		}
+		seen.max = trace.seq
+	}
+	seen.seqs[trace.seq] = true
+	return true
+}
+
+func (fed *federation) touch(bkey bucketKey) {
+	fed.lock.Lock()
+	defer fed.lock.Unlock()
+	fed.dirty[bkey] = true
+	fed.cond.Signal()
+}
+
+// Updates the subscriptions of the peers, the registrations are done by this goroutine so that
+// the handling of the local registrations never waits for a peer.
+func (fed *federation) run() {
+	defer close(fed.done)
+	for {
+		fed.lock.Lock()
+		for (len(fed.dirty) == 0) && !fed.closed {
+			fed.cond.Wait()
+		}
+		peers := append([]*peerLink(nil), fed.peers...)
+		if fed.closed {
+			fed.lock.Unlock()
+			for _, peer := range peers {
+				for bkey, ops := range peer.subs {
+					for rkey, op := range ops {
+						fed.deregister(fed.id(bkey, rkey), op)
+					}
+				}
+			}
+			return
+		}
+		dirty := fed.dirty
+		fed.dirty = make(map[bucketKey]bool)
+		fed.lock.Unlock()
+
+		for bkey := range dirty {
+			fed.update(bkey, peers)
+		}
+	}
+}
+
+func (fed *federation) id(bkey bucketKey, rkey string) Identifier {
+	ids := fed.ids[bkey]
+	if ids == nil {
+		ids = make(map[string]Identifier)
+		fed.ids[bkey] = ids
+	}
+	id, ok := ids[rkey]
+	if !ok {
+		id = Identifier(federationPrefix + strconv.Itoa(int(atomic.AddUint32(&federationCounter, 1))))
+		ids[rkey] = id
+	}
+	return id
+}
+
+// Registers anew the subscriptions of the bucket to each peer, and deregisters the ones of
+// the routes without subscription.
+func (fed *federation) update(bkey bucketKey, peers []*peerLink) {
+	for _, peer := range peers {
+		requests := fed.handler.federationRequests(bkey, peer.uri)
+		ops := peer.subs[bkey]
+		if ops == nil {
+			ops = make(map[string]AsyncOperation)
+			peer.subs[bkey] = ops
+		}
+		for rkey, old := range ops {
+			if requests[rkey] == nil {
+				delete(ops, rkey)
+				fed.deregister(fed.id(bkey, rkey), old)
+			}
+		}
+		for rkey, preq := range requests {
+			// The new registration replaces the previous one, which has the same identifier
+			op, err := fed.register(peer, bkey, fed.id(bkey, rkey), preq)
+			if err != nil {
+				logger.Warnf("Broker: cannot register subscription %s to peer %s: %s", fed.id(bkey, rkey), *peer.uri, err)
+				continue
+			}
+			if old := ops[rkey]; old != nil {
+				old.Close()
+			}
+			ops[rkey] = op
+		}
+		if len(ops) == 0 {
+			delete(peer.subs, bkey)
+		}
+	}
+}
+
+func (fed *federation) clientContext(bkey bucketKey) (*ClientContext, error) {
+	fed.lock.Lock()
+	defer fed.lock.Unlock()
+	if fed.closed {
+		return nil, NewMalError(ERROR_SHUTDOWN)
+	}
+	skey := sessionKey{bkey.session, bkey.sessionName}
+	cctx := fed.cctxs[skey]
+	if cctx == nil {
+		var err error
+		ctx := fed.handler.cctx.Ctx
+		service := strings.TrimPrefix(string(*fed.handler.cctx.Uri), string(*ctx.NewURI("")))
+		name := service + "/" + federationName + strconv.Itoa(int(atomic.AddUint32(&federationCounter, 1)))
+		cctx, err = NewClientContext(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		cctx.SetSession(bkey.session)
+		cctx.SetSessionName(bkey.sessionName)
+		fed.cctxs[skey] = cctx
+	}
+	return cctx, nil
+}
+
+// Waits for the completion of a future sent to a peer.
+func waitPeer(future *Future) error {
+	select {
+	case <-future.Done():
+		_, err := future.Get()
+		return err
+	case <-time.After(federationTimeout):
+		return NewMalError(ERROR_DELIVERY_TIMEDOUT)
+	}
+}
+
+// Declares the route of a subscription to the peer through its federation service.
+func (fed *federation) declare(cctx *ClientContext, peer *peerLink, id Identifier, route URIList) error {
+	op := cctx.NewAsyncOperation(peer.uri, fed.area, fed.areaVersion, fed.service, FEDERATION_SERVICE_LINK, nil)
+	defer op.Close()
+	body := op.NewBody()
+	body.EncodeParameter(&id)
+	body.EncodeLastParameter(&route, false)
+	future, err := op.Submit(body)
+	if err != nil {
+		return err
+	}
+	return waitPeer(future)
+}
+
+func (fed *federation) register(peer *peerLink, bkey bucketKey, id Identifier, preq *peerRequest) (AsyncOperation, error) {
+	cctx, err := fed.clientContext(bkey)
+	if err != nil {
+		return nil, err
+	}
+	if err := fed.declare(cctx, peer, id, preq.route); err != nil {
+		return nil, err
+	}
+	callbacks := &AsyncCallbacks{
+		OnNotify: func(msg *Message) {
+			fed.handler.forward(bkey, peer.uri, msg)
+		},
+		OnError: func(msg *Message, err error) {
+			if msg != nil {
+				logger.Warnf("Broker: subscription to peer %s fails: %s", *peer.uri, err)
+			}
+		},
+	}
+	// The model may be a keyed subscription, so the area version is the one of the broker
+	model := preq.model
+	op := cctx.NewAsyncOperation(peer.uri, model.serviceArea, fed.handler.areaVersion, model.service, model.operation, callbacks)
+	body := op.NewBody()
+	subs := &Subscription{id, EntityRequestList([]*EntityRequest{preq.request})}
+	body.EncodeLastParameter(subs, false)
+	future, err := op.Register(body)
+	if err == nil {
+		err = waitPeer(future)
+	}
+	if err != nil {
+		op.Close()
+		return nil, err
+	}
+	return op, nil
+}
+
+func (fed *federation) deregister(id Identifier, op AsyncOperation) {
+	body := op.NewBody()
+	idlist := IdentifierList([]*Identifier{&id})
+	body.EncodeLastParameter(&idlist, false)
+	future, err := op.Deregister(body)
+	if err == nil {
+		// The error acknowledge of the broker is ignored (see OnDeregister)
+		waitPeer(future)
+	}
+	op.Close()
+}
+
+// Deregisters the subscriptions from the peers, then closes the ClientContexts.
+func (fed *federation) close() {
+	fed.lock.Lock()
+	fed.closed = true
+	fed.cond.Broadcast()
+	fed.lock.Unlock()
+	<-fed.done
+
+	fed.lock.Lock()
+	cctxs := fed.cctxs
+	fed.cctxs = nil
+	fed.lock.Unlock()
+	for _, cctx := range cctxs {
+		cctx.Close()
+	}
+}
@@ -0,0 +1,249 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp"  // Needed to initialize TCP transport factory
+	"testing"
+	"time"
+)
+
+// A site with a local broker and a subscriber to all keys of this broker.
+type fedSite struct {
+	broker *LocalBroker
+	subop  SubscriberOperation
+}
+
+func newFedSite(t *testing.T, broker_url string, subscriber_url string) *fedSite {
+	broker_ctx, err := NewContext(broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	t.Cleanup(func() { broker_ctx.Close() })
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	t.Cleanup(broker.Close)
+	if err := broker.RegisterFederationService(200, 1, 3); err != nil {
+		t.Fatal("Error registering federation service, ", err)
+	}
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+
+	sub_ctx, err := NewContext(subscriber_url)
+	if err != nil {
+		t.Fatal("Error creating subscriber context, ", err)
+	}
+	t.Cleanup(func() { sub_ctx.Close() })
+	subscriber, err := NewClientContext(sub_ctx, "subscriber")
+	if err != nil {
+		t.Fatal("Error creating subscriber, ", err)
+	}
+	t.Cleanup(func() { subscriber.Close() })
+	return &fedSite{broker: broker, subop: subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)}
+}
+
+// Links the broker of the site to the broker of the peer site.
+func (site *fedSite) link(t *testing.T, peer *fedSite) {
+	if err := site.broker.AddPeer(peer.broker.Uri()); err != nil {
+		t.Fatal("Error adding peer, ", err)
+	}
+}
+
+func (site *fedSite) subscribe(t *testing.T) {
+	site.subscribeAs(t, Identifier("AllKeys"))
+}
+
+func (site *fedSite) subscribeAs(t *testing.T, subid Identifier) {
+	body := site.subop.NewBody()
+	eksub := &EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}
+	erlist := EntityRequestList([]*EntityRequest{
+		&EntityRequest{nil, false, false, false, false, EntityKeyList([]*EntityKey{eksub})},
+	})
+	body.EncodeLastParameter(&Subscription{subid, erlist}, false)
+	_, err := site.subop.Register(body)
+	if err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+}
+
+func (site *fedSite) publish(t *testing.T, key string, value byte) {
+	ekey := &EntityKey{NewIdentifier(key), NewLong(1), NewLong(1), NewLong(1)}
+	hdrs := UpdateHeaderList([]*UpdateHeader{&UpdateHeader{*TimeNow(), *site.broker.Uri(), MAL_UPDATETYPE_CREATION, *ekey}})
+	values := BlobList([]*Blob{&Blob{value}})
+	if err := site.broker.Publish(&hdrs, &values); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+}
+
+// Returns the values notified to the subscriber until the timeout.
+func (site *fedSite) notified(t *testing.T) []byte {
+	values := make([]byte, 0)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		msg, err := site.subop.GetNotifyWithContext(ctx)
+		cancel()
+		if errors.Is(err, ErrDeliveryTimedOut) {
+			return values
+		}
+		if err != nil {
+			t.Fatal("Error in GetNotify, ", err)
+		}
+		msg.DecodeParameter(NullIdentifier)
+		msg.DecodeParameter(NullUpdateHeaderList)
+		p, err := msg.DecodeLastParameter(NullBlobList, false)
+		if err != nil {
+			t.Fatal("Error decoding notify, ", err)
+		}
+		for _, blob := range *p.(*BlobList) {
+			values = append(values, (*blob)[0])
+		}
+	}
+}
+
+// Links 2 brokers to each other, each subscriber must receive once the updates published on
+// both brokers.
+func testFederation(t *testing.T, site1 *fedSite, site2 *fedSite) {
+	site1.link(t, site2)
+	site2.link(t, site1)
+	site1.subscribe(t)
+	site2.subscribe(t)
+	// Waits for the registration of the subscriptions to the peers
+	time.Sleep(500 * time.Millisecond)
+
+	site1.publish(t, "key1", 1)
+	site2.publish(t, "key2", 2)
+
+	for i, site := range []*fedSite{site1, site2} {
+		values := site.notified(t)
+		if (len(values) != 2) || (values[0]+values[1] != 3) || (values[0]*values[1] != 2) {
+			t.Errorf("Subscriber#%d, bad notified values: %v", i+1, values)
+		}
+	}
+}
+
+func TestFederationTCP(t *testing.T) {
+	site1 := newFedSite(t, "maltcp://127.0.0.1:16055", "maltcp://127.0.0.1:16056")
+	site2 := newFedSite(t, "maltcp://127.0.0.1:16057", "maltcp://127.0.0.1:16058")
+	testFederation(t, site1, site2)
+}
+
+func TestFederationInVM(t *testing.T) {
+	site1 := newFedSite(t, "invm://fed_broker1", "invm://fed_subscriber1")
+	site2 := newFedSite(t, "invm://fed_broker2", "invm://fed_subscriber2")
+	testFederation(t, site1, site2)
+}
+
+// Links 3 brokers in a chain, the updates published on the first one are forwarded to the
+// subscriber of the last one. The identifier of its subscription does not make it a peer.
+func TestFederationChain(t *testing.T) {
+	site1 := newFedSite(t, "invm://chain_broker1", "invm://chain_subscriber1")
+	site2 := newFedSite(t, "invm://chain_broker2", "invm://chain_subscriber2")
+	site3 := newFedSite(t, "invm://chain_broker3", "invm://chain_subscriber3")
+	site2.link(t, site1)
+	site3.link(t, site2)
+	site3.subscribeAs(t, Identifier("federation/1"))
+	// Waits for the registration of the subscriptions along the chain
+	time.Sleep(500 * time.Millisecond)
+
+	site1.publish(t, "key1", 1)
+	if values := site3.notified(t); (len(values) != 1) || (values[0] != 1) {
+		t.Errorf("Bad notified values: %v", values)
+	}
+}
+
+// Checks that each subscriber receives once the values published on all sites.
+func checkFedValues(t *testing.T, sites []*fedSite, expected int) {
+	for i, site := range sites {
+		values := site.notified(t)
+		if len(values) != expected {
+			t.Errorf("Subscriber#%d, bad notified values: %v", i+1, values)
+			continue
+		}
+		received := make(map[byte]bool)
+		for _, value := range values {
+			received[value] = true
+		}
+		if len(received) != expected {
+			t.Errorf("Subscriber#%d, duplicate notified values: %v", i+1, values)
+		}
+	}
+}
+
+// Links 3 brokers in a ring of unidirectional links, the updates are not forwarded endlessly
+// and each subscriber receives once the updates published on each broker.
+func TestFederationRing(t *testing.T) {
+	sites := []*fedSite{
+		newFedSite(t, "invm://ring_broker1", "invm://ring_subscriber1"),
+		newFedSite(t, "invm://ring_broker2", "invm://ring_subscriber2"),
+		newFedSite(t, "invm://ring_broker3", "invm://ring_subscriber3"),
+	}
+	sites[1].link(t, sites[0])
+	sites[2].link(t, sites[1])
+	sites[0].link(t, sites[2])
+	for _, site := range sites {
+		site.subscribe(t)
+	}
+	// Waits for the registration of the subscriptions around the ring
+	time.Sleep(time.Second)
+
+	for i, site := range sites {
+		site.publish(t, "key", byte(i+1))
+	}
+	checkFedValues(t, sites, 3)
+}
+
+// Links 4 brokers in a diamond, the subscriber of the last broker receives once the updates
+// of the first one although they are forwarded along 2 paths.
+func TestFederationDiamond(t *testing.T) {
+	sites := []*fedSite{
+		newFedSite(t, "invm://diamond_broker1", "invm://diamond_subscriber1"),
+		newFedSite(t, "invm://diamond_broker2", "invm://diamond_subscriber2"),
+		newFedSite(t, "invm://diamond_broker3", "invm://diamond_subscriber3"),
+		newFedSite(t, "invm://diamond_broker4", "invm://diamond_subscriber4"),
+	}
+	sites[1].link(t, sites[0])
+	sites[2].link(t, sites[0])
+	sites[3].link(t, sites[1])
+	sites[3].link(t, sites[2])
+	for _, site := range sites {
+		site.subscribe(t)
+	}
+	// Waits for the registration of the subscriptions along the paths
+	time.Sleep(time.Second)
+
+	sites[0].publish(t, "key", 1)
+	checkFedValues(t, sites, 1)
+}
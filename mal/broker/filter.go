@@ -0,0 +1,518 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Change detection of a subscription: an update is notified only if its numeric field changes
+// by more than the threshold since the last notified value of the same key, the first value of
+// a key is always notified (see SetSubscriptionChange). The field is designated as in a
+// CompositeFilter.
+type ChangeFilter struct {
+	Field     string
+	Threshold float64
+}
+
+// Value filters and change detection of a subscription, the updates must match all the
+// filters.
+type subFilter struct {
+	lock    sync.Mutex
+	filters []*archive.CompositeFilter
+	change  *ChangeFilter
+	// Last notified value of each key for the change detection, it is only allocated once
+	// filters are given (see copyFrom)
+	last map[keyValue]float64
+}
+
+func (f *subFilter) set(filters []*archive.CompositeFilter) {
+	f.lock.Lock()
+	f.filters = filters
+	if f.last == nil {
+		f.last = make(map[keyValue]float64)
+	}
+	f.lock.Unlock()
+}
+
+func (f *subFilter) add(filter *archive.CompositeFilter) {
+	f.lock.Lock()
+	f.filters = append(append([]*archive.CompositeFilter(nil), f.filters...), filter)
+	f.lock.Unlock()
+}
+
+// Sets the change detection, nil removes it. The last notified values are forgotten.
+func (f *subFilter) setChange(change *ChangeFilter) {
+	f.lock.Lock()
+	f.change = change
+	f.last = make(map[keyValue]float64)
+	f.lock.Unlock()
+}
+
+// Returns the filters and the change detection.
+func (f *subFilter) get() ([]*archive.CompositeFilter, *ChangeFilter) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.filters, f.change
+}
+
+// Keeps the filters of a replaced subscription, unless filters were given with the new
+// registration.
+func (f *subFilter) copyFrom(old *subFilter) {
+	f.lock.Lock()
+	given := f.last != nil
+	f.lock.Unlock()
+	if given {
+		return
+	}
+	filters, change := old.get()
+	f.set(filters)
+	f.setChange(change)
+}
+
+// Returns the updates matching the filters.
+func (f *subFilter) apply(uhlist *UpdateHeaderList, updtHandler UpdateValueHandler, updates []int) []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if (len(f.filters) == 0) && (f.change == nil) {
+		return updates
+	}
+	generic, ok := updtHandler.(*GenericUpdateValueHandler)
+	if !ok {
+		return nil
+	}
+	matching := make([]int, 0, len(updates))
+	for _, idx := range updates {
+		values := generic.GetUpdateValues(idx)
+		matches := true
+		for _, filter := range f.filters {
+			field, ok := fieldValue(values, string(filter.FieldName))
+			if matches = ok && compare(field, filter.Type, filter.FieldValue); !matches {
+				break
+			}
+		}
+		if matches && (f.change != nil) {
+			key := newKeyValue(&(*uhlist)[idx].Key)
+			field, ok := fieldValue(values, f.change.Field)
+			var value float64
+			if ok {
+				value, ok = toFloat(field)
+			}
+			last, seen := f.last[key]
+			if matches = ok && (!seen || (math.Abs(value-last) > f.change.Threshold)); matches {
+				f.last[key] = value
+			}
+		}
+		if matches {
+			matching = append(matching, idx)
+		}
+	}
+	return matching
+}
+
+// Returns the field designated by the name in the update values.
+func fieldValue(values []Element, name string) (reflect.Value, bool) {
+	var path []string
+	if name != "" {
+		path = strings.Split(name, ".")
+	}
+	list := 0
+	if len(path) > 0 {
+		if n, err := strconv.Atoi(path[0]); err == nil {
+			list = n
+			path = path[1:]
+		}
+	}
+	if (list < 0) || (list >= len(values)) || (values[list] == nil) {
+		return reflect.Value{}, false
+	}
+	value := reflect.ValueOf(values[list])
+	for _, field := range path {
+		value = reflect.Indirect(value)
+		if value.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		value = value.FieldByName(field)
+		if !value.IsValid() {
+			return reflect.Value{}, false
+		}
+	}
+	value = reflect.Indirect(value)
+	return value, value.IsValid()
+}
+
+func toFloat(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
+
+// Compares the field to the value of the filter, values of different kinds never match.
+func compare(field reflect.Value, op archive.ExpressionOperator, attr Attribute) bool {
+	ref := reflect.Indirect(reflect.ValueOf(attr))
+	var cmp int
+	if x, ok := toFloat(field); ok {
+		y, ok := toFloat(ref)
+		if !ok {
+			return false
+		}
+		if x < y {
+			cmp = -1
+		} else if x > y {
+			cmp = 1
+		}
+	} else if field.Kind() == reflect.String {
+		if ref.Kind() != reflect.String {
+			return false
+		}
+		switch op {
+		case archive.EXPRESSIONOPERATOR_CONTAINS:
+			return strings.Contains(field.String(), ref.String())
+		case archive.EXPRESSIONOPERATOR_ICONTAINS:
+			return strings.Contains(strings.ToLower(field.String()), strings.ToLower(ref.String()))
+		}
+		cmp = strings.Compare(field.String(), ref.String())
+	} else if field.Kind() == reflect.Bool {
+		if ref.Kind() != reflect.Bool {
+			return false
+		}
+		if field.Bool() != ref.Bool() {
+			cmp = 1
+		}
+		if (op != archive.EXPRESSIONOPERATOR_EQUAL) && (op != archive.EXPRESSIONOPERATOR_DIFFER) {
+			return false
+		}
+	} else if (field.Kind() == reflect.Slice) && (field.Type().Elem().Kind() == reflect.Uint8) {
+		if (ref.Kind() != reflect.Slice) || (ref.Type().Elem().Kind() != reflect.Uint8) {
+			return false
+		}
+		cmp = bytes.Compare(field.Bytes(), ref.Bytes())
+	} else {
+		return false
+	}
+
+	switch op {
+	case archive.EXPRESSIONOPERATOR_EQUAL:
+		return cmp == 0
+	case archive.EXPRESSIONOPERATOR_DIFFER:
+		return cmp != 0
+	case archive.EXPRESSIONOPERATOR_GREATER:
+		return cmp > 0
+	case archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL:
+		return cmp >= 0
+	case archive.EXPRESSIONOPERATOR_LESS:
+		return cmp < 0
+	case archive.EXPRESSIONOPERATOR_LESS_OR_EQUAL:
+		return cmp <= 0
+	}
+	return false
+}
+
+func checkFilter(filter *archive.CompositeFilter) error {
+	if _, err := archive.ExpressionOperatorFromNumericValue(uint32(filter.Type)); err != nil {
+		return err
+	}
+	if (filter.FieldValue == nil) || filter.FieldValue.IsNull() {
+		return errors.New("Null filter value")
+	}
+	return nil
+}
+
+// Verifies that the filters can be evaluated by the broker.
+func (handler *BrokerHandler) checkFilters(filters []*archive.CompositeFilter) error {
+	if _, ok := handler.updtHandler.(*GenericUpdateValueHandler); !ok {
+		return NewMalError(ERROR_UNSUPPORTED_OPERATION, NewString("Value filters need a GenericUpdateValueHandler"))
+	}
+	for _, filter := range filters {
+		if filter == nil {
+			return NewMalError(ERROR_BAD_ENCODING, NewString("Null filter"))
+		}
+		if err := checkFilter(filter); err != nil {
+			return NewMalError(ERROR_BAD_ENCODING, NewString(err.Error()))
+		}
+	}
+	return nil
+}
+
+// Sets the value filters given with the registration of a new subscription, so that they
+// apply to all its notifications including the initial ones of the last value cache.
+func (handler *BrokerHandler) setRegisterFilters(sub *BrokerSub, filters *archive.CompositeFilterList) error {
+	if filters == nil {
+		return nil
+	}
+	if err := handler.checkFilters(*filters); err != nil {
+		return err
+	}
+	sub.filter.set(append([]*archive.CompositeFilter(nil), *filters...))
+	return nil
+}
+
+// Enables the registration of subscriptions with value filters for the clients of the broker
+// using the specified area version (see RegisterWithFilters): the body of their REGISTER
+// message is the Subscription followed by a CompositeFilterList, NULL if there is no filter.
+// The other messages of these clients are handled as those of the broker operation.
+func (handler *BrokerHandler) EnableRegisterFilters(area UShort, areaVersion UOctet, service UShort, operation UShort) error {
+	return handler.cctx.RegisterBrokerHandler(area, areaVersion, service, operation, func(msg *Message, t Transaction) error {
+		handler.touch(msg.UriFrom)
+		if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH_REGISTER {
+			handler.OnPublishRegister(msg, t.(PublisherTransaction))
+		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH {
+			handler.OnPublish(msg, t.(PublisherTransaction))
+		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH_DEREGISTER {
+			handler.OnPublishDeregister(msg, t.(PublisherTransaction))
+		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_REGISTER {
+			handler.OnFilteredRegister(msg, t.(SubscriberTransaction))
+		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_DEREGISTER {
+			handler.OnDeregister(msg, t.(SubscriberTransaction))
+		} else {
+			return errors.New("Bad stage")
+		}
+		return nil
+	})
+}
+
+func (handler *BrokerHandler) filteredRegister(msg *Message, transaction SubscriberTransaction) (*BrokerSub, error) {
+	p, err := msg.DecodeParameter(NullSubscription)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil || p.IsNull() {
+		return nil, NewMalError(ERROR_BAD_ENCODING, NewString("Null subscription"))
+	}
+	f, err := msg.DecodeLastParameter(archive.NullCompositeFilterList, false)
+	if err != nil {
+		return nil, err
+	}
+	var filters *archive.CompositeFilterList
+	if (f != nil) && !f.IsNull() {
+		filters = f.(*archive.CompositeFilterList)
+	}
+	return handler.registerSub(msg, p.(*Subscription), filters, transaction)
+}
+
+func (handler *BrokerHandler) OnFilteredRegister(msg *Message, transaction SubscriberTransaction) error {
+	sub, err := handler.filteredRegister(msg, transaction)
+	if err != nil {
+		return transaction.AckRegister(errorBody(transaction, err), true)
+	}
+	err = transaction.AckRegister(nil, false)
+	if err != nil {
+		return err
+	}
+	handler.sendLastValues(sub)
+	return nil
+}
+
+// Registers a subscription with its value filters to a broker enabling them (see
+// EnableRegisterFilters), the filters may be nil.
+func RegisterWithFilters(op SubscriberOperation, sub *Subscription, filters *archive.CompositeFilterList) (*Message, error) {
+	body := op.NewBody()
+	err := body.EncodeParameter(sub)
+	if err != nil {
+		return nil, err
+	}
+	if filters == nil {
+		filters = archive.NullCompositeFilterList
+	}
+	err = body.EncodeLastParameter(filters, false)
+	if err != nil {
+		return nil, err
+	}
+	return op.Register(body)
+}
+
+// Sets the value filters of a subscription, replacing the previous ones, an empty list
+// removes the filters. The filters are kept when the subscription is registered anew without
+// filters. They can only be evaluated on the values of a GenericUpdateValueHandler, otherwise
+// an UNSUPPORTED_OPERATION error is returned. An UNKNOWN error is returned if there is no such
+// subscription.
+func (handler *BrokerHandler) SetSubscriptionFilters(subscriber *URI, subid Identifier, filters ...*archive.CompositeFilter) error {
+	sub, err := handler.filteredSub(subscriber, subid, filters)
+	if err != nil {
+		return err
+	}
+	sub.filter.set(append([]*archive.CompositeFilter(nil), filters...))
+	handler.saveSub(sub)
+	return nil
+}
+
+// Adds a value filter to a subscription.
+func (handler *BrokerHandler) addSubscriptionFilter(subscriber *URI, subid Identifier, filter *archive.CompositeFilter) error {
+	sub, err := handler.filteredSub(subscriber, subid, []*archive.CompositeFilter{filter})
+	if err != nil {
+		return err
+	}
+	sub.filter.add(filter)
+	handler.saveSub(sub)
+	return nil
+}
+
+// Sets the change detection of a subscription (see ChangeFilter), nil removes it. Like the
+// value filters it needs a GenericUpdateValueHandler, otherwise an UNSUPPORTED_OPERATION error
+// is returned. An UNKNOWN error is returned if there is no such subscription.
+func (handler *BrokerHandler) SetSubscriptionChange(subscriber *URI, subid Identifier, change *ChangeFilter) error {
+	if (change != nil) && (change.Threshold < 0) {
+		return NewMalError(ERROR_BAD_ENCODING, NewString("Negative change threshold"))
+	}
+	sub, err := handler.filteredSub(subscriber, subid, nil)
+	if err != nil {
+		return err
+	}
+	sub.filter.setChange(change)
+	handler.saveSub(sub)
+	return nil
+}
+
+// Verifies the filters and returns the subscription they apply to.
+func (handler *BrokerHandler) filteredSub(subscriber *URI, subid Identifier, filters []*archive.CompositeFilter) (*BrokerSub, error) {
+	if err := handler.checkFilters(filters); err != nil {
+		return nil, err
+	}
+	key := subkey(string(*subscriber), string(subid))
+	handler.lock.RLock()
+	sub := handler.subs[key]
+	handler.lock.RUnlock()
+	if sub == nil {
+		return nil, NewMalError(ERROR_UNKNOWN, NewString(key))
+	}
+	return sub, nil
+}
+
+// Operations of the filter service of the broker (see RegisterFilterService), they use the
+// SUBMIT interaction pattern.
+const (
+	FILTER_SERVICE_ADD UShort = iota + 1
+	FILTER_SERVICE_CLEAR
+	FILTER_SERVICE_CHANGE
+)
+
+// Registers the filter service of the broker in its client context, so that the subscribers
+// can attach value filters to their subscriptions using a FilterConsumer.
+func (handler *BrokerHandler) RegisterFilterService(area UShort, areaVersion UOctet, service UShort) error {
+	err := handler.cctx.RegisterSubmitHandler(area, areaVersion, service, FILTER_SERVICE_ADD, func(msg *Message, t Transaction) error {
+		params, err := decodeParameters(msg.Body, NullIdentifier, archive.NullCompositeFilter)
+		if err != nil {
+			return err
+		}
+		if err := handler.addSubscriptionFilter(msg.UriFrom, *params[0].(*Identifier), params[1].(*archive.CompositeFilter)); err != nil {
+			return err
+		}
+		return t.(SubmitTransaction).Ack(nil, false)
+	})
+	if err != nil {
+		return err
+	}
+	err = handler.cctx.RegisterSubmitHandler(area, areaVersion, service, FILTER_SERVICE_CLEAR, func(msg *Message, t Transaction) error {
+		params, err := decodeParameters(msg.Body, NullIdentifier)
+		if err != nil {
+			return err
+		}
+		if err := handler.SetSubscriptionFilters(msg.UriFrom, *params[0].(*Identifier)); err != nil {
+			return err
+		}
+		return t.(SubmitTransaction).Ack(nil, false)
+	})
+	if err != nil {
+		return err
+	}
+	// The parameters are the subscription, the field and the threshold, a negative threshold
+	// removes the change detection.
+	return handler.cctx.RegisterSubmitHandler(area, areaVersion, service, FILTER_SERVICE_CHANGE, func(msg *Message, t Transaction) error {
+		params, err := decodeParameters(msg.Body, NullIdentifier, NullString, NullDouble)
+		if err != nil {
+			return err
+		}
+		var change *ChangeFilter
+		if threshold := float64(*params[2].(*Double)); threshold >= 0 {
+			change = &ChangeFilter{string(*params[1].(*String)), threshold}
+		}
+		if err := handler.SetSubscriptionChange(msg.UriFrom, *params[0].(*Identifier), change); err != nil {
+			return err
+		}
+		return t.(SubmitTransaction).Ack(nil, false)
+	})
+}
+
+// Client of the filter service of a remote broker (see RegisterFilterService), the filters
+// apply to the subscriptions registered by its client context.
+type FilterConsumer struct {
+	cctx        *ClientContext
+	broker      *URI
+	area        UShort
+	areaVersion UOctet
+	service     UShort
+}
+
+func NewFilterConsumer(cctx *ClientContext, broker *URI, area UShort, areaVersion UOctet, service UShort) *FilterConsumer {
+	return &FilterConsumer{cctx: cctx, broker: broker, area: area, areaVersion: areaVersion, service: service}
+}
+
+// Adds a value filter to a subscription.
+func (consumer *FilterConsumer) AddFilter(subid Identifier, filter *archive.CompositeFilter) error {
+	op := consumer.cctx.NewSubmitOperation(consumer.broker, consumer.area, consumer.areaVersion, consumer.service, FILTER_SERVICE_ADD)
+	body := op.NewBody()
+	body.EncodeParameter(&subid)
+	body.EncodeLastParameter(filter, false)
+	_, err := op.Submit(body)
+	return err
+}
+
+// Removes the value filters of a subscription.
+func (consumer *FilterConsumer) ClearFilters(subid Identifier) error {
+	op := consumer.cctx.NewSubmitOperation(consumer.broker, consumer.area, consumer.areaVersion, consumer.service, FILTER_SERVICE_CLEAR)
+	body := op.NewBody()
+	body.EncodeLastParameter(&subid, false)
+	_, err := op.Submit(body)
+	return err
+}
+
+// Sets the change detection of a subscription (see ChangeFilter), nil removes it.
+func (consumer *FilterConsumer) SetChange(subid Identifier, change *ChangeFilter) error {
+	field, threshold := NewString(""), NewDouble(-1)
+	if change != nil {
+		field, threshold = NewString(change.Field), NewDouble(change.Threshold)
+	}
+	op := consumer.cctx.NewSubmitOperation(consumer.broker, consumer.area, consumer.areaVersion, consumer.service, FILTER_SERVICE_CHANGE)
+	body := op.NewBody()
+	body.EncodeParameter(&subid)
+	body.EncodeParameter(field)
+	body.EncodeLastParameter(threshold, false)
+	_, err := op.Submit(body)
+	return err
+}
@@ -0,0 +1,295 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"context"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp"  // Needed to initialize TCP transport factory
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	filter_broker_url     = "maltcp://127.0.0.1:16072"
+	filter_subscriber_url = "maltcp://127.0.0.1:16073"
+	filter_register_url   = "maltcp://127.0.0.1:16083"
+)
+
+// Publishes a Long value for the key.
+func publishLong(t *testing.T, broker *LocalBroker, key string, value int64) {
+	hdrs := UpdateHeaderList([]*UpdateHeader{
+		&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_UPDATE, EntityKey{NewIdentifier(key), NewLong(1), NewLong(1), NewLong(1)}},
+	})
+	values := LongList([]*Long{NewLong(value)})
+	if err := broker.Publish(&hdrs, &values); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+}
+
+// Verifies the values of the next notifies, the filtered values would be notified first.
+func checkFilteredNotifies(t *testing.T, subop SubscriberOperation, expected ...int64) {
+	for _, value := range expected {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		msg, err := subop.GetNotifyWithContext(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal("Error in GetNotify, ", err)
+		}
+		msg.DecodeParameter(NullIdentifier)
+		msg.DecodeParameter(NullUpdateHeaderList)
+		p, err := msg.DecodeLastParameter(NullLongList, false)
+		if err != nil {
+			t.Fatal("Error decoding notify, ", err)
+		}
+		if longs := *p.(*LongList); (len(longs) != 1) || (*longs[0] != Long(value)) {
+			t.Errorf("Bad notified values %v, expect %d", longs, value)
+		}
+	}
+}
+
+func TestValueFilters(t *testing.T) {
+	broker_ctx, err := NewContext(filter_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, NewGenericUpdateValueHandler(NullLongList), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	if err := broker.RegisterFilterService(200, 1, 2); err != nil {
+		t.Fatal("Error registering filter service, ", err)
+	}
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+
+	sub_ctx, err := NewContext(filter_subscriber_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer sub_ctx.Close()
+	subscriber, err := NewClientContext(sub_ctx, "subscriber")
+	if err != nil {
+		t.Fatal("Error creating subscriber, ", err)
+	}
+	subop := subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body := subop.NewBody()
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, eklist}})
+	subid := Identifier("Filtered")
+	body.EncodeLastParameter(&Subscription{subid, erlist}, false)
+	if _, err := subop.Register(body); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+
+	// Threshold filter set locally
+	err = broker.SetSubscriptionFilters(subscriber.Uri, subid, &archive.CompositeFilter{"", archive.EXPRESSIONOPERATOR_GREATER, NewLong(10)})
+	if err != nil {
+		t.Fatal("Error setting filters, ", err)
+	}
+	publishLong(t, broker, "key1", 5)
+	publishLong(t, broker, "key1", 20)
+	checkFilteredNotifies(t, subop, 20)
+
+	// Invalid filters are rejected
+	err = broker.SetSubscriptionFilters(subscriber.Uri, subid, &archive.CompositeFilter{"", archive.ExpressionOperator(99), NewLong(1)})
+	if err == nil {
+		t.Error("Filter with an unknown operator should be rejected")
+	}
+	err = broker.SetSubscriptionChange(subscriber.Uri, subid, &ChangeFilter{"", -1})
+	if err == nil {
+		t.Error("Change detection with a negative threshold should be rejected")
+	}
+	err = broker.SetSubscriptionFilters(subscriber.Uri, Identifier("Unknown"))
+	if err == nil {
+		t.Error("Filters of an unknown subscription should be rejected")
+	}
+
+	// Change detection set remotely, the threshold filter is removed
+	consumer := NewFilterConsumer(subscriber, broker.Uri(), 200, 1, 2)
+	if err := consumer.ClearFilters(subid); err != nil {
+		t.Fatal("Error clearing filters, ", err)
+	}
+	if err := consumer.SetChange(subid, &ChangeFilter{"0", 5}); err != nil {
+		t.Fatal("Error setting change detection, ", err)
+	}
+	for _, value := range []int64{0, 3, 9, 6, 2} {
+		publishLong(t, broker, "key1", value)
+	}
+	publishLong(t, broker, "key2", 4)
+	checkFilteredNotifies(t, subop, 0, 9, 2, 4)
+
+	// Cancelling the wait ends the operation, so it is only checked last
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := subop.GetNotifyWithContext(ctx); err == nil {
+		t.Error("Unexpected notify")
+	}
+}
+
+// The filters given with the registration apply to the initial notifies of the last value
+// cache.
+func TestRegisterFilters(t *testing.T) {
+	broker_ctx, err := NewContext(filter_register_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, NewGenericUpdateValueHandler(NullLongList), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	broker.SetLastValueCache(10)
+	if err := broker.EnableRegisterFilters(200, 2, 1, 1); err != nil {
+		t.Fatal("Error enabling the registration with filters, ", err)
+	}
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+	publishLong(t, broker, "key1", 5)
+	publishLong(t, broker, "key2", 20)
+
+	subscriber, err := NewClientContext(broker_ctx, "subscriber")
+	if err != nil {
+		t.Fatal("Error creating subscriber, ", err)
+	}
+	defer subscriber.Close()
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, eklist}})
+	// Without filters the list is NULL
+	unfiltered := subscriber.NewSubscriberOperation(broker.Uri(), 200, 2, 1, 1)
+	if _, err := RegisterWithFilters(unfiltered, &Subscription{Identifier("Unfiltered"), erlist}, nil); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+	checkFilteredNotifies(t, unfiltered, 5, 20)
+
+	subop := subscriber.NewSubscriberOperation(broker.Uri(), 200, 2, 1, 1)
+	filters := archive.CompositeFilterList([]*archive.CompositeFilter{
+		&archive.CompositeFilter{"", archive.EXPRESSIONOPERATOR_GREATER, NewLong(10)},
+	})
+	if _, err := RegisterWithFilters(subop, &Subscription{Identifier("Filtered"), erlist}, &filters); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+	publishLong(t, broker, "key1", 8)
+	publishLong(t, broker, "key1", 30)
+	checkFilteredNotifies(t, subop, 20, 30)
+	checkFilteredNotifies(t, unfiltered, 8, 30)
+
+	// A filter without value is rejected with the registration
+	subop = subscriber.NewSubscriberOperation(broker.Uri(), 200, 2, 1, 1)
+	filters = archive.CompositeFilterList([]*archive.CompositeFilter{
+		&archive.CompositeFilter{"", archive.EXPRESSIONOPERATOR_GREATER, nil},
+	})
+	if _, err := RegisterWithFilters(subop, &Subscription{Identifier("Bad"), erlist}, &filters); err == nil {
+		t.Error("Registration with a bad filter should be rejected")
+	}
+}
+
+// Starts a broker restoring the registrations saved in the specified file.
+func startFilteredBroker(t *testing.T, path string) (*Context, *LocalBroker) {
+	ctx, err := NewContext("invm://fstore_broker")
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	cctx, err := NewClientContext(ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, NewGenericUpdateValueHandler(NullLongList), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("Error creating store, ", err)
+	}
+	if err := broker.SetRegistrationStore(store); err != nil {
+		t.Fatal("Error restoring registrations, ", err)
+	}
+	return ctx, broker
+}
+
+// The value filters and the change detection are saved with the subscription.
+func TestFilterStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrations.json")
+	broker_ctx, broker := startFilteredBroker(t, path)
+
+	sub_ctx, err := NewContext("invm://fstore_subscriber")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer sub_ctx.Close()
+	subscriber, err := NewClientContext(sub_ctx, "subscriber")
+	if err != nil {
+		t.Fatal("Error creating subscriber, ", err)
+	}
+	subop := subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body := subop.NewBody()
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, eklist}})
+	subid := Identifier("Filtered")
+	body.EncodeLastParameter(&Subscription{subid, erlist}, false)
+	if _, err := subop.Register(body); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+	err = broker.SetSubscriptionFilters(subscriber.Uri, subid, &archive.CompositeFilter{"", archive.EXPRESSIONOPERATOR_LESS, NewLong(100)})
+	if err != nil {
+		t.Fatal("Error setting filters, ", err)
+	}
+	if err := broker.SetSubscriptionChange(subscriber.Uri, subid, &ChangeFilter{"", 5}); err != nil {
+		t.Fatal("Error setting change detection, ", err)
+	}
+
+	// Restarts the broker, the subscriber does not register again
+	broker.Close()
+	broker_ctx.Close()
+	broker_ctx, broker = startFilteredBroker(t, path)
+	defer broker_ctx.Close()
+	defer broker.Close()
+	eklist = EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+	for _, value := range []int64{0, 3, 200, 9} {
+		publishLong(t, broker, "key1", value)
+	}
+	checkFilteredNotifies(t, subop, 0, 9)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := subop.GetNotifyWithContext(ctx); err == nil {
+		t.Error("Unexpected notify")
+	}
+}
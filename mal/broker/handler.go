@@ -26,9 +26,13 @@ package broker
 import (
 	"errors"
 	"fmt"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
 	. "github.com/CNES/ccsdsmo-malgo/mal"
 	. "github.com/CNES/ccsdsmo-malgo/mal/api"
 	"github.com/CNES/ccsdsmo-malgo/mal/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -41,15 +45,36 @@ var (
 
 // Structure used to memorize a subscriber registration
 type BrokerSub struct {
+	// Counters of the notifications and updates sent to the subscription, they are first to be
+	// 64-bit aligned for atomic operations.
+	notifies uint64
+	updates  uint64
+	// Unique identifier of the subscription (see subkey)
+	key         string
+	urifrom     *URI
 	subid       Identifier
 	domain      IdentifierList
 	session     SessionType
 	sessionName Identifier
 	serviceArea UShort
+	areaVersion UOctet
 	service     UShort
 	operation   UShort
 	entities    *EntityRequestList
 	transaction SubscriberTransaction
+	// Route of the subscription of a peer broker, nil for the other subscriptions (see
+	// federation)
+	route URIList
+	// Delivery queue of the subscription, nil if the notifications are sent synchronously
+	queue *deliveryQueue
+	// Batch of the pending updates of the subscription, nil if the batching is disabled
+	batch *notifyBatch
+	// Value filters of the subscription (see SetSubscriptionFilters)
+	filter subFilter
+	// Saved form of the registration, without its filters (see saveSub)
+	reg *Registration
+	// Keyed part of a subscription of the keyed model, nil otherwise (see EnableKeyedModel)
+	keyed *keyedSub
 }
 
 func subkey(urifrom string, subid string) string {
@@ -168,6 +193,8 @@ func (sub *BrokerSub) matches(msg *Message, key *EntityKey) bool {
 
 // Structure used to memorize a publisher registration
 type BrokerPub struct {
+	// Counter of the accepted publications, first to be 64-bit aligned for atomic operations.
+	publishes   uint64
 	domain      IdentifierList
 	session     SessionType
 	sessionName Identifier
@@ -175,23 +202,118 @@ type BrokerPub struct {
 	Service     UShort
 	operation   UShort
 	keys        *EntityKeyList
+	// Names of the keys of a publisher of the keyed model, nil otherwise
+	keyNames IdentifierList
 	// TODO (AF): Is it needed ? used ? => PublishError ?
 	transaction PublisherTransaction
 }
 
+// Verifies the validity of a publication (see 3.5.6.8 e, f): the message must be sent with the
+// domain, session and service of the registration, otherwise an INCORRECT_STATE error is
+// returned. A publisher of the keyed model may also publish in a sub-domain of the domain of
+// its registration (see KeyedUpdateHeader). Each published key must match one of the
+// registered keys, otherwise an UNKNOWN error with the list of the unknown keys is returned.
+func (pub *BrokerPub) verify(msg *Message, uhlist *UpdateHeaderList) *MalError {
+	domain := sameDomain(msg.Domain, pub.domain)
+	if !domain && (pub.keyNames != nil) {
+		domain = isSubDomain(msg.Domain, pub.domain)
+	}
+	if !domain || (msg.Session != pub.session) || (msg.SessionName != pub.sessionName) ||
+		(msg.ServiceArea != pub.serviceArea) || (msg.Service != pub.Service) || (msg.Operation != pub.operation) {
+		logger.Warnf("Broker.Publish: publication does not match the registration of %s", *msg.UriFrom)
+		return NewMalError(ERROR_INCORRECT_STATE)
+	}
+
+	var unknown EntityKeyList
+	for _, hdr := range *uhlist {
+		registered := false
+		for _, rkey := range *pub.keys {
+			if rkey.Match(&hdr.Key) {
+				registered = true
+				break
+			}
+		}
+		if !registered {
+			unknown = append(unknown, &hdr.Key)
+		}
+	}
+	if len(unknown) != 0 {
+		logger.Warnf("Broker.Publish: %d unknown keys published by %s", len(unknown), *msg.UriFrom)
+		return NewMalError(ERROR_UNKNOWN, &unknown)
+	}
+	return nil
+}
+
+func sameDomain(domain1 IdentifierList, domain2 IdentifierList) bool {
+	if len(domain1) != len(domain2) {
+		return false
+	}
+	for idx, id := range domain1 {
+		if *id != *domain2[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the domain starts with the identifiers of the parent domain.
+func isSubDomain(domain IdentifierList, parent IdentifierList) bool {
+	if len(domain) < len(parent) {
+		return false
+	}
+	return sameDomain(domain[:len(parent)], parent)
+}
+
 // TODO (AF): Creates a client interface to handle broker implementation
 
 type BrokerHandler struct {
+	// Sequence number of the last publication, it is first to be 64-bit aligned for atomic
+	// operations (see newTrace).
+	seq  uint64
 	cctx *ClientContext
+	// Area version of the broker operation, the clients of the keyed model use another one
+	areaVersion UOctet
 
+	// Handler given at creation, it is only used as a model for the handlers of each
+	// publish, except by LocalPublish.
 	updtHandler UpdateValueHandler
+	// Serializes the uses of updtHandler by LocalPublish
+	updtLock sync.Mutex
 
+	// Lock protecting the maps of subscribers and publishers
+	lock sync.RWMutex
 	// Map of all active subscribers
 	subs map[string]*BrokerSub
+	// Index of the active subscribers used to match the publications
+	index *subIndex
+	// Configuration of the delivery queues of the subscriptions, no queue if the depth is 0
+	queueDepth  uint
+	queuePolicy QueuePolicy
+	// Configuration of the batching of the notifications, no batching if the window is 0
+	batchWindow   time.Duration
+	batchMax      uint
+	batchCoalesce bool
+	// Last value of each published key, nil if disabled
+	cache *lastValueCache
+	// Persistent store of the registrations, nil if disabled
+	store RegistrationStore
+	// Links to the peer brokers, nil if there is no peer
+	federation *federation
+	// Limits of the registrations
+	limits Limits
+	// Purge of the lost consumers, nil if disabled
+	cleanup *cleanup
+	// Demand of the publishers, nil if not tracked
+	demands *demandTracker
+	// Keys of the keyed model, nil if it is not enabled
+	keySchema KeySchema
 	// Map o fall active publishers
 	pubs map[string]*BrokerPub
 }
 
+// An UpdateValueHandler holds the update values of a publish. If it implements
+// UpdateValueHandlerFactory a new handler is created for each publish allowing concurrent
+// publications, otherwise the publications are serialized.
 type UpdateValueHandler interface {
 	InitUpdateValueList(list []ElementList) error
 	DecodeUpdateValueList(body Body) error
@@ -201,6 +323,38 @@ type UpdateValueHandler interface {
 	ResetValues()
 }
 
+// Optional interface of an UpdateValueHandler creating the handler of each publish.
+type UpdateValueHandlerFactory interface {
+	// Creates a new empty handler with the same configuration.
+	CreateUpdateValueHandler() UpdateValueHandler
+}
+
+// Optional interface of an UpdateValueHandler allowing to keep an update value after the
+// publish, it is needed by the last value cache.
+type UpdateValueSelector interface {
+	// Creates a new handler holding only the update value of the specified index.
+	SelectUpdateValue(idx int) UpdateValueHandler
+}
+
+// Optional interface of an UpdateValueHandler allowing to gather update values, it is needed
+// by the batching of the notifications.
+type UpdateValueAppender interface {
+	// Appends the update values held by a handler with the same configuration. The appended
+	// values can then be encoded using AppendValue.
+	AppendUpdateValues(from UpdateValueHandler)
+}
+
+// Returns the UpdateValueHandler of a new publish and the function releasing it. If the
+// handler given at the broker creation is not an UpdateValueHandlerFactory it is shared,
+// so the publications are serialized until the release.
+func (handler *BrokerHandler) newUpdateValueHandler() (UpdateValueHandler, func()) {
+	if factory, ok := handler.updtHandler.(UpdateValueHandlerFactory); ok {
+		return factory.CreateUpdateValueHandler(), func() {}
+	}
+	handler.updtLock.Lock()
+	return handler.updtHandler, handler.updtLock.Unlock
+}
+
 // ################################################################################
 // Implements an UpdateValueHandler for Blob update value type
 
@@ -213,6 +367,10 @@ func NewBlobUpdateValueHandler() *BlobUpdateValueHandler {
 	return new(BlobUpdateValueHandler)
 }
 
+func (handler *BlobUpdateValueHandler) CreateUpdateValueHandler() UpdateValueHandler {
+	return NewBlobUpdateValueHandler()
+}
+
 // Function used to initialize the UpdateValueHandler from a list of values.
 // This function is used with local broker.
 func (handler *BlobUpdateValueHandler) InitUpdateValueList(list []ElementList) error {
@@ -269,6 +427,19 @@ func (handler *BlobUpdateValueHandler) ResetValues() {
 	handler.values = handler.values[:0]
 }
 
+func (handler *BlobUpdateValueHandler) SelectUpdateValue(idx int) UpdateValueHandler {
+	list := BlobList([]*Blob{([]*Blob)(*handler.list)[idx]})
+	return &BlobUpdateValueHandler{list: &list, values: BlobList(make([]*Blob, 0, 1))}
+}
+
+func (handler *BlobUpdateValueHandler) AppendUpdateValues(from UpdateValueHandler) {
+	if handler.list == nil {
+		list := BlobList(make([]*Blob, 0))
+		handler.list = &list
+	}
+	*handler.list = append(*handler.list, *from.(*BlobUpdateValueHandler).list...)
+}
+
 // ################################################################################
 // Implements a generic UpdateValueHandler
 
@@ -295,6 +466,12 @@ func NewGenericUpdateValueHandler(valueType ...ElementList) *GenericUpdateValueH
 	}
 }
 
+func (handler *GenericUpdateValueHandler) CreateUpdateValueHandler() UpdateValueHandler {
+	return &GenericUpdateValueHandler{
+		valueType: handler.valueType,
+	}
+}
+
 // Function used to initialize the UpdateValueHandler from a list of values.
 // This function is used with local broker.
 func (handler *GenericUpdateValueHandler) InitUpdateValueList(list []ElementList) error {
@@ -417,16 +594,58 @@ func (handler *GenericUpdateValueHandler) ResetValues() {
 	}
 }
 
+func (handler *GenericUpdateValueHandler) SelectUpdateValue(idx int) UpdateValueHandler {
+	selected := &GenericUpdateValueHandler{
+		valueType: handler.valueType,
+		list:      make([]ElementList, len(handler.list)),
+		values:    make([]ElementList, len(handler.list)),
+	}
+	for i, list := range handler.list {
+		selected.list[i] = list.CreateElement().(ElementList)
+		selected.list[i].AppendElement(list.GetElementAt(idx))
+		selected.values[i] = list.CreateElement().(ElementList)
+	}
+	return selected
+}
+
+// Returns the update value of the specified index in each update value list, it is used to
+// evaluate the value filters.
+func (handler *GenericUpdateValueHandler) GetUpdateValues(idx int) []Element {
+	values := make([]Element, len(handler.list))
+	for i, list := range handler.list {
+		values[i] = list.GetElementAt(idx)
+	}
+	return values
+}
+
+func (handler *GenericUpdateValueHandler) AppendUpdateValues(from UpdateValueHandler) {
+	other := from.(*GenericUpdateValueHandler)
+	if handler.list == nil {
+		handler.list = make([]ElementList, len(other.list))
+		handler.values = make([]ElementList, len(other.list))
+		for i, list := range other.list {
+			handler.list[i] = list.CreateElement().(ElementList)
+			handler.values[i] = list.CreateElement().(ElementList)
+		}
+	}
+	for i, list := range other.list {
+		for idx := 0; idx < list.Size(); idx++ {
+			handler.list[i].AppendElement(list.GetElementAt(idx))
+		}
+	}
+}
+
 // ################################################################################
 // Implements a BrokerHandler
 
 func NewBroker(cctx *ClientContext, updtHandler UpdateValueHandler, area UShort, areaVersion UOctet, service UShort, operation UShort) (*BrokerHandler, error) {
 	subs := make(map[string]*BrokerSub)
 	pubs := make(map[string]*BrokerPub)
-	broker := &BrokerHandler{cctx: cctx, updtHandler: updtHandler, subs: subs, pubs: pubs}
+	broker := &BrokerHandler{seq: uint64(time.Now().UnixNano()), cctx: cctx, areaVersion: areaVersion, updtHandler: updtHandler, subs: subs, index: newSubIndex(), pubs: pubs}
 
 	brokerHandler := func(msg *Message, t Transaction) error {
 		//		fmt.Println("##########", msg.Body)
+		broker.touch(msg.UriFrom)
 		if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH_REGISTER {
 			broker.OnPublishRegister(msg, t.(PublisherTransaction))
 		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH {
@@ -457,47 +676,354 @@ func (handler *BrokerHandler) ClientContext() *ClientContext {
 	return handler.cctx
 }
 
+// Configures the delivery queues of the subscriptions registered afterwards: the notifications
+// of each subscription are queued and sent by a dedicated goroutine, the policy defines the
+// behaviour when the queue is full. With a depth of 0 (default) the notifications are sent
+// synchronously by the publish.
+func (handler *BrokerHandler) SetDeliveryQueues(depth uint, policy QueuePolicy) *BrokerHandler {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	handler.queueDepth = depth
+	handler.queuePolicy = policy
+	return handler
+}
+
+// Configures the batching of the notifications of the subscriptions registered afterwards: the
+// updates matching a subscription are accumulated during the window, or until maxUpdates
+// updates if not 0, then sent in a single notify. With coalesce only the latest update of each
+// key is kept in the window. A window of 0 (default) disables the batching. The batching is not
+// enabled if the UpdateValueHandler given at the broker creation does not implement the
+// UpdateValueHandlerFactory, UpdateValueSelector and UpdateValueAppender interfaces.
+func (handler *BrokerHandler) SetBatching(window time.Duration, maxUpdates uint, coalesce bool) *BrokerHandler {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if (window > 0) && !canBatch(handler.updtHandler) {
+		logger.Warnf("Broker: the update values cannot be gathered, the batching is disabled")
+		window = 0
+	}
+	handler.batchWindow = window
+	handler.batchMax = maxUpdates
+	handler.batchCoalesce = coalesce
+	return handler
+}
+
+// Enables the last value cache: the broker keeps the last update of each key published, and
+// sends the matching ones to each new subscription as initial notifies. When the cache holds
+// maxEntries keys the least recently updated one is removed, a size of 0 (default) disables
+// the cache. The cache is not enabled if the UpdateValueHandler given at the broker creation
+// is not an UpdateValueSelector.
+func (handler *BrokerHandler) SetLastValueCache(maxEntries uint) *BrokerHandler {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if _, ok := handler.updtHandler.(UpdateValueSelector); !ok && (maxEntries != 0) {
+		logger.Warnf("Broker: the update values cannot be selected, the last value cache is disabled")
+		maxEntries = 0
+	}
+	if maxEntries == 0 {
+		handler.cache = nil
+	} else {
+		handler.cache = newLastValueCache(maxEntries)
+	}
+	return handler
+}
+
+// Sets the persistent store of the registrations, the subscribers and publishers saved in
+// the store are restored: a restarted broker notifies the recorded subscribers without they
+// register again. Then each registration and deregistration is saved in the store.
+func (handler *BrokerHandler) SetRegistrationStore(store RegistrationStore) error {
+	regs, err := store.Load()
+	if err != nil {
+		return err
+	}
+	for _, reg := range regs {
+		msg := reg.message()
+		if reg.Subscription != nil {
+			logger.Infof("Broker: restores subscription %s", reg.Key)
+			transaction := handler.cctx.NewSubscriberTransaction(msg)
+			var sub *BrokerSub
+			if reg.KeyedSubscription != nil {
+				sub, err = restoreKeyedSub(msg, reg, transaction)
+				if err != nil {
+					logger.Warnf("Broker: cannot restore subscription %s: %s", reg.Key, err)
+					continue
+				}
+			} else {
+				sub = newBrokerSub(msg, reg.Subscription, transaction)
+			}
+			if err := restoreFilters(sub, reg); err != nil {
+				logger.Warnf("Broker: cannot restore subscription %s: %s", reg.Key, err)
+				continue
+			}
+			sub.route = reg.Route
+			sub.reg = reg
+			if err := handler.addSub(sub); err != nil {
+				logger.Warnf("Broker: cannot restore subscription %s: %s", reg.Key, err)
+			}
+		} else if reg.Keys != nil {
+			logger.Infof("Broker: restores publisher %s", reg.Key)
+			var transaction PublisherTransaction
+			if *msg.UriFrom != *handler.cctx.Uri {
+				transaction = handler.cctx.NewPublisherTransaction(msg)
+			}
+			pub := newBrokerPub(msg, reg.Keys, transaction)
+			pub.keyNames = reg.KeyNames
+			if err := handler.addPub(string(*msg.UriFrom), pub); err != nil {
+				logger.Warnf("Broker: cannot restore publisher %s: %s", reg.Key, err)
+			}
+		}
+	}
+	handler.lock.Lock()
+	handler.store = store
+	handler.lock.Unlock()
+	return nil
+}
+
+// Saves a registration in the store, if any. A failure is only logged, the registration
+// remains active until the broker stops.
+func (handler *BrokerHandler) save(reg *Registration) {
+	handler.lock.RLock()
+	store := handler.store
+	handler.lock.RUnlock()
+	if store == nil {
+		return
+	}
+	if err := store.Save(reg); err != nil {
+		logger.Errorf("Broker: cannot save registration %s: %s", reg.Key, err)
+	}
+}
+
+// Removes a registration from the store, if any.
+func (handler *BrokerHandler) unsave(key string) {
+	handler.lock.RLock()
+	store := handler.store
+	handler.lock.RUnlock()
+	if store == nil {
+		return
+	}
+	if err := store.Remove(key); err != nil {
+		logger.Errorf("Broker: cannot remove registration %s: %s", key, err)
+	}
+}
+
+// Returns the statistics of the delivery queues of the active subscriptions.
+func (handler *BrokerHandler) GetQueueStats() []QueueStats {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	stats := make([]QueueStats, 0, len(handler.subs))
+	for _, sub := range handler.subs {
+		if sub.queue != nil {
+			stats = append(stats, sub.queue.getStats())
+		}
+	}
+	return stats
+}
+
 func (handler *BrokerHandler) Close() {
 	// TODO (AF): Removes all remaining subscribers and publishers
+	handler.lock.Lock()
+	for _, sub := range handler.subs {
+		if sub.queue != nil {
+			sub.queue.close()
+		}
+		if sub.batch != nil {
+			sub.batch.close()
+		}
+	}
+	federation := handler.federation
+	demands := handler.demands
+	handler.lock.Unlock()
+	handler.stopCleanup()
+	if demands != nil {
+		demands.close()
+	}
+	if federation != nil {
+		federation.close()
+	}
 	handler.cctx.Close()
 }
 
-func (handler *BrokerHandler) register(msg *Message, transaction SubscriberTransaction) error {
+func (handler *BrokerHandler) register(msg *Message, transaction SubscriberTransaction) (*BrokerSub, error) {
 	p, err := msg.DecodeLastParameter(NullSubscription, false)
 	//	decoder := handler.encoding.NewDecoder(msg.Body)
 	//	sub, err := DecodeSubscription(decoder)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	sub := p.(*Subscription)
+	return handler.registerSub(msg, p.(*Subscription), nil, transaction)
+}
 
-	subkey := subkey(string(*msg.UriFrom), string(sub.SubscriptionId))
-	logger.Infof("Broker.Register: %t -> %t", subkey, sub.Entities)
+// Registers a subscription with its value filters, if any (see EnableRegisterFilters).
+func (handler *BrokerHandler) registerSub(msg *Message, sub *Subscription, filters *archive.CompositeFilterList, transaction SubscriberTransaction) (*BrokerSub, error) {
+	bsub := newBrokerSub(msg, sub, transaction)
+	if err := handler.setRegisterFilters(bsub, filters); err != nil {
+		return nil, err
+	}
+	if federation := handler.getFederation(); federation != nil {
+		bsub.route = federation.route(bsub.key)
+	}
+	logger.Infof("Broker.Register: %t -> %t", bsub.key, sub.Entities)
+	if err := handler.addSub(bsub); err != nil {
+		return nil, err
+	}
 
-	// Note (AF): Be careful the replacement of a subscription should be an atomic operation.
-	handler.subs[subkey] = &BrokerSub{
+	bsub.reg = newRegistration(subRegistrationKey(bsub.key), msg)
+	bsub.reg.Subscription = sub
+	bsub.reg.Route = bsub.route
+	handler.saveSub(bsub)
+
+	return bsub, nil
+}
+
+// Saves the registration of a subscription with its value filters and change detection, if
+// the subscription is still registered.
+func (handler *BrokerHandler) saveSub(sub *BrokerSub) {
+	if sub.reg == nil {
+		return
+	}
+	reg := *sub.reg
+	filters, change := sub.filter.get()
+	if len(filters) != 0 {
+		list := archive.CompositeFilterList(filters)
+		data, err := encodeElement(&list)
+		if err != nil {
+			logger.Errorf("Broker: cannot save registration %s: %s", reg.Key, err)
+			return
+		}
+		reg.Filters = data
+	}
+	reg.Change = change
+	handler.lock.RLock()
+	registered := handler.subs[sub.key] == sub
+	handler.lock.RUnlock()
+	if registered {
+		handler.save(&reg)
+	}
+}
+
+// Restores the value filters and change detection of a saved subscription.
+func restoreFilters(sub *BrokerSub, reg *Registration) error {
+	if reg.Filters != nil {
+		p, err := decodeElement(reg.Filters, archive.NullCompositeFilterList)
+		if err != nil {
+			return err
+		}
+		sub.filter.set(*p.(*archive.CompositeFilterList))
+	}
+	if reg.Change != nil {
+		sub.filter.setChange(reg.Change)
+	}
+	return nil
+}
+
+func newBrokerSub(msg *Message, sub *Subscription, transaction SubscriberTransaction) *BrokerSub {
+	return &BrokerSub{
+		key:         subkey(string(*msg.UriFrom), string(sub.SubscriptionId)),
+		urifrom:     msg.UriFrom,
 		subid:       sub.SubscriptionId,
 		domain:      msg.Domain,
 		session:     msg.Session,
 		sessionName: msg.SessionName,
 		serviceArea: msg.ServiceArea,
+		areaVersion: msg.AreaVersion,
 		service:     msg.Service,
 		operation:   msg.Operation,
 		entities:    &sub.Entities,
 		transaction: transaction,
 	}
+}
 
+// Adds the subscription, replacing the previous one with the same identifier. Returns a
+// TOO_MANY error if the subscription exceeds the limits.
+func (handler *BrokerHandler) addSub(sub *BrokerSub) error {
+	// Note (AF): Be careful the replacement of a subscription should be an atomic operation.
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if err := handler.checkSubLimits(sub); err != nil {
+		return err
+	}
+	if old := handler.subs[sub.key]; old != nil {
+		handler.removeSub(old)
+		sub.filter.copyFrom(&old.filter)
+	}
+	// The notifies of the peers carry the trace of their publication, so they are not batched
+	if (handler.batchWindow > 0) && (sub.route == nil) {
+		sub.batch = newNotifyBatch(handler, sub, handler.batchWindow, handler.batchMax, handler.batchCoalesce)
+	}
+	if handler.queueDepth > 0 {
+		sub.queue = newDeliveryQueue(sub, sub.key, handler.queueDepth, handler.queuePolicy, func(err error) {
+			handler.notified(sub, err)
+		})
+	}
+	handler.subs[sub.key] = sub
+	handler.index.add(sub)
+	handler.touchFederation(sub)
+	handler.touchDemand()
 	return nil
 }
 
+// Removes the subscription, its pending notifications are discarded. The lock must be held.
+func (handler *BrokerHandler) removeSub(sub *BrokerSub) {
+	if sub.queue != nil {
+		sub.queue.close()
+	}
+	if sub.batch != nil {
+		sub.batch.close()
+	}
+	handler.touchFederation(sub)
+	handler.touchDemand()
+	handler.index.remove(sub)
+	delete(handler.subs, sub.key)
+}
+
+// Removes a subscription whose delivery queue overflows with the DISCONNECT policy, the final
+// error notify is sent by the queue.
+func (handler *BrokerHandler) disconnect(sub *BrokerSub) {
+	handler.lock.Lock()
+	current := handler.subs[sub.key] == sub
+	if current {
+		if sub.batch != nil {
+			sub.batch.close()
+		}
+		handler.touchFederation(sub)
+		handler.touchDemand()
+		handler.index.remove(sub)
+		delete(handler.subs, sub.key)
+	}
+	handler.lock.Unlock()
+	if current {
+		handler.unsave(subRegistrationKey(sub.key))
+	}
+}
+
+// Sends the cached updates matching a new subscription.
+func (handler *BrokerHandler) sendLastValues(sub *BrokerSub) {
+	handler.lock.RLock()
+	cache := handler.cache
+	handler.lock.RUnlock()
+	if cache == nil {
+		return
+	}
+	for _, item := range cache.notifications(sub) {
+		if sub.route != nil {
+			encodeTrace(item.body, handler.newTrace())
+		}
+		if !handler.notify(sub, item.keys, item.body) {
+			return
+		}
+	}
+}
+
 func (handler *BrokerHandler) OnRegister(msg *Message, transaction SubscriberTransaction) error {
-	err := handler.register(msg, transaction)
+	sub, err := handler.register(msg, transaction)
 	if err != nil {
-		return transaction.AckRegister(nil, true)
-	} else {
-		// TODO (AF): Builds and encode error structure (cf. 3.5.6.11.3)
-		return transaction.AckRegister(nil, false)
+		return transaction.AckRegister(errorBody(transaction, err), true)
 	}
+	err = transaction.AckRegister(nil, false)
+	if err != nil {
+		return err
+	}
+	handler.sendLastValues(sub)
+	return nil
 }
 
 func (handler *BrokerHandler) deregister(msg *Message, transaction SubscriberTransaction) error {
@@ -509,11 +1035,20 @@ func (handler *BrokerHandler) deregister(msg *Message, transaction SubscriberTra
 	}
 	list := p.(*IdentifierList)
 
+	removed := make([]string, 0, len(*list))
+	handler.lock.Lock()
 	for _, id := range []*Identifier(*list) {
 		subkey := subkey(string(*msg.UriFrom), string(*id))
 		logger.Infof("Broker.Deregister: %v", subkey)
 		// TODDO (AF): May be we have to verify if the subscriber is registered.
-		delete(handler.subs, string(subkey))
+		if sub := handler.subs[subkey]; sub != nil {
+			handler.removeSub(sub)
+			removed = append(removed, subkey)
+		}
+	}
+	handler.lock.Unlock()
+	for _, subkey := range removed {
+		handler.unsave(subRegistrationKey(subkey))
 	}
 	return nil
 }
@@ -538,7 +1073,19 @@ func (handler *BrokerHandler) publishRegister(msg *Message, transaction Publishe
 	logger.Infof("Broker.PublishRegister: %t", list)
 
 	pubid := string(*msg.UriFrom)
-	handler.pubs[pubid] = &BrokerPub{
+	if err := handler.addPub(pubid, newBrokerPub(msg, list, transaction)); err != nil {
+		return err
+	}
+
+	reg := newRegistration(pubRegistrationKey(pubid), msg)
+	reg.Keys = list
+	handler.save(reg)
+
+	return nil
+}
+
+func newBrokerPub(msg *Message, list *EntityKeyList, transaction PublisherTransaction) *BrokerPub {
+	return &BrokerPub{
 		domain:      msg.Domain,
 		session:     msg.Session,
 		sessionName: msg.SessionName,
@@ -548,17 +1095,28 @@ func (handler *BrokerHandler) publishRegister(msg *Message, transaction Publishe
 		keys:        list,
 		transaction: transaction,
 	}
+}
 
+// Registers the publisher, replacing its previous registration. Returns a TOO_MANY error if
+// the registration exceeds the limits.
+func (handler *BrokerHandler) addPub(pubid string, pub *BrokerPub) error {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if err := handler.checkPubLimits(pubid, pub.keys); err != nil {
+		return err
+	}
+	handler.pubs[pubid] = pub
+	if handler.demands != nil {
+		handler.demands.reset(pubid)
+	}
 	return nil
 }
 
 func (handler *BrokerHandler) OnPublishRegister(msg *Message, transaction PublisherTransaction) error {
 	err := handler.publishRegister(msg, transaction)
 	if err != nil {
-		// TODO (AF): Builds and encode reply
-		return transaction.AckRegister(nil, true)
+		return transaction.AckRegister(errorBody(transaction, err), true)
 	} else {
-		// TODO (AF): Builds and encode error structure (cf 3.5.6.11.6)
 		return transaction.AckRegister(nil, false)
 	}
 }
@@ -567,7 +1125,11 @@ func (handler *BrokerHandler) publishDeregister(msg *Message, transaction Publis
 	pubid := string(*msg.UriFrom)
 	logger.Infof("Broker.PublishDeregister: %v", pubid)
 	// TODDO (AF): May be we have to verify if the publisher is registered.
+	handler.lock.Lock()
 	delete(handler.pubs, string(pubid))
+	handler.touchDemand()
+	handler.lock.Unlock()
+	handler.unsave(pubRegistrationKey(pubid))
 
 	return nil
 }
@@ -592,13 +1154,15 @@ func (handler *BrokerHandler) publish(pub *Message, transaction PublisherTransac
 	uhlist := p1.(*UpdateHeaderList)
 	logger.Infof("Broker.Publish, DecodeUpdateHeaderList -> %+v", uhlist)
 
-	handler.updtHandler.DecodeUpdateValueList(pub.Body)
+	updtHandler, release := handler.newUpdateValueHandler()
+	defer release()
+	err = updtHandler.DecodeUpdateValueList(pub.Body)
 	if err != nil {
 		return err
 	}
-	logger.Infof("Broker.Publish, DecodeUpdateList -> %d", handler.updtHandler.UpdateValueListSize())
+	logger.Infof("Broker.Publish, DecodeUpdateList -> %d", updtHandler.UpdateValueListSize())
 
-	return handler.doPublish(pub, uhlist, handler.updtHandler)
+	return handler.doPublish(pub, uhlist, updtHandler)
 }
 
 func (handler *BrokerHandler) doPublish(pub *Message, uhlist *UpdateHeaderList, updtHandler UpdateValueHandler) error {
@@ -606,32 +1170,67 @@ func (handler *BrokerHandler) doPublish(pub *Message, uhlist *UpdateHeaderList,
 
 	uvlSize := updtHandler.UpdateValueListSize()
 	if len(*uhlist) != uvlSize {
-		return fmt.Errorf("The UpdateValue list size (%d) does not match the UpdateHeader list size (%d).", uvlSize, len(*uhlist))
+		msg := fmt.Sprintf("The UpdateValue list size (%d) does not match the UpdateHeader list size (%d).", uvlSize, len(*uhlist))
+		return NewMalError(ERROR_BAD_ENCODING, NewString(msg))
 	}
 
-	// TODO (AF): Verify the publication validity see 3.5.6.8 e, f
 	pubid := string(*pub.UriFrom)
+	handler.lock.RLock()
 	publisher := handler.pubs[pubid]
+	handler.lock.RUnlock()
 	if publisher == nil {
 		logger.Warnf("Publisher not registered: %s", pubid)
-		return errors.New("Publisher not registered")
+		return NewMalError(ERROR_INCORRECT_STATE)
 	}
+	if merr := publisher.verify(pub, uhlist); merr != nil {
+		return merr
+	}
+	atomic.AddUint64(&publisher.publishes, 1)
 
-	for _, sub := range handler.subs {
-		var headers UpdateHeaderList = make([]*UpdateHeader, 0, len(*uhlist))
-		for idx, hdr := range *uhlist {
-			if sub.matches(pub, &hdr.Key) {
-				logger.Infof("Broker.Publish match !!")
-				// Adds the update to the notify message for this subscription
-				headers = append(headers, hdr)
-				updtHandler.AppendValue(idx)
-			}
+	// The matching subscriptions are found using the index, then the notifications are
+	// sent outside of the lock.
+	handler.lock.RLock()
+	matches := handler.index.match(pub, uhlist)
+	cache := handler.cache
+	handler.lock.RUnlock()
+
+	if cache != nil {
+		cache.put(pub, uhlist, updtHandler)
+	}
+	handler.notifyMatches(matches, pub.Domain, uhlist, updtHandler, nil)
+	return nil
+}
+
+// Sends to each matching subscription a notification with its matching updates, published
+// in the specified domain. The notifications of the peers carry the trace of the publication,
+// a new one if it is nil.
+func (handler *BrokerHandler) notifyMatches(matches []*subMatch, domain IdentifierList, uhlist *UpdateHeaderList, updtHandler UpdateValueHandler, trace *fedTrace) {
+	for _, match := range matches {
+		sub := match.sub
+		updates := match.updates
+		if sub.keyed != nil {
+			updates = sub.keyed.selectUpdates(uhlist, updates)
 		}
-		if len(headers) == 0 {
-			// there is no update matching this subscription
-			updtHandler.ResetValues()
+		updates = sub.filter.apply(uhlist, updtHandler, updates)
+		if len(updates) == 0 {
 			continue
 		}
+		if sub.batch != nil {
+			sub.batch.add(domain, uhlist, updtHandler, updates)
+			continue
+		}
+		if sub.keyed != nil {
+			handler.notifyKeyed(sub, domain, uhlist, updtHandler, updates)
+			continue
+		}
+		var headers UpdateHeaderList = make([]*UpdateHeader, 0, len(updates))
+		keys := make([]*EntityKey, 0, len(updates))
+		for _, idx := range updates {
+			// Adds the update to the notify message for this subscription
+			headers = append(headers, (*uhlist)[idx])
+			keys = append(keys, &(*uhlist)[idx].Key)
+			updtHandler.AppendValue(idx)
+		}
 
 		body := sub.transaction.NewBody()
 		//		buf := make([][]byte, 1)
@@ -642,10 +1241,43 @@ func (handler *BrokerHandler) doPublish(pub *Message, uhlist *UpdateHeaderList,
 		//		headers.Encode(encoder)
 		body.EncodeParameter(&headers)
 		updtHandler.EncodeUpdateValueList(body)
+		if sub.route != nil {
+			if trace == nil {
+				trace = handler.newTrace()
+			}
+			encodeTrace(body, trace)
+		}
 		//		sub.transaction.Notify(encoder.Body(), false)
-		sub.transaction.Notify(body, false)
+		handler.notify(sub, keys, body)
+	}
+}
+
+// Sends a notification to the subscription, directly or through its delivery queue. Returns
+// false if the subscription is disconnected.
+func (handler *BrokerHandler) notify(sub *BrokerSub, keys []*EntityKey, body Body) bool {
+	atomic.AddUint64(&sub.notifies, 1)
+	atomic.AddUint64(&sub.updates, uint64(len(keys)))
+	if sub.queue == nil {
+		handler.notified(sub, sub.transaction.Notify(body, false))
+	} else if !sub.queue.push(keys, body) {
+		handler.disconnect(sub)
+		return false
+	}
+	return true
+}
+
+// Handles the result of the sending of a notification: a delivered notification renews the
+// lease of the subscriber, after a failure the registrations of the subscriber are purged if
+// the cleanup is enabled.
+func (handler *BrokerHandler) notified(sub *BrokerSub, err error) {
+	if err == nil {
+		handler.touch(sub.urifrom)
+		return
+	}
+	logger.Warnf("Broker: cannot notify subscription %s: %s", sub.key, err)
+	if sub.urifrom != nil {
+		go handler.lost(*sub.urifrom, err)
 	}
-	return nil
 }
 
 func (handler *BrokerHandler) OnPublish(msg *Message, transaction PublisherTransaction) error {
@@ -654,19 +1286,30 @@ func (handler *BrokerHandler) OnPublish(msg *Message, transaction PublisherTrans
 
 	err := handler.publish(msg, transaction)
 	if err != nil {
-		// TODO (AF): Returns a PublishError MAL message to publisher
-		pubid := string(*msg.UriFrom)
-		publisher := handler.pubs[pubid]
-
-		body := publisher.transaction.NewBody()
-		body.EncodeParameter(NewUInteger(0))
-		body.EncodeLastParameter(NewString(err.Error()), false)
-		transaction.PublishError(body)
+		// Returns a PublishError MAL message to publisher
+		transaction.PublishError(errorBody(transaction, err))
 		return err
 	}
 	return nil
 }
 
+// Builds the body of an error message (error code then extra information), the errors other
+// than MalError come from the decoding of the message.
+func errorBody(transaction Transaction, err error) Body {
+	merr, ok := err.(*MalError)
+	if !ok {
+		merr = NewMalError(ERROR_BAD_ENCODING, NewString(err.Error()))
+	}
+	var extraInfo Element = merr.ExtraInfo
+	if extraInfo == nil {
+		extraInfo = NullString
+	}
+	body := transaction.NewBody()
+	body.EncodeParameter(&merr.Code)
+	body.EncodeLastParameter(extraInfo, false)
+	return body
+}
+
 // ################################################################################
 // Definition of a local (embeded) broker.
 
@@ -691,7 +1334,129 @@ func (broker *LocalBroker) ClientContext() *ClientContext {
 
 func (broker *LocalBroker) Close() {
 	// TODO (AF): Removes all remaining subscribers and publishers
-	broker.handler.cctx.Close()
+	broker.handler.Close()
+}
+
+// Configures the delivery queues of the subscriptions (see BrokerHandler.SetDeliveryQueues).
+func (broker *LocalBroker) SetDeliveryQueues(depth uint, policy QueuePolicy) *LocalBroker {
+	broker.handler.SetDeliveryQueues(depth, policy)
+	return broker
+}
+
+// Configures the batching of the notifications (see BrokerHandler.SetBatching).
+func (broker *LocalBroker) SetBatching(window time.Duration, maxUpdates uint, coalesce bool) *LocalBroker {
+	broker.handler.SetBatching(window, maxUpdates, coalesce)
+	return broker
+}
+
+// Enables the last value cache (see BrokerHandler.SetLastValueCache).
+func (broker *LocalBroker) SetLastValueCache(maxEntries uint) *LocalBroker {
+	broker.handler.SetLastValueCache(maxEntries)
+	return broker
+}
+
+// Sets the limits of the registrations (see BrokerHandler.SetLimits).
+func (broker *LocalBroker) SetLimits(limits Limits) *LocalBroker {
+	broker.handler.SetLimits(limits)
+	return broker
+}
+
+// Enables the purge of the lost consumers (see BrokerHandler.EnableCleanup).
+func (broker *LocalBroker) EnableCleanup(lease time.Duration, hook PurgeHandler) *LocalBroker {
+	broker.handler.EnableCleanup(lease, hook)
+	return broker
+}
+
+// Registers the keep-alive operation of the broker (see BrokerHandler.EnableKeepAlive).
+func (broker *LocalBroker) EnableKeepAlive(area UShort, areaVersion UOctet, service UShort, operation UShort) error {
+	return broker.handler.EnableKeepAlive(area, areaVersion, service, operation)
+}
+
+// Purges the registrations of the destination of a failed message (see BrokerHandler.OnError).
+func (broker *LocalBroker) OnError(merr *MessageError) {
+	broker.handler.OnError(merr)
+}
+
+// Returns the registered keys of the local publisher matched by at least one subscription.
+func (broker *LocalBroker) GetDemand() EntityKeyList {
+	return broker.handler.GetDemand(broker.Uri())
+}
+
+// Sets the handler called on each demand change (see BrokerHandler.SetDemandHandler).
+func (broker *LocalBroker) SetDemandHandler(hook DemandHandler) *LocalBroker {
+	broker.handler.SetDemandHandler(hook)
+	return broker
+}
+
+// Sends the demand changes to the remote publishers (see BrokerHandler.EnableRemoteDemand).
+func (broker *LocalBroker) EnableRemoteDemand(area UShort, areaVersion UOctet, service UShort, operation UShort) *LocalBroker {
+	broker.handler.EnableRemoteDemand(area, areaVersion, service, operation)
+	return broker
+}
+
+// Sets the value filters of a subscription (see BrokerHandler.SetSubscriptionFilters).
+func (broker *LocalBroker) SetSubscriptionFilters(subscriber *URI, subid Identifier, filters ...*archive.CompositeFilter) error {
+	return broker.handler.SetSubscriptionFilters(subscriber, subid, filters...)
+}
+
+// Sets the change detection of a subscription (see BrokerHandler.SetSubscriptionChange).
+func (broker *LocalBroker) SetSubscriptionChange(subscriber *URI, subid Identifier, change *ChangeFilter) error {
+	return broker.handler.SetSubscriptionChange(subscriber, subid, change)
+}
+
+// Enables the registration with value filters (see BrokerHandler.EnableRegisterFilters).
+func (broker *LocalBroker) EnableRegisterFilters(area UShort, areaVersion UOctet, service UShort, operation UShort) error {
+	return broker.handler.EnableRegisterFilters(area, areaVersion, service, operation)
+}
+
+// Registers the filter service of the broker (see BrokerHandler.RegisterFilterService).
+func (broker *LocalBroker) RegisterFilterService(area UShort, areaVersion UOctet, service UShort) error {
+	return broker.handler.RegisterFilterService(area, areaVersion, service)
+}
+
+// Enables the keyed publish-subscribe model (see BrokerHandler.EnableKeyedModel).
+func (broker *LocalBroker) EnableKeyedModel(area UShort, areaVersion UOctet, service UShort, operation UShort, schema KeySchema) error {
+	return broker.handler.EnableKeyedModel(area, areaVersion, service, operation, schema)
+}
+
+// Registers the federation service of the broker (see BrokerHandler.RegisterFederationService).
+func (broker *LocalBroker) RegisterFederationService(area UShort, areaVersion UOctet, service UShort) error {
+	return broker.handler.RegisterFederationService(area, areaVersion, service)
+}
+
+// Links the broker to a peer broker (see BrokerHandler.AddPeer).
+func (broker *LocalBroker) AddPeer(peer *URI) error {
+	return broker.handler.AddPeer(peer)
+}
+
+// Sets the persistent store of the registrations (see BrokerHandler.SetRegistrationStore).
+func (broker *LocalBroker) SetRegistrationStore(store RegistrationStore) error {
+	return broker.handler.SetRegistrationStore(store)
+}
+
+// Returns the statistics of the delivery queues of the active subscriptions.
+func (broker *LocalBroker) GetQueueStats() []QueueStats {
+	return broker.handler.GetQueueStats()
+}
+
+// Returns the active subscriptions (see BrokerHandler.ListSubscriptions).
+func (broker *LocalBroker) ListSubscriptions() SubscriptionInfoList {
+	return broker.handler.ListSubscriptions()
+}
+
+// Returns the registered publishers (see BrokerHandler.ListPublishers).
+func (broker *LocalBroker) ListPublishers() PublisherInfoList {
+	return broker.handler.ListPublishers()
+}
+
+// Forcibly removes a subscription (see BrokerHandler.RemoveSubscription).
+func (broker *LocalBroker) RemoveSubscription(subscriber *URI, subid Identifier) bool {
+	return broker.handler.RemoveSubscription(subscriber, subid)
+}
+
+// Forcibly removes the registration of a publisher (see BrokerHandler.RemovePublisher).
+func (broker *LocalBroker) RemovePublisher(publisher *URI) bool {
+	return broker.handler.RemovePublisher(publisher)
 }
 
 func NewLocalBroker(cctx *ClientContext, updtHandler UpdateValueHandler, area UShort, areaVersion UOctet, service UShort, operation UShort) (*LocalBroker, error) {
@@ -711,17 +1476,29 @@ func (handler *BrokerHandler) LocalPublishRegister(area UShort, areaVersion UOct
 	cctx := handler.cctx
 	pubid := string(*cctx.Uri)
 	logger.Infof("Broker.LocalPublishRegister: %v, %t", pubid, list)
-	handler.pubs[pubid] = &BrokerPub{
-		domain:      cctx.Domain,
-		session:     cctx.Session,
-		sessionName: cctx.SessionName,
-		serviceArea: area,
-		Service:     service,
-		operation:   operation,
-		keys:        list,
-		transaction: nil,
+	msg := &Message{
+		UriFrom:          cctx.Uri,
+		AuthenticationId: cctx.AuthenticationId,
+		EncodingId:       cctx.EncodingId,
+		QoSLevel:         cctx.QoSLevel,
+		Priority:         cctx.Priority,
+		Domain:           cctx.Domain,
+		NetworkZone:      cctx.NetworkZone,
+		Session:          cctx.Session,
+		SessionName:      cctx.SessionName,
+		ServiceArea:      area,
+		AreaVersion:      areaVersion,
+		Service:          service,
+		Operation:        operation,
+	}
+	if err := handler.addPub(pubid, newBrokerPub(msg, list, nil)); err != nil {
+		return err
 	}
 
+	reg := newRegistration(pubRegistrationKey(pubid), msg)
+	reg.Keys = list
+	handler.save(reg)
+
 	return nil
 }
 
@@ -734,18 +1511,42 @@ func (handler *BrokerHandler) LocalPublishDeregister() error {
 	pubid := string(*cctx.Uri)
 	logger.Infof("Broker.LocalPublishDeregister: %v", pubid)
 	// TODDO (AF): May be we have to verify if the publisher is registered.
+	handler.lock.Lock()
 	delete(handler.pubs, string(pubid))
+	handler.touchDemand()
+	handler.lock.Unlock()
+	handler.unsave(pubRegistrationKey(pubid))
 
 	return nil
 }
 
 //func (broker *LocalBroker) Publish(uhlist *UpdateHeaderList, updtHandler UpdateValueHandler) error {
 func (broker *LocalBroker) Publish(uhlist *UpdateHeaderList, uvlist ...ElementList) error {
-	broker.handler.updtHandler.InitUpdateValueList(uvlist)
-	return broker.handler.LocalPublish(broker.area, broker.areaVersion, broker.service, broker.operation, uhlist)
+	return broker.handler.LocalPublishValues(broker.area, broker.areaVersion, broker.service, broker.operation, uhlist, uvlist...)
 }
 
+// Publishes the update values previously set in the UpdateValueHandler given at the broker
+// creation. The calls are serialized, however the initialization of the handler by the caller
+// is not, LocalPublishValues should be used by concurrent publishers.
 func (handler *BrokerHandler) LocalPublish(area UShort, areaVersion UOctet, service UShort, operation UShort, uhlist *UpdateHeaderList) error {
+	handler.updtLock.Lock()
+	defer handler.updtLock.Unlock()
+	return handler.localPublish(area, areaVersion, service, operation, uhlist, handler.updtHandler)
+}
+
+// Publishes the specified update values, they are held by a new UpdateValueHandler so this
+// function can be called concurrently (see UpdateValueHandlerFactory).
+func (handler *BrokerHandler) LocalPublishValues(area UShort, areaVersion UOctet, service UShort, operation UShort, uhlist *UpdateHeaderList, uvlist ...ElementList) error {
+	updtHandler, release := handler.newUpdateValueHandler()
+	defer release()
+	err := updtHandler.InitUpdateValueList(uvlist)
+	if err != nil {
+		return err
+	}
+	return handler.localPublish(area, areaVersion, service, operation, uhlist, updtHandler)
+}
+
+func (handler *BrokerHandler) localPublish(area UShort, areaVersion UOctet, service UShort, operation UShort, uhlist *UpdateHeaderList, updtHandler UpdateValueHandler) error {
 	logger.Debugf("Broker.LocalPublish -> %v", uhlist)
 
 	cctx := handler.cctx
@@ -769,5 +1570,5 @@ func (handler *BrokerHandler) LocalPublish(area UShort, areaVersion UOctet, serv
 		TransactionId:    0,
 		Body:             nil,
 	}
-	return handler.doPublish(pub, uhlist, handler.updtHandler)
+	return handler.doPublish(pub, uhlist, updtHandler)
 }
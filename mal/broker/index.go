@@ -0,0 +1,274 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"strings"
+)
+
+// Value used in the bucket keys for the area, service or operation of a request matching
+// all areas, services or operations.
+const anyId int32 = -1
+
+// Identifies the bucket of the keys of an entity request, the requests of a bucket match
+// exactly the same update messages (see MAL specification 3.5.6.5 e to l).
+type bucketKey struct {
+	session     SessionType
+	sessionName Identifier
+	area        int32
+	service     int32
+	operation   int32
+	// Complete domain of the request (domain of the subscription and subdomain of the request)
+	domain string
+	// True if the domain is a prefix, ie the subdomain of the request ends with the wildcard
+	prefix bool
+}
+
+// Holds the keys of the requests of a bucket indexed by their first sub-key.
+type keyBucket struct {
+	bkey bucketKey
+	// Complete domain of the requests, ending with the wildcard if it is a prefix
+	domain    IdentifierList
+	values    map[Identifier][]*indexEntry
+	nulls     []*indexEntry
+	wildcards []*indexEntry
+}
+
+// An entity key of a subscription.
+type indexEntry struct {
+	sub    *BrokerSub
+	key    *EntityKey
+	bucket *keyBucket
+}
+
+// Index of the subscriptions of a broker, it allows to evaluate each update only against the
+// keys of the requests that may match the update message.
+type subIndex struct {
+	buckets map[bucketKey]*keyBucket
+	// Entries of each subscription, used to remove it
+	entries map[*BrokerSub][]*indexEntry
+}
+
+// Subscription matching a publication, with the index of the matching updates.
+type subMatch struct {
+	sub     *BrokerSub
+	updates []int
+}
+
+func newSubIndex() *subIndex {
+	return &subIndex{
+		buckets: make(map[bucketKey]*keyBucket),
+		entries: make(map[*BrokerSub][]*indexEntry),
+	}
+}
+
+// Returns the keys of the domain and of each of its prefixes, the key of the domain is the
+// last one.
+func domainKeys(domain []*Identifier) []string {
+	keys := make([]string, len(domain)+1)
+	var builder strings.Builder
+	for i, id := range domain {
+		builder.WriteByte(0)
+		builder.WriteString(string(*id))
+		keys[i+1] = builder.String()
+	}
+	return keys
+}
+
+func selector(all Boolean, id UShort) int32 {
+	if all {
+		return anyId
+	}
+	return int32(id)
+}
+
+// Adds the keys of all entity requests of the subscription.
+func (idx *subIndex) add(sub *BrokerSub) {
+	entries := make([]*indexEntry, 0)
+	for _, request := range []*EntityRequest(*sub.entities) {
+		// e) f) g) The subdomain is appended to the domain of the subscription, its final
+		// Identifier may be the wildcard
+		domain := []*Identifier(sub.domain)
+		prefix := false
+		if request.SubDomain != nil {
+			domain = make([]*Identifier, 0, len(sub.domain)+len(*request.SubDomain))
+			domain = append(domain, sub.domain...)
+			domain = append(domain, *request.SubDomain...)
+			if (len(domain) > 0) && (*domain[len(domain)-1] == "*") {
+				prefix = true
+				domain = domain[:len(domain)-1]
+			}
+		}
+		bkey := bucketKey{
+			session:     sub.session,
+			sessionName: sub.sessionName,
+			area:        selector(request.AllAreas, sub.serviceArea),
+			service:     selector(request.AllServices, sub.service),
+			operation:   selector(request.AllOperations, sub.operation),
+			domain:      domainKeys(domain)[len(domain)],
+			prefix:      prefix,
+		}
+		bucket := idx.buckets[bkey]
+		if bucket == nil {
+			bucket = &keyBucket{bkey: bkey, values: make(map[Identifier][]*indexEntry)}
+			bucket.domain = make([]*Identifier, 0, len(domain)+1)
+			bucket.domain = append(bucket.domain, domain...)
+			if prefix {
+				bucket.domain = append(bucket.domain, NewIdentifier("*"))
+			}
+			idx.buckets[bkey] = bucket
+		}
+		for _, rkey := range []*EntityKey(request.EntityKeys) {
+			entry := &indexEntry{sub: sub, key: rkey, bucket: bucket}
+			if rkey.FirstSubKey == nil {
+				bucket.nulls = append(bucket.nulls, entry)
+			} else if *rkey.FirstSubKey == "*" {
+				bucket.wildcards = append(bucket.wildcards, entry)
+			} else {
+				bucket.values[*rkey.FirstSubKey] = append(bucket.values[*rkey.FirstSubKey], entry)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	idx.entries[sub] = entries
+}
+
+func removeEntry(entries []*indexEntry, entry *indexEntry) []*indexEntry {
+	for i, e := range entries {
+		if e == entry {
+			entries[i] = entries[len(entries)-1]
+			entries[len(entries)-1] = nil
+			return entries[:len(entries)-1]
+		}
+	}
+	return entries
+}
+
+// Removes all keys of the subscription.
+func (idx *subIndex) remove(sub *BrokerSub) {
+	for _, entry := range idx.entries[sub] {
+		bucket := entry.bucket
+		if entry.key.FirstSubKey == nil {
+			bucket.nulls = removeEntry(bucket.nulls, entry)
+		} else if *entry.key.FirstSubKey == "*" {
+			bucket.wildcards = removeEntry(bucket.wildcards, entry)
+		} else {
+			values := removeEntry(bucket.values[*entry.key.FirstSubKey], entry)
+			if len(values) == 0 {
+				delete(bucket.values, *entry.key.FirstSubKey)
+			} else {
+				bucket.values[*entry.key.FirstSubKey] = values
+			}
+		}
+		if (len(bucket.nulls) == 0) && (len(bucket.wildcards) == 0) && (len(bucket.values) == 0) {
+			delete(idx.buckets, bucket.bkey)
+		}
+	}
+	delete(idx.entries, sub)
+}
+
+// Returns the buckets whose requests match the update message, regardless of the keys.
+func (idx *subIndex) candidates(msg *Message) []*keyBucket {
+	domains := domainKeys(msg.Domain)
+	buckets := make([]*keyBucket, 0)
+	bkey := bucketKey{session: msg.Session, sessionName: msg.SessionName}
+	for _, area := range [2]int32{int32(msg.ServiceArea), anyId} {
+		bkey.area = area
+		for _, service := range [2]int32{int32(msg.Service), anyId} {
+			bkey.service = service
+			for _, operation := range [2]int32{int32(msg.Operation), anyId} {
+				bkey.operation = operation
+				// The complete domain, then each prefix of the domain
+				bkey.domain, bkey.prefix = domains[len(domains)-1], false
+				if bucket := idx.buckets[bkey]; bucket != nil {
+					buckets = append(buckets, bucket)
+				}
+				for _, domain := range domains {
+					bkey.domain, bkey.prefix = domain, true
+					if bucket := idx.buckets[bkey]; bucket != nil {
+						buckets = append(buckets, bucket)
+					}
+				}
+			}
+		}
+	}
+	return buckets
+}
+
+// Returns the subscriptions matching the updates of a publication, for each one the indexes
+// of the matching updates are in ascending order.
+func (idx *subIndex) match(msg *Message, uhlist *UpdateHeaderList) []*subMatch {
+	return matchBuckets(idx.candidates(msg), uhlist)
+}
+
+// Returns the subscriptions of the buckets matching the updates.
+func matchBuckets(buckets []*keyBucket, uhlist *UpdateHeaderList) []*subMatch {
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	found := make(map[*BrokerSub]*subMatch)
+	matches := make([]*subMatch, 0)
+	check := func(entries []*indexEntry, i int, key *EntityKey) {
+		for _, entry := range entries {
+			m := found[entry.sub]
+			if (m != nil) && (m.updates[len(m.updates)-1] == i) {
+				// This update already matches the subscription
+				continue
+			}
+			if entry.key.Match(key) {
+				if m == nil {
+					m = &subMatch{sub: entry.sub}
+					found[entry.sub] = m
+					matches = append(matches, m)
+				}
+				m.updates = append(m.updates, i)
+			}
+		}
+	}
+	for i, hdr := range *uhlist {
+		key := &hdr.Key
+		for _, bucket := range buckets {
+			if key.FirstSubKey == nil {
+				check(bucket.nulls, i, key)
+			} else {
+				check(bucket.values[*key.FirstSubKey], i, key)
+			}
+			check(bucket.wildcards, i, key)
+		}
+	}
+	return matches
+}
+
+// Returns all entries of the bucket.
+func (bucket *keyBucket) entries() []*indexEntry {
+	entries := make([]*indexEntry, 0, len(bucket.nulls)+len(bucket.wildcards))
+	entries = append(entries, bucket.nulls...)
+	entries = append(entries, bucket.wildcards...)
+	for _, values := range bucket.values {
+		entries = append(entries, values...)
+	}
+	return entries
+}
@@ -0,0 +1,224 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"fmt"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Reference implementation: evaluates each update against each subscription.
+func linearMatch(subs []*BrokerSub, msg *Message, uhlist *UpdateHeaderList) map[*BrokerSub][]int {
+	result := make(map[*BrokerSub][]int)
+	for _, sub := range subs {
+		for idx, hdr := range *uhlist {
+			if sub.matches(msg, &hdr.Key) {
+				result[sub] = append(result[sub], idx)
+			}
+		}
+	}
+	return result
+}
+
+func indexMatch(index *subIndex, msg *Message, uhlist *UpdateHeaderList) map[*BrokerSub][]int {
+	result := make(map[*BrokerSub][]int)
+	for _, match := range index.match(msg, uhlist) {
+		result[match.sub] = match.updates
+	}
+	return result
+}
+
+func identifiers(names ...string) IdentifierList {
+	list := make([]*Identifier, len(names))
+	for i, name := range names {
+		list[i] = NewIdentifier(name)
+	}
+	return IdentifierList(list)
+}
+
+var (
+	testDomains    = []IdentifierList{identifiers(), identifiers("sc1"), identifiers("sc1", "payload"), identifiers("sc2", "payload")}
+	testSubDomains = []*IdentifierList{nil, nil}
+	testSessions   = []SessionType{SESSIONTYPE_LIVE, SESSIONTYPE_SIMULATION}
+)
+
+func init() {
+	for _, subdomain := range []IdentifierList{identifiers("*"), identifiers("payload"), identifiers("payload", "*")} {
+		subdomain := subdomain
+		testSubDomains = append(testSubDomains, &subdomain)
+	}
+}
+
+func randomSubKey(rnd *rand.Rand, wildcard bool, n int) *Long {
+	if wildcard && (rnd.Intn(4) == 0) {
+		return NewLong(0)
+	}
+	return NewLong(int64(rnd.Intn(n) + 1))
+}
+
+// Creates an entity key, the first sub-key of a request key may be the wildcard.
+func randomKey(rnd *rand.Rand, request bool, nkeys int) *EntityKey {
+	first := NewIdentifier(fmt.Sprintf("key%d", rnd.Intn(nkeys)))
+	if request && (rnd.Intn(8) == 0) {
+		first = NewIdentifier("*")
+	}
+	return &EntityKey{first, randomSubKey(rnd, request, 2), randomSubKey(rnd, request, 2), randomSubKey(rnd, request, 2)}
+}
+
+func randomSub(rnd *rand.Rand, id int, nkeys int) *BrokerSub {
+	requests := make([]*EntityRequest, 1+rnd.Intn(2))
+	for i := range requests {
+		keys := make([]*EntityKey, 1+rnd.Intn(4))
+		for j := range keys {
+			keys[j] = randomKey(rnd, true, nkeys)
+		}
+		requests[i] = &EntityRequest{
+			SubDomain:     testSubDomains[rnd.Intn(len(testSubDomains))],
+			AllAreas:      Boolean(rnd.Intn(4) == 0),
+			AllServices:   Boolean(rnd.Intn(4) == 0),
+			AllOperations: Boolean(rnd.Intn(4) == 0),
+			EntityKeys:    EntityKeyList(keys),
+		}
+	}
+	entities := EntityRequestList(requests)
+	return &BrokerSub{
+		subid:       Identifier(fmt.Sprintf("sub%d", id)),
+		domain:      testDomains[rnd.Intn(len(testDomains))],
+		session:     testSessions[rnd.Intn(len(testSessions))],
+		serviceArea: UShort(200 + rnd.Intn(2)),
+		service:     UShort(1 + rnd.Intn(2)),
+		operation:   UShort(1 + rnd.Intn(2)),
+		entities:    &entities,
+	}
+}
+
+func randomPublish(rnd *rand.Rand, nupdates int, nkeys int) (*Message, *UpdateHeaderList) {
+	msg := &Message{
+		Domain:      testDomains[rnd.Intn(len(testDomains))],
+		Session:     testSessions[rnd.Intn(len(testSessions))],
+		ServiceArea: UShort(200 + rnd.Intn(2)),
+		Service:     UShort(1 + rnd.Intn(2)),
+		Operation:   UShort(1 + rnd.Intn(2)),
+	}
+	hdrs := make([]*UpdateHeader, nupdates)
+	for i := range hdrs {
+		hdrs[i] = &UpdateHeader{Key: *randomKey(rnd, false, nkeys)}
+	}
+	uhlist := UpdateHeaderList(hdrs)
+	return msg, &uhlist
+}
+
+// The index must give the same results than the evaluation of each subscription.
+func TestSubIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	index := newSubIndex()
+	subs := make([]*BrokerSub, 0)
+	for i := 0; i < 200; i++ {
+		sub := randomSub(rnd, i, 10)
+		subs = append(subs, sub)
+		index.add(sub)
+	}
+	// Removes some subscriptions
+	for i := 0; i < 50; i++ {
+		idx := rnd.Intn(len(subs))
+		index.remove(subs[idx])
+		subs = append(subs[:idx], subs[idx+1:]...)
+	}
+
+	matches := 0
+	for i := 0; i < 500; i++ {
+		msg, uhlist := randomPublish(rnd, 20, 10)
+		expected := linearMatch(subs, msg, uhlist)
+		result := indexMatch(index, msg, uhlist)
+		if !reflect.DeepEqual(expected, result) {
+			t.Fatalf("Publish #%d: index matches %v, expect %v", i, result, expected)
+		}
+		matches += len(result)
+	}
+	if matches == 0 {
+		t.Error("The test publications should match subscriptions")
+	}
+
+	// Removes all subscriptions
+	for _, sub := range subs {
+		index.remove(sub)
+	}
+	if (len(index.buckets) != 0) || (len(index.entries) != 0) {
+		t.Errorf("Index not empty: %d buckets, %d entries", len(index.buckets), len(index.entries))
+	}
+}
+
+// Null first sub-keys only match null or wildcard request keys.
+func TestSubIndexNullKey(t *testing.T) {
+	entities := EntityRequestList([]*EntityRequest{&EntityRequest{
+		EntityKeys: EntityKeyList([]*EntityKey{&EntityKey{nil, NewLong(0), NewLong(0), NewLong(0)}}),
+	}})
+	sub := &BrokerSub{subid: "sub", session: SESSIONTYPE_LIVE, serviceArea: 200, service: 1, operation: 1, entities: &entities}
+	index := newSubIndex()
+	index.add(sub)
+
+	msg := &Message{Session: SESSIONTYPE_LIVE, ServiceArea: 200, Service: 1, Operation: 1}
+	uhlist := UpdateHeaderList([]*UpdateHeader{
+		&UpdateHeader{Key: EntityKey{NewIdentifier("key"), NewLong(1), NewLong(1), NewLong(1)}},
+		&UpdateHeader{Key: EntityKey{nil, NewLong(1), NewLong(1), NewLong(1)}},
+	})
+	matches := index.match(msg, &uhlist)
+	if (len(matches) != 1) || !reflect.DeepEqual(matches[0].updates, []int{1}) {
+		t.Errorf("Bad matches %+v", matches)
+	}
+}
+
+func benchmarkMatch(b *testing.B, indexed bool) {
+	rnd := rand.New(rand.NewSource(1))
+	index := newSubIndex()
+	subs := make([]*BrokerSub, 0)
+	for i := 0; i < 500; i++ {
+		sub := randomSub(rnd, i, 5000)
+		subs = append(subs, sub)
+		index.add(sub)
+	}
+	msg, uhlist := randomPublish(rnd, 1000, 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if indexed {
+			index.match(msg, uhlist)
+		} else {
+			linearMatch(subs, msg, uhlist)
+		}
+	}
+}
+
+// Matches a publication of 1000 updates against 500 subscriptions using the previous linear
+// evaluation of each subscription.
+func BenchmarkMatchLinear(b *testing.B) {
+	benchmarkMatch(b, false)
+}
+
+// Matches a publication of 1000 updates against 500 subscriptions using the index.
+func BenchmarkMatchIndex(b *testing.B) {
+	benchmarkMatch(b, true)
+}
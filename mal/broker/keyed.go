@@ -0,0 +1,553 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+)
+
+// Names of the keys of the keyed publish-subscribe model (see EnableKeyedModel). They are
+// mapped in order on the sub-keys of an EntityKey, so that the clients of both models share
+// the same updates: the first key holds an Identifier or a String, the others an integer
+// attribute up to Long. A key missing from an update is a NULL sub-key.
+type KeySchema []Identifier
+
+// Returns the position of the named key in the sub-keys, -1 if it is unknown.
+func (schema KeySchema) position(name Identifier) int {
+	for pos, id := range schema {
+		if id == name {
+			return pos
+		}
+	}
+	return -1
+}
+
+// Returns the position of each named key, or an UNKNOWN error with the unknown names.
+func (schema KeySchema) positions(names IdentifierList) ([]int, error) {
+	positions := make([]int, len(names))
+	var unknown IdentifierList
+	for i, name := range names {
+		positions[i] = schema.position(*name)
+		if positions[i] < 0 {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) != 0 {
+		return nil, NewMalError(ERROR_UNKNOWN, &unknown)
+	}
+	return positions, nil
+}
+
+// Builds the EntityKey of an update of the keyed model, the values are given in the order of
+// the names.
+func (schema KeySchema) EntityKey(names IdentifierList, values NullableAttributeList) (*EntityKey, error) {
+	if len(values) != len(names) {
+		msg := fmt.Sprintf("%d key values for %d keys", len(values), len(names))
+		return nil, NewMalError(ERROR_BAD_ENCODING, NewString(msg))
+	}
+	positions, err := schema.positions(names)
+	if err != nil {
+		return nil, err
+	}
+	key := &EntityKey{}
+	for i, pos := range positions {
+		part, err := newKeyPart(pos, values[i])
+		if err != nil {
+			return nil, err
+		}
+		part.set(key, pos)
+	}
+	return key, nil
+}
+
+// Returns the values of the named keys in an EntityKey, the value of an unknown key is NULL.
+func (schema KeySchema) KeyValues(key *EntityKey, names IdentifierList) NullableAttributeList {
+	values := make(NullableAttributeList, len(names))
+	for i, name := range names {
+		pos := schema.position(*name)
+		if pos == 0 {
+			if key.FirstSubKey != nil {
+				values[i] = NewIdentifier(string(*key.FirstSubKey))
+			}
+		} else if pos > 0 {
+			if subkey := longSubKey(key, pos); subkey != nil {
+				values[i] = NewLong(int64(*subkey))
+			}
+		}
+	}
+	return values
+}
+
+func longSubKey(key *EntityKey, pos int) *Long {
+	switch pos {
+	case 1:
+		return key.SecondSubKey
+	case 2:
+		return key.ThirdSubKey
+	case 3:
+		return key.FourthSubKey
+	}
+	return nil
+}
+
+// Returns an EntityKey with the wildcard value for the specified sub-keys, the others are NULL.
+func wildcardKey(positions ...int) *EntityKey {
+	key := &EntityKey{}
+	for _, pos := range positions {
+		switch pos {
+		case 0:
+			key.FirstSubKey = NewIdentifier("*")
+		case 1:
+			key.SecondSubKey = NewLong(0)
+		case 2:
+			key.ThirdSubKey = NewLong(0)
+		case 3:
+			key.FourthSubKey = NewLong(0)
+		}
+	}
+	return key
+}
+
+// Value of a sub-key.
+type keyPart struct {
+	null bool
+	id   Identifier
+	long Long
+}
+
+// Converts the value of the key at the specified position.
+func newKeyPart(pos int, value Attribute) (keyPart, error) {
+	if (value == nil) || value.IsNull() {
+		return keyPart{null: true}, nil
+	}
+	if pos == 0 {
+		switch v := value.(type) {
+		case *Identifier:
+			return keyPart{id: *v}, nil
+		case *String:
+			return keyPart{id: Identifier(*v)}, nil
+		}
+		return keyPart{}, NewMalError(ERROR_BAD_ENCODING, NewString("The first key must be an Identifier or a String"))
+	}
+	switch v := value.(type) {
+	case *Octet:
+		return keyPart{long: Long(*v)}, nil
+	case *UOctet:
+		return keyPart{long: Long(*v)}, nil
+	case *Short:
+		return keyPart{long: Long(*v)}, nil
+	case *UShort:
+		return keyPart{long: Long(*v)}, nil
+	case *Integer:
+		return keyPart{long: Long(*v)}, nil
+	case *UInteger:
+		return keyPart{long: Long(*v)}, nil
+	case *Long:
+		return keyPart{long: *v}, nil
+	}
+	return keyPart{}, NewMalError(ERROR_BAD_ENCODING, NewString("The keys other than the first one must be integers"))
+}
+
+func (part keyPart) set(key *EntityKey, pos int) {
+	if part.null {
+		switch pos {
+		case 0:
+			key.FirstSubKey = nil
+		case 1:
+			key.SecondSubKey = nil
+		case 2:
+			key.ThirdSubKey = nil
+		case 3:
+			key.FourthSubKey = nil
+		}
+		return
+	}
+	switch pos {
+	case 0:
+		key.FirstSubKey = NewIdentifier(string(part.id))
+	case 1:
+		key.SecondSubKey = NewLong(int64(part.long))
+	case 2:
+		key.ThirdSubKey = NewLong(int64(part.long))
+	case 3:
+		key.FourthSubKey = NewLong(int64(part.long))
+	}
+}
+
+// Returns true if the sub-key has exactly this value, the wildcards of the EntityKey do not
+// apply.
+func (part keyPart) matches(key *EntityKey, pos int) bool {
+	if pos == 0 {
+		if key.FirstSubKey == nil {
+			return part.null
+		}
+		return !part.null && (*key.FirstSubKey == part.id)
+	}
+	subkey := longSubKey(key, pos)
+	if subkey == nil {
+		return part.null
+	}
+	return !part.null && (*subkey == part.long)
+}
+
+// Maximum number of entity keys of the translation of a keyed subscription.
+const maxTranslatedKeys = 256
+
+// Filter of a keyed subscription on the key at the specified position.
+type keyFilter struct {
+	pos   int
+	parts []keyPart
+}
+
+// Keyed part of a subscription: the exact filters, as the translated entity requests may
+// match more updates ('*' and 0 are wildcards in an EntityKey), and the names of the keys
+// whose values are notified.
+type keyedSub struct {
+	schema   KeySchema
+	filters  []keyFilter
+	selected IdentifierList
+}
+
+func (keyed *keyedSub) matches(key *EntityKey) bool {
+	for _, filter := range keyed.filters {
+		found := false
+		for _, part := range filter.parts {
+			if part.matches(key, filter.pos) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the updates whose keys match the filters.
+func (keyed *keyedSub) selectUpdates(uhlist *UpdateHeaderList, updates []int) []int {
+	selected := make([]int, 0, len(updates))
+	for _, idx := range updates {
+		if keyed.matches(&(*uhlist)[idx].Key) {
+			selected = append(selected, idx)
+		}
+	}
+	return selected
+}
+
+// Builds the header notifying an update published in the specified domain.
+func (keyed *keyedSub) header(hdr *UpdateHeader, domain IdentifierList) *KeyedUpdateHeader {
+	return &KeyedUpdateHeader{
+		Source:    Identifier(hdr.SourceURI),
+		Domain:    &domain,
+		KeyValues: keyed.schema.KeyValues(&hdr.Key, keyed.selected),
+	}
+}
+
+// Translates a keyed subscription into a subscription with a single entity request matching
+// at least the same updates. Returns also the domain of the subscription and its keyed part.
+func (schema KeySchema) translate(msg *Message, sub *KeyedSubscription) (*Subscription, IdentifierList, *keyedSub, error) {
+	keyed := &keyedSub{schema: schema}
+	if sub.SelectedKeys != nil {
+		if _, err := schema.positions(*sub.SelectedKeys); err != nil {
+			return nil, nil, nil, err
+		}
+		keyed.selected = *sub.SelectedKeys
+	} else {
+		for i := range schema {
+			keyed.selected = append(keyed.selected, &schema[i])
+		}
+	}
+	if sub.Filters != nil {
+		for _, filter := range *sub.Filters {
+			pos := schema.position(filter.Name)
+			if pos < 0 {
+				return nil, nil, nil, NewMalError(ERROR_UNKNOWN, &IdentifierList{&filter.Name})
+			}
+			parts := make([]keyPart, 0, len(filter.Values))
+			for _, value := range filter.Values {
+				part, err := newKeyPart(pos, value)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				parts = append(parts, part)
+			}
+			keyed.filters = append(keyed.filters, keyFilter{pos, parts})
+		}
+	}
+
+	// The keys are the product of the values of the filters, the first filter of a key is
+	// enough as the updates are verified afterwards. A filter which would make the product
+	// exceed maxTranslatedKeys is ignored, the key remains a wildcard.
+	keys := []*EntityKey{wildcardKey(0, 1, 2, 3)}
+	filtered := make(map[int]bool)
+	for _, filter := range keyed.filters {
+		if filtered[filter.pos] || (len(keys)*len(filter.parts) > maxTranslatedKeys) {
+			continue
+		}
+		filtered[filter.pos] = true
+		product := make([]*EntityKey, 0, len(keys)*len(filter.parts))
+		for _, key := range keys {
+			for _, part := range filter.parts {
+				k := *key
+				part.set(&k, filter.pos)
+				product = append(product, &k)
+			}
+		}
+		keys = product
+	}
+
+	domain := msg.Domain
+	var subdomain *IdentifierList
+	if sub.Domain != nil {
+		domain = *sub.Domain
+		if n := len(domain); (n > 0) && (*domain[n-1] == "*") {
+			domain = domain[:n-1]
+			subdomain = &IdentifierList{NewIdentifier("*")}
+		}
+	}
+	request := &EntityRequest{subdomain, false, false, false, false, EntityKeyList(keys)}
+	return &Subscription{sub.SubscriptionId, EntityRequestList{request}}, domain, keyed, nil
+}
+
+// Enables the keyed publish-subscribe model of the newer MAL drafts (MAL v2) for the clients
+// of the broker using the specified area version, with the keys of the schema (up to 4). The
+// clients of both models share the same updates: the keyed updates are translated into
+// updates with an EntityKey (see KeySchema) and notified to the matching subscriptions of
+// both models, the notifications of the keyed subscriptions hold a single update. With
+// batching (see SetBatching) the updates of a keyed subscription are gathered during the
+// window, then notified one by one.
+func (handler *BrokerHandler) EnableKeyedModel(area UShort, areaVersion UOctet, service UShort, operation UShort, schema KeySchema) error {
+	if (len(schema) == 0) || (len(schema) > 4) {
+		return errors.New("The key schema must have 1 to 4 keys")
+	}
+	for i := range schema {
+		if schema.position(schema[i]) != i {
+			return fmt.Errorf("Duplicate key %s in the key schema", schema[i])
+		}
+	}
+	handler.lock.Lock()
+	handler.keySchema = append(KeySchema(nil), schema...)
+	handler.lock.Unlock()
+
+	return handler.cctx.RegisterBrokerHandler(area, areaVersion, service, operation, func(msg *Message, t Transaction) error {
+		handler.touch(msg.UriFrom)
+		if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH_REGISTER {
+			handler.OnKeyedPublishRegister(msg, t.(PublisherTransaction))
+		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH {
+			handler.OnKeyedPublish(msg, t.(PublisherTransaction))
+		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_PUBLISH_DEREGISTER {
+			handler.OnPublishDeregister(msg, t.(PublisherTransaction))
+		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_REGISTER {
+			handler.OnKeyedRegister(msg, t.(SubscriberTransaction))
+		} else if msg.InteractionStage == MAL_IP_STAGE_PUBSUB_DEREGISTER {
+			handler.OnDeregister(msg, t.(SubscriberTransaction))
+		} else {
+			return errors.New("Bad stage")
+		}
+		return nil
+	})
+}
+
+func (handler *BrokerHandler) getKeySchema() KeySchema {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	return handler.keySchema
+}
+
+func (handler *BrokerHandler) keyedRegister(msg *Message, transaction SubscriberTransaction) (*BrokerSub, error) {
+	p, err := msg.DecodeLastParameter(NullKeyedSubscription, false)
+	if err != nil {
+		return nil, err
+	}
+	keyedsub := p.(*KeyedSubscription)
+	schema := handler.getKeySchema()
+	bsub, err := newKeyedSub(msg, schema, keyedsub, transaction)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Broker.RegisterKeyed: %s -> %v", bsub.key, *bsub.entities)
+	if err := handler.addSub(bsub); err != nil {
+		return nil, err
+	}
+
+	reg := newRegistration(subRegistrationKey(bsub.key), msg)
+	reg.Subscription = &Subscription{bsub.subid, *bsub.entities}
+	reg.KeySchema = schema
+	reg.KeyedSubscription, err = encodeElement(keyedsub)
+	if err != nil {
+		logger.Errorf("Broker: cannot save registration %s: %s", reg.Key, err)
+		handler.unsave(reg.Key)
+		return bsub, nil
+	}
+	bsub.reg = reg
+	handler.saveSub(bsub)
+	return bsub, nil
+}
+
+// Creates the subscription translating a subscription of the keyed model.
+func newKeyedSub(msg *Message, schema KeySchema, keyedsub *KeyedSubscription, transaction SubscriberTransaction) (*BrokerSub, error) {
+	sub, domain, keyed, err := schema.translate(msg, keyedsub)
+	if err != nil {
+		return nil, err
+	}
+	bsub := newBrokerSub(msg, sub, transaction)
+	bsub.domain = domain
+	bsub.keyed = keyed
+	return bsub, nil
+}
+
+// Restores a saved subscription of the keyed model.
+func restoreKeyedSub(msg *Message, reg *Registration, transaction SubscriberTransaction) (*BrokerSub, error) {
+	p, err := decodeElement(reg.KeyedSubscription, NullKeyedSubscription)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyedSub(msg, reg.KeySchema, p.(*KeyedSubscription), transaction)
+}
+
+func (handler *BrokerHandler) OnKeyedRegister(msg *Message, transaction SubscriberTransaction) error {
+	sub, err := handler.keyedRegister(msg, transaction)
+	if err != nil {
+		return transaction.AckRegister(errorBody(transaction, err), true)
+	}
+	err = transaction.AckRegister(nil, false)
+	if err != nil {
+		return err
+	}
+	handler.sendLastValues(sub)
+	return nil
+}
+
+func (handler *BrokerHandler) keyedPublishRegister(msg *Message, transaction PublisherTransaction) error {
+	p, err := msg.DecodeLastParameter(NullIdentifierList, false)
+	if err != nil {
+		return err
+	}
+	names := append(IdentifierList{}, *p.(*IdentifierList)...)
+	positions, err := handler.getKeySchema().positions(names)
+	if err != nil {
+		return err
+	}
+	for i, pos := range positions {
+		for _, other := range positions[:i] {
+			if pos == other {
+				return NewMalError(ERROR_BAD_ENCODING, NewString(fmt.Sprintf("Duplicate key %s", *names[i])))
+			}
+		}
+	}
+	logger.Infof("Broker.PublishRegisterKeyed: %v", names)
+
+	// The publisher may publish any value of its keys, the other keys are NULL
+	pub := newBrokerPub(msg, &EntityKeyList{wildcardKey(positions...)}, transaction)
+	pub.keyNames = names
+	pubid := string(*msg.UriFrom)
+	if err := handler.addPub(pubid, pub); err != nil {
+		return err
+	}
+
+	reg := newRegistration(pubRegistrationKey(pubid), msg)
+	reg.Keys = pub.keys
+	reg.KeyNames = names
+	handler.save(reg)
+	return nil
+}
+
+func (handler *BrokerHandler) OnKeyedPublishRegister(msg *Message, transaction PublisherTransaction) error {
+	err := handler.keyedPublishRegister(msg, transaction)
+	if err != nil {
+		return transaction.AckRegister(errorBody(transaction, err), true)
+	}
+	return transaction.AckRegister(nil, false)
+}
+
+// Translates a keyed publish into a publish of a single update, the domain of the update
+// header, if any, replaces the domain of the message. It is checked against the domain of the
+// publisher registration (see BrokerPub.verify).
+func (handler *BrokerHandler) keyedPublish(pub *Message) error {
+	p, err := pub.DecodeParameter(NullKeyedUpdateHeader)
+	if err != nil {
+		return err
+	}
+	header := p.(*KeyedUpdateHeader)
+	updtHandler, release := handler.newUpdateValueHandler()
+	defer release()
+	err = updtHandler.DecodeUpdateValueList(pub.Body)
+	if err != nil {
+		return err
+	}
+
+	handler.lock.RLock()
+	publisher := handler.pubs[string(*pub.UriFrom)]
+	schema := handler.keySchema
+	handler.lock.RUnlock()
+	if (publisher == nil) || (publisher.keyNames == nil) {
+		logger.Warnf("Keyed publisher not registered: %s", *pub.UriFrom)
+		return NewMalError(ERROR_INCORRECT_STATE)
+	}
+	key, err := schema.EntityKey(publisher.keyNames, header.KeyValues)
+	if err != nil {
+		return err
+	}
+
+	msg := *pub
+	if header.Domain != nil {
+		msg.Domain = *header.Domain
+	}
+	uhlist := UpdateHeaderList([]*UpdateHeader{&UpdateHeader{pub.Timestamp, *pub.UriFrom, MAL_UPDATETYPE_UPDATE, *key}})
+	return handler.doPublish(&msg, &uhlist, updtHandler)
+}
+
+func (handler *BrokerHandler) OnKeyedPublish(msg *Message, transaction PublisherTransaction) error {
+	err := handler.keyedPublish(msg)
+	if err != nil {
+		// Returns a PublishError MAL message to publisher
+		transaction.PublishError(errorBody(transaction, err))
+		return err
+	}
+	return nil
+}
+
+// Sends the updates to a keyed subscription, a notification for each update.
+func (handler *BrokerHandler) notifyKeyed(sub *BrokerSub, domain IdentifierList, uhlist *UpdateHeaderList, updtHandler UpdateValueHandler, updates []int) {
+	for _, idx := range updates {
+		if !handler.notifyKeyedUpdate(sub, domain, (*uhlist)[idx], updtHandler, idx) {
+			return
+		}
+	}
+}
+
+// Sends to a keyed subscription the notification of the update at the specified index of the
+// UpdateValueHandler, returns false if the subscription is removed.
+func (handler *BrokerHandler) notifyKeyedUpdate(sub *BrokerSub, domain IdentifierList, hdr *UpdateHeader, updtHandler UpdateValueHandler, idx int) bool {
+	body := sub.transaction.NewBody()
+	body.EncodeParameter(&sub.subid)
+	body.EncodeParameter(sub.keyed.header(hdr, domain))
+	updtHandler.AppendValue(idx)
+	updtHandler.EncodeUpdateValueList(body)
+	return handler.notify(sub, []*EntityKey{&hdr.Key}, body)
+}
@@ -0,0 +1,458 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"context"
+	"fmt"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp"  // Needed to initialize TCP transport factory
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	keyed_broker_url     = "maltcp://127.0.0.1:16074"
+	keyed_subscriber_url = "maltcp://127.0.0.1:16075"
+	keyed_publisher_url  = "maltcp://127.0.0.1:16076"
+	mixed_broker_url     = "maltcp://127.0.0.1:16078"
+	mixed_subscriber_url = "maltcp://127.0.0.1:16079"
+	mixed_publisher_url  = "maltcp://127.0.0.1:16080"
+	kstore_broker_url    = "maltcp://127.0.0.1:16085"
+	kstore_client_url    = "maltcp://127.0.0.1:16086"
+)
+
+func newKeyedClient(t *testing.T, url string, name string) *ClientContext {
+	ctx, err := NewContext(url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	t.Cleanup(func() { ctx.Close() })
+	cctx, err := NewClientContext(ctx, name)
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	return cctx
+}
+
+// Waits for the next notify of a keyed subscription, verifies its key values and returns
+// its value.
+func keyedNotify(t *testing.T, subop SubscriberOperation, keyValues ...Attribute) byte {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	msg, err := subop.GetNotifyWithContext(ctx)
+	if err != nil {
+		t.Fatal("Error in GetNotify, ", err)
+	}
+	subid, header, err := DecodeKeyedNotify(msg)
+	if err != nil {
+		t.Fatal("Error decoding notify, ", err)
+	}
+	ok := (*subid == "Keyed") && (len(header.KeyValues) == len(keyValues))
+	for i := 0; ok && (i < len(keyValues)); i++ {
+		ok = *header.KeyValues[i].(*Long) == *keyValues[i].(*Long)
+	}
+	if !ok {
+		t.Errorf("Bad notified header %s %v, expect %v", *subid, header.KeyValues, keyValues)
+	}
+	p, err := msg.DecodeLastParameter(NullBlobList, false)
+	if err != nil {
+		t.Fatal("Error decoding values, ", err)
+	}
+	return (*(*p.(*BlobList))[0])[0]
+}
+
+// The updates of the publishers of both models are notified to the subscriptions of both
+// models.
+func TestKeyedModel(t *testing.T) {
+	broker, err := NewLocalBroker(newKeyedClient(t, keyed_broker_url, "broker"), NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	err = broker.EnableKeyedModel(200, MAL_KEYED_AREA_VERSION, 1, 1, KeySchema{"name", "index"})
+	if err != nil {
+		t.Fatal("Error enabling the keyed model, ", err)
+	}
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+
+	// Subscription of the keyed model to the index 0 of p1, only the index is notified
+	subscriber := newKeyedClient(t, keyed_subscriber_url, "subscriber")
+	keyedop := subscriber.NewSubscriberOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	_, err = keyedop.RegisterKeyed(&KeyedSubscription{
+		SubscriptionId: "Keyed",
+		SelectedKeys:   &IdentifierList{NewIdentifier("index")},
+		Filters: &SubscriptionFilterList{
+			&SubscriptionFilter{"name", NullableAttributeList{NewString("p1")}},
+			&SubscriptionFilter{"index", NullableAttributeList{NewLong(0)}},
+		},
+	})
+	if err != nil {
+		t.Fatal("Error registering keyed subscription, ", err)
+	}
+	badop := subscriber.NewSubscriberOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	_, err = badop.RegisterKeyed(&KeyedSubscription{SubscriptionId: "Bad", SelectedKeys: &IdentifierList{NewIdentifier("unknown")}})
+	if err == nil {
+		t.Error("Subscription with an unknown key should be rejected")
+	}
+	// Subscription to all keys
+	subop := subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body := subop.NewBody()
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, eklist}})
+	body.EncodeLastParameter(&Subscription{Identifier("All"), erlist}, false)
+	if _, err := subop.Register(body); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+
+	key := func(name string, index int64) UpdateHeader {
+		return UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_UPDATE, EntityKey{NewIdentifier(name), NewLong(index), nil, nil}}
+	}
+	hdrs := UpdateHeaderList([]*UpdateHeader{&UpdateHeader{}, &UpdateHeader{}, &UpdateHeader{}})
+	*hdrs[0], *hdrs[1], *hdrs[2] = key("p1", 1), key("p1", 0), key("p2", 0)
+	values := BlobList([]*Blob{&Blob{1}, &Blob{2}, &Blob{3}})
+	if err := broker.Publish(&hdrs, &values); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	if value := keyedNotify(t, keyedop, NewLong(0)); value != 2 {
+		t.Errorf("Bad notified value %d", value)
+	}
+
+	// Publisher of the keyed model
+	publisher := newKeyedClient(t, keyed_publisher_url, "publisher")
+	pubop := publisher.NewPublisherOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	if _, err := pubop.RegisterKeyed(&IdentifierList{NewIdentifier("name"), NewIdentifier("index")}); err != nil {
+		t.Fatal("Error registering keyed publisher, ", err)
+	}
+	header := &KeyedUpdateHeader{Source: "publisher", KeyValues: NullableAttributeList{NewIdentifier("p1"), NewInteger(0)}}
+	if err := pubop.PublishKeyed(header, &BlobList{&Blob{4}}); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	if value := keyedNotify(t, keyedop, NewLong(0)); value != 4 {
+		t.Errorf("Bad notified value %d", value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, count := range []int{3, 1} {
+		msg, err := subop.GetNotifyWithContext(ctx)
+		if err != nil {
+			t.Fatal("Error in GetNotify, ", err)
+		}
+		msg.DecodeParameter(NullIdentifier)
+		p, err := msg.DecodeParameter(NullUpdateHeaderList)
+		if err != nil {
+			t.Fatal("Error decoding notify, ", err)
+		}
+		if headers := *p.(*UpdateHeaderList); len(headers) != count {
+			t.Errorf("Bad notified headers %v", headers)
+		} else if count == 1 {
+			// The update of the keyed publisher
+			if (*headers[0].Key.FirstSubKey != "p1") || (*headers[0].Key.SecondSubKey != 0) || (headers[0].SourceURI != *publisher.Uri) {
+				t.Errorf("Bad translated header %v", headers[0])
+			}
+		}
+	}
+}
+
+// Registers a subscription to the specified keys.
+func registerKeys(t *testing.T, cctx *ClientContext, broker *URI, subid string, keys ...*EntityKey) SubscriberOperation {
+	subop := cctx.NewSubscriberOperation(broker, 200, 1, 1, 1)
+	body := subop.NewBody()
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, EntityKeyList(keys)}})
+	body.EncodeLastParameter(&Subscription{Identifier(subid), erlist}, false)
+	if _, err := subop.Register(body); err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+	return subop
+}
+
+// The updates of a keyed publisher using a part of the keys have NULL sub-keys, they are
+// matched against specific sub-keys of the other subscriptions. The translation of a keyed
+// subscription with many filter values is bounded.
+func TestKeyedMixedKeys(t *testing.T) {
+	broker, err := NewLocalBroker(newKeyedClient(t, mixed_broker_url, "broker"), NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	broker.SetLimits(Limits{MaxKeys: 256})
+	err = broker.EnableKeyedModel(200, MAL_KEYED_AREA_VERSION, 1, 1, KeySchema{"name", "index"})
+	if err != nil {
+		t.Fatal("Error enabling the keyed model, ", err)
+	}
+
+	subscriber := newKeyedClient(t, mixed_subscriber_url, "subscriber")
+	specific := registerKeys(t, subscriber, broker.Uri(), "Specific", &EntityKey{NewIdentifier("*"), NewLong(5), NewLong(0), NewLong(0)})
+	all := registerKeys(t, subscriber, broker.Uri(), "All", &EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)})
+	names := make(NullableAttributeList, 0, 300)
+	for i := 0; i < 300; i++ {
+		names = append(names, NewString(fmt.Sprintf("n%d", i)))
+	}
+	keyedop := subscriber.NewSubscriberOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	_, err = keyedop.RegisterKeyed(&KeyedSubscription{
+		SubscriptionId: "Keyed",
+		SelectedKeys:   &IdentifierList{},
+		Filters:        &SubscriptionFilterList{&SubscriptionFilter{"name", names}},
+	})
+	if err != nil {
+		t.Fatal("Error registering keyed subscription, ", err)
+	}
+
+	publisher := newKeyedClient(t, mixed_publisher_url, "publisher")
+	pubop := publisher.NewPublisherOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	if _, err := pubop.RegisterKeyed(&IdentifierList{NewIdentifier("name")}); err != nil {
+		t.Fatal("Error registering keyed publisher, ", err)
+	}
+	for i, name := range []string{"other", "n1"} {
+		header := &KeyedUpdateHeader{Source: "publisher", KeyValues: NullableAttributeList{NewIdentifier(name)}}
+		if err := pubop.PublishKeyed(header, &BlobList{&Blob{byte(i)}}); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+
+	if value := keyedNotify(t, keyedop); value != 1 {
+		t.Errorf("Bad notified value %d", value)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, name := range []string{"other", "n1"} {
+		msg, err := all.GetNotifyWithContext(ctx)
+		if err != nil {
+			t.Fatal("Error in GetNotify, ", err)
+		}
+		msg.DecodeParameter(NullIdentifier)
+		p, err := msg.DecodeParameter(NullUpdateHeaderList)
+		if err != nil {
+			t.Fatal("Error decoding notify, ", err)
+		}
+		key := (*p.(*UpdateHeaderList))[0].Key
+		if (*key.FirstSubKey != Identifier(name)) || (key.SecondSubKey != nil) {
+			t.Errorf("Bad notified key %v", key)
+		}
+	}
+	// Cancelling the wait ends the operation, so it is only checked last
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := specific.GetNotifyWithContext(ctx); err == nil {
+		t.Error("Unexpected notify")
+	}
+}
+
+// Waits for the next notify of a keyed subscription, returns its header and its value.
+func keyedUpdate(t *testing.T, subop SubscriberOperation) (*KeyedUpdateHeader, byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	msg, err := subop.GetNotifyWithContext(ctx)
+	if err != nil {
+		t.Fatal("Error in GetNotify, ", err)
+	}
+	_, header, err := DecodeKeyedNotify(msg)
+	if err != nil {
+		t.Fatal("Error decoding notify, ", err)
+	}
+	p, err := msg.DecodeLastParameter(NullBlobList, false)
+	if err != nil {
+		t.Fatal("Error decoding values, ", err)
+	}
+	return header, (*(*p.(*BlobList))[0])[0]
+}
+
+// A keyed publisher may publish in a sub-domain of its registration, not in another domain.
+func TestKeyedDomain(t *testing.T) {
+	broker, err := NewLocalBroker(newKeyedClient(t, "invm://kdomain_broker", "broker"), NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	err = broker.EnableKeyedModel(200, MAL_KEYED_AREA_VERSION, 1, 1, KeySchema{"name"})
+	if err != nil {
+		t.Fatal("Error enabling the keyed model, ", err)
+	}
+
+	subscriber := newKeyedClient(t, "invm://kdomain_subscriber", "subscriber")
+	subscriber.SetDomain(IdentifierList{NewIdentifier("a")})
+	keyedop := subscriber.NewSubscriberOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	_, err = keyedop.RegisterKeyed(&KeyedSubscription{
+		SubscriptionId: "Keyed",
+		Domain:         &IdentifierList{NewIdentifier("a"), NewIdentifier("*")},
+	})
+	if err != nil {
+		t.Fatal("Error registering keyed subscription, ", err)
+	}
+
+	publisher := newKeyedClient(t, "invm://kdomain_publisher", "publisher")
+	publisher.SetDomain(IdentifierList{NewIdentifier("a")})
+	pubop := publisher.NewPublisherOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	if _, err := pubop.RegisterKeyed(&IdentifierList{NewIdentifier("name")}); err != nil {
+		t.Fatal("Error registering keyed publisher, ", err)
+	}
+	header := &KeyedUpdateHeader{
+		Source:    "publisher",
+		Domain:    &IdentifierList{NewIdentifier("a"), NewIdentifier("b")},
+		KeyValues: NullableAttributeList{NewIdentifier("p1")},
+	}
+	if err := pubop.PublishKeyed(header, &BlobList{&Blob{1}}); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	notified, value := keyedUpdate(t, keyedop)
+	if (value != 1) || (notified.Domain == nil) || (len(*notified.Domain) != 2) || (*(*notified.Domain)[1] != "b") {
+		t.Errorf("Bad notified update %v %d", notified, value)
+	}
+
+	// The domain does not extend the domain of the registration
+	header.Domain = &IdentifierList{NewIdentifier("c")}
+	if err := pubop.PublishKeyed(header, &BlobList{&Blob{2}}); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	msg, err := pubop.GetPublishError()
+	if (err != nil) || (msg == nil) {
+		t.Fatal("Expect a PublishError, ", err)
+	}
+	if code, err := msg.DecodeParameter(NullUInteger); (err != nil) || (*code.(*UInteger) != ERROR_INCORRECT_STATE) {
+		t.Errorf("Bad PublishError %v, %v", code, err)
+	}
+}
+
+// Starts a broker of both models restoring the registrations saved in the specified file.
+func startKeyedStoredBroker(t *testing.T, path string) (*Context, *LocalBroker) {
+	ctx, err := NewContext(kstore_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	cctx, err := NewClientContext(ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	err = broker.EnableKeyedModel(200, MAL_KEYED_AREA_VERSION, 1, 1, KeySchema{"name", "index"})
+	if err != nil {
+		t.Fatal("Error enabling the keyed model, ", err)
+	}
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("Error creating store, ", err)
+	}
+	if err := broker.SetRegistrationStore(store); err != nil {
+		t.Fatal("Error restoring registrations, ", err)
+	}
+	return ctx, broker
+}
+
+// The keyed subscriptions and publishers are restored with their filters and keys.
+func TestKeyedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrations.json")
+	broker_ctx, broker := startKeyedStoredBroker(t, path)
+
+	client := newKeyedClient(t, kstore_client_url, "client")
+	keyedop := client.NewSubscriberOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	_, err := keyedop.RegisterKeyed(&KeyedSubscription{
+		SubscriptionId: "Keyed",
+		SelectedKeys:   &IdentifierList{NewIdentifier("index")},
+		Filters: &SubscriptionFilterList{
+			&SubscriptionFilter{"name", NullableAttributeList{NewString("p1")}},
+			&SubscriptionFilter{"index", NullableAttributeList{NewLong(2)}},
+		},
+	})
+	if err != nil {
+		t.Fatal("Error registering keyed subscription, ", err)
+	}
+	pubop := client.NewPublisherOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	if _, err := pubop.RegisterKeyed(&IdentifierList{NewIdentifier("name"), NewIdentifier("index")}); err != nil {
+		t.Fatal("Error registering keyed publisher, ", err)
+	}
+
+	// Restarts the broker, the subscriber and the publisher do not register again
+	broker.Close()
+	broker_ctx.Close()
+	time.Sleep(200 * time.Millisecond)
+	broker_ctx, broker = startKeyedStoredBroker(t, path)
+	defer broker_ctx.Close()
+	defer broker.Close()
+
+	for i, values := range []NullableAttributeList{
+		NullableAttributeList{NewIdentifier("p1"), NewLong(1)},
+		NullableAttributeList{NewIdentifier("p2"), NewLong(2)},
+		NullableAttributeList{NewIdentifier("p1"), NewLong(2)},
+	} {
+		header := &KeyedUpdateHeader{Source: "publisher", KeyValues: values}
+		if err := pubop.PublishKeyed(header, &BlobList{&Blob{byte(i)}}); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+	if value := keyedNotify(t, keyedop, NewLong(2)); value != 2 {
+		t.Errorf("Bad notified value %d", value)
+	}
+}
+
+// The updates of a keyed subscription are gathered in the batching window, then notified one
+// by one.
+func TestKeyedBatching(t *testing.T) {
+	broker, err := NewLocalBroker(newKeyedClient(t, "invm://kbatch_broker", "broker"), NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	broker.SetBatching(100*time.Millisecond, 0, true)
+	err = broker.EnableKeyedModel(200, MAL_KEYED_AREA_VERSION, 1, 1, KeySchema{"name", "index"})
+	if err != nil {
+		t.Fatal("Error enabling the keyed model, ", err)
+	}
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+
+	subscriber := newKeyedClient(t, "invm://kbatch_subscriber", "subscriber")
+	keyedop := subscriber.NewSubscriberOperation(broker.Uri(), 200, MAL_KEYED_AREA_VERSION, 1, 1)
+	_, err = keyedop.RegisterKeyed(&KeyedSubscription{SubscriptionId: "Keyed", SelectedKeys: &IdentifierList{NewIdentifier("index")}})
+	if err != nil {
+		t.Fatal("Error registering keyed subscription, ", err)
+	}
+
+	// The first update of the key 0 is replaced by the last one
+	for i, index := range []int64{0, 1, 0} {
+		hdrs := UpdateHeaderList([]*UpdateHeader{&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_UPDATE, EntityKey{NewIdentifier("p1"), NewLong(index), nil, nil}}})
+		if err := broker.Publish(&hdrs, &BlobList{&Blob{byte(i)}}); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+	if value := keyedNotify(t, keyedop, NewLong(1)); value != 1 {
+		t.Errorf("Bad notified value %d", value)
+	}
+	if value := keyedNotify(t, keyedop, NewLong(0)); value != 2 {
+		t.Errorf("Bad notified value %d", value)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := keyedop.GetNotifyWithContext(ctx); err == nil {
+		t.Error("Unexpected notify")
+	}
+}
@@ -0,0 +1,201 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"testing"
+	"time"
+)
+
+const (
+	lvc_broker1_url    = "maltcp://127.0.0.1:16050"
+	lvc_broker2_url    = "maltcp://127.0.0.1:16051"
+	lvc_subscriber_url = "maltcp://127.0.0.1:16052"
+)
+
+func newLastValueBroker(t *testing.T, url string, updtHandler UpdateValueHandler) (*Context, *LocalBroker) {
+	ctx, err := NewContext(url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	cctx, err := NewClientContext(ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewLocalBroker(cctx, updtHandler, 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	broker.PublishRegister(&eklist)
+	return ctx, broker
+}
+
+// Registers a subscription to all keys, then returns the notifies received before the timeout.
+func lastValueSubscribe(t *testing.T, subscriber *ClientContext, broker *LocalBroker) []*Message {
+	subop := subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body := subop.NewBody()
+	eksub := &EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}
+	erlist := EntityRequestList([]*EntityRequest{
+		&EntityRequest{nil, false, false, false, false, EntityKeyList([]*EntityKey{eksub})},
+	})
+	body.EncodeLastParameter(&Subscription{Identifier("LastValues"), erlist}, false)
+	_, err := subop.Register(body)
+	if err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+
+	notifies := make([]*Message, 0)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		msg, err := subop.GetNotifyWithContext(ctx)
+		cancel()
+		if errors.Is(err, ErrDeliveryTimedOut) {
+			return notifies
+		}
+		if err != nil {
+			t.Fatal("Error in GetNotify, ", err)
+		}
+		notifies = append(notifies, msg)
+	}
+}
+
+func TestLastValueCache(t *testing.T) {
+	sub_ctx, err := NewContext(lvc_subscriber_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer sub_ctx.Close()
+	subscriber, err := NewClientContext(sub_ctx, "subscriber")
+	if err != nil {
+		t.Fatal("Error creating subscriber, ", err)
+	}
+	defer subscriber.Close()
+
+	keys := make([]*EntityKey, 3)
+	for i := range keys {
+		keys[i] = &EntityKey{NewIdentifier("key"), NewLong(int64(i + 1)), NewLong(0), NewLong(0)}
+	}
+	header := func(uri *URI, updateType UpdateType, key int) *UpdateHeader {
+		return &UpdateHeader{*TimeNow(), *uri, updateType, *keys[key]}
+	}
+
+	// With a Blob handler and a cache of 2 keys
+	ctx1, broker1 := newLastValueBroker(t, lvc_broker1_url, NewBlobUpdateValueHandler())
+	defer ctx1.Close()
+	defer broker1.Close()
+	broker1.SetLastValueCache(2)
+
+	uri := broker1.Uri()
+	hdrs := UpdateHeaderList([]*UpdateHeader{header(uri, MAL_UPDATETYPE_CREATION, 0), header(uri, MAL_UPDATETYPE_CREATION, 1)})
+	values := BlobList([]*Blob{&Blob{1}, &Blob{2}})
+	if err := broker1.Publish(&hdrs, &values); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	// The key 0 is updated, then the key 1 is removed from the cache by the key 2
+	hdrs = UpdateHeaderList([]*UpdateHeader{header(uri, MAL_UPDATETYPE_UPDATE, 0), header(uri, MAL_UPDATETYPE_CREATION, 2)})
+	values = BlobList([]*Blob{&Blob{3}, &Blob{4}})
+	if err := broker1.Publish(&hdrs, &values); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+
+	notifies := lastValueSubscribe(t, subscriber, broker1)
+	if len(notifies) != 2 {
+		t.Fatalf("Bad number of initial notifies: %d, expect 2", len(notifies))
+	}
+	for i, expected := range []struct {
+		key   Long
+		value byte
+	}{{1, 3}, {3, 4}} {
+		msg := notifies[i]
+		msg.DecodeParameter(NullIdentifier)
+		p, err := msg.DecodeParameter(NullUpdateHeaderList)
+		if err != nil {
+			t.Fatal("Error decoding notify, ", err)
+		}
+		uhlist := *p.(*UpdateHeaderList)
+		p, err = msg.DecodeLastParameter(NullBlobList, false)
+		if err != nil {
+			t.Fatal("Error decoding notify, ", err)
+		}
+		blist := *p.(*BlobList)
+		if (len(uhlist) != 1) || (len(blist) != 1) {
+			t.Fatalf("Bad size of initial notify #%d: %d %d", i, len(uhlist), len(blist))
+		}
+		if (*uhlist[0].Key.SecondSubKey != expected.key) || ((*blist[0])[0] != expected.value) {
+			t.Errorf("Bad initial notify #%d: %v %v", i, *uhlist[0].Key.SecondSubKey, *blist[0])
+		}
+	}
+
+	// With a generic handler, a deleted key is removed from the cache
+	ctx2, broker2 := newLastValueBroker(t, lvc_broker2_url, NewGenericUpdateValueHandler(NullIntegerList, NullStringList))
+	defer ctx2.Close()
+	defer broker2.Close()
+	broker2.SetLastValueCache(10)
+
+	uri = broker2.Uri()
+	hdrs = UpdateHeaderList([]*UpdateHeader{header(uri, MAL_UPDATETYPE_CREATION, 0), header(uri, MAL_UPDATETYPE_CREATION, 1)})
+	ilist := IntegerList([]*Integer{NewInteger(1), NewInteger(2)})
+	slist := StringList([]*String{NewString("one"), NewString("two")})
+	if err := broker2.Publish(&hdrs, &ilist, &slist); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+	hdrs = UpdateHeaderList([]*UpdateHeader{header(uri, MAL_UPDATETYPE_DELETION, 0)})
+	ilist = IntegerList([]*Integer{NewInteger(0)})
+	slist = StringList([]*String{NewString("")})
+	if err := broker2.Publish(&hdrs, &ilist, &slist); err != nil {
+		t.Fatal("Error publishing, ", err)
+	}
+
+	notifies = lastValueSubscribe(t, subscriber, broker2)
+	if len(notifies) != 1 {
+		t.Fatalf("Bad number of initial notifies: %d, expect 1", len(notifies))
+	}
+	msg := notifies[0]
+	msg.DecodeParameter(NullIdentifier)
+	p, err := msg.DecodeParameter(NullUpdateHeaderList)
+	if err != nil {
+		t.Fatal("Error decoding notify, ", err)
+	}
+	uhlist := *p.(*UpdateHeaderList)
+	p, err = msg.DecodeParameter(NullIntegerList)
+	if err != nil {
+		t.Fatal("Error decoding notify, ", err)
+	}
+	integers := *p.(*IntegerList)
+	p, err = msg.DecodeLastParameter(NullStringList, false)
+	if err != nil {
+		t.Fatal("Error decoding notify, ", err)
+	}
+	strs := *p.(*StringList)
+	if (len(uhlist) != 1) || (*uhlist[0].Key.SecondSubKey != 2) || (*integers[0] != 2) || (*strs[0] != "two") {
+		t.Errorf("Bad initial notify: %v %v %v", uhlist, integers, strs)
+	}
+}
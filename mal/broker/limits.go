@@ -0,0 +1,109 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"fmt"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+)
+
+// Limits of the resources used by the registrations of a broker, a limit of 0 means no limit.
+// A registration exceeding a limit is rejected with a TOO_MANY error.
+type Limits struct {
+	// Maximum number of active subscriptions
+	MaxSubscriptions uint
+	// Maximum number of active subscriptions of a consumer URI
+	MaxSubscriptionsPerConsumer uint
+	// Maximum number of entity keys of a registration, for a subscription it is the total
+	// number of keys of its entity requests
+	MaxKeys uint
+	// Maximum number of registered publishers
+	MaxPublishers uint
+}
+
+// Sets the limits of the registrations, the active registrations exceeding the new limits are
+// kept.
+func (handler *BrokerHandler) SetLimits(limits Limits) *BrokerHandler {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	handler.limits = limits
+	return handler
+}
+
+func tooMany(format string, args ...interface{}) *MalError {
+	msg := fmt.Sprintf(format, args...)
+	logger.Warnf("Broker: %s", msg)
+	return NewMalError(ERROR_TOO_MANY, NewString(msg))
+}
+
+// Verifies that a new subscription does not exceed the limits, a subscription replacing
+// the one with the same identifier is always allowed to keep the same number of
+// subscriptions. The lock must be held.
+func (handler *BrokerHandler) checkSubLimits(sub *BrokerSub) error {
+	limits := &handler.limits
+	if limits.MaxKeys > 0 {
+		nbkeys := 0
+		for _, request := range *sub.entities {
+			nbkeys += len(request.EntityKeys)
+		}
+		if uint(nbkeys) > limits.MaxKeys {
+			return tooMany("too many keys (%d) in subscription %s", nbkeys, sub.key)
+		}
+	}
+	if handler.subs[sub.key] != nil {
+		return nil
+	}
+	if (limits.MaxSubscriptions > 0) && (uint(len(handler.subs)) >= limits.MaxSubscriptions) {
+		return tooMany("too many subscriptions, rejects %s", sub.key)
+	}
+	if limits.MaxSubscriptionsPerConsumer > 0 {
+		var count uint = 0
+		for _, s := range handler.subs {
+			if *s.urifrom == *sub.urifrom {
+				count += 1
+			}
+		}
+		if count >= limits.MaxSubscriptionsPerConsumer {
+			return tooMany("too many subscriptions of %s, rejects %s", *sub.urifrom, sub.key)
+		}
+	}
+	return nil
+}
+
+// Verifies that a publisher registration does not exceed the limits, the registration of an
+// already registered publisher replaces the previous one. The lock must be held.
+func (handler *BrokerHandler) checkPubLimits(pubid string, keys *EntityKeyList) error {
+	limits := &handler.limits
+	if (limits.MaxKeys > 0) && (uint(len(*keys)) > limits.MaxKeys) {
+		return tooMany("too many keys (%d) registered by publisher %s", len(*keys), pubid)
+	}
+	if handler.pubs[pubid] != nil {
+		return nil
+	}
+	if (limits.MaxPublishers > 0) && (uint(len(handler.pubs)) >= limits.MaxPublishers) {
+		return tooMany("too many publishers, rejects %s", pubid)
+	}
+	return nil
+}
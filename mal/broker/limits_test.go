@@ -0,0 +1,136 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"testing"
+)
+
+const (
+	limits_broker_url = "maltcp://127.0.0.1:16061"
+	limits_client_url = "maltcp://127.0.0.1:16062"
+)
+
+// Registers a subscription with the specified number of keys, returns the error of the
+// registration.
+func limitsSubscribe(subscriber *ClientContext, broker *URI, subid string, nbkeys int) error {
+	subop := subscriber.NewSubscriberOperation(broker, 200, 1, 1, 1)
+	keys := make(EntityKeyList, 0, nbkeys)
+	for i := 0; i < nbkeys; i++ {
+		keys = append(keys, &EntityKey{NewIdentifier("key"), NewLong(int64(i)), NewLong(0), NewLong(0)})
+	}
+	erlist := EntityRequestList([]*EntityRequest{&EntityRequest{nil, false, false, false, false, keys}})
+	body := subop.NewBody()
+	body.EncodeLastParameter(&Subscription{Identifier(subid), erlist}, false)
+	_, err := subop.Register(body)
+	return err
+}
+
+// Verifies that the error is a TOO_MANY error with a message.
+func checkTooMany(t *testing.T, what string, err error) {
+	if !errors.Is(err, ErrTooMany) {
+		t.Errorf("%s: expect TOO_MANY error, get %v", what, err)
+		return
+	}
+	if _, ok := err.(*MalError).ExtraInfo.(*String); !ok {
+		t.Errorf("%s: bad extra information %v", what, err.(*MalError).ExtraInfo)
+	}
+}
+
+func TestBrokerLimits(t *testing.T) {
+	broker_ctx, err := NewContext(limits_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+	broker.SetLimits(Limits{MaxSubscriptions: 3, MaxSubscriptionsPerConsumer: 2, MaxKeys: 2, MaxPublishers: 1})
+
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	err = broker.LocalPublishRegister(200, 1, 1, 1, &eklist)
+	if err != nil {
+		t.Fatal("Error registering publisher, ", err)
+	}
+
+	client_ctx, err := NewContext(limits_client_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer client_ctx.Close()
+	client1, err := NewClientContext(client_ctx, "client1")
+	if err != nil {
+		t.Fatal("Error creating client, ", err)
+	}
+	defer client1.Close()
+	client2, err := NewClientContext(client_ctx, "client2")
+	if err != nil {
+		t.Fatal("Error creating client, ", err)
+	}
+	defer client2.Close()
+
+	// Limit of subscriptions per consumer, a replacement is allowed
+	for _, subid := range []string{"sub1", "sub2", "sub1"} {
+		if err := limitsSubscribe(client1, broker.Uri(), subid, 2); err != nil {
+			t.Errorf("Error registering %s, %v", subid, err)
+		}
+	}
+	checkTooMany(t, "subscriptions per consumer", limitsSubscribe(client1, broker.Uri(), "sub3", 1))
+
+	// Limit of keys per subscription
+	checkTooMany(t, "keys per subscription", limitsSubscribe(client2, broker.Uri(), "sub1", 3))
+
+	// Limit of subscriptions
+	if err := limitsSubscribe(client2, broker.Uri(), "sub1", 1); err != nil {
+		t.Errorf("Error registering sub1, %v", err)
+	}
+	checkTooMany(t, "subscriptions", limitsSubscribe(client2, broker.Uri(), "sub2", 1))
+	if n := len(broker.ListSubscriptions()); n != 3 {
+		t.Errorf("Bad number of subscriptions %d, expect 3", n)
+	}
+
+	// Limit of publishers
+	pubop := client1.NewPublisherOperation(broker.Uri(), 200, 1, 1, 1)
+	body := pubop.NewBody()
+	body.EncodeLastParameter(&eklist, false)
+	_, err = pubop.Register(body)
+	checkTooMany(t, "publishers", err)
+
+	// Limit of keys per publisher
+	broker.LocalPublishDeregister()
+	eklist = append(eklist, eklist[0], eklist[0])
+	checkTooMany(t, "keys per publisher", broker.LocalPublishRegister(200, 1, 1, 1, &eklist))
+}
@@ -0,0 +1,173 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"errors"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"testing"
+	"time"
+)
+
+const (
+	pv_broker_url    = "maltcp://127.0.0.1:16043"
+	pv_publisher_url = "maltcp://127.0.0.1:16044"
+	pv_local_url     = "maltcp://127.0.0.1:16077"
+)
+
+// Waits for the next PublishError of the specified operation.
+func waitPublishError(t *testing.T, op PublisherOperation) *MalError {
+	for i := 0; i < 40; i++ {
+		msg, err := op.GetPublishError()
+		if err != nil {
+			t.Fatal("Error getting PublishError, ", err)
+		}
+		if msg != nil {
+			return NewMalErrorFromPublishError(msg)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("No PublishError received")
+	return nil
+}
+
+func TestPublishValidation(t *testing.T) {
+	broker_ctx, err := NewContext(pv_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+
+	// A local publication without registration is rejected
+	key1 := &EntityKey{NewIdentifier("key1"), NewLong(1), NewLong(1), NewLong(1)}
+	hdrs := UpdateHeaderList([]*UpdateHeader{&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_CREATION, *key1}})
+	values := BlobList([]*Blob{&Blob{1}})
+	err = broker.LocalPublishValues(200, 1, 1, 1, &hdrs, &values)
+	if !errors.Is(err, ErrIncorrectState) {
+		t.Errorf("Bad error %v, expect %v", err, ErrIncorrectState)
+	}
+
+	pub_ctx, err := NewContext(pv_publisher_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer pub_ctx.Close()
+	publisher, err := NewClientContext(pub_ctx, "publisher")
+	if err != nil {
+		t.Fatal("Error creating publisher, ", err)
+	}
+	defer publisher.Close()
+	publisher.SetDomain(IdentifierList([]*Identifier{NewIdentifier("spacecraft1")}))
+
+	pubop := publisher.NewPublisherOperation(broker.Uri(), 200, 1, 1, 1)
+	body := pubop.NewBody()
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("key1"), NewLong(0), NewLong(0), NewLong(0)}})
+	body.EncodeLastParameter(&eklist, false)
+	_, err = pubop.Register(body)
+	if err != nil {
+		t.Fatal("Error registering publisher, ", err)
+	}
+	defer pubop.Deregister(nil)
+
+	publish := func(keys ...*EntityKey) {
+		hdrs := make([]*UpdateHeader, 0, len(keys))
+		values := make([]*Blob, 0, len(keys))
+		for _, key := range keys {
+			hdrs = append(hdrs, &UpdateHeader{*TimeNow(), *publisher.Uri, MAL_UPDATETYPE_CREATION, *key})
+			values = append(values, &Blob{1})
+		}
+		hdrlist, blist := UpdateHeaderList(hdrs), BlobList(values)
+		body := pubop.NewBody()
+		body.EncodeParameter(&hdrlist)
+		body.EncodeLastParameter(&blist, false)
+		if err := pubop.Publish(body); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+
+	// Unknown keys are reported with an UNKNOWN error
+	key2 := &EntityKey{NewIdentifier("key2"), NewLong(1), NewLong(1), NewLong(1)}
+	key3 := &EntityKey{NewIdentifier("key3"), NewLong(1), NewLong(1), NewLong(1)}
+	publish(key1, key2, key3)
+	merr := waitPublishError(t, pubop)
+	if merr.Code != ERROR_UNKNOWN {
+		t.Errorf("Bad error code %d, expect %d", merr.Code, ERROR_UNKNOWN)
+	}
+	unknown, ok := merr.ExtraInfo.(*EntityKeyList)
+	if !ok || len(*unknown) != 2 || *(*unknown)[0].FirstSubKey != "key2" || *(*unknown)[1].FirstSubKey != "key3" {
+		t.Errorf("Bad list of unknown keys %v", merr.ExtraInfo)
+	}
+
+	// A publication in another domain is rejected
+	publisher.SetDomain(IdentifierList([]*Identifier{NewIdentifier("spacecraft2")}))
+	publish(key1)
+	merr = waitPublishError(t, pubop)
+	if !errors.Is(merr, ErrIncorrectState) {
+		t.Errorf("Bad error %v, expect %v", merr, ErrIncorrectState)
+	}
+	publisher.SetDomain(IdentifierList([]*Identifier{NewIdentifier("spacecraft1")}))
+}
+
+// A NULL sub-key never matches a specific sub-key of the registration.
+func TestPublishNullSubKey(t *testing.T) {
+	broker_ctx, err := NewContext(pv_local_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	defer broker_ctx.Close()
+	cctx, err := NewClientContext(broker_ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	defer broker.Close()
+
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("key1"), NewLong(5), NewLong(0), NewLong(0)}})
+	if err := broker.LocalPublishRegister(200, 1, 1, 1, &eklist); err != nil {
+		t.Fatal("Error registering publisher, ", err)
+	}
+	key := &EntityKey{NewIdentifier("key1"), nil, nil, nil}
+	hdrs := UpdateHeaderList([]*UpdateHeader{&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_CREATION, *key}})
+	values := BlobList([]*Blob{&Blob{1}})
+	err = broker.LocalPublishValues(200, 1, 1, 1, &hdrs, &values)
+	var merr *MalError
+	if !errors.As(err, &merr) || (merr.Code != ERROR_UNKNOWN) {
+		t.Errorf("Bad error %v, expect an UNKNOWN error", err)
+	}
+}
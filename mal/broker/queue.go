@@ -0,0 +1,236 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"sync"
+)
+
+// Defines the behaviour of a delivery queue when it is full.
+type QueuePolicy byte
+
+const (
+	// The publisher waits until the subscriber consumes a notification.
+	QUEUE_BLOCK QueuePolicy = iota
+	// The oldest pending notification is dropped.
+	QUEUE_DROP_OLDEST
+	// A pending notification is replaced by a new one updating all its keys, if the queue is
+	// still full the oldest pending notification is dropped.
+	QUEUE_CONFLATE
+	// The subscription is removed and a final error notify is sent to the subscriber.
+	QUEUE_DISCONNECT
+)
+
+// Statistics of the delivery queue of a subscription.
+type QueueStats struct {
+	// Unique identifier of the subscription: URI of the subscriber and subscription identifier
+	Subscription string
+	Pending      int
+	Enqueued     uint64
+	Delivered    uint64
+	Dropped      uint64
+	Conflated    uint64
+}
+
+// A notification waiting in a delivery queue.
+type notification struct {
+	keys []*EntityKey
+	body Body
+}
+
+// Outbound queue of a subscription, the notifications are sent by a dedicated goroutine so
+// that a slow subscriber does not delay the others.
+type deliveryQueue struct {
+	sub    *BrokerSub
+	depth  int
+	policy QueuePolicy
+
+	lock  sync.Mutex
+	cond  *sync.Cond
+	items []*notification
+	// Error notify sent when the subscription is disconnected
+	final  Body
+	closed bool
+	stats  QueueStats
+	// Called after each notification with the error of its sending, may be nil
+	sent func(err error)
+}
+
+func newDeliveryQueue(sub *BrokerSub, subkey string, depth uint, policy QueuePolicy, sent func(err error)) *deliveryQueue {
+	q := &deliveryQueue{
+		sub:    sub,
+		depth:  int(depth),
+		policy: policy,
+		items:  make([]*notification, 0, depth),
+		sent:   sent,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	q.stats.Subscription = subkey
+	go q.deliver()
+	return q
+}
+
+// Sends the pending notifications until the queue is closed.
+func (q *deliveryQueue) deliver() {
+	for {
+		q.lock.Lock()
+		for (len(q.items) == 0) && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			final := q.final
+			q.lock.Unlock()
+			if final != nil {
+				q.sub.transaction.Notify(final, true)
+			}
+			return
+		}
+		item := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.lock.Unlock()
+		// Wakes up a blocked publisher
+		q.cond.Broadcast()
+
+		err := q.sub.transaction.Notify(item.body, false)
+		if q.sent != nil {
+			q.sent(err)
+		} else if err != nil {
+			logger.Warnf("Broker: cannot notify subscription %s: %s", q.stats.Subscription, err)
+		}
+		q.lock.Lock()
+		q.stats.Delivered += 1
+		q.lock.Unlock()
+	}
+}
+
+func sameKey(key1 *EntityKey, key2 *EntityKey) bool {
+	sameId := func(id1 *Identifier, id2 *Identifier) bool {
+		return ((id1 == nil) && (id2 == nil)) || ((id1 != nil) && (id2 != nil) && (*id1 == *id2))
+	}
+	sameLong := func(l1 *Long, l2 *Long) bool {
+		return ((l1 == nil) && (l2 == nil)) || ((l1 != nil) && (l2 != nil) && (*l1 == *l2))
+	}
+	return sameId(key1.FirstSubKey, key2.FirstSubKey) && sameLong(key1.SecondSubKey, key2.SecondSubKey) &&
+		sameLong(key1.ThirdSubKey, key2.ThirdSubKey) && sameLong(key1.FourthSubKey, key2.FourthSubKey)
+}
+
+// Returns true if all the keys of the notification are in the specified list.
+func (item *notification) updatedBy(keys []*EntityKey) bool {
+	for _, key := range item.keys {
+		updated := false
+		for _, k := range keys {
+			if sameKey(key, k) {
+				updated = true
+				break
+			}
+		}
+		if !updated {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes the pending notifications updated by the new one.
+func (q *deliveryQueue) conflate(keys []*EntityKey) {
+	items := q.items[:0]
+	for _, item := range q.items {
+		if item.updatedBy(keys) {
+			q.stats.Conflated += 1
+		} else {
+			items = append(items, item)
+		}
+	}
+	for i := len(items); i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	q.items = items
+}
+
+// Queues a notification according to the policy, returns false if the subscription must be
+// disconnected.
+func (q *deliveryQueue) push(keys []*EntityKey, body Body) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.policy == QUEUE_CONFLATE {
+		q.conflate(keys)
+	}
+	for !q.closed && (len(q.items) >= q.depth) {
+		switch q.policy {
+		case QUEUE_BLOCK:
+			q.cond.Wait()
+			continue
+		case QUEUE_DISCONNECT:
+			logger.Warnf("Broker: delivery queue of %s overflows, disconnects the subscription", q.stats.Subscription)
+			q.fail()
+			return false
+		}
+		// QUEUE_DROP_OLDEST and QUEUE_CONFLATE
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.stats.Dropped += 1
+	}
+	if q.closed {
+		return true
+	}
+	q.items = append(q.items, &notification{keys: keys, body: body})
+	q.stats.Enqueued += 1
+	q.cond.Broadcast()
+	return true
+}
+
+// Closes the queue and sends a final DELIVERY_FAILED error notify, the lock must be held.
+func (q *deliveryQueue) fail() {
+	code := ERROR_DELIVERY_FAILED
+	body := q.sub.transaction.NewBody()
+	body.EncodeParameter(&code)
+	body.EncodeLastParameter(NewString("Subscriber too slow, delivery queue overflow"), false)
+	q.final = body
+	q.stats.Dropped += uint64(len(q.items))
+	q.closeLocked()
+}
+
+func (q *deliveryQueue) closeLocked() {
+	q.closed = true
+	q.items = nil
+	q.cond.Broadcast()
+}
+
+// Closes the queue, the pending notifications are discarded.
+func (q *deliveryQueue) close() {
+	q.lock.Lock()
+	q.closeLocked()
+	q.lock.Unlock()
+}
+
+func (q *deliveryQueue) getStats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := q.stats
+	stats.Pending = len(q.items)
+	return stats
+}
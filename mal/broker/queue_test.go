@@ -0,0 +1,242 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/invm" // Needed to initialize InVM transport factory
+	"sync"
+	"testing"
+	"time"
+)
+
+// Subscriber transaction recording the notifications, the first notification is blocked
+// until the gate is opened.
+type stubTransaction struct {
+	SubscriberTransaction
+	ctx      *Context
+	gate     chan bool
+	notified chan *stubNotify
+	// Value identifying each notification body
+	lock   sync.Mutex
+	values map[Body]byte
+}
+
+type stubNotify struct {
+	body    Body
+	isError bool
+}
+
+func newStubTransaction(t *testing.T, url string) *stubTransaction {
+	ctx, err := NewContext(url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	return &stubTransaction{ctx: ctx, gate: make(chan bool), notified: make(chan *stubNotify, 100), values: make(map[Body]byte)}
+}
+
+func (tx *stubTransaction) NewBody() Body {
+	return tx.ctx.NewBody()
+}
+
+func (tx *stubTransaction) Notify(body Body, isError bool) error {
+	<-tx.gate
+	tx.notified <- &stubNotify{body, isError}
+	return nil
+}
+
+// Opens the gate and returns the values of the notifications (see notifyBody).
+func (tx *stubTransaction) release(t *testing.T, n int) []byte {
+	close(tx.gate)
+	values := make([]byte, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case notify := <-tx.notified:
+			if notify.isError {
+				values = append(values, 0)
+				continue
+			}
+			values = append(values, tx.value(notify.body))
+		case <-time.After(time.Second):
+			t.Fatalf("Missing notification: %d/%d", i, n)
+		}
+	}
+	return values
+}
+
+func (tx *stubTransaction) value(body Body) byte {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	return tx.values[body]
+}
+
+// Creates the body of a test notification identified by the value.
+func notifyBody(tx *stubTransaction, value byte) Body {
+	body := tx.NewBody()
+	tx.lock.Lock()
+	tx.values[body] = value
+	tx.lock.Unlock()
+	return body
+}
+
+func testKey(name string) []*EntityKey {
+	return []*EntityKey{&EntityKey{NewIdentifier(name), NewLong(1), NewLong(1), NewLong(1)}}
+}
+
+// Creates a queue whose first notification is in progress, blocked by the gate.
+func newTestQueue(t *testing.T, url string, depth uint, policy QueuePolicy) (*stubTransaction, *deliveryQueue) {
+	tx := newStubTransaction(t, url)
+	q := newDeliveryQueue(&BrokerSub{transaction: tx}, "sub", depth, policy, nil)
+	q.push(testKey("key0"), notifyBody(tx, 1))
+	for i := 0; i < 100; i++ {
+		if q.getStats().Pending == 0 {
+			return tx, q
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("The first notification should be in progress")
+	return nil, nil
+}
+
+func checkValues(t *testing.T, values []byte, expected ...byte) {
+	if string(values) != string(expected) {
+		t.Errorf("Bad notifications %v, expect %v", values, expected)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	tx, q := newTestQueue(t, "invm://queue_drop", 2, QUEUE_DROP_OLDEST)
+	defer tx.ctx.Close()
+	defer q.close()
+	for value := byte(2); value <= 4; value++ {
+		if !q.push(testKey("key1"), notifyBody(tx, value)) {
+			t.Fatal("The subscription should not be disconnected")
+		}
+	}
+	stats := q.getStats()
+	if (stats.Pending != 2) || (stats.Dropped != 1) || (stats.Enqueued != 4) {
+		t.Errorf("Bad statistics %+v", stats)
+	}
+	checkValues(t, tx.release(t, 3), 1, 3, 4)
+}
+
+func TestQueueConflate(t *testing.T) {
+	tx, q := newTestQueue(t, "invm://queue_conflate", 2, QUEUE_CONFLATE)
+	defer tx.ctx.Close()
+	defer q.close()
+	q.push(testKey("key1"), notifyBody(tx, 2))
+	q.push(testKey("key2"), notifyBody(tx, 3))
+	// Replaces the pending notification of key1
+	q.push(testKey("key1"), notifyBody(tx, 4))
+	// The queue is full, drops the notification of key2
+	q.push(testKey("key3"), notifyBody(tx, 5))
+	stats := q.getStats()
+	if (stats.Pending != 2) || (stats.Conflated != 1) || (stats.Dropped != 1) {
+		t.Errorf("Bad statistics %+v", stats)
+	}
+	checkValues(t, tx.release(t, 3), 1, 4, 5)
+}
+
+func TestQueueBlock(t *testing.T) {
+	tx, q := newTestQueue(t, "invm://queue_block", 1, QUEUE_BLOCK)
+	defer tx.ctx.Close()
+	defer q.close()
+	q.push(testKey("key1"), notifyBody(tx, 2))
+	done := make(chan bool)
+	body := notifyBody(tx, 3)
+	go func() {
+		q.push(testKey("key1"), body)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("The publisher should be blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	checkValues(t, tx.release(t, 3), 1, 2, 3)
+	<-done
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	tx := newStubTransaction(t, "invm://queue_disconnect")
+	defer tx.ctx.Close()
+
+	handler := &BrokerHandler{
+		updtHandler: NewBlobUpdateValueHandler(),
+		subs:        make(map[string]*BrokerSub),
+		index:       newSubIndex(),
+		pubs:        make(map[string]*BrokerPub),
+	}
+	handler.SetDeliveryQueues(1, QUEUE_DISCONNECT)
+	wildcard := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("*"), NewLong(0), NewLong(0), NewLong(0)}})
+	entities := EntityRequestList([]*EntityRequest{&EntityRequest{EntityKeys: wildcard}})
+	handler.addSub(&BrokerSub{key: "sub", subid: "sub", serviceArea: 200, service: 1, operation: 1, entities: &entities, transaction: tx})
+	handler.pubs["publisher"] = &BrokerPub{serviceArea: 200, Service: 1, operation: 1, keys: &wildcard}
+
+	uri := URI("publisher")
+	pub := &Message{UriFrom: &uri, ServiceArea: 200, Service: 1, Operation: 1}
+	publish := func(value byte) {
+		uhlist := UpdateHeaderList([]*UpdateHeader{&UpdateHeader{Key: *testKey("key1")[0]}})
+		updtHandler, release := handler.newUpdateValueHandler()
+		defer release()
+		updtHandler.InitUpdateValueList([]ElementList{&BlobList{&Blob{value}}})
+		if err := handler.doPublish(pub, &uhlist, updtHandler); err != nil {
+			t.Fatal("Error publishing, ", err)
+		}
+	}
+	// The first notification is in progress, the second one is pending
+	publish(1)
+	for len(handler.GetQueueStats()) != 1 || handler.GetQueueStats()[0].Pending != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	publish(2)
+	if stats := handler.GetQueueStats(); (len(stats) != 1) || (stats[0].Pending != 1) {
+		t.Fatalf("Bad statistics %+v", stats)
+	}
+	// The queue overflows
+	publish(3)
+	if len(handler.subs) != 0 || len(handler.GetQueueStats()) != 0 {
+		t.Error("The subscription should be removed")
+	}
+
+	close(tx.gate)
+	for _, isError := range []bool{false, true} {
+		select {
+		case notify := <-tx.notified:
+			if notify.isError != isError {
+				t.Fatalf("Bad notification, error: %t", notify.isError)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Missing notification")
+		}
+	}
+	// Later publications are not delivered
+	publish(4)
+	select {
+	case <-tx.notified:
+		t.Error("Unexpected notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,147 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker_test
+
+import (
+	"context"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	. "github.com/CNES/ccsdsmo-malgo/mal/api"
+	. "github.com/CNES/ccsdsmo-malgo/mal/broker"
+	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp" // Needed to initialize TCP transport factory
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	rs_broker_url     = "maltcp://127.0.0.1:16053"
+	rs_subscriber_url = "maltcp://127.0.0.1:16054"
+)
+
+// Starts a broker restoring the registrations saved in the specified file.
+func startStoredBroker(t *testing.T, path string) (*Context, *BrokerHandler) {
+	ctx, err := NewContext(rs_broker_url)
+	if err != nil {
+		t.Fatal("Error creating broker context, ", err)
+	}
+	cctx, err := NewClientContext(ctx, "broker")
+	if err != nil {
+		t.Fatal("Error creating client context, ", err)
+	}
+	broker, err := NewBroker(cctx, NewBlobUpdateValueHandler(), 200, 1, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating broker, ", err)
+	}
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("Error creating store, ", err)
+	}
+	err = broker.SetRegistrationStore(store)
+	if err != nil {
+		t.Fatal("Error restoring registrations, ", err)
+	}
+	return ctx, broker
+}
+
+func TestRegistrationStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrations.json")
+
+	broker_ctx, broker := startStoredBroker(t, path)
+	eklist := EntityKeyList([]*EntityKey{&EntityKey{NewIdentifier("key1"), NewLong(0), NewLong(0), NewLong(0)}})
+	err := broker.LocalPublishRegister(200, 1, 1, 1, &eklist)
+	if err != nil {
+		t.Fatal("Error registering publisher, ", err)
+	}
+
+	sub_ctx, err := NewContext(rs_subscriber_url)
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer sub_ctx.Close()
+	subscriber, err := NewClientContext(sub_ctx, "subscriber")
+	if err != nil {
+		t.Fatal("Error creating subscriber, ", err)
+	}
+	defer subscriber.Close()
+
+	subop := subscriber.NewSubscriberOperation(broker.Uri(), 200, 1, 1, 1)
+	body := subop.NewBody()
+	eksub := &EntityKey{NewIdentifier("key1"), NewLong(0), NewLong(0), NewLong(0)}
+	erlist := EntityRequestList([]*EntityRequest{
+		&EntityRequest{nil, false, false, false, false, EntityKeyList([]*EntityKey{eksub})},
+	})
+	subid := Identifier("Persistent")
+	body.EncodeLastParameter(&Subscription{subid, erlist}, false)
+	_, err = subop.Register(body)
+	if err != nil {
+		t.Fatal("Error registering subscriber, ", err)
+	}
+
+	// Restarts the broker, the subscriber and the publisher do not register again
+	broker.Close()
+	broker_ctx.Close()
+	// Lets the subscriber detect the closing of its connection to the broker
+	time.Sleep(200 * time.Millisecond)
+	broker_ctx, broker = startStoredBroker(t, path)
+	defer broker_ctx.Close()
+	defer broker.Close()
+
+	key := &EntityKey{NewIdentifier("key1"), NewLong(1), NewLong(2), NewLong(3)}
+	hdrs := UpdateHeaderList([]*UpdateHeader{&UpdateHeader{*TimeNow(), *broker.Uri(), MAL_UPDATETYPE_CREATION, *key}})
+	values := BlobList([]*Blob{&Blob{7}})
+	err = broker.LocalPublishValues(200, 1, 1, 1, &hdrs, &values)
+	if err != nil {
+		t.Fatal("Error publishing after restart, ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	msg, err := subop.GetNotifyWithContext(ctx)
+	if err != nil {
+		t.Fatal("Error in GetNotify after restart, ", err)
+	}
+	msg.DecodeParameter(NullIdentifier)
+	msg.DecodeParameter(NullUpdateHeaderList)
+	p, err := msg.DecodeLastParameter(NullBlobList, false)
+	if err != nil {
+		t.Fatal("Error decoding notify, ", err)
+	}
+	if blist := *p.(*BlobList); (len(blist) != 1) || ((*blist[0])[0] != 7) {
+		t.Errorf("Bad notified values %v", blist)
+	}
+
+	// The deregistration is removed from the store
+	body = subop.NewBody()
+	idlist := IdentifierList([]*Identifier{&subid})
+	body.EncodeLastParameter(&idlist, false)
+	subop.Deregister(body)
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("Error reading store, ", err)
+	}
+	regs, _ := store.Load()
+	if (len(regs) != 1) || (regs[0].Keys == nil) {
+		t.Errorf("Bad saved registrations %v", regs)
+	}
+}
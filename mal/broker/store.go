@@ -0,0 +1,226 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package broker
+
+import (
+	"encoding/json"
+	. "github.com/CNES/ccsdsmo-malgo/mal"
+	"github.com/CNES/ccsdsmo-malgo/mal/encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Saved form of a subscriber or publisher registration: the header of the registration
+// message, needed to rebuild the transaction, and its content.
+type Registration struct {
+	// Unique identifier of the registration (see subRegistrationKey and pubRegistrationKey)
+	Key string
+
+	UriFrom          URI
+	AuthenticationId Blob
+	EncodingId       UOctet
+	QoSLevel         QoSLevel
+	Priority         UInteger
+	Domain           IdentifierList
+	NetworkZone      Identifier
+	Session          SessionType
+	SessionName      Identifier
+	TransactionId    ULong
+	ServiceArea      UShort
+	AreaVersion      UOctet
+	Service          UShort
+	Operation        UShort
+
+	// Subscription of a subscriber, nil for a publisher
+	Subscription *Subscription
+	// Route of the subscription of a peer broker, nil otherwise (see RegisterFederationService)
+	Route URIList
+	// Keys of a publisher, nil for a subscriber
+	Keys *EntityKeyList
+
+	// Value filters of a subscription encoded with the MAL binary encoding, as they hold
+	// abstract attributes, and its change detection, nil if there is none (see
+	// SetSubscriptionFilters and SetSubscriptionChange)
+	Filters Blob
+	Change  *ChangeFilter
+
+	// Subscription of the keyed model, encoded with the MAL binary encoding as its filters
+	// hold abstract attributes, and the key schema it is translated with. The Subscription
+	// field holds its translation. Nil otherwise (see EnableKeyedModel).
+	KeyedSubscription Blob
+	KeySchema         KeySchema
+	// Names of the keys of a publisher of the keyed model, nil otherwise
+	KeyNames IdentifierList
+}
+
+// Persistent store of the broker registrations, it allows a restarted broker to restore its
+// subscribers and publishers (see BrokerHandler.SetRegistrationStore).
+type RegistrationStore interface {
+	// Saves a registration, replacing the previous one with the same key.
+	Save(reg *Registration) error
+	// Removes the registration with the specified key, if any.
+	Remove(key string) error
+	// Returns all saved registrations.
+	Load() ([]*Registration, error)
+}
+
+func subRegistrationKey(subkey string) string {
+	return "sub:" + subkey
+}
+
+func pubRegistrationKey(pubid string) string {
+	return "pub:" + pubid
+}
+
+func newRegistration(key string, msg *Message) *Registration {
+	return &Registration{
+		Key:              key,
+		UriFrom:          *msg.UriFrom,
+		AuthenticationId: msg.AuthenticationId,
+		EncodingId:       msg.EncodingId,
+		QoSLevel:         msg.QoSLevel,
+		Priority:         msg.Priority,
+		Domain:           msg.Domain,
+		NetworkZone:      msg.NetworkZone,
+		Session:          msg.Session,
+		SessionName:      msg.SessionName,
+		TransactionId:    msg.TransactionId,
+		ServiceArea:      msg.ServiceArea,
+		AreaVersion:      msg.AreaVersion,
+		Service:          msg.Service,
+		Operation:        msg.Operation,
+	}
+}
+
+// Rebuilds the header of the registration message.
+func (reg *Registration) message() *Message {
+	uri := reg.UriFrom
+	stage := MAL_IP_STAGE_PUBSUB_REGISTER
+	if reg.Subscription == nil {
+		stage = MAL_IP_STAGE_PUBSUB_PUBLISH_REGISTER
+	}
+	return &Message{
+		UriFrom:          &uri,
+		AuthenticationId: reg.AuthenticationId,
+		EncodingId:       reg.EncodingId,
+		QoSLevel:         reg.QoSLevel,
+		Priority:         reg.Priority,
+		Domain:           reg.Domain,
+		NetworkZone:      reg.NetworkZone,
+		Session:          reg.Session,
+		SessionName:      reg.SessionName,
+		InteractionType:  MAL_INTERACTIONTYPE_PUBSUB,
+		InteractionStage: stage,
+		TransactionId:    reg.TransactionId,
+		ServiceArea:      reg.ServiceArea,
+		AreaVersion:      reg.AreaVersion,
+		Service:          reg.Service,
+		Operation:        reg.Operation,
+	}
+}
+
+// Encodes an element with the MAL binary encoding, so that the elements holding abstract
+// attributes can be saved.
+func encodeElement(element Element) (Blob, error) {
+	encoder := binary.NewBinaryEncoder(make([]byte, 0, 256), false)
+	if err := element.Encode(encoder); err != nil {
+		return nil, err
+	}
+	return Blob(encoder.Body()), nil
+}
+
+// Decodes an element saved with encodeElement, null gives the type of the element.
+func decodeElement(data Blob, null Element) (Element, error) {
+	return null.Decode(binary.NewBinaryDecoder([]byte(data), false))
+}
+
+// ################################################################################
+// Implements a RegistrationStore in a JSON file
+
+type FileStore struct {
+	path string
+	lock sync.Mutex
+	regs map[string]*Registration
+}
+
+// Creates a store saving the registrations in the specified file, the registrations
+// previously saved in this file are loaded.
+func NewFileStore(path string) (*FileStore, error) {
+	store := &FileStore{path: path, regs: make(map[string]*Registration)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &store.regs)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Writes all registrations in a temporary file then renames it, so the file is never
+// partially written.
+func (store *FileStore) write() error {
+	data, err := json.MarshalIndent(store.regs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := store.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.path)
+}
+
+func (store *FileStore) Save(reg *Registration) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.regs[reg.Key] = reg
+	return store.write()
+}
+
+func (store *FileStore) Remove(key string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.regs[key]; !ok {
+		return nil
+	}
+	delete(store.regs, key)
+	return store.write()
+}
+
+func (store *FileStore) Load() ([]*Registration, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	regs := make([]*Registration, 0, len(store.regs))
+	for _, reg := range store.regs {
+		regs = append(regs, reg)
+	}
+	return regs, nil
+}
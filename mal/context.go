@@ -25,6 +25,8 @@ package mal
 
 import (
 	"errors"
+	"sync"
+	"time"
 )
 
 type Listener interface {
@@ -38,28 +40,45 @@ type Listener interface {
 //	newEndPoint(uri Uri_t, ch chan) EndPoint, Error
 //}
 
+const (
+	_CTX_ACTIVE byte = iota
+	_CTX_CLOSING
+	_CTX_CLOSED
+)
+
 type Context struct {
-	uri       URI
-	listeners map[URI]Listener
-	ch        chan *Message
-	ends      chan bool
+	uri URI
+	// Protects the map of listeners and the status of the context, the map should always
+	// be acceded through synchronized functions.
+	lock      sync.RWMutex
+	listeners map[URI]*dispatcher
+	status    byte
+	// Counts the messages being pushed in the dispatch queues (resp. being transmitted)
+	receiving sync.WaitGroup
+	sending   sync.WaitGroup
+	// Default length and overflow policy of the dispatch queues
+	dfltLength uint
+	dfltPolicy DispatchPolicy
 	// Access Control handler
-	achdlr    AccessControl
+	achdlr AccessControl
+	// Ordered chain of interceptors, copied on each modification (see AddInterceptor)
+	interceptors []Interceptor
+	// Error channel and listener notified of asynchronous failures
 	errch     chan *MessageError
+	errlst    ErrorListener
 	transport Transport
 }
 
 // Be careful: Depending of the application logic if there is not enough slots in
-// the internal channel there may be a blocking of the underlying transport threads.
+// the dispatch queue of a listener there may be a blocking of the underlying transport
+// threads (see SetDispatch and RegisterEndPointWithDispatch).
 func NewContext(url string) (*Context, error) {
-	listeners := make(map[URI]Listener)
-	// TODO (AF): Fix length of channel
-	ch := make(chan *Message, 10)
-	ends := make(chan bool)
+	listeners := make(map[URI]*dispatcher)
 	ctx := &Context{
-		listeners: listeners,
-		ch:        ch,
-		ends:      ends,
+		listeners:  listeners,
+		status:     _CTX_ACTIVE,
+		dfltLength: dflt_dispatch_queue_length,
+		dfltPolicy: DISPATCH_BLOCK,
 	}
 
 	transport, uri, err := NewTransport(url, ctx)
@@ -72,7 +91,6 @@ func NewContext(url string) (*Context, error) {
 	ctx.uri = *uri
 	ctx.transport = transport
 
-	go ctx.handle()
 	return ctx, nil
 }
 
@@ -85,17 +103,45 @@ func (ctx *Context) NewBody() Body {
 	return ctx.transport.NewBody()
 }
 
+// Fixes the access control handler of this MAL context, all incoming and outgoing messages
+// are checked by this handler. A rejected incoming message is answered with a MAL error
+// message (if the interaction stage allows it).
 // Note (AF): May be we should provide a non programmatic way to fix the AccessControl handler
 // in the MAL context (using a factory as in MAL Java API for example).
 func (ctx *Context) SetAccessControl(achdlr AccessControl) {
 	ctx.achdlr = achdlr
 }
 
+// Fixes the channel receiving the asynchronous failures of this MAL context (see Error),
+// a nil channel removes it. The channel belongs to the caller, it is never closed.
+// Be careful: a failure is discarded if there is no free slot in the channel, the
+// channel should be buffered and read continuously.
 func (ctx *Context) SetErrorChannel(errch chan *MessageError) {
-	if ctx.errch != nil {
-		close(ctx.errch)
-	}
+	ctx.lock.Lock()
 	ctx.errch = errch
+	ctx.lock.Unlock()
+}
+
+// Fixes the listener notified of the asynchronous failures of this MAL context (see Error).
+// The listener is called synchronously, it should not block.
+func (ctx *Context) SetErrorListener(errlst ErrorListener) {
+	ctx.lock.Lock()
+	ctx.errlst = errlst
+	ctx.lock.Unlock()
+}
+
+// Fixes the default length and overflow policy of the dispatch queue of listeners
+// registered afterwards.
+func (ctx *Context) SetDispatch(length uint, policy DispatchPolicy) error {
+	if err := checkDispatch(length, policy); err != nil {
+		logger.Warnf("Context.SetDispatch: %v", err)
+		return err
+	}
+	ctx.lock.Lock()
+	ctx.dfltLength = length
+	ctx.dfltPolicy = policy
+	ctx.lock.Unlock()
+	return nil
 }
 
 func (ctx *Context) NewURI(id string) *URI {
@@ -104,14 +150,34 @@ func (ctx *Context) NewURI(id string) *URI {
 	return &uri
 }
 
-// Registers an End-Point with the specified MAL URI.
+// Registers an End-Point with the specified MAL URI, using the default length and
+// overflow policy of the dispatch queue.
 func (ctx *Context) RegisterEndPoint(uri *URI, listener Listener) error {
-	// TODO (AF): Verify if the context is alive
+	ctx.lock.RLock()
+	length, policy := ctx.dfltLength, ctx.dfltPolicy
+	ctx.lock.RUnlock()
+	return ctx.RegisterEndPointWithDispatch(uri, listener, length, policy)
+}
+
+// Registers an End-Point with the specified MAL URI. Incoming messages are queued in
+// a dedicated dispatch queue of the specified length, the policy defines the behavior
+// when this queue is full.
+func (ctx *Context) RegisterEndPointWithDispatch(uri *URI, listener Listener, length uint, policy DispatchPolicy) error {
 	if listener == nil {
 		logger.Warnf("Context.RegisterEndPoint: Cannot not register nil listener for %s", *uri)
 		return errors.New("EndPoint is nil")
 	}
+	if err := checkDispatch(length, policy); err != nil {
+		logger.Warnf("Context.RegisterEndPoint: %v for %s", err, *uri)
+		return err
+	}
 	// TODO (AF): Verify the uri
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.status != _CTX_ACTIVE {
+		logger.Warnf("Context.RegisterEndPoint: context closed, cannot register %s", *uri)
+		return errors.New("MAL context closed")
+	}
 	// Verify that the URI is not already registered
 	old := ctx.listeners[*uri]
 	if old != nil {
@@ -119,62 +185,105 @@ func (ctx *Context) RegisterEndPoint(uri *URI, listener Listener) error {
 		return errors.New("EndPoint already exists: " + string(*uri))
 	}
 	// Registers the uri
-	ctx.listeners[*uri] = listener
+	ctx.listeners[*uri] = newDispatcher(ctx, listener, length, policy)
 	return nil
 }
 
 // Gets the End-Point asssociated with the specified MAL URI.
 func (ctx *Context) GetEndPoint(uri *URI) (Listener, error) {
-	listener := ctx.listeners[*uri]
-	if listener == nil {
+	ctx.lock.RLock()
+	d := ctx.listeners[*uri]
+	ctx.lock.RUnlock()
+	if d == nil {
 		logger.Warnf("Context.GetEndPoint: %s not registered", *uri)
 		return nil, errors.New("EndPoint doesn't exist: " + string(*uri))
 	}
-	return listener, nil
+	return d.listener, nil
 }
 
-// Removes the End-Point asssociated with the specified MAL URI.
+// Removes the End-Point asssociated with the specified MAL URI. The messages remaining
+// in its dispatch queue are not delivered, their originators receive a DELIVERY_FAILED
+// error. The method waits for the end of the message being delivered, if any.
+// Be careful: this method should not be called by the listener while a message is
+// delivered, it would wait for itself, see ReleaseEndPoint.
 func (ctx *Context) UnregisterEndPoint(uri *URI) error {
-	listener := ctx.listeners[*uri]
-	if listener == nil {
-		logger.Warnf("Context.UnregisterEndPoint: %s not registered", *uri)
-		return errors.New("EndPoint doesn't exist: " + string(*uri))
+	d, err := ctx.unregister(uri)
+	if err != nil {
+		return err
 	}
-	delete(ctx.listeners, *uri)
+	<-d.ends
 	return nil
 }
 
-// Routes messages from transport to registered MAL EndPoint
-func (ctx *Context) handle() {
-	for {
-		msg, more := <-ctx.ch
-		if more {
-			logger.Debugf("Context.handle: receive: %+v for %s", msg, *msg.UriTo)
-			to, ok := ctx.listeners[*msg.UriTo]
-			if ok {
-				to.OnMessage(msg)
-				logger.Debugf("Context.handle: Message delivered: %s", msg)
-			} else {
-				logger.Errorf("Context.handle: Cannot route message to: %s", *msg.UriTo)
-			}
-		} else {
-			logger.Infof("Context.handle: ends: %s", msg)
-			ctx.ends <- true
-		}
+// Removes the End-Point asssociated with the specified MAL URI from its own listener,
+// i.e. while a message is delivered by the OnMessage method. The messages remaining in
+// its dispatch queue are not delivered, the dispatch goroutine ends once the current
+// delivery returns.
+func (ctx *Context) ReleaseEndPoint(uri *URI) error {
+	_, err := ctx.unregister(uri)
+	return err
+}
+
+func (ctx *Context) unregister(uri *URI) (*dispatcher, error) {
+	ctx.lock.Lock()
+	d := ctx.listeners[*uri]
+	if d == nil {
+		ctx.lock.Unlock()
+		logger.Warnf("Context.UnregisterEndPoint: %s not registered", *uri)
+		return nil, errors.New("EndPoint doesn't exist: " + string(*uri))
 	}
+	delete(ctx.listeners, *uri)
+	ctx.lock.Unlock()
+	d.stop(false)
+	return d, nil
 }
 
 // Close the MAL context, closing all registered listeners (end-point, etc.) and transport.
+// The context stops accepting incoming messages, then messages already queued are
+// delivered to the listeners. The originators of the messages that a listener does not
+// consume in time receive a DELIVERY_FAILED error. The OnClose method of each remaining
+// listener is called once, it should release a delivery in progress: Close returns only
+// when all the dispatch goroutines have ended, then the transport is closed.
+// Be careful: this method should not be called from a listener, it waits for the end of
+// the message delivery.
 func (ctx *Context) Close() error {
-	for uri, listener := range ctx.listeners {
+	ctx.lock.Lock()
+	if ctx.status != _CTX_ACTIVE {
+		ctx.lock.Unlock()
+		return nil
+	}
+	ctx.status = _CTX_CLOSING
+	listeners := ctx.listeners
+	ctx.listeners = make(map[URI]*dispatcher)
+	ctx.lock.Unlock()
+
+	// Stops the dispatchers first so that the incoming messages blocked on a full dispatch
+	// queue are released, then waits for the delivery of the queued messages.
+	for _, d := range listeners {
+		d.stop(true)
+	}
+	ctx.receiving.Wait()
+	deadline := time.Now().Add(dispatch_drain_timeout)
+	for uri, d := range listeners {
+		aborted := !d.wait(deadline)
+		if aborted {
+			logger.Warnf("Context.Close: %s does not consume its messages, rejects them", uri)
+			d.abort()
+		}
 		logger.Infof("Context.Close: %s", uri)
-		listener.OnClose()
+		d.listener.OnClose()
+		if aborted {
+			// The message being delivered is not interrupted, waits for the end of its
+			// delivery (released by OnClose for an end-point).
+			<-d.ends
+		}
 	}
 
+	ctx.lock.Lock()
+	ctx.status = _CTX_CLOSED
+	ctx.lock.Unlock()
+	ctx.sending.Wait()
 	return ctx.transport.Close()
-	// TODO (AF):
-	//	close(ctx.ch)
-	//	<-ctx.ends
 }
 
 // ================================================================================
@@ -182,11 +291,37 @@ func (ctx *Context) Close() error {
 
 // Method implementing SEND request to the transport layer.
 func (ctx *Context) Send(msg *Message) error {
+	return ctx.send(msg, true)
+}
+
+// Sends a message, if check is set the message is first checked by the access control
+// handler of the context.
+func (ctx *Context) send(msg *Message, check bool) error {
+	ctx.lock.RLock()
+	if ctx.status == _CTX_CLOSED {
+		ctx.lock.RUnlock()
+		return errors.New("MAL context closed")
+	}
+	ctx.sending.Add(1)
+	ctx.lock.RUnlock()
+	defer ctx.sending.Done()
+
 	msg.Timestamp = *TimeNow()
-	// TODO (AF): May be we should handle errors internally using the error channel.
-	if ctx.achdlr != nil {
-		err := ctx.achdlr.check(msg)
+	ok, err := ctx.interceptSend(msg)
+	if err != nil {
+		logger.Warnf("Context.Send: message to %s rejected by interceptor: %s", uriString(msg.UriTo), err.Error())
+		ctx.Error(NewMessageError(msg, errorCode(err, ERROR_INTERNAL), err))
+		return err
+	}
+	if !ok {
+		logger.Debugf("Context.Send: message to %s discarded by interceptor", uriString(msg.UriTo))
+		return nil
+	}
+	if check && (ctx.achdlr != nil) {
+		err := ctx.achdlr.CheckSend(msg)
 		if err != nil {
+			logger.Warnf("Context.Send: message to %s rejected: %s", uriString(msg.UriTo), err.Error())
+			ctx.Error(NewMessageError(msg, errorCode(err, ERROR_AUTHORISATION_FAIL), err))
 			return err
 		}
 	}
@@ -197,17 +332,106 @@ func (ctx *Context) Send(msg *Message) error {
 func (ctx *Context) Receive(msg *Message) error {
 	// TODO (AF): This method should not returned errors. Errors should be handled
 	// internally using the error channel.
+	ctx.lock.RLock()
+	if ctx.status != _CTX_ACTIVE {
+		ctx.lock.RUnlock()
+		logger.Warnf("Context.Receive: context closed, message from %s rejected", uriString(msg.UriFrom))
+		return errors.New("MAL context closed")
+	}
+	ctx.receiving.Add(1)
+	ctx.lock.RUnlock()
+	defer ctx.receiving.Done()
+
 	if ctx.achdlr != nil {
-		err := ctx.achdlr.check(msg)
+		err := ctx.achdlr.CheckReceive(msg)
 		if err != nil {
+			logger.Warnf("Context.Receive: message from %s rejected: %s", uriString(msg.UriFrom), err.Error())
+			if ctx.rejectMessage(msg, errorCode(err, ERROR_AUTHORISATION_FAIL), err) {
+				// The error is reported to the originator
+				return nil
+			}
 			return err
 		}
 	}
+	ok, err := ctx.interceptReceive(msg)
+	if err != nil {
+		logger.Warnf("Context.Receive: message from %s rejected by interceptor: %s", uriString(msg.UriFrom), err.Error())
+		if ctx.rejectMessage(msg, errorCode(err, ERROR_INTERNAL), err) {
+			return nil
+		}
+		return err
+	}
+	if !ok {
+		logger.Debugf("Context.Receive: message from %s discarded by interceptor", uriString(msg.UriFrom))
+		return nil
+	}
+	ctx.lock.RLock()
+	d, ok := ctx.listeners[*msg.UriTo]
+	ctx.lock.RUnlock()
+	if !ok {
+		logger.Errorf("Context.Receive: Cannot route message to: %s", *msg.UriTo)
+		ctx.replyError(msg, ERROR_DESTINATION_UNKNOWN, ERROR_DESTINATION_UNKNOWN_MESSAGE)
+		return nil
+	}
 	logger.Debugf("Context.Receive: forward to client %s", *msg.UriTo)
-	ctx.ch <- msg
+	if err := d.push(msg); err != nil {
+		logger.Warnf("Context.Receive: %s closed, rejects message from %s", *msg.UriTo, uriString(msg.UriFrom))
+		ctx.replyError(msg, ERROR_DELIVERY_FAILED, ERROR_DELIVERY_FAILED_MESSAGE)
+	}
 	return nil
 }
 
+// Reports to the originator of an incoming message that it has been rejected, returns
+// true if an error message has been sent. The error message is not checked by the access
+// control handler, so that the originator of a message rejected by the access control is
+// always informed.
+func (ctx *Context) rejectMessage(msg *Message, code UInteger, err error) bool {
+	ctx.Error(NewMessageError(msg, code, err))
+	reply, rerr := NewErrorReply(msg, ctx.NewBody(), code, NewString(err.Error()))
+	if (reply == nil) && (rerr == nil) {
+		return false
+	}
+	if rerr == nil {
+		rerr = ctx.send(reply, false)
+	}
+	if rerr != nil {
+		logger.Errorf("Context.Receive: cannot reply error to %s: %s", uriString(msg.UriFrom), rerr.Error())
+		return false
+	}
+	return true
+}
+
+// Returns the MAL error code carried by the specified error, or the default code.
+func errorCode(err error, dflt UInteger) UInteger {
+	switch e := err.(type) {
+	case *AccessError:
+		return e.Code
+	case *MessageError:
+		return e.Code
+	}
+	return dflt
+}
+
+// Method implementing ERROR indication from transport layer, it is also used internally
+// to report failures (access control, routing, etc.). The failure is published to the
+// error channel and listener of this context.
+func (ctx *Context) Error(merr *MessageError) {
+	logger.Warnf("Context.Error: %s", merr.Error())
+	ctx.lock.RLock()
+	errch, errlst := ctx.errch, ctx.errlst
+	if errch != nil {
+		select {
+		case errch <- merr:
+		default:
+			logger.Warnf("Context.Error: error channel full, discards error")
+		}
+	}
+	ctx.lock.RUnlock()
+	if errlst != nil {
+		errlst.OnError(merr)
+	}
+}
+
 // Method implementing RECEIVEMULTIPLE indication from transport layer.
 func (ctx *Context) ReceiveMultiple(msgs ...*Message) error {
 	for _, msg := range msgs {
@@ -0,0 +1,217 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2019 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package mal
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defines the policy applied when the dispatch queue of an end-point is full.
+type DispatchPolicy uint8
+
+const (
+	// Waits for a free slot in the queue, the underlying transport thread is blocked.
+	DISPATCH_BLOCK DispatchPolicy = iota
+	// Drops the oldest queued message, its originator receives a DELIVERY_FAILED error.
+	// This policy requires a queue with at least one slot.
+	DISPATCH_DROP_OLDEST
+	// Rejects the incoming message, its originator receives a DELIVERY_DELAYED error.
+	DISPATCH_REJECT
+)
+
+const (
+	// Defines the default length of the dispatch queue of each registered listener.
+	dflt_dispatch_queue_length uint = 10
+	// Defines the maximum delay given to a listener to consume the messages remaining in
+	// its dispatch queue when the MAL context is closed.
+	dispatch_drain_timeout = 1 * time.Second
+)
+
+// Each registered listener has its own dispatch queue and goroutine, so a slow listener
+// does not delay the other listeners of the MAL context.
+type dispatcher struct {
+	ctx      *Context
+	listener Listener
+	policy   DispatchPolicy
+	queue    chan *Message
+	// Held in read mode while a message is pushed, so that no message is queued once the
+	// dispatcher is stopped.
+	lock    sync.RWMutex
+	stopped bool
+	// Closed to release the pushers waiting for a free slot when the dispatcher is stopped.
+	done chan bool
+	// Closed to stop the dispatch goroutine once no message can be pushed, if drain is set
+	// the queued messages are delivered before ending.
+	halt  chan bool
+	drain bool
+	// Closed when the dispatch goroutine ends.
+	ends chan bool
+	// Closed when the delivery of the remaining messages is abandoned, see abort.
+	aborted chan bool
+}
+
+// Verifies the length and overflow policy of a dispatch queue.
+func checkDispatch(length uint, policy DispatchPolicy) error {
+	if policy == DISPATCH_DROP_OLDEST && length == 0 {
+		return errors.New("DISPATCH_DROP_OLDEST requires a dispatch queue with at least one slot")
+	}
+	return nil
+}
+
+func newDispatcher(ctx *Context, listener Listener, length uint, policy DispatchPolicy) *dispatcher {
+	d := &dispatcher{
+		ctx:      ctx,
+		listener: listener,
+		policy:   policy,
+		queue:    make(chan *Message, length),
+		done:     make(chan bool),
+		halt:     make(chan bool),
+		ends:     make(chan bool),
+		aborted:  make(chan bool),
+	}
+	go d.run()
+	return d
+}
+
+// Pushes an incoming message in the dispatch queue depending of the overflow policy,
+// fails if the dispatcher is stopped.
+func (d *dispatcher) push(msg *Message) error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.stopped {
+		return errors.New("EndPoint closed")
+	}
+	switch d.policy {
+	case DISPATCH_DROP_OLDEST:
+		select {
+		case d.queue <- msg:
+			return nil
+		case <-d.done:
+			return errors.New("EndPoint closed")
+		default:
+		}
+		select {
+		case old := <-d.queue:
+			logger.Warnf("Context.dispatch: queue full for %s, drops message from %s", *old.UriTo, uriString(old.UriFrom))
+			d.ctx.replyError(old, ERROR_DELIVERY_FAILED, ERROR_DELIVERY_FAILED_MESSAGE)
+		default:
+		}
+		// The freed slot may be taken by a concurrent pusher, then waits as DISPATCH_BLOCK.
+		select {
+		case d.queue <- msg:
+			return nil
+		case <-d.done:
+			return errors.New("EndPoint closed")
+		}
+	case DISPATCH_REJECT:
+		select {
+		case d.queue <- msg:
+			return nil
+		case <-d.done:
+			return errors.New("EndPoint closed")
+		default:
+			logger.Warnf("Context.dispatch: queue full for %s, rejects message from %s", *msg.UriTo, uriString(msg.UriFrom))
+			d.ctx.replyError(msg, ERROR_DELIVERY_DELAYED, ERROR_DELIVERY_DELAYED_MESSAGE)
+			return nil
+		}
+	default:
+		select {
+		case d.queue <- msg:
+			return nil
+		case <-d.done:
+			return errors.New("EndPoint closed")
+		}
+	}
+}
+
+func (d *dispatcher) run() {
+	defer close(d.ends)
+	for {
+		select {
+		case msg := <-d.queue:
+			d.listener.OnMessage(msg)
+		case <-d.halt:
+			for {
+				select {
+				case msg := <-d.queue:
+					if d.drain && !d.isAborted() {
+						d.listener.OnMessage(msg)
+					} else {
+						d.ctx.replyError(msg, ERROR_DELIVERY_FAILED, ERROR_DELIVERY_FAILED_MESSAGE)
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Stops the dispatch goroutine, the ends channel is closed when it is done.
+func (d *dispatcher) stop(drain bool) {
+	close(d.done)
+	d.lock.Lock()
+	d.stopped = true
+	d.drain = drain
+	d.lock.Unlock()
+	close(d.halt)
+}
+
+// Waits for the end of the dispatch goroutine until the specified deadline, returns false
+// if the goroutine is still running.
+func (d *dispatcher) wait(deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-d.ends:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Abandons the delivery of the remaining messages, their originators receive a
+// DELIVERY_FAILED error. The message being delivered, if any, is not interrupted.
+func (d *dispatcher) abort() {
+	close(d.aborted)
+	for {
+		select {
+		case msg := <-d.queue:
+			d.ctx.replyError(msg, ERROR_DELIVERY_FAILED, ERROR_DELIVERY_FAILED_MESSAGE)
+		default:
+			return
+		}
+	}
+}
+
+func (d *dispatcher) isAborted() bool {
+	select {
+	case <-d.aborted:
+		return true
+	default:
+		return false
+	}
+}
@@ -25,6 +25,7 @@ package mal
 
 import (
 	"errors"
+	"sync"
 	"sync/atomic"
 )
 
@@ -47,6 +48,10 @@ type EndPoint struct {
 	Uri *URI
 	ch  chan *Message
 	tid uint64
+	// Closed when the end-point is closed, the message channel may belong to the caller
+	// so it is never closed.
+	done chan bool
+	once sync.Once
 }
 
 // Creates a new end-point in related MAL context for specified service.
@@ -60,7 +65,7 @@ func NewEndPoint(ctx *Context, service string, ch chan *Message) (*EndPoint, err
 		ch = make(chan *Message, dflt_endpoint_channel_length)
 	}
 	uri := ctx.NewURI(service)
-	endpoint := &EndPoint{ctx, uri, ch, 0}
+	endpoint := &EndPoint{Ctx: ctx, Uri: uri, ch: ch, done: make(chan bool)}
 	err := ctx.RegisterEndPoint(uri, endpoint)
 	if err != nil {
 		return nil, err
@@ -79,13 +84,24 @@ func (endpoint *EndPoint) Send(msg *Message) error {
 	return endpoint.Ctx.Send(msg)
 }
 
+// Receives the next message, the messages already delivered in the channel remain
+// available after the end-point is closed.
 func (endpoint *EndPoint) Recv() (*Message, error) {
-	msg, ok := <-endpoint.ch
-	if ok {
-		return msg, nil
-	} else {
-		return nil, errors.New("MAL context closed")
+	select {
+	case msg, ok := <-endpoint.ch:
+		if ok {
+			return msg, nil
+		}
+	case <-endpoint.done:
+		select {
+		case msg, ok := <-endpoint.ch:
+			if ok {
+				return msg, nil
+			}
+		default:
+		}
 	}
+	return nil, errors.New("MAL context closed")
 }
 
 // Gets next TransactionId for this end-point.
@@ -95,17 +111,30 @@ func (endpoint *EndPoint) TransactionId() ULong {
 
 // Closes this end-point.
 func (endpoint *EndPoint) Close() error {
+	endpoint.shutdown()
 	return endpoint.Ctx.UnregisterEndPoint(endpoint.Uri)
 }
 
+func (endpoint *EndPoint) shutdown() {
+	endpoint.once.Do(func() { close(endpoint.done) })
+}
+
 // ================================================================================
 // Defines Listener interface used by context to route MAL messages
 
+// Delivers the message in the channel, once the end-point is closed a message which
+// cannot be delivered is rejected with a DELIVERY_FAILED error.
 func (endpoint *EndPoint) OnMessage(msg *Message) {
-	endpoint.ch <- msg
+	select {
+	case endpoint.ch <- msg:
+	case <-endpoint.done:
+		logger.Warnf("EndPoint.OnMessage: %s closed, rejects message from %s", *endpoint.Uri, uriString(msg.UriFrom))
+		endpoint.Ctx.replyError(msg, ERROR_DELIVERY_FAILED, ERROR_DELIVERY_FAILED_MESSAGE)
+	}
 }
 
+// Called once when the underlying MAL context is closed, a blocked Recv returns.
 func (endpoint *EndPoint) OnClose() error {
-	// TODO (AF): ?
+	endpoint.shutdown()
 	return nil
 }
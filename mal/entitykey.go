@@ -207,6 +207,7 @@ func (rkey *EntityKey) Match(key *EntityKey) bool {
 	//    NULL.
 	// d) If a sub-key contains the wildcard value it shall match a sub-key that contains any
 	//    value including NULL.
+	// A specific value never matches a NULL sub-key of the key.
 
 	logger.Debugf("EntityKey.Match request -> %s", *rkey)
 	logger.Debugf("EntityKey.Match update -> %s", *key)
@@ -217,7 +218,7 @@ func (rkey *EntityKey) Match(key *EntityKey) bool {
 			return false
 		}
 	} else if (string)(*rkey.FirstSubKey) != "*" {
-		if (rkey.FirstSubKey == nil) || ((string)(*rkey.FirstSubKey) != (string)(*key.FirstSubKey)) {
+		if (key.FirstSubKey == nil) || ((string)(*rkey.FirstSubKey) != (string)(*key.FirstSubKey)) {
 			logger.Debugf("EntityKey.Match #1.2 !NOK!")
 			return false
 		}
@@ -229,7 +230,7 @@ func (rkey *EntityKey) Match(key *EntityKey) bool {
 			return false
 		}
 	} else if (int64)(*rkey.SecondSubKey) != 0 {
-		if (rkey.SecondSubKey == nil) || ((int64)(*rkey.SecondSubKey) != (int64)(*key.SecondSubKey)) {
+		if (key.SecondSubKey == nil) || ((int64)(*rkey.SecondSubKey) != (int64)(*key.SecondSubKey)) {
 			logger.Debugf("EntityKey.Match #2.2 !NOK!")
 			return false
 		}
@@ -241,7 +242,7 @@ func (rkey *EntityKey) Match(key *EntityKey) bool {
 			return false
 		}
 	} else if (int64)(*rkey.ThirdSubKey) != 0 {
-		if (rkey.ThirdSubKey == nil) || ((int64)(*rkey.ThirdSubKey) != (int64)(*key.ThirdSubKey)) {
+		if (key.ThirdSubKey == nil) || ((int64)(*rkey.ThirdSubKey) != (int64)(*key.ThirdSubKey)) {
 			logger.Debugf("EntityKey.Match #3.2 !NOK!")
 			return false
 		}
@@ -253,7 +254,7 @@ func (rkey *EntityKey) Match(key *EntityKey) bool {
 			return false
 		}
 	} else if (int64)(*rkey.FourthSubKey) != 0 {
-		if (rkey.FourthSubKey == nil) || ((int64)(*rkey.FourthSubKey) != (int64)(*key.FourthSubKey)) {
+		if (key.FourthSubKey == nil) || ((int64)(*rkey.FourthSubKey) != (int64)(*key.FourthSubKey)) {
 			logger.Debugf("EntityKey.Match #4.2 !NOK!")
 			return false
 		}
@@ -23,12 +23,145 @@
  */
 package mal
 
+import (
+	"errors"
+	"fmt"
+)
+
+// Describes an asynchronous failure of the MAL layer: the offending message (nil if
+// it cannot be decoded), the corresponding MAL error code and the cause.
 type MessageError struct {
-	err error
-	msg *Message
+	Msg  *Message
+	Code UInteger
+	Err  error
+}
+
+func NewMessageError(msg *Message, code UInteger, err error) *MessageError {
+	return &MessageError{Msg: msg, Code: code, Err: err}
+}
+
+func (merr *MessageError) Error() string {
+	if merr.Msg != nil {
+		return fmt.Sprintf("MAL error %d on message from %s to %s: %v", merr.Code, uriString(merr.Msg.UriFrom), uriString(merr.Msg.UriTo), merr.Err)
+	}
+	return fmt.Sprintf("MAL error %d: %v", merr.Code, merr.Err)
+}
+
+// Returns the cause of the failure.
+func (merr *MessageError) Unwrap() error {
+	return merr.Err
 }
 
-// TODO (AF): Is it really useful?
+// Listener notified of each asynchronous failure of a MAL context, see
+// Context.SetErrorListener.
 type ErrorListener interface {
-	onError(err *MessageError)
+	OnError(err *MessageError)
+}
+
+// Returns the interaction stage used to report an error to the originator of the
+// specified message. The boolean result is false if the message cannot be answered
+// (SEND interaction, error message or message that is not an initiating stage).
+func ErrorReplyStage(msg *Message) (InteractionStage, bool) {
+	if msg.IsErrorMessage {
+		return 0, false
+	}
+	switch msg.InteractionType {
+	case MAL_INTERACTIONTYPE_SUBMIT:
+		if msg.InteractionStage == MAL_IP_STAGE_SUBMIT {
+			return MAL_IP_STAGE_SUBMIT_ACK, true
+		}
+	case MAL_INTERACTIONTYPE_REQUEST:
+		if msg.InteractionStage == MAL_IP_STAGE_REQUEST {
+			return MAL_IP_STAGE_REQUEST_RESPONSE, true
+		}
+	case MAL_INTERACTIONTYPE_INVOKE:
+		if msg.InteractionStage == MAL_IP_STAGE_INVOKE {
+			return MAL_IP_STAGE_INVOKE_ACK, true
+		}
+	case MAL_INTERACTIONTYPE_PROGRESS:
+		if msg.InteractionStage == MAL_IP_STAGE_PROGRESS {
+			return MAL_IP_STAGE_PROGRESS_ACK, true
+		}
+	case MAL_INTERACTIONTYPE_PUBSUB:
+		switch msg.InteractionStage {
+		case MAL_IP_STAGE_PUBSUB_REGISTER:
+			return MAL_IP_STAGE_PUBSUB_REGISTER_ACK, true
+		case MAL_IP_STAGE_PUBSUB_PUBLISH_REGISTER:
+			return MAL_IP_STAGE_PUBSUB_PUBLISH_REGISTER_ACK, true
+		case MAL_IP_STAGE_PUBSUB_PUBLISH:
+			// The error is reported through a PUBLISH_ERROR message
+			return MAL_IP_STAGE_PUBSUB_PUBLISH, true
+		case MAL_IP_STAGE_PUBSUB_DEREGISTER:
+			return MAL_IP_STAGE_PUBSUB_DEREGISTER_ACK, true
+		case MAL_IP_STAGE_PUBSUB_PUBLISH_DEREGISTER:
+			return MAL_IP_STAGE_PUBSUB_PUBLISH_DEREGISTER_ACK, true
+		}
+	}
+	return 0, false
+}
+
+// Sends back to the originator of the specified message a MAL error message with the
+// standard error body: the error code (UInteger) followed by the extra information.
+// Nothing is sent if the message cannot be answered (see ErrorReplyStage). A nil extra
+// information is encoded as a null String.
+func (ctx *Context) SendErrorReply(msg *Message, code UInteger, extraInfo Element) error {
+	reply, err := NewErrorReply(msg, ctx.NewBody(), code, extraInfo)
+	if reply == nil || err != nil {
+		return err
+	}
+	logger.Debugf("Context.SendErrorReply: %d to %s", code, *msg.UriFrom)
+	return ctx.Send(reply)
+}
+
+// Builds the MAL error message answering the specified message, the standard error body
+// is encoded in the specified writeable body. Returns nil if the message cannot be
+// answered (see ErrorReplyStage).
+func NewErrorReply(msg *Message, body Body, code UInteger, extraInfo Element) (*Message, error) {
+	stage, ok := ErrorReplyStage(msg)
+	if !ok || msg.UriFrom == nil {
+		return nil, nil
+	}
+	if extraInfo == nil {
+		extraInfo = NullString
+	}
+	err := body.EncodeParameter(&code)
+	if err != nil {
+		return nil, err
+	}
+	err = body.EncodeLastParameter(extraInfo, false)
+	if err != nil {
+		return nil, err
+	}
+	reply := &Message{
+		UriFrom:          msg.UriTo,
+		UriTo:            msg.UriFrom,
+		AuthenticationId: msg.AuthenticationId,
+		EncodingId:       msg.EncodingId,
+		QoSLevel:         msg.QoSLevel,
+		Priority:         msg.Priority,
+		Domain:           msg.Domain,
+		NetworkZone:      msg.NetworkZone,
+		Session:          msg.Session,
+		SessionName:      msg.SessionName,
+		InteractionType:  msg.InteractionType,
+		InteractionStage: stage,
+		TransactionId:    msg.TransactionId,
+		ServiceArea:      msg.ServiceArea,
+		AreaVersion:      msg.AreaVersion,
+		Service:          msg.Service,
+		Operation:        msg.Operation,
+		IsErrorMessage:   true,
+		Body:             body,
+	}
+	return reply, nil
+}
+
+// Reports an incoming message that cannot be delivered through the error channel and
+// listener, then sends back an error message to its originator.
+func (ctx *Context) replyError(msg *Message, code UInteger, info String) {
+	ctx.Error(NewMessageError(msg, code, errors.New(string(info))))
+	err := ctx.SendErrorReply(msg, code, &info)
+	if err != nil {
+		logger.Errorf("Context.replyError: cannot reply error to %s: %s", uriString(msg.UriFrom), err.Error())
+	}
 }
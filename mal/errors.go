@@ -23,46 +23,109 @@
  */
 package mal
 
-import ()
+import (
+	"errors"
+	"sync"
+)
 
+// Note: The standard error codes and messages are declared in newmapping.go, these
+// constants are kept for compatibility.
 const (
-	MAL_ERROR_DELIVERY_FAILED       UInteger = 65536
-	MAL_ERROR_DELIVERY_TIMEDOUT     UInteger = 65537
-	MAL_ERROR_DELIVERY_DELAYED      UInteger = 65538
-	MAL_ERROR_DESTINATION_UNKNOWN   UInteger = 65539
-	MAL_ERROR_DESTINATION_TRANSIENT UInteger = 65540
-	MAL_ERROR_DESTINATION_LOST      UInteger = 65541
-	MAL_ERROR_AUTHENTICATION_FAIL   UInteger = 65542
-	MAL_ERROR_AUTHORISATION_FAIL    UInteger = 65543
-	MAL_ERROR_ENCRYPTION_FAIL       UInteger = 65544
-	MAL_ERROR_UNSUPPORTED_AREA      UInteger = 65545
-	MAL_ERROR_UNSUPPORTED_OPERATION UInteger = 65546
-	MAL_ERROR_UNSUPPORTED_VERSION   UInteger = 65547
-	MAL_ERROR_BAD_ENCODING          UInteger = 65548
-	MAL_ERROR_INTERNAL              UInteger = 65549
-	MAL_ERROR_UNKNOWN               UInteger = 65550
-	MAL_ERROR_INCORRECT_STATE       UInteger = 65551
-	MAL_ERROR_TOO_MANY              UInteger = 65552
-	MAL_ERROR_SHUTDOWN              UInteger = 65553
+	MAL_ERROR_DELIVERY_FAILED       UInteger = ERROR_DELIVERY_FAILED
+	MAL_ERROR_DELIVERY_TIMEDOUT     UInteger = ERROR_DELIVERY_TIMEDOUT
+	MAL_ERROR_DELIVERY_DELAYED      UInteger = ERROR_DELIVERY_DELAYED
+	MAL_ERROR_DESTINATION_UNKNOWN   UInteger = ERROR_DESTINATION_UNKNOWN
+	MAL_ERROR_DESTINATION_TRANSIENT UInteger = ERROR_DESTINATION_TRANSIENT
+	MAL_ERROR_DESTINATION_LOST      UInteger = ERROR_DESTINATION_LOST
+	MAL_ERROR_AUTHENTICATION_FAIL   UInteger = ERROR_AUTHENTICATION_FAIL
+	MAL_ERROR_AUTHORISATION_FAIL    UInteger = ERROR_AUTHORISATION_FAIL
+	MAL_ERROR_ENCRYPTION_FAIL       UInteger = ERROR_ENCRYPTION_FAIL
+	MAL_ERROR_UNSUPPORTED_AREA      UInteger = ERROR_UNSUPPORTED_AREA
+	MAL_ERROR_UNSUPPORTED_OPERATION UInteger = ERROR_UNSUPPORTED_OPERATION
+	MAL_ERROR_UNSUPPORTED_VERSION   UInteger = ERROR_UNSUPPORTED_VERSION
+	MAL_ERROR_BAD_ENCODING          UInteger = ERROR_BAD_ENCODING
+	MAL_ERROR_INTERNAL              UInteger = ERROR_INTERNAL
+	MAL_ERROR_UNKNOWN               UInteger = ERROR_UNKNOWN
+	MAL_ERROR_INCORRECT_STATE       UInteger = ERROR_INCORRECT_STATE
+	MAL_ERROR_TOO_MANY              UInteger = ERROR_TOO_MANY
+	MAL_ERROR_SHUTDOWN              UInteger = ERROR_SHUTDOWN
+
+	MAL_ERROR_DELIVERY_FAILED_MESSAGE       String = ERROR_DELIVERY_FAILED_MESSAGE
+	MAL_ERROR_DELIVERY_TIMEDOUT_MESSAGE     String = ERROR_DELIVERY_TIMEDOUT_MESSAGE
+	MAL_ERROR_DELIVERY_DELAYED_MESSAGE      String = ERROR_DELIVERY_DELAYED_MESSAGE
+	MAL_ERROR_DESTINATION_UNKNOWN_MESSAGE   String = ERROR_DESTINATION_UNKNOWN_MESSAGE
+	MAL_ERROR_DESTINATION_TRANSIENT_MESSAGE String = ERROR_DESTINATION_TRANSIENT_MESSAGE
+	MAL_ERROR_DESTINATION_LOST_MESSAGE      String = ERROR_DESTINATION_LOST_MESSAGE
+	MAL_ERROR_AUTHENTICATION_FAIL_MESSAGE   String = ERROR_AUTHENTICATION_FAIL_MESSAGE
+	MAL_ERROR_AUTHORISATION_FAIL_MESSAGE    String = ERROR_AUTHORISATION_FAIL_MESSAGE
+	MAL_ERROR_ENCRYPTION_FAIL_MESSAGE       String = ERROR_ENCRYPTION_FAIL_MESSAGE
+	MAL_ERROR_UNSUPPORTED_AREA_MESSAGE      String = ERROR_UNSUPPORTED_AREA_MESSAGE
+	MAL_ERROR_UNSUPPORTED_OPERATION_MESSAGE String = ERROR_UNSUPPORTED_OPERATION_MESSAGE
+	MAL_ERROR_UNSUPPORTED_VERSION_MESSAGE   String = ERROR_UNSUPPORTED_VERSION_MESSAGE
+	MAL_ERROR_BAD_ENCODING_MESSAGE          String = ERROR_BAD_ENCODING_MESSAGE
+	MAL_ERROR_INTERNAL_MESSAGE              String = ERROR_INTERNAL_MESSAGE
+	MAL_ERROR_UNKNOWN_MESSAGE               String = ERROR_UNKNOWN_MESSAGE
+	MAL_ERROR_INCORRECT_STATE_MESSAGE       String = ERROR_INCORRECT_STATE_MESSAGE
+	MAL_ERROR_TOO_MANY_MESSAGE              String = ERROR_TOO_MANY_MESSAGE
+	MAL_ERROR_SHUTDOWN_MESSAGE              String = ERROR_SHUTDOWN_MESSAGE
+)
 
-	MAL_ERROR_DELIVERY_FAILED_MESSAGE       String = "Confirmed communication error."
-	MAL_ERROR_DELIVERY_TIMEDOUT_MESSAGE     String = "Unconfirmed communication error."
-	MAL_ERROR_DELIVERY_DELAYED_MESSAGE      String = "Message queued somewhere awaiting contact."
-	MAL_ERROR_DESTINATION_UNKNOWN_MESSAGE   String = "Destination cannot be contacted."
-	MAL_ERROR_DESTINATION_TRANSIENT_MESSAGE String = "Destination middleware reports destination application does not exist."
-	MAL_ERROR_DESTINATION_LOST_MESSAGE      String = "Destination lost halfway through conversation."
-	MAL_ERROR_AUTHENTICATION_FAIL_MESSAGE   String = "A failure to authenticate the message correctly."
-	MAL_ERROR_AUTHORISATION_FAIL_MESSAGE    String = "A failure in the MAL to authorise the message."
-	MAL_ERROR_ENCRYPTION_FAIL_MESSAGE       String = "A failure in the MAL to encrypt/decrypt the message."
-	MAL_ERROR_UNSUPPORTED_AREA_MESSAGE      String = "The destination does not support the service area."
-	MAL_ERROR_UNSUPPORTED_OPERATION_MESSAGE String = "The destination does not support the operation."
-	MAL_ERROR_UNSUPPORTED_VERSION_MESSAGE   String = "The destination does not support the area version."
-	MAL_ERROR_BAD_ENCODING_MESSAGE          String = "The destination was unable to decode the message."
-	MAL_ERROR_INTERNAL_MESSAGE              String = "An internal error has occurred."
-	MAL_ERROR_UNKNOWN_MESSAGE               String = "Operation specific."
-	MAL_ERROR_INCORRECT_STATE_MESSAGE       String = "The destination was not in the correct state for the received message."
-	MAL_ERROR_TOO_MANY_MESSAGE              String = "Maximum number of subscriptions or providers of a broker has been exceeded."
-	MAL_ERROR_SHUTDOWN_MESSAGE              String = "The component is being shutdown."
+// Describes an error code of the catalogue.
+type ErrorDefinition struct {
+	Code        UInteger
+	Name        string
+	Description String
+	// Null value of the type of the extra information, used to decode it. A nil value
+	// means that the type is unknown.
+	ExtraInfo Element
+}
+
+var (
+	errorsLock sync.RWMutex
+	errorsDefs = make(map[UInteger]*ErrorDefinition)
 )
 
-// TODO (AF): Defines a map allowing to get message from error code.
+func init() {
+	defs := []ErrorDefinition{
+		{ERROR_DELIVERY_FAILED, "DELIVERY_FAILED", ERROR_DELIVERY_FAILED_MESSAGE, NullString},
+		{ERROR_DELIVERY_TIMEDOUT, "DELIVERY_TIMEDOUT", ERROR_DELIVERY_TIMEDOUT_MESSAGE, NullString},
+		{ERROR_DELIVERY_DELAYED, "DELIVERY_DELAYED", ERROR_DELIVERY_DELAYED_MESSAGE, NullString},
+		{ERROR_DESTINATION_UNKNOWN, "DESTINATION_UNKNOWN", ERROR_DESTINATION_UNKNOWN_MESSAGE, NullString},
+		{ERROR_DESTINATION_TRANSIENT, "DESTINATION_TRANSIENT", ERROR_DESTINATION_TRANSIENT_MESSAGE, NullString},
+		{ERROR_DESTINATION_LOST, "DESTINATION_LOST", ERROR_DESTINATION_LOST_MESSAGE, NullString},
+		{ERROR_AUTHENTICATION_FAIL, "AUTHENTICATION_FAIL", ERROR_AUTHENTICATION_FAIL_MESSAGE, NullString},
+		{ERROR_AUTHORISATION_FAIL, "AUTHORISATION_FAIL", ERROR_AUTHORISATION_FAIL_MESSAGE, NullString},
+		{ERROR_ENCRYPTION_FAIL, "ENCRYPTION_FAIL", ERROR_ENCRYPTION_FAIL_MESSAGE, NullString},
+		{ERROR_UNSUPPORTED_AREA, "UNSUPPORTED_AREA", ERROR_UNSUPPORTED_AREA_MESSAGE, NullString},
+		{ERROR_UNSUPPORTED_OPERATION, "UNSUPPORTED_OPERATION", ERROR_UNSUPPORTED_OPERATION_MESSAGE, NullString},
+		{ERROR_UNSUPPORTED_VERSION, "UNSUPPORTED_VERSION", ERROR_UNSUPPORTED_VERSION_MESSAGE, NullString},
+		{ERROR_BAD_ENCODING, "BAD_ENCODING", ERROR_BAD_ENCODING_MESSAGE, NullString},
+		{ERROR_INTERNAL, "INTERNAL", ERROR_INTERNAL_MESSAGE, NullString},
+		{ERROR_UNKNOWN, "UNKNOWN", ERROR_UNKNOWN_MESSAGE, NullString},
+		{ERROR_INCORRECT_STATE, "INCORRECT_STATE", ERROR_INCORRECT_STATE_MESSAGE, NullString},
+		{ERROR_TOO_MANY, "TOO_MANY", ERROR_TOO_MANY_MESSAGE, NullString},
+		{ERROR_SHUTDOWN, "SHUTDOWN", ERROR_SHUTDOWN_MESSAGE, NullString},
+	}
+	for idx := range defs {
+		errorsDefs[defs[idx].Code] = &defs[idx]
+	}
+}
+
+// Registers an error code in the catalogue, typically the specific errors of a service
+// area. It is not allowed to redefine an already registered code.
+func RegisterError(def *ErrorDefinition) error {
+	errorsLock.Lock()
+	defer errorsLock.Unlock()
+	if _, ok := errorsDefs[def.Code]; ok {
+		return errors.New("Error code already registered: " + def.Name)
+	}
+	errorsDefs[def.Code] = def
+	return nil
+}
+
+// Returns the definition of the specified error code, nil if the code is not registered.
+func LookupError(code UInteger) *ErrorDefinition {
+	errorsLock.RLock()
+	defer errorsLock.RUnlock()
+	return errorsDefs[code]
+}
@@ -0,0 +1,98 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2018 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package mal
+
+import (
+	"errors"
+)
+
+// Defines the interface of an interceptor of a MAL context. The InterceptSend method is
+// called for each outgoing message before the access control check and its transmission,
+// the InterceptReceive method is called for each incoming message after the access
+// control check and before its routing. An interceptor may modify the message in place.
+//
+// A non nil returned error rejects the message, the error may be a MessageError or an
+// AccessError in order to specify the MAL error code (INTERNAL by default). A false
+// returned value without error short-circuits the message: it is silently discarded and
+// the following interceptors are not called.
+type Interceptor interface {
+	InterceptSend(msg *Message) (bool, error)
+	InterceptReceive(msg *Message) (bool, error)
+}
+
+// Adds an interceptor at the end of the chain of this MAL context, the interceptors are
+// called in their order of registration for both outgoing and incoming messages.
+func (ctx *Context) AddInterceptor(interceptor Interceptor) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	// The chain is never modified in place, so it can be used without lock.
+	chain := make([]Interceptor, len(ctx.interceptors), len(ctx.interceptors)+1)
+	copy(chain, ctx.interceptors)
+	ctx.interceptors = append(chain, interceptor)
+}
+
+// Removes the specified interceptor from the chain of this MAL context.
+func (ctx *Context) RemoveInterceptor(interceptor Interceptor) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for idx, i := range ctx.interceptors {
+		if i == interceptor {
+			chain := make([]Interceptor, 0, len(ctx.interceptors)-1)
+			chain = append(chain, ctx.interceptors[:idx]...)
+			ctx.interceptors = append(chain, ctx.interceptors[idx+1:]...)
+			return nil
+		}
+	}
+	return errors.New("Interceptor not registered")
+}
+
+func (ctx *Context) getInterceptors() []Interceptor {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+	return ctx.interceptors
+}
+
+// Passes an outgoing message through the chain of interceptors, returns false if the
+// message should not be transmitted.
+func (ctx *Context) interceptSend(msg *Message) (bool, error) {
+	for _, interceptor := range ctx.getInterceptors() {
+		ok, err := interceptor.InterceptSend(msg)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Passes an incoming message through the chain of interceptors, returns false if the
+// message should not be delivered.
+func (ctx *Context) interceptReceive(msg *Message) (bool, error) {
+	for _, interceptor := range ctx.getInterceptors() {
+		ok, err := interceptor.InterceptReceive(msg)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
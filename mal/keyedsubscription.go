@@ -0,0 +1,163 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package mal
+
+import ()
+
+// ################################################################################
+// Defines MAL KeyedSubscription type
+// ################################################################################
+
+// Version of the MAL area defining the structures of the keyed publish-subscribe model of the
+// newer MAL drafts (MAL v2), where the entity keys are replaced by named keys.
+const MAL_KEYED_AREA_VERSION UOctet = 0x02
+
+// Subscription of the keyed publish-subscribe model. Domain is the domain of the updates, it
+// may end with the wildcard '*', the domain of the message is used if it is NULL. The updates
+// must match all the filters, a key without filter matches any value. SelectedKeys are the
+// names of the keys whose values are notified, all keys if it is NULL.
+type KeyedSubscription struct {
+	SubscriptionId Identifier
+	Domain         *IdentifierList
+	SelectedKeys   *IdentifierList
+	Filters        *SubscriptionFilterList
+}
+
+var (
+	NullKeyedSubscription *KeyedSubscription = nil
+)
+
+func NewKeyedSubscription() *KeyedSubscription {
+	return new(KeyedSubscription)
+}
+
+// ================================================================================
+// Defines MAL KeyedSubscription type as a MAL Composite
+
+func (subs *KeyedSubscription) Composite() Composite {
+	return subs
+}
+
+// ================================================================================
+// Defines MAL KeyedSubscription type as a MAL Element
+
+// Registers MAL KeyedSubscription type for polymorpsism handling
+func init() {
+	RegisterMALElement(MAL_KEYED_SUBSCRIPTION_SHORT_FORM, NullKeyedSubscription)
+}
+
+const MAL_KEYED_SUBSCRIPTION_TYPE_SHORT_FORM Integer = 0x17
+const MAL_KEYED_SUBSCRIPTION_SHORT_FORM Long = 0x1000002000017
+
+// Returns the absolute short form of the element type.
+func (*KeyedSubscription) GetShortForm() Long {
+	return MAL_KEYED_SUBSCRIPTION_SHORT_FORM
+}
+
+// Returns the number of the area this element type belongs to.
+func (*KeyedSubscription) GetAreaNumber() UShort {
+	return MAL_ATTRIBUTE_AREA_NUMBER
+}
+
+// Returns the version of the area this element type belongs to.
+func (*KeyedSubscription) GetAreaVersion() UOctet {
+	return MAL_KEYED_AREA_VERSION
+}
+
+// Returns the number of the service this element type belongs to.
+func (*KeyedSubscription) GetServiceNumber() UShort {
+	return MAL_ATTRIBUTE_AREA_SERVICE_NUMBER
+}
+
+// Returns the relative short form of the element type.
+func (*KeyedSubscription) GetTypeShortForm() Integer {
+	return MAL_KEYED_SUBSCRIPTION_TYPE_SHORT_FORM
+}
+
+// Encodes this element using the supplied encoder.
+// @param encoder The encoder to use, must not be null.
+func (subs *KeyedSubscription) Encode(encoder Encoder) error {
+	err := encoder.EncodeIdentifier(&subs.SubscriptionId)
+	if err != nil {
+		return err
+	}
+	err = encoder.EncodeNullableElement(subs.Domain)
+	if err != nil {
+		return err
+	}
+	err = encoder.EncodeNullableElement(subs.SelectedKeys)
+	if err != nil {
+		return err
+	}
+	return encoder.EncodeNullableElement(subs.Filters)
+}
+
+// Decodes an instance of this element type using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded instance, may be not the same instance as this Element.
+func (subs *KeyedSubscription) Decode(decoder Decoder) (Element, error) {
+	return DecodeKeyedSubscription(decoder)
+}
+
+// Decodes an instance of KeyedSubscription using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded KeyedSubscription instance.
+func DecodeKeyedSubscription(decoder Decoder) (*KeyedSubscription, error) {
+	subscriptionId, err := decoder.DecodeIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	domain, err := decoder.DecodeNullableElement(NullIdentifierList)
+	if err != nil {
+		return nil, err
+	}
+	selectedKeys, err := decoder.DecodeNullableElement(NullIdentifierList)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := decoder.DecodeNullableElement(NullSubscriptionFilterList)
+	if err != nil {
+		return nil, err
+	}
+	var subs = KeyedSubscription{
+		SubscriptionId: *subscriptionId,
+		Domain:         domain.(*IdentifierList),
+		SelectedKeys:   selectedKeys.(*IdentifierList),
+		Filters:        filters.(*SubscriptionFilterList),
+	}
+	return &subs, nil
+}
+
+// The method allows the creation of an element in a generic way, i.e., using the MAL Element polymorphism.
+func (*KeyedSubscription) CreateElement() Element {
+	return NewKeyedSubscription()
+}
+
+func (subs *KeyedSubscription) IsNull() bool {
+	return subs == nil
+}
+
+func (*KeyedSubscription) Null() Element {
+	return NullKeyedSubscription
+}
@@ -0,0 +1,150 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package mal
+
+import ()
+
+// ################################################################################
+// Defines MAL KeyedUpdateHeader type
+// ################################################################################
+
+// Header of an update of the keyed publish-subscribe model. Source identifies the publisher
+// of the update, Domain is the domain of the update, the domain of the message is used if it
+// is NULL (the domain of a published update must be the domain of the publisher registration
+// or one of its sub-domains). KeyValues are the values of the keys in the order of the key names given at the
+// registration of the publisher, or of the selected keys of the subscription in a notify.
+type KeyedUpdateHeader struct {
+	Source    Identifier
+	Domain    *IdentifierList
+	KeyValues NullableAttributeList
+}
+
+var (
+	NullKeyedUpdateHeader *KeyedUpdateHeader = nil
+)
+
+func NewKeyedUpdateHeader() *KeyedUpdateHeader {
+	return new(KeyedUpdateHeader)
+}
+
+// ================================================================================
+// Defines MAL KeyedUpdateHeader type as a MAL Composite
+
+func (header *KeyedUpdateHeader) Composite() Composite {
+	return header
+}
+
+// ================================================================================
+// Defines MAL KeyedUpdateHeader type as a MAL Element
+
+// Registers MAL KeyedUpdateHeader type for polymorpsism handling
+func init() {
+	RegisterMALElement(MAL_KEYED_UPDATE_HEADER_SHORT_FORM, NullKeyedUpdateHeader)
+}
+
+const MAL_KEYED_UPDATE_HEADER_TYPE_SHORT_FORM Integer = 0x1A
+const MAL_KEYED_UPDATE_HEADER_SHORT_FORM Long = 0x100000200001A
+
+// Returns the absolute short form of the element type.
+func (*KeyedUpdateHeader) GetShortForm() Long {
+	return MAL_KEYED_UPDATE_HEADER_SHORT_FORM
+}
+
+// Returns the number of the area this element type belongs to.
+func (*KeyedUpdateHeader) GetAreaNumber() UShort {
+	return MAL_ATTRIBUTE_AREA_NUMBER
+}
+
+// Returns the version of the area this element type belongs to.
+func (*KeyedUpdateHeader) GetAreaVersion() UOctet {
+	return MAL_KEYED_AREA_VERSION
+}
+
+// Returns the number of the service this element type belongs to.
+func (*KeyedUpdateHeader) GetServiceNumber() UShort {
+	return MAL_ATTRIBUTE_AREA_SERVICE_NUMBER
+}
+
+// Returns the relative short form of the element type.
+func (*KeyedUpdateHeader) GetTypeShortForm() Integer {
+	return MAL_KEYED_UPDATE_HEADER_TYPE_SHORT_FORM
+}
+
+// Encodes this element using the supplied encoder.
+// @param encoder The encoder to use, must not be null.
+func (header *KeyedUpdateHeader) Encode(encoder Encoder) error {
+	err := encoder.EncodeIdentifier(&header.Source)
+	if err != nil {
+		return err
+	}
+	err = encoder.EncodeNullableElement(header.Domain)
+	if err != nil {
+		return err
+	}
+	return header.KeyValues.Encode(encoder)
+}
+
+// Decodes an instance of this element type using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded instance, may be not the same instance as this Element.
+func (header *KeyedUpdateHeader) Decode(decoder Decoder) (Element, error) {
+	return DecodeKeyedUpdateHeader(decoder)
+}
+
+// Decodes an instance of KeyedUpdateHeader using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded KeyedUpdateHeader instance.
+func DecodeKeyedUpdateHeader(decoder Decoder) (*KeyedUpdateHeader, error) {
+	source, err := decoder.DecodeIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	domain, err := decoder.DecodeNullableElement(NullIdentifierList)
+	if err != nil {
+		return nil, err
+	}
+	keyValues, err := DecodeNullableAttributeList(decoder)
+	if err != nil {
+		return nil, err
+	}
+	var header = KeyedUpdateHeader{
+		Source:    *source,
+		Domain:    domain.(*IdentifierList),
+		KeyValues: keyValues,
+	}
+	return &header, nil
+}
+
+// The method allows the creation of an element in a generic way, i.e., using the MAL Element polymorphism.
+func (*KeyedUpdateHeader) CreateElement() Element {
+	return NewKeyedUpdateHeader()
+}
+
+func (header *KeyedUpdateHeader) IsNull() bool {
+	return header == nil
+}
+
+func (*KeyedUpdateHeader) Null() Element {
+	return NullKeyedUpdateHeader
+}
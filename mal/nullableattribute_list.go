@@ -0,0 +1,69 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package mal
+
+import ()
+
+// ################################################################################
+// Defines NullableAttributeList type
+// ################################################################################
+
+// List of attributes of any type, each one may be NULL. It is used by the structures of the
+// keyed publish-subscribe model, it is not a MAL Element so it cannot be a parameter of a
+// message.
+type NullableAttributeList []Attribute
+
+// Encodes the list using the supplied encoder.
+// @param encoder The encoder to use, must not be null.
+func (list NullableAttributeList) Encode(encoder Encoder) error {
+	err := encoder.EncodeUInteger(NewUInteger(uint32(len(list))))
+	if err != nil {
+		return err
+	}
+	for _, att := range list {
+		err = encoder.EncodeNullableAttribute(att)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes a NullableAttributeList using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded NullableAttributeList.
+func DecodeNullableAttributeList(decoder Decoder) (NullableAttributeList, error) {
+	size, err := decoder.DecodeUInteger()
+	if err != nil {
+		return nil, err
+	}
+	list := NullableAttributeList(make([]Attribute, int(*size)))
+	for i := 0; i < len(list); i++ {
+		list[i], err = decoder.DecodeNullableAttribute()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
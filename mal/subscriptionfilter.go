@@ -0,0 +1,137 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package mal
+
+import ()
+
+// ################################################################################
+// Defines MAL SubscriptionFilter type
+// ################################################################################
+
+// Filter of a subscription of the keyed publish-subscribe model (see KeyedSubscription): the
+// key with the specified name must have one of the values.
+type SubscriptionFilter struct {
+	Name   Identifier
+	Values NullableAttributeList
+}
+
+var (
+	NullSubscriptionFilter *SubscriptionFilter = nil
+)
+
+func NewSubscriptionFilter() *SubscriptionFilter {
+	return new(SubscriptionFilter)
+}
+
+// ================================================================================
+// Defines MAL SubscriptionFilter type as a MAL Composite
+
+func (filter *SubscriptionFilter) Composite() Composite {
+	return filter
+}
+
+// ================================================================================
+// Defines MAL SubscriptionFilter type as a MAL Element
+
+// Registers MAL SubscriptionFilter type for polymorpsism handling
+func init() {
+	RegisterMALElement(MAL_SUBSCRIPTION_FILTER_SHORT_FORM, NullSubscriptionFilter)
+}
+
+const MAL_SUBSCRIPTION_FILTER_TYPE_SHORT_FORM Integer = 0x1F
+const MAL_SUBSCRIPTION_FILTER_SHORT_FORM Long = 0x100000200001F
+
+// Returns the absolute short form of the element type.
+func (*SubscriptionFilter) GetShortForm() Long {
+	return MAL_SUBSCRIPTION_FILTER_SHORT_FORM
+}
+
+// Returns the number of the area this element type belongs to.
+func (*SubscriptionFilter) GetAreaNumber() UShort {
+	return MAL_ATTRIBUTE_AREA_NUMBER
+}
+
+// Returns the version of the area this element type belongs to.
+func (*SubscriptionFilter) GetAreaVersion() UOctet {
+	return MAL_KEYED_AREA_VERSION
+}
+
+// Returns the number of the service this element type belongs to.
+func (*SubscriptionFilter) GetServiceNumber() UShort {
+	return MAL_ATTRIBUTE_AREA_SERVICE_NUMBER
+}
+
+// Returns the relative short form of the element type.
+func (*SubscriptionFilter) GetTypeShortForm() Integer {
+	return MAL_SUBSCRIPTION_FILTER_TYPE_SHORT_FORM
+}
+
+// Encodes this element using the supplied encoder.
+// @param encoder The encoder to use, must not be null.
+func (filter *SubscriptionFilter) Encode(encoder Encoder) error {
+	err := encoder.EncodeIdentifier(&filter.Name)
+	if err != nil {
+		return err
+	}
+	return filter.Values.Encode(encoder)
+}
+
+// Decodes an instance of this element type using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded instance, may be not the same instance as this Element.
+func (filter *SubscriptionFilter) Decode(decoder Decoder) (Element, error) {
+	return DecodeSubscriptionFilter(decoder)
+}
+
+// Decodes an instance of SubscriptionFilter using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded SubscriptionFilter instance.
+func DecodeSubscriptionFilter(decoder Decoder) (*SubscriptionFilter, error) {
+	name, err := decoder.DecodeIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	values, err := DecodeNullableAttributeList(decoder)
+	if err != nil {
+		return nil, err
+	}
+	var filter = SubscriptionFilter{
+		Name:   *name,
+		Values: values,
+	}
+	return &filter, nil
+}
+
+// The method allows the creation of an element in a generic way, i.e., using the MAL Element polymorphism.
+func (*SubscriptionFilter) CreateElement() Element {
+	return NewSubscriptionFilter()
+}
+
+func (filter *SubscriptionFilter) IsNull() bool {
+	return filter == nil
+}
+
+func (*SubscriptionFilter) Null() Element {
+	return NullSubscriptionFilter
+}
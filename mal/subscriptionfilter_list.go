@@ -0,0 +1,163 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package mal
+
+// ################################################################################
+// Defines MAL SubscriptionFilterList type
+// ################################################################################
+
+type SubscriptionFilterList []*SubscriptionFilter
+
+var (
+	NullSubscriptionFilterList *SubscriptionFilterList = nil
+)
+
+func NewSubscriptionFilterList(size int) *SubscriptionFilterList {
+	var list SubscriptionFilterList = SubscriptionFilterList(make([]*SubscriptionFilter, size))
+	return &list
+}
+
+// ================================================================================
+// Defines MAL SubscriptionFilterList type as an ElementList
+
+func (list *SubscriptionFilterList) Size() int {
+	if list != nil {
+		return len(*list)
+	}
+	return -1
+}
+
+func (list *SubscriptionFilterList) GetElementAt(i int) Element {
+	if list != nil {
+		if i < list.Size() {
+			return (*list)[i]
+		}
+		return nil
+	}
+	return nil
+}
+
+func (list *SubscriptionFilterList) AppendElement(element Element) {
+	if list != nil {
+		*list = append(*list, element.(*SubscriptionFilter))
+	}
+}
+
+// ================================================================================
+// Defines MAL SubscriptionFilterList type as a MAL Composite
+
+func (list *SubscriptionFilterList) Composite() Composite {
+	return list
+}
+
+// ================================================================================
+// Defines MAL SubscriptionFilterList type as a MAL Element
+
+const MAL_SUBSCRIPTION_FILTER_LIST_TYPE_SHORT_FORM Integer = -0x1F
+const MAL_SUBSCRIPTION_FILTER_LIST_SHORT_FORM Long = 0x1000002FFFFE1
+
+// Registers MAL SubscriptionFilterList type for polymorpsism handling
+func init() {
+	RegisterMALElement(MAL_SUBSCRIPTION_FILTER_LIST_SHORT_FORM, NullSubscriptionFilterList)
+}
+
+// Returns the absolute short form of the element type.
+func (*SubscriptionFilterList) GetShortForm() Long {
+	return MAL_SUBSCRIPTION_FILTER_LIST_SHORT_FORM
+}
+
+// Returns the number of the area this element type belongs to.
+func (*SubscriptionFilterList) GetAreaNumber() UShort {
+	return MAL_ATTRIBUTE_AREA_NUMBER
+}
+
+// Returns the version of the area this element type belongs to.
+func (*SubscriptionFilterList) GetAreaVersion() UOctet {
+	return MAL_KEYED_AREA_VERSION
+}
+
+// Returns the number of the service this element type belongs to.
+func (*SubscriptionFilterList) GetServiceNumber() UShort {
+	return MAL_ATTRIBUTE_AREA_SERVICE_NUMBER
+}
+
+// Returns the relative short form of the element type.
+func (*SubscriptionFilterList) GetTypeShortForm() Integer {
+	return MAL_SUBSCRIPTION_FILTER_LIST_TYPE_SHORT_FORM
+}
+
+// Encodes this element using the supplied encoder.
+// @param encoder The encoder to use, must not be null.
+func (list *SubscriptionFilterList) Encode(encoder Encoder) error {
+	err := encoder.EncodeUInteger(NewUInteger(uint32(len([]*SubscriptionFilter(*list)))))
+	if err != nil {
+		return err
+	}
+	for _, e := range []*SubscriptionFilter(*list) {
+		err = encoder.EncodeNullableElement(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes an instance of this element type using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded instance, may be not the same instance as this Element.
+func (list *SubscriptionFilterList) Decode(decoder Decoder) (Element, error) {
+	return DecodeSubscriptionFilterList(decoder)
+}
+
+// Decodes an instance of SubscriptionFilterList using the supplied decoder.
+// @param decoder The decoder to use, must not be null.
+// @return the decoded SubscriptionFilterList instance.
+func DecodeSubscriptionFilterList(decoder Decoder) (*SubscriptionFilterList, error) {
+	size, err := decoder.DecodeUInteger()
+	if err != nil {
+		return nil, err
+	}
+	list := SubscriptionFilterList(make([]*SubscriptionFilter, int(*size)))
+	for i := 0; i < len(list); i++ {
+		element, err := decoder.DecodeNullableElement(NullSubscriptionFilter)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = element.(*SubscriptionFilter)
+	}
+	return &list, nil
+}
+
+// The method allows the creation of an element in a generic way, i.e., using the MAL Element polymorphism.
+func (list *SubscriptionFilterList) CreateElement() Element {
+	return NewSubscriptionFilterList(0)
+}
+
+func (list *SubscriptionFilterList) IsNull() bool {
+	return list == nil
+}
+
+func (*SubscriptionFilterList) Null() Element {
+	return NullSubscriptionFilterList
+}
@@ -47,6 +47,12 @@ type TransportCallback interface {
 	ReceiveMultiple(msgs ...*Message) error
 }
 
+// Optional interface of a TransportCallback receiving the asynchronous failures of the
+// transport (transmission, decoding, etc.), it is implemented by the MAL Context.
+type TransportErrorCallback interface {
+	Error(err *MessageError)
+}
+
 type TransportFactory interface {
 	NewTransport(u *url.URL, ctx TransportCallback) (Transport, *URI, error)
 }
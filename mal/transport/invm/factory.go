@@ -27,12 +27,39 @@ import (
 	"errors"
 	. "github.com/CNES/ccsdsmo-malgo/mal"
 	"net/url"
+	"sync"
 )
 
 type InVMTransportFactory struct {
 }
 
+// Map containing all InVM transports, this map should always be acceded though
+// synchronized functions: addTransport, delTransport and getTransport.
 var contexts map[string]*InVMTransport = make(map[string]*InVMTransport)
+var contextslock sync.RWMutex
+
+func addTransport(uri string, transport *InVMTransport) bool {
+	contextslock.Lock()
+	defer contextslock.Unlock()
+	if contexts[uri] != nil {
+		return false
+	}
+	contexts[uri] = transport
+	return true
+}
+
+func delTransport(uri string) {
+	contextslock.Lock()
+	delete(contexts, uri)
+	contextslock.Unlock()
+}
+
+func getTransport(uri string) *InVMTransport {
+	contextslock.RLock()
+	transport := contexts[uri]
+	contextslock.RUnlock()
+	return transport
+}
 
 func init() {
 	RegisterTransportFactory("invm", new(InVMTransportFactory))
@@ -55,11 +82,10 @@ func (*InVMTransportFactory) NewTransport(u *url.URL, ctx TransportCallback) (Tr
 	}
 
 	// Registers the MAL context
-	if contexts[string(uri)] != nil {
-		logger.Warnf("InVMTransportFactory.InVMTransportFactory: MAL context already registered ", uri)
+	if !addTransport(string(uri), transport) {
+		logger.Warnf("InVMTransportFactory.InVMTransportFactory: MAL context already registered %s", uri)
 		return nil, NullURI, errors.New("MAL context already registered")
 	}
-	contexts[string(uri)] = transport
 
 	return transport, &transport.uri, nil
 }
@@ -58,13 +58,18 @@ func (*InVMTransport) Transmit(msg *Message) error {
 		return err
 	}
 
-	// Transform Body to readable
-	msg.Body.(*InVMBody).content = msg.Body.(*InVMBody).getEncodedContent()
-	msg.Body.Reset(false)
+	if msg.Body == nil {
+		// The messages without body (e.g. acknowledges) are received with an empty one
+		msg.Body = NewInVMBody(make([]byte, 0), false)
+	} else {
+		// Transform Body to readable
+		msg.Body.(*InVMBody).content = msg.Body.(*InVMBody).getEncodedContent()
+		msg.Body.Reset(false)
+	}
 
 	urito := url.URL{Scheme: u.Scheme, Host: u.Host}
-	transport, ok := contexts[urito.String()]
-	if ok {
+	transport := getTransport(urito.String())
+	if transport != nil {
 		logger.Debugf("Forward Message%+v to %s", *msg, *msg.UriTo)
 		return transport.ctx.Receive(msg)
 	}
@@ -78,6 +83,6 @@ func (transport *InVMTransport) TransmitMultiple(msgs ...*Message) error {
 
 func (transport *InVMTransport) Close() error {
 	logger.Infof("InVMTransport.Close: %s", transport.uri)
-	delete(contexts, string(transport.uri))
+	delTransport(string(transport.uri))
 	return nil
 }
@@ -185,3 +185,333 @@ func TestLocal2(t *testing.T) {
 	}
 	time.Sleep(1000 * time.Millisecond)
 }
+
+// Test the concurrent registration of end-points and the closing of the context
+func TestClose(t *testing.T) {
+	ctx, err := NewContext("invm://close")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+
+	done := make(chan *EndPoint)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			endpoint, err := NewEndPoint(ctx, fmt.Sprintf("endpoint%d", i), nil)
+			if err != nil {
+				t.Error("Error creating endpoint, ", err)
+			}
+			done <- endpoint
+		}(i)
+	}
+	endpoints := make([]*EndPoint, 0, 10)
+	for i := 0; i < 10; i++ {
+		endpoints = append(endpoints, <-done)
+	}
+
+	body := invm.NewInVMBody(make([]byte, 0, 1024), true)
+	body.EncodeLastParameter(NewString("message"), false)
+	msg := &Message{
+		UriFrom:          endpoints[0].Uri,
+		UriTo:            endpoints[1].Uri,
+		TransactionId:    endpoints[0].TransactionId(),
+		InteractionType:  MAL_INTERACTIONTYPE_SEND,
+		InteractionStage: MAL_IP_STAGE_SEND,
+		Body:             body,
+	}
+	endpoints[0].Send(msg)
+
+	ctx.Close()
+	// The message sent before closing should be delivered, then the channel closed.
+	r, err := endpoints[1].Recv()
+	if r == nil || err != nil {
+		t.Errorf("Message should be delivered before closing: %v", err)
+	}
+	r, err = endpoints[1].Recv()
+	if r != nil || err == nil {
+		t.Error("End-point should be closed")
+	}
+
+	// Closing twice should be harmless.
+	if err := ctx.Close(); err != nil {
+		t.Error("Error closing context twice, ", err)
+	}
+	if _, err := NewEndPoint(ctx, "late", nil); err == nil {
+		t.Error("Registration should fail on a closed context")
+	}
+	if err := endpoints[0].Send(msg); err == nil {
+		t.Error("Send should fail on a closed context")
+	}
+}
+
+// Test the closing of a context with an end-point which does not read its messages
+func TestCloseUnread(t *testing.T) {
+	ctx, err := NewContext("invm://unread")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	unreadch := make(chan *Message)
+	unread, err := NewEndPoint(ctx, "unread", unreadch)
+	if err != nil {
+		t.Fatal("Error creating end-point, ", err)
+	}
+	consumer, err := NewEndPoint(ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating end-point, ", err)
+	}
+	for i := 0; i < 3; i++ {
+		body := invm.NewInVMBody(make([]byte, 0, 1024), true)
+		body.EncodeLastParameter(NewString("message"), false)
+		msg := &Message{
+			UriTo:            unread.Uri,
+			TransactionId:    consumer.TransactionId(),
+			InteractionType:  MAL_INTERACTIONTYPE_SEND,
+			InteractionStage: MAL_IP_STAGE_SEND,
+			Body:             body,
+		}
+		if err := consumer.Send(msg); err != nil {
+			t.Error("Error sending message, ", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan bool)
+	go func() {
+		ctx.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Context.Close blocked by the unread end-point")
+	}
+	// The channel belongs to the caller, it should not be closed.
+	select {
+	case _, ok := <-unreadch:
+		if !ok {
+			t.Error("The channel of the end-point should not be closed")
+		}
+	default:
+	}
+	if _, err := unread.Recv(); err == nil {
+		t.Error("End-point should be closed")
+	}
+}
+
+// A listener blocked in the delivery of its first message until the context is closed.
+type blockedListener struct {
+	closed    chan bool
+	delivered chan bool
+}
+
+func (l *blockedListener) OnMessage(msg *Message) {
+	select {
+	case <-l.delivered:
+		return
+	default:
+	}
+	<-l.closed
+	time.Sleep(100 * time.Millisecond)
+	close(l.delivered)
+}
+
+func (l *blockedListener) OnClose() error {
+	close(l.closed)
+	return nil
+}
+
+// Test that the closing of a context waits for the end of a delivery exceeding the
+// drain delay.
+func TestCloseBlocked(t *testing.T) {
+	ctx, err := NewContext("invm://blocked")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	consumer, err := NewEndPoint(ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating end-point, ", err)
+	}
+	listener := &blockedListener{make(chan bool), make(chan bool)}
+	uri := ctx.NewURI("listener")
+	if err := ctx.RegisterEndPoint(uri, listener); err != nil {
+		t.Fatal("Error registering listener, ", err)
+	}
+	for i := 0; i < 2; i++ {
+		body := invm.NewInVMBody(make([]byte, 0, 1024), true)
+		body.EncodeLastParameter(NewString("message"), false)
+		msg := &Message{
+			UriTo:            uri,
+			TransactionId:    consumer.TransactionId(),
+			InteractionType:  MAL_INTERACTIONTYPE_SEND,
+			InteractionStage: MAL_IP_STAGE_SEND,
+			Body:             body,
+		}
+		if err := consumer.Send(msg); err != nil {
+			t.Fatal("Error sending message, ", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx.Close()
+	select {
+	case <-listener.delivered:
+	default:
+		t.Error("Context.Close should wait for the message being delivered")
+	}
+}
+
+// Test the isolation of end-points and the overflow policy of dispatch queues
+func TestDispatch(t *testing.T) {
+	ctx, err := NewContext("invm://dispatch")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer ctx.Close()
+
+	// Dropping the oldest message requires a queued message.
+	if err := ctx.SetDispatch(0, DISPATCH_DROP_OLDEST); err == nil {
+		t.Error("DISPATCH_DROP_OLDEST should be rejected for an unbuffered queue")
+	}
+	if err := ctx.RegisterEndPointWithDispatch(ctx.NewURI("unbuffered"), &slowListener{}, 0, DISPATCH_DROP_OLDEST); err == nil {
+		t.Error("DISPATCH_DROP_OLDEST should be rejected for an unbuffered queue")
+	}
+
+	// The slow end-point has an unbuffered channel, its dispatch queue has only one slot.
+	ctx.SetDispatch(1, DISPATCH_REJECT)
+	slowch := make(chan *Message)
+	slow, err := NewEndPoint(ctx, "slow", slowch)
+	if err != nil {
+		t.Fatal("Error creating end-point, ", err)
+	}
+	ctx.SetDispatch(10, DISPATCH_BLOCK)
+	fast, err := NewEndPoint(ctx, "fast", nil)
+	if err != nil {
+		t.Fatal("Error creating end-point, ", err)
+	}
+	consumer, err := NewEndPoint(ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating end-point, ", err)
+	}
+
+	send := func(to *EndPoint, itype InteractionType) {
+		body := invm.NewInVMBody(make([]byte, 0, 1024), true)
+		body.EncodeLastParameter(NewString("message"), false)
+		msg := &Message{
+			UriTo:            to.Uri,
+			TransactionId:    consumer.TransactionId(),
+			InteractionType:  itype,
+			InteractionStage: MAL_IP_STAGE_INIT,
+			Body:             body,
+		}
+		if err := consumer.Send(msg); err != nil {
+			t.Error("Error sending message, ", err)
+		}
+	}
+
+	// The first message blocks the dispatch goroutine, the second one fills the queue.
+	send(slow, MAL_INTERACTIONTYPE_REQUEST)
+	time.Sleep(100 * time.Millisecond)
+	send(slow, MAL_INTERACTIONTYPE_REQUEST)
+	send(slow, MAL_INTERACTIONTYPE_REQUEST)
+
+	msg, err := consumer.Recv()
+	if err != nil || !bool(msg.IsErrorMessage) {
+		t.Fatal("Expect an error message")
+	}
+	code, err := msg.DecodeParameter(NullUInteger)
+	if err != nil || *code.(*UInteger) != ERROR_DELIVERY_DELAYED {
+		t.Errorf("Expect DELIVERY_DELAYED, get %v, %v", code, err)
+	}
+
+	// The slow end-point should not delay the other ones.
+	received := make(chan bool)
+	go func() {
+		fast.Recv()
+		close(received)
+	}()
+	send(fast, MAL_INTERACTIONTYPE_SEND)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Error("Message not delivered to fast end-point")
+	}
+
+	go func() {
+		for range slowch {
+		}
+	}()
+}
+
+// A listener delivering slowly its messages, it releases itself if self is set.
+type slowListener struct {
+	ctx       *Context
+	uri       *URI
+	self      bool
+	delivered chan bool
+}
+
+func (l *slowListener) OnMessage(msg *Message) {
+	time.Sleep(100 * time.Millisecond)
+	if l.self {
+		l.ctx.ReleaseEndPoint(l.uri)
+	}
+	close(l.delivered)
+}
+
+func (l *slowListener) OnClose() error {
+	return nil
+}
+
+// Test that the unregistration of an end-point waits for the message being delivered,
+// and that the listener itself can release it without waiting.
+func TestUnregisterWait(t *testing.T) {
+	ctx, err := NewContext("invm://unregister")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer ctx.Close()
+
+	consumer, err := NewEndPoint(ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating end-point, ", err)
+	}
+	send := func(l *slowListener) {
+		if err := ctx.RegisterEndPoint(l.uri, l); err != nil {
+			t.Fatal("Error registering listener, ", err)
+		}
+		body := invm.NewInVMBody(make([]byte, 0, 1024), true)
+		body.EncodeLastParameter(NewString("message"), false)
+		msg := &Message{
+			UriTo:            l.uri,
+			TransactionId:    consumer.TransactionId(),
+			InteractionType:  MAL_INTERACTIONTYPE_SEND,
+			InteractionStage: MAL_IP_STAGE_SEND,
+			Body:             body,
+		}
+		if err := consumer.Send(msg); err != nil {
+			t.Fatal("Error sending message, ", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	listener := &slowListener{ctx, ctx.NewURI("listener"), false, make(chan bool)}
+	send(listener)
+	if err := ctx.UnregisterEndPoint(listener.uri); err != nil {
+		t.Fatal("Error unregistering listener, ", err)
+	}
+	select {
+	case <-listener.delivered:
+	default:
+		t.Error("UnregisterEndPoint should wait for the message being delivered")
+	}
+
+	listener = &slowListener{ctx, ctx.NewURI("self"), true, make(chan bool)}
+	send(listener)
+	select {
+	case <-listener.delivered:
+	case <-time.After(time.Second):
+		t.Fatal("UnregisterEndPoint blocked in the listener")
+	}
+	if _, err := ctx.GetEndPoint(listener.uri); err == nil {
+		t.Error("Listener should be unregistered")
+	}
+}
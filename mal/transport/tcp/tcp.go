@@ -319,8 +319,11 @@ func (transport *TCPTransport) readMessage(cnx net.Conn) (*Message, error) {
 	// Decodes the message
 	msg, err := transport.decode(newbuf, cnx.RemoteAddr().String())
 	if err != nil {
-		logger.Errorf("TCPTransport.readMessage(%s), error receiving message: %s", err.Error())
-		return nil, err
+		logger.Errorf("TCPTransport.readMessage(%s), error receiving message: %s", cnx.RemoteAddr(), err.Error())
+		// The message is fully read so the connection can be used anew, only the faulty
+		// message is discarded.
+		transport.error(NewMessageError(msg, ERROR_BAD_ENCODING, err))
+		return nil, nil
 	}
 	logger.Debugf("TCPTransport.readMessage(%s), receives %s from %s to %s", cnx.RemoteAddr(), msg, *msg.UriFrom, *msg.UriTo)
 
@@ -341,6 +344,8 @@ func (transport *TCPTransport) handleOut() {
 			u, err := url.Parse(string(*msg.UriTo))
 			if err != nil {
 				logger.Errorf("TCPTransport.handleOut, cannot route message to %s", *msg.UriTo)
+				transport.reportError(msg, ERROR_DESTINATION_UNKNOWN, err)
+				msg = nil
 				continue
 			}
 			urito := u.Host
@@ -351,7 +356,8 @@ func (transport *TCPTransport) handleOut() {
 				cnx, err = net.Dial("tcp", urito)
 				if err != nil {
 					logger.Errorf("TCPTransport.handleOut, cannot creates connection to %s: %s", urito, err.Error())
-					// TODO (AF): Handles the faulty message, forwards it to error listener
+					transport.reportError(msg, ERROR_DESTINATION_UNKNOWN, err)
+					msg = nil
 					continue
 				}
 				// Registers the created connection..
@@ -371,19 +377,44 @@ func (transport *TCPTransport) handleOut() {
 				// try to send anew the message
 				if nbtry < 3 {
 					continue
-				} else {
-					// TODO (AF): Handles the faulty message, forwards it to error listener
 				}
+				transport.reportError(msg, ERROR_DELIVERY_FAILED, err)
 			}
 			msg = nil
 		} else {
+			// The channel is closed, the transport is closing.
 			logger.Infof("TCPTransport.handleOut, ends")
-			transport.ends <- true
+			close(transport.ends)
+			break
 		}
 	}
 	logger.Debugf("TCPTransport.handleOut exited")
 }
 
+// Reports a transmission failure to the MAL context, the local originator of the message
+// receives a MAL error message if the interaction stage allows it.
+func (transport *TCPTransport) reportError(msg *Message, code UInteger, err error) {
+	transport.error(NewMessageError(msg, code, err))
+	body := NewTCPBody(make([]byte, 0, 64), true)
+	reply, err := NewErrorReply(msg, body, code, NewString(err.Error()))
+	if reply == nil || err != nil {
+		return
+	}
+	// Transforms the body to readable as a received message
+	body.content = body.getEncodedContent()
+	body.Reset(false)
+	// The reply is delivered asynchronously so that a blocked dispatch of the originator
+	// does not block the outgoing messages.
+	go transport.ctx.Receive(reply)
+}
+
+// Reports an asynchronous failure to the MAL context if it accepts them.
+func (transport *TCPTransport) error(merr *MessageError) {
+	if ecb, ok := transport.ctx.(TransportErrorCallback); ok {
+		ecb.Error(merr)
+	}
+}
+
 func write32(value uint32, buf []byte) {
 	buf[0] = byte(value >> 24)
 	buf[1] = byte(value >> 16)
@@ -193,3 +193,153 @@ func TestTCP2(t *testing.T) {
 	}
 	time.Sleep(1000 * time.Millisecond)
 }
+
+// Test the reporting of transmission failures through the error channel
+func TestTCPError(t *testing.T) {
+	ctx, err := NewContext("maltcp://127.0.0.1:16030")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer ctx.Close()
+	errch := make(chan *MessageError, 10)
+	ctx.SetErrorChannel(errch)
+
+	consumer, err := NewEndPoint(ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+
+	// There is no listener on this port
+	urito := URI("maltcp://127.0.0.1:16031/provider")
+	body := tcp.NewTCPBody(make([]byte, 0, 1024), true)
+	body.EncodeLastParameter(NewString("message"), false)
+	msg := &Message{
+		UriTo:            &urito,
+		TransactionId:    consumer.TransactionId(),
+		InteractionType:  MAL_INTERACTIONTYPE_SEND,
+		InteractionStage: MAL_IP_STAGE_SEND,
+		QoSLevel:         QOSLEVEL_BESTEFFORT,
+		Session:          SESSIONTYPE_LIVE,
+		Body:             body,
+	}
+	consumer.Send(msg)
+
+	select {
+	case merr := <-errch:
+		if merr.Msg != msg || merr.Code != ERROR_DESTINATION_UNKNOWN {
+			t.Errorf("Unexpected error: %s", merr)
+		}
+	case <-time.After(time.Second):
+		t.Error("Transmission failure not reported")
+	}
+
+	// The originator of a request receives an error message
+	body = tcp.NewTCPBody(make([]byte, 0, 1024), true)
+	body.EncodeLastParameter(NewString("request"), false)
+	msg = &Message{
+		UriTo:            &urito,
+		TransactionId:    consumer.TransactionId(),
+		InteractionType:  MAL_INTERACTIONTYPE_REQUEST,
+		InteractionStage: MAL_IP_STAGE_REQUEST,
+		QoSLevel:         QOSLEVEL_BESTEFFORT,
+		Session:          SESSIONTYPE_LIVE,
+		Body:             body,
+	}
+	consumer.Send(msg)
+
+	reply, err := consumer.Recv()
+	if err != nil || !bool(reply.IsErrorMessage) {
+		t.Fatal("Expect an error message, ", err)
+	}
+	code, err := reply.DecodeParameter(NullUInteger)
+	if err != nil || *code.(*UInteger) != ERROR_DESTINATION_UNKNOWN {
+		t.Errorf("Expect DESTINATION_UNKNOWN, get %v, %v", code, err)
+	}
+}
+
+// Listener blocking the delivery of the messages until released.
+type blockedListener struct {
+	release chan bool
+}
+
+func (listener *blockedListener) OnMessage(msg *Message) {
+	<-listener.release
+}
+
+func (listener *blockedListener) OnClose() error {
+	return nil
+}
+
+// Test that the error replies of a blocked originator do not block the outgoing messages
+func TestTCPErrorBlocked(t *testing.T) {
+	ctx, err := NewContext("maltcp://127.0.0.1:16087?dialretries=0")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer ctx.Close()
+	ctx2, err := NewContext("maltcp://127.0.0.1:16088")
+	if err != nil {
+		t.Fatal("Error creating context, ", err)
+	}
+	defer ctx2.Close()
+
+	listener := &blockedListener{release: make(chan bool)}
+	defer close(listener.release)
+	blocked := ctx.NewURI("blocked")
+	if err := ctx.RegisterEndPointWithDispatch(blocked, listener, 1, DISPATCH_BLOCK); err != nil {
+		t.Fatal("Error registering end-point, ", err)
+	}
+	consumer, err := NewEndPoint(ctx, "consumer", nil)
+	if err != nil {
+		t.Fatal("Error creating consumer, ", err)
+	}
+	provider, err := NewEndPoint(ctx2, "provider", nil)
+	if err != nil {
+		t.Fatal("Error creating provider, ", err)
+	}
+
+	// There is no listener on this port, the error replies fill the dispatch queue
+	urito := URI("maltcp://127.0.0.1:16031/provider")
+	for i := 0; i < 4; i++ {
+		body := tcp.NewTCPBody(make([]byte, 0, 1024), true)
+		body.EncodeLastParameter(NewString("request"), false)
+		msg := &Message{
+			UriFrom:          blocked,
+			UriTo:            &urito,
+			TransactionId:    ULong(i),
+			InteractionType:  MAL_INTERACTIONTYPE_REQUEST,
+			InteractionStage: MAL_IP_STAGE_REQUEST,
+			QoSLevel:         QOSLEVEL_BESTEFFORT,
+			Session:          SESSIONTYPE_LIVE,
+			Body:             body,
+		}
+		ctx.Send(msg)
+	}
+
+	body := tcp.NewTCPBody(make([]byte, 0, 1024), true)
+	body.EncodeLastParameter(NewString("message"), false)
+	msg := &Message{
+		UriTo:            provider.Uri,
+		TransactionId:    consumer.TransactionId(),
+		InteractionType:  MAL_INTERACTIONTYPE_SEND,
+		InteractionStage: MAL_IP_STAGE_SEND,
+		QoSLevel:         QOSLEVEL_BESTEFFORT,
+		Session:          SESSIONTYPE_LIVE,
+		Body:             body,
+	}
+	consumer.Send(msg)
+
+	received := make(chan *Message, 1)
+	go func() {
+		msg, _ := provider.Recv()
+		received <- msg
+	}()
+	select {
+	case msg := <-received:
+		if msg == nil {
+			t.Error("Expect a message")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Outgoing messages blocked by the error replies")
+	}
+}